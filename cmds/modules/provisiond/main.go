@@ -2,6 +2,7 @@ package provisiond
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"os"
 	"path/filepath"
@@ -13,6 +14,8 @@ import (
 	"github.com/threefoldtech/zos/pkg/app"
 	"github.com/threefoldtech/zos/pkg/environment"
 	"github.com/threefoldtech/zos/pkg/provision/explorer"
+	"github.com/threefoldtech/zos/pkg/provision/journal"
+	"github.com/threefoldtech/zos/pkg/provision/local"
 	"github.com/threefoldtech/zos/pkg/provision/primitives"
 	"github.com/threefoldtech/zos/pkg/provision/primitives/cache"
 	"github.com/urfave/cli/v2"
@@ -28,6 +31,8 @@ import (
 
 const (
 	module = "provision"
+	// workers is the number of reservations provisioned concurrently
+	workers = 10
 )
 
 // Module entry point
@@ -45,9 +50,43 @@ var Module cli.Command = cli.Command{
 			Usage: "connection string to the message `BROKER`",
 			Value: "unix:///var/run/redis.sock",
 		},
+		&cli.StringFlag{
+			Name:  "local",
+			Usage: "receive reservations on a local API listening on `ADDRESS` (unix:///path or tcp://host:port) instead of the explorer",
+		},
+		&cli.StringFlag{
+			Name:  "keys",
+			Usage: "json `FILE` mapping user IDs to their hex encoded public keys. required with --local, if not set, the keys are fetched from the explorer",
+		},
+		&cli.BoolFlag{
+			Name:  "legacy-signing",
+			Usage: "accept the reservations signed with the legacy scheme that doesn't cover their ID, creation date and duration",
+		},
+		&cli.DurationFlag{
+			Name:  "grace",
+			Usage: "suspend the workloads of the expired reservations for `DURATION` before they are decommissioned. if not set, they are decommissioned as soon as they expire",
+		},
+		&cli.StringSliceFlag{
+			Name:  "expiry-warning",
+			Usage: "warn the users `DURATION` before their reservations expire, can be repeated",
+			Value: cli.NewStringSlice("72h", "24h", "1h"),
+		},
+		&cli.StringFlag{
+			Name:  "policy",
+			Usage: "toml `FILE` with the cpu overcommit ratio and the quotas of the users",
+		},
 		&cli.BoolFlag{
 			Name:  "clean",
-			Usage: "cleans stale reservations and exits. Should be done only if provisiond is stopped",
+			Usage: "cleans stale reservations, prints the clean up report and exits. Should be done only if provisiond is stopped",
+		},
+		&cli.StringFlag{
+			Name:  "clean-schedule",
+			Usage: "cron `SPEC` of when the stale resources are cleaned up",
+			Value: "@midnight",
+		},
+		&cli.BoolFlag{
+			Name:  "clean-dry-run",
+			Usage: "only report the stale resources, don't remove them",
 		},
 	},
 	Action: action,
@@ -116,11 +155,24 @@ func action(cli *cli.Context) error {
 		return errors.Wrap(err, "failed to instantiate BCDB client")
 	}
 
+	// resources policy set by the farmer, no quotas by default
+	var policy primitives.Policy
+	if path := cli.String("policy"); path != "" {
+		policy, err = primitives.LoadPolicy(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to load resources policy")
+		}
+	}
+
 	// keep track of resource units reserved and amount of workloads provisionned
-	statser := &primitives.Counters{}
+	statser := primitives.NewCounters(policy)
 
 	// to store reservation locally on the node
-	localStore, err := cache.NewFSStore(filepath.Join(storageDir, "reservations"))
+	localStore, err := cache.NewBoltStore(
+		filepath.Join(storageDir, "reservations.db"),
+		// the reservations of the filesystem cache are migrated on first start
+		filepath.Join(storageDir, "reservations"),
+	)
 	if err != nil {
 		return errors.Wrap(err, "failed to create local reservation store")
 	}
@@ -128,13 +180,99 @@ func action(cli *cli.Context) error {
 	// update stats from the local reservation cache
 	localStore.Sync(statser)
 
+	// to roll back the reservations that were half way provisioned
+	provisionJournal, err := journal.NewFSJournal(filepath.Join(storageDir, "journal"))
+	if err != nil {
+		return errors.Wrap(err, "failed to create provisioning journal")
+	}
+
 	provisioner := primitives.NewProvisioner(localStore, zbusCl)
 
-	puller := explorer.NewPoller(e, primitives.WorkloadToProvisionType, primitives.ProvisionOrder)
-	janitor := provision.NewJanitor(zbusCl, puller)
+	ctx := context.Background()
+	ctx, _ = utils.WithSignal(ctx)
+	utils.OnDone(ctx, func(_ error) {
+		log.Info().Msg("shutting down")
+	})
+
+	var (
+		puller   provision.ReservationPoller
+		feedback provision.Feedbacker
+		signing  []int
+	)
+
+	// to verify the reservations signature
+	var keys provision.UserKeyResolver = explorer.NewKeyResolver(e)
+	if path := cli.String("keys"); path != "" {
+		keys, err = provision.NewFileKeyResolver(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to load users public keys")
+		}
+	}
+
+	if address := cli.String("local"); address != "" {
+		// the users keys can't be fetched from the explorer
+		// when the reservations don't come from it
+		if cli.String("keys") == "" {
+			return errors.New("--keys is required to verify the reservations received on the local API")
+		}
+
+		api, err := local.NewServer(filepath.Join(storageDir, "local"), nodeID.Identity(), keys, primitives.ProvisionOrder)
+		if err != nil {
+			return errors.Wrap(err, "failed to create local reservation server")
+		}
+
+		listener, err := local.Listen(address)
+		if err != nil {
+			return errors.Wrap(err, "failed to listen for local reservations")
+		}
+
+		go func() {
+			if err := api.Serve(ctx, listener); err != nil {
+				log.Fatal().Err(err).Msg("local reservation server failed")
+			}
+		}()
+
+		log.Info().Str("address", address).Msg("receiving reservations from local API")
+		puller, feedback = api, api
+		signing = []int{provision.SigningV1}
+	} else {
+		puller = explorer.NewPoller(e, primitives.WorkloadToProvisionType, primitives.ProvisionOrder)
+		feedback = explorer.NewFeedback(e, primitives.ResultToSchemaType)
+		// the explorer reservations are only signed over the challenge
+		// computed from the workload by primitives.WorkloadToProvisionType
+		signing = []int{provision.SigningExplorer}
+	}
+
+	if cli.Bool("legacy-signing") {
+		log.Warn().Msg("accepting reservations signed with the legacy scheme")
+		signing = append(signing, provision.SigningLegacy)
+	}
+
+	var warnings []time.Duration
+	for _, value := range cli.StringSlice("expiry-warning") {
+		warning, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid expiry warning '%s'", value)
+		}
+		warnings = append(warnings, warning)
+	}
+
+	janitor := provision.NewJanitor(
+		zbusCl,
+		puller,
+		filepath.Join(storageDir, "cleanup.json"),
+		cli.Bool("clean-dry-run"),
+	)
 
 	if cli.Bool("clean") {
-		return janitor.CleanupResources(cli.Context)
+		report, err := janitor.CleanupResources(cli.Context)
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
 	}
 	engine, err := provision.New(provision.EngineOps{
 		NodeID: nodeID.Identity(),
@@ -143,13 +281,29 @@ func action(cli *cli.Context) error {
 			provision.PollSource(puller, nodeID),
 			provision.NewDecommissionSource(localStore),
 		),
-		Provisioners:   provisioner.Provisioners,
-		Decomissioners: provisioner.Decommissioners,
-		Feedback:       explorer.NewFeedback(e, primitives.ResultToSchemaType),
-		Signer:         identity,
-		Statser:        statser,
-		ZbusCl:         zbusCl,
-		Janitor:        janitor,
+		Provisioners:    provisioner.Provisioners,
+		Decomissioners:  provisioner.Decommissioners,
+		Updaters:        provisioner.Updaters,
+		Rollbacks:       provisioner.Rollbacks,
+		Checkers:        provisioner.Checkers,
+		Suspenders:      provisioner.Suspenders,
+		Resumers:        provisioner.Resumers,
+		GracePeriod:     cli.Duration("grace"),
+		ExpiryWarnings:  warnings,
+		Journal:         provisionJournal,
+		Attempts:        localStore,
+		Feedback:        feedback,
+		Signer:          identity,
+		Keys:            keys,
+		SigningVersions: signing,
+		Statser:         statser,
+		Capacity:        primitives.NewCapacity(statser, localStore, zbusCl),
+		ZbusCl:          zbusCl,
+		Janitor:         janitor,
+		CleanupSchedule: cli.String("clean-schedule"),
+		Workers:         workers,
+		Order:           primitives.ProvisionOrder,
+		LockKeys:        primitives.LockKeys,
 	})
 
 	if err != nil {
@@ -162,12 +316,6 @@ func action(cli *cli.Context) error {
 		Str("broker", msgBrokerCon).
 		Msg("starting provision module")
 
-	ctx := context.Background()
-	ctx, _ = utils.WithSignal(ctx)
-	utils.OnDone(ctx, func(_ error) {
-		log.Info().Msg("shutting down")
-	})
-
 	// call the runtime upgrade before running engine
 	provisioner.RuntimeUpgrade(ctx)
 
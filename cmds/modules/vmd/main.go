@@ -2,9 +2,14 @@ package vmd
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg"
 	"github.com/threefoldtech/zos/pkg/utils"
 	"github.com/threefoldtech/zos/pkg/vm"
 	"github.com/urfave/cli/v2"
@@ -36,17 +41,114 @@ var Module cli.Command = cli.Command{
 			Usage: "number of workers `N`",
 			Value: 1,
 		},
+		&cli.StringFlag{
+			Name:  "console",
+			Usage: "unix `SOCKET` to serve the vms consoles over websocket, empty to disable",
+			Value: "/var/run/vmd-console.sock",
+		},
+		&cli.StringFlag{
+			Name:  "restart",
+			Usage: "`MODE` to restart the vms when they exit (always, on-failure, never)",
+			Value: string(vm.RestartAlways),
+		},
+		&cli.IntFlag{
+			Name:  "restart-max",
+			Usage: "maximum number of restarts of a vm within the restart window before it's deleted, 0 for no limit",
+			Value: 3,
+		},
+		&cli.DurationFlag{
+			Name:  "restart-window",
+			Usage: "`DURATION` of the window in which the restarts of a vm are counted",
+			Value: 2 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "restart-delay",
+			Usage: "`DURATION` to wait before restarting a vm",
+			Value: 2 * time.Second,
+		},
+		&cli.Uint64Flag{
+			Name:  "disk-read-bps",
+			Usage: "default read throughput limit in `BYTES` per second of the vms disks, 0 for no limit",
+		},
+		&cli.Uint64Flag{
+			Name:  "disk-write-bps",
+			Usage: "default write throughput limit in `BYTES` per second of the vms disks, 0 for no limit",
+		},
+		&cli.Uint64Flag{
+			Name:  "disk-read-iops",
+			Usage: "default read operations per second limit of the vms disks, 0 for no limit",
+		},
+		&cli.Uint64Flag{
+			Name:  "disk-write-iops",
+			Usage: "default write operations per second limit of the vms disks, 0 for no limit",
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:   "supervise",
+			Usage:  "runs and supervises a single vm, it is started by vmd",
+			Hidden: true,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "socket",
+					Usage:    "`PATH` of the api socket of the vm",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "logs",
+					Usage:    "`PATH` of the log file of the vm",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "state",
+					Usage:    "`PATH` of the file to write the vm state to",
+					Required: true,
+				},
+			},
+			ArgsUsage: "<config>",
+			Action:    supervise,
+		},
 	},
 	Action: action,
 }
 
+func supervise(cli *cli.Context) error {
+	if cli.NArg() != 1 {
+		return errors.New("the vm config path is required")
+	}
+
+	ctx, _ := utils.WithSignal(context.Background())
+	return vm.Supervise(ctx, cli.Args().First(), cli.String("socket"), cli.String("logs"), cli.String("state"))
+}
+
 func action(cli *cli.Context) error {
 	var (
 		moduleRoot   string = cli.String("root")
 		msgBrokerCon string = cli.String("broker")
 		workerNr     uint   = cli.Uint("workers")
+		consoleSock  string = cli.String("console")
+
+		policy = vm.RestartPolicy{
+			Mode:        vm.RestartMode(cli.String("restart")),
+			MaxRestarts: cli.Int("restart-max"),
+			Window:      cli.Duration("restart-window"),
+			Delay:       cli.Duration("restart-delay"),
+		}
+
+		io = pkg.VMIO{
+			ReadBps:   cli.Uint64("disk-read-bps"),
+			WriteBps:  cli.Uint64("disk-write-bps"),
+			ReadIOPS:  cli.Uint64("disk-read-iops"),
+			WriteIOPS: cli.Uint64("disk-write-iops"),
+		}
 	)
 
+	switch policy.Mode {
+	case vm.RestartAlways, vm.RestartOnFailure, vm.RestartNever:
+	default:
+		return fmt.Errorf("invalid restart mode '%s'", policy.Mode)
+	}
+
 	if err := os.MkdirAll(moduleRoot, 0755); err != nil {
 		log.Fatal().Err(err).Str("root", moduleRoot).Msg("Failed to create module root")
 	}
@@ -57,7 +159,7 @@ func action(cli *cli.Context) error {
 		return errors.Wrap(err, "fail to connect to message broker server")
 	}
 
-	mod, err := vm.NewVMModule(client, moduleRoot)
+	mod, err := vm.NewVMModule(client, moduleRoot, policy, io)
 	if err != nil {
 		return errors.Wrap(err, "failed to create a new instance of manager")
 	}
@@ -71,6 +173,29 @@ func action(cli *cli.Context) error {
 
 	mod.Monitor(ctx)
 
+	if consoleSock != "" {
+		if err := os.Remove(consoleSock); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove console socket")
+		}
+
+		listener, err := net.Listen("unix", consoleSock)
+		if err != nil {
+			return errors.Wrap(err, "failed to listen for console connections")
+		}
+
+		console := http.Server{Handler: mod.ConsoleHandler()}
+		go func() {
+			<-ctx.Done()
+			console.Close()
+		}()
+
+		go func() {
+			if err := console.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Error().Err(err).Msg("console server failed")
+			}
+		}()
+	}
+
 	log.Info().
 		Str("broker", msgBrokerCon).
 		Uint("worker nr", workerNr).
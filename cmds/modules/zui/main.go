@@ -75,7 +75,7 @@ func action(ctx *cli.Context) error {
 
 	provision := ui.NewGrid()
 	provision.Title = "Provision"
-	provision.SetRect(0, 12, width, 18)
+	provision.SetRect(0, 12, width, 20)
 	provision.Border = false
 
 	var flag signalFlag
@@ -8,6 +8,7 @@ import (
 	"github.com/gizak/termui/v3/widgets"
 	"github.com/pkg/errors"
 	"github.com/threefoldtech/zbus"
+	"github.com/threefoldtech/zos/pkg"
 	"github.com/threefoldtech/zos/pkg/stubs"
 )
 
@@ -21,6 +22,8 @@ func provisionRender(client zbus.Client, grid *ui.Grid, render *signalFlag) erro
 		{"Containers", "", "Volumes", ""},
 		{"Networks", "", "VMs", ""},
 		{"ZDB NS", "", "Debug", ""},
+		{"Running", "", "Restarting", ""},
+		{"Degraded", "", "Stopped", ""},
 	}
 
 	grid.Set(
@@ -51,6 +54,29 @@ func provisionRender(client zbus.Client, grid *ui.Grid, render *signalFlag) erro
 		}
 	}()
 
+	statuses, err := monitor.Statuses(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to start workloads status stream")
+	}
+
+	go func() {
+		for list := range statuses {
+			states := make(map[pkg.WorkloadState]int)
+			for _, status := range list {
+				states[status.State]++
+			}
+
+			prov.Mutex.Lock()
+			prov.Rows[4][1] = fmt.Sprint(states[pkg.WorkloadRunning])
+			prov.Rows[4][3] = fmt.Sprint(states[pkg.WorkloadRestarting])
+			prov.Rows[5][1] = fmt.Sprint(states[pkg.WorkloadDegraded])
+			prov.Rows[5][3] = fmt.Sprint(states[pkg.WorkloadStopped])
+			prov.Mutex.Unlock()
+
+			render.Signal()
+		}
+	}()
+
 	sysMonitor := stubs.NewSystemMonitorStub(client)
 	stream, err := sysMonitor.CPU(context.Background())
 	if err != nil {
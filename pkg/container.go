@@ -77,4 +77,9 @@ type ContainerModule interface {
 	// Inspect, return information about the container, given its container id
 	Inspect(ns string, id ContainerID) (Container, error)
 	Delete(ns string, id ContainerID) error
+
+	// Pause freezes all the processes of the container
+	Pause(ns string, id ContainerID) error
+	// Resume unfreezes a paused container
+	Resume(ns string, id ContainerID) error
 }
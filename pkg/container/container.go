@@ -455,6 +455,13 @@ func (c *Module) Delete(ns string, id pkg.ContainerID) error {
 	task, err := container.Task(ctx, nil)
 	if err == nil {
 		// err == nil, there is a task running inside the container
+		// the processes of a paused container can't receive the signals
+		if status, err := task.Status(ctx); err == nil && status.Status == containerd.Paused {
+			if err := task.Resume(ctx); err != nil {
+				log.Error().Err(err).Str("id", string(id)).Msg("failed to resume paused container")
+			}
+		}
+
 		exitC, err := task.Wait(ctx)
 		if err != nil {
 			return err
@@ -492,6 +499,65 @@ func (c *Module) Delete(ns string, id pkg.ContainerID) error {
 	return container.Delete(ctx)
 }
 
+// Pause freezes the task running inside a container
+func (c *Module) Pause(ns string, id pkg.ContainerID) error {
+	log.Info().Str("id", string(id)).Str("ns", ns).Msg("pause container")
+
+	return c.withTask(ns, id, func(ctx context.Context, task containerd.Task) error {
+		status, err := task.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		if status.Status == containerd.Paused {
+			return nil
+		}
+
+		return task.Pause(ctx)
+	})
+}
+
+// Resume unfreezes the task of a paused container
+func (c *Module) Resume(ns string, id pkg.ContainerID) error {
+	log.Info().Str("id", string(id)).Str("ns", ns).Msg("resume container")
+
+	return c.withTask(ns, id, func(ctx context.Context, task containerd.Task) error {
+		status, err := task.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		if status.Status != containerd.Paused {
+			return nil
+		}
+
+		return task.Resume(ctx)
+	})
+}
+
+// withTask calls fn with the task running inside the container
+func (c *Module) withTask(ns string, id pkg.ContainerID, fn func(ctx context.Context, task containerd.Task) error) error {
+	client, err := containerd.New(c.containerd)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx := namespaces.WithNamespace(context.Background(), ns)
+
+	container, err := client.LoadContainer(ctx, string(id))
+	if err != nil {
+		return err
+	}
+
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return errors.Wrapf(err, "container %s has no running task", id)
+	}
+
+	return fn(ctx, task)
+}
+
 func (c *Module) ensureNamespace(ctx context.Context, client *containerd.Client, namespace string) error {
 	service := client.NamespaceService()
 	namespaces, err := service.List(ctx)
@@ -44,6 +44,22 @@ func (s *StorageMock) ReleaseFilesystem(name string) error {
 	return args.Error(0)
 }
 
+// UpdateFilesystem updates filesystem mock
+func (s *StorageMock) UpdateFilesystem(name string, size uint64) (pkg.Filesystem, error) {
+	args := s.Called(name, size)
+	return pkg.Filesystem{
+		Path: args.String(0),
+	}, args.Error(1)
+}
+
+// SnapshotFilesystem snapshots filesystem mock
+func (s *StorageMock) SnapshotFilesystem(name, snapshot string) (pkg.Filesystem, error) {
+	args := s.Called(name, snapshot)
+	return pkg.Filesystem{
+		Path: args.String(0),
+	}, args.Error(1)
+}
+
 // ListFilesystems list filesystem mock
 func (s *StorageMock) ListFilesystems() ([]pkg.Filesystem, error) {
 	args := s.Called()
@@ -20,6 +20,18 @@ type Member struct {
 	YggdrasilIP net.IP
 }
 
+// YggTap describes a tap device of a virtual machine hooked to the yggdrasil network
+type YggTap struct {
+	// Name of the tap device
+	Name string
+	// HW is the mac address the VM must use on this device
+	HW net.HardwareAddr
+	// IP is the yggdrasil IP of the VM
+	IP net.IPNet
+	// Gateway to use to reach the yggdrasil network (200::/7)
+	Gateway net.IP
+}
+
 // ContainerNetworkConfig defines how to construct the network namespace of a container
 type ContainerNetworkConfig struct {
 	IPs         []string
@@ -59,19 +71,25 @@ type Networker interface {
 	ZDBDestroy(ns string) error
 
 	// SetupTap sets up a tap device in the network namespace for the networkID. It is hooked
-	// to the network bridge. The name of the tap interface is returned
-	SetupTap(networkID NetID) (string, error)
+	// to the network bridge. The name identifies the owner of the tap so a network can have
+	// multiple taps, an empty name is the single tap the VMs used to get before.
+	// The name of the tap interface is returned
+	SetupTap(networkID NetID, name string) (string, error)
 
 	// TapExists checks if the tap device exists already
-	TapExists(networkID NetID) (bool, error)
+	TapExists(networkID NetID, name string) (bool, error)
 
 	// RemoveTap removes the tap device from the network namespace
 	// of the networkID
-	RemoveTap(networkID NetID) error
+	RemoveTap(networkID NetID, name string) error
 
 	// PublicIPv4Support enabled on this node for reservations
 	PublicIPv4Support() bool
 
+	// WireguardPorts returns the wireguard listen ports already used
+	// by the network resources of this node
+	WireguardPorts() ([]uint, error)
+
 	// SetupPubTap sets up a tap device in the host namespace for the public ip
 	// reservation id. It is hooked to the public bridge. The name of the tap
 	// interface is returned
@@ -83,6 +101,21 @@ type Networker interface {
 	// RemovePubTap removes the public tap device from the host namespace
 	RemovePubTap(PubIPReservationID string) error
 
+	// SetupPubIPv6Tap sets up a tap device in the host namespace hooked to the
+	// public bridge, the VM gets its public IPv6 with slaac. The name identifies the
+	// owner of the tap. The name of the tap interface is returned
+	SetupPubIPv6Tap(name string) (string, error)
+
+	// RemovePubIPv6Tap removes the public IPv6 tap device of name
+	RemovePubIPv6Tap(name string) error
+
+	// SetupYggTap sets up a tap device in the host namespace hooked to the
+	// yggdrasil network. The name identifies the owner of the tap
+	SetupYggTap(name string) (YggTap, error)
+
+	// RemoveYggTap removes the yggdrasil tap device of name
+	RemoveYggTap(name string) error
+
 	// GetSubnet of the network with the given ID on the local node
 	GetSubnet(networkID NetID) (net.IPNet, error)
 
@@ -9,6 +9,7 @@ import (
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	"github.com/threefoldtech/zos/pkg"
 	"github.com/threefoldtech/zos/pkg/crypto"
 
 	"github.com/stretchr/testify/assert"
@@ -42,3 +43,25 @@ func TestKeys(t *testing.T) {
 
 	assert.Equal(t, wgKey, wgKey2)
 }
+
+func TestTapName(t *testing.T) {
+	netID := pkg.NetID("7Tbx1sP5o3ASM")
+
+	legacy, err := tapName(netID, "")
+	require.NoError(t, err)
+	assert.Equal(t, "t-7Tbx1sP5o3ASM", legacy)
+
+	first, err := tapName(netID, "1234567890-1")
+	require.NoError(t, err)
+	second, err := tapName(netID, "1234567891-1")
+	require.NoError(t, err)
+
+	assert.NotEqual(t, first, second)
+	assert.NotEqual(t, legacy, first)
+	assert.Len(t, first, 15)
+
+	_, err = tapName(pkg.NetID("a-network-id-too-long"), "")
+	assert.Error(t, err)
+
+	assert.NotEqual(t, hashedTapName("6-", "1-1"), hashedTapName("y-", "1-1"))
+}
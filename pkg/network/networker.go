@@ -2,6 +2,7 @@ package network
 
 import (
 	"context"
+	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/jbenet/go-base58"
 	"github.com/termie/go-shutil"
 
 	"github.com/threefoldtech/tfexplorer/client"
@@ -382,10 +384,10 @@ func (n networker) createMacVlan(iface string, hw net.HardwareAddr, ips []*net.I
 	return nil
 }
 
-// SetupTap interface in the network resource. We only allow 1 tap interface to be
-// set up per NR currently
-func (n *networker) SetupTap(networkID pkg.NetID) (string, error) {
-	log.Info().Str("network-id", string(networkID)).Msg("Setting up tap interface")
+// SetupTap interface in the network resource. Each owner (name) gets its own
+// tap, an empty name is the single tap per NR the VMs used to get
+func (n *networker) SetupTap(networkID pkg.NetID, name string) (string, error) {
+	log.Info().Str("network-id", string(networkID)).Str("name", name).Msg("Setting up tap interface")
 
 	localNR, err := n.networkOf(string(networkID))
 	if err != nil {
@@ -402,7 +404,7 @@ func (n *networker) SetupTap(networkID pkg.NetID) (string, error) {
 		return "", errors.Wrap(err, "could not get network namespace bridge")
 	}
 
-	tapIface, err := tapName(networkID)
+	tapIface, err := tapName(networkID, name)
 	if err != nil {
 		return "", errors.Wrap(err, "could not get network namespace tap device name")
 	}
@@ -412,10 +414,10 @@ func (n *networker) SetupTap(networkID pkg.NetID) (string, error) {
 	return tapIface, err
 }
 
-func (n *networker) TapExists(networkID pkg.NetID) (bool, error) {
-	log.Info().Str("network-id", string(networkID)).Msg("Checking if tap interface exists")
+func (n *networker) TapExists(networkID pkg.NetID, name string) (bool, error) {
+	log.Info().Str("network-id", string(networkID)).Str("name", name).Msg("Checking if tap interface exists")
 
-	tapIface, err := tapName(networkID)
+	tapIface, err := tapName(networkID, name)
 	if err != nil {
 		return false, errors.Wrap(err, "could not get network namespace tap device name")
 	}
@@ -424,10 +426,10 @@ func (n *networker) TapExists(networkID pkg.NetID) (bool, error) {
 }
 
 // RemoveTap in the network resource.
-func (n *networker) RemoveTap(networkID pkg.NetID) error {
-	log.Info().Str("network-id", string(networkID)).Msg("Removing tap interface")
+func (n *networker) RemoveTap(networkID pkg.NetID, name string) error {
+	log.Info().Str("network-id", string(networkID)).Str("name", name).Msg("Removing tap interface")
 
-	tapIface, err := tapName(networkID)
+	tapIface, err := tapName(networkID, name)
 	if err != nil {
 		return errors.Wrap(err, "could not get network namespace tap device name")
 	}
@@ -485,6 +487,72 @@ func (n *networker) RemovePubTap(pubIPReservationID string) error {
 	return ifaceutil.Delete(tapIface, nil)
 }
 
+// SetupPubIPv6Tap sets up a tap device in the host namespace hooked to the
+// public bridge. The VM gets its public IPv6 with slaac
+func (n *networker) SetupPubIPv6Tap(name string) (string, error) {
+	log.Info().Str("name", name).Msg("Setting up public IPv6 tap interface")
+
+	ipv4Only, err := n.ndmz.IsIPv4Only()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to check ipv6 support")
+	}
+	if ipv4Only {
+		return "", errors.New("this node runs in IPv4 only mode, can't create public IPv6 tap")
+	}
+
+	tapIface := hashedTapName("6-", name)
+	hw := ifaceutil.HardwareAddrFromInputBytes([]byte(tapIface))
+	_, err = macvtap.CreateMACvTap(tapIface, public.PublicBridge, hw)
+
+	return tapIface, err
+}
+
+// RemovePubIPv6Tap removes the public IPv6 tap device of name
+func (n *networker) RemovePubIPv6Tap(name string) error {
+	log.Info().Str("name", name).Msg("Removing public IPv6 tap interface")
+
+	return ifaceutil.Delete(hashedTapName("6-", name), nil)
+}
+
+// SetupYggTap sets up a tap device in the host namespace hooked to the
+// yggdrasil network, and returns the yggdrasil config the VM must use
+func (n *networker) SetupYggTap(name string) (tap pkg.YggTap, err error) {
+	log.Info().Str("name", name).Msg("Setting up yggdrasil tap interface")
+
+	if n.ygg == nil {
+		return tap, errors.New("yggdrasil is not enabled on this node")
+	}
+
+	tap.Name = hashedTapName("y-", name)
+	tap.HW = ifaceutil.HardwareAddrFromInputBytes([]byte(tap.Name))
+
+	ip, err := n.ygg.SubnetFor(tap.HW)
+	if err != nil {
+		return tap, fmt.Errorf("failed to generate ygg subnet IP: %w", err)
+	}
+	tap.IP = net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(64, 128),
+	}
+
+	gw, err := n.ygg.Gateway()
+	if err != nil {
+		return tap, fmt.Errorf("failed to get ygg gateway IP: %w", err)
+	}
+	tap.Gateway = gw.IP
+
+	_, err = macvtap.CreateMACvTap(tap.Name, public.PublicBridge, tap.HW)
+
+	return tap, err
+}
+
+// RemoveYggTap removes the yggdrasil tap device of name
+func (n *networker) RemoveYggTap(name string) error {
+	log.Info().Str("name", name).Msg("Removing yggdrasil tap interface")
+
+	return ifaceutil.Delete(hashedTapName("y-", name), nil)
+}
+
 // GetPublicIPv6Subnet returns the IPv6 prefix op the public subnet of the host
 func (n *networker) GetPublicIPv6Subnet() (net.IPNet, error) {
 	addrs, err := n.ndmz.GetIP(ndmz.FamilyV6)
@@ -846,6 +914,11 @@ func (n *networker) releasePort(port uint16) error {
 	return nil
 }
 
+// WireguardPorts implements pkg.Networker interface
+func (n *networker) WireguardPorts() ([]uint, error) {
+	return n.portSet.List()
+}
+
 func (n *networker) publishWGPorts() error {
 	ports, err := n.portSet.List()
 	if err != nil {
@@ -1044,13 +1117,29 @@ func createNetNS(name string) (ns.NetNS, error) {
 	return netNs, nil
 }
 
-// tapName returns the name of the tap device for a network namespace
-func tapName(netID pkg.NetID) (string, error) {
-	name := fmt.Sprintf("t-%s", netID)
-	if len(name) > 15 {
-		return "", errors.Errorf("tap name too long %s", name)
+// tapName returns the name of the tap device of owner name in a network namespace.
+// The taps created before a network could have multiple taps have no owner
+func tapName(netID pkg.NetID, name string) (string, error) {
+	if name != "" {
+		return hashedTapName("t-", string(netID), name), nil
 	}
-	return name, nil
+
+	tap := fmt.Sprintf("t-%s", netID)
+	if len(tap) > 15 {
+		return "", errors.Errorf("tap name too long %s", tap)
+	}
+	return tap, nil
+}
+
+// hashedTapName builds a tap device name from a 2 chars prefix and a hash of parts
+// that always fits in the 15 chars limit of the interface names
+func hashedTapName(prefix string, parts ...string) string {
+	h := md5.Sum([]byte(strings.Join(parts, "/")))
+	b := base58.Encode(h[:])
+	if len(b) > 13 {
+		b = b[:13]
+	}
+	return prefix + b
 }
 
 func pubTapName(resID string) (string, error) {
@@ -2,7 +2,11 @@ package pkg
 
 //go:generate zbusc -module provision -version 0.0.1 -name provision -package stubs github.com/threefoldtech/zos/pkg+Provision stubs/provision_stub.go
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
 
 // ProvisionCounters struct
 type ProvisionCounters struct {
@@ -14,8 +18,177 @@ type ProvisionCounters struct {
 	Debug     int64 `json:"debug"`
 }
 
+// WorkloadState is the health of a deployed workload
+type WorkloadState string
+
+const (
+	// WorkloadRunning the workload is up and healthy
+	WorkloadRunning WorkloadState = "running"
+	// WorkloadRestarting the workload is down but is being restarted by the node
+	WorkloadRestarting WorkloadState = "restarting"
+	// WorkloadDegraded the workload is up but some of its resources are missing
+	WorkloadDegraded WorkloadState = "degraded"
+	// WorkloadStopped the workload is down and won't come back on its own
+	WorkloadStopped WorkloadState = "stopped"
+	// WorkloadSuspended the reservation expired and the workload is suspended
+	// until the reservation is extended or the grace period is over
+	WorkloadSuspended WorkloadState = "suspended"
+)
+
+// WorkloadStatus is the last known state of a deployed workload
+type WorkloadStatus struct {
+	ID    string        `json:"id"`
+	Type  string        `json:"type"`
+	State WorkloadState `json:"state"`
+	// LastError is the reason why the workload is not running
+	LastError string `json:"last_error,omitempty"`
+	// Checked is when the workload state was checked the last time
+	Checked time.Time `json:"checked"`
+	// Since is when the workload entered its current state
+	Since time.Time `json:"since"`
+}
+
+// ExpiryWarning informs the owner of a reservation that it is about to expire
+type ExpiryWarning struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Expires is when the reservation expires
+	Expires time.Time `json:"expires"`
+	// GraceEnds is when the workload is decommissioned if the
+	// reservation is not extended
+	GraceEnds time.Time `json:"grace_ends"`
+	// Suspended is set once the reservation expired and its
+	// workload is suspended
+	Suspended bool `json:"suspended"`
+}
+
+// ProvisionEventType is the kind of a provisioning event
+type ProvisionEventType string
+
+const (
+	// EventReceived the reservation is received by the node
+	EventReceived ProvisionEventType = "received"
+	// EventProvisioning the reservation passed the admission and
+	// its workload is being deployed
+	EventProvisioning ProvisionEventType = "provisioning"
+	// EventProvisioned the workload is deployed or updated
+	EventProvisioned ProvisionEventType = "provisioned"
+	// EventFailed the reservation could not be provisioned
+	EventFailed ProvisionEventType = "failed"
+	// EventDecommissioned the workload is removed from the node
+	EventDecommissioned ProvisionEventType = "decommissioned"
+	// EventExpired the reservation expired
+	EventExpired ProvisionEventType = "expired"
+)
+
+// ProvisionEvent is emitted by the provision engine each time
+// a reservation goes through one of the provisioning steps
+type ProvisionEvent struct {
+	Event ProvisionEventType `json:"event"`
+	ID    string             `json:"id"`
+	Type  string             `json:"type"`
+	// Error is set for the failed events
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// CleanupAction is what the janitor did with a resource
+type CleanupAction string
+
+const (
+	// CleanupRemoved the resource is not used by any reservation and was removed
+	CleanupRemoved CleanupAction = "removed"
+	// CleanupWouldRemove the resource would have been removed but
+	// the janitor runs in dry-run mode
+	CleanupWouldRemove CleanupAction = "would-remove"
+	// CleanupKept the resource is still in use, or it can't be
+	// known if it is in use
+	CleanupKept CleanupAction = "kept"
+	// CleanupFailed the resource should have been removed but the removal failed
+	CleanupFailed CleanupAction = "failed"
+)
+
+// CleanupItem is a resource checked by the janitor
+type CleanupItem struct {
+	// Kind of resource: zdb-namespace, zdb-container, vm, volume, vdisk or public-ip
+	Kind   string        `json:"kind"`
+	Name   string        `json:"name"`
+	Action CleanupAction `json:"action"`
+	// Reason why the resource was removed or kept
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CleanupReport is what the janitor did during a clean up of the node
+type CleanupReport struct {
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	DryRun   bool          `json:"dry_run"`
+	Items    []CleanupItem `json:"items"`
+}
+
+// ReservationInfo is a reservation deployed on the node
+type ReservationInfo struct {
+	ID     string `json:"id"`
+	NodeID string `json:"node_id"`
+	User   string `json:"user_id"`
+	Type   string `json:"type"`
+	// Data is the reservation type arguments
+	Data     json.RawMessage `json:"data"`
+	Created  time.Time       `json:"created"`
+	Duration time.Duration   `json:"duration"`
+	// Expires is when the reservation expires
+	Expires         time.Time `json:"expires"`
+	Reference       string    `json:"reference"`
+	WorkloadVersion int       `json:"workload_version"`
+	// Suspended is set if the reservation expired and its workload
+	// is suspended during the grace period
+	Suspended bool `json:"suspended"`
+}
+
+// ResultInfo is the result of the deployment of a reservation
+type ResultInfo struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+	// Error is set if the deployment failed
+	Error string `json:"error"`
+	// Data is the information generated by the deployment
+	Data            json.RawMessage `json:"data"`
+	Created         time.Time       `json:"created"`
+	WorkloadVersion int             `json:"workload_version"`
+}
+
+// ReservationFilter selects reservations from the ones deployed on the node.
+// Empty fields are ignored
+type ReservationFilter struct {
+	Type string `json:"type"`
+	User string `json:"user_id"`
+	// ExpiresAfter and ExpiresBefore select the reservations
+	// that expire within a time window
+	ExpiresAfter  time.Time `json:"expires_after"`
+	ExpiresBefore time.Time `json:"expires_before"`
+}
+
 // Provision interface
 type Provision interface {
 	Counters(ctx context.Context) <-chan ProvisionCounters
 	DecommissionCached(id string, reason string) error
+	Statuses(ctx context.Context) <-chan []WorkloadStatus
+	// Events streams the provisioning events as they happen
+	Events(ctx context.Context) <-chan ProvisionEvent
+
+	// ListReservations returns the deployed reservations that match the filter
+	ListReservations(filter ReservationFilter) ([]ReservationInfo, error)
+	// GetReservation returns a deployed reservation
+	GetReservation(id string) (ReservationInfo, error)
+	// GetResult returns the result of the deployment of a reservation
+	GetResult(id string) (ResultInfo, error)
+
+	// CanProvision validates the reservation and checks that the node has
+	// enough free resources to provision it, without deploying anything
+	CanProvision(reservation ReservationInfo) error
+
+	// LastCleanup returns the report of the last clean up of the lingering resources
+	LastCleanup() (CleanupReport, error)
 }
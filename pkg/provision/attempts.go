@@ -0,0 +1,127 @@
+package provision
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// attemptRetention is how long the attempts are kept after the reservation expired
+const attemptRetention = 30 * 24 * time.Hour
+
+// AttemptState is the outcome of the processing of a reservation
+type AttemptState string
+
+const (
+	// AttemptProvisioned the workload is deployed
+	AttemptProvisioned AttemptState = "provisioned"
+	// AttemptFailed the provision failed, the reservation is marked as deleted
+	AttemptFailed AttemptState = "failed"
+	// AttemptDecommissioned the workload is removed, the reservation
+	// can't be provisioned anymore
+	AttemptDecommissioned AttemptState = "decommissioned"
+)
+
+// Attempt is the last time the engine processed a reservation
+type Attempt struct {
+	ID              string       `json:"id"`
+	WorkloadVersion int          `json:"workload_version"`
+	State           AttemptState `json:"state"`
+	// Expires is the expiration of the reservation, once expired the
+	// reservation can't be provisioned anymore so the attempt can be pruned
+	Expires time.Time `json:"expires"`
+	Time    time.Time `json:"time"`
+}
+
+// AttemptStore keeps track of the last attempt to process each reservation
+// so the engine never provisions the same reservation twice, even after a restart
+// or if the reservation is received from different sources
+type AttemptStore interface {
+	// GetAttempt returns the last attempt for the reservation id, the boolean
+	// is false if the reservation was never processed
+	GetAttempt(id string) (Attempt, bool, error)
+	// SetAttempt records the last attempt for a reservation
+	SetAttempt(attempt Attempt) error
+	// PruneAttempts removes the attempts of the reservations that expired before t
+	PruneAttempts(t time.Time) error
+}
+
+// memAttempts is used if the engine has no attempt store, duplicates are
+// then only detected until provisiond restarts
+type memAttempts struct {
+	sync.Mutex
+	attempts map[string]Attempt
+}
+
+func newMemAttempts() *memAttempts {
+	return &memAttempts{attempts: make(map[string]Attempt)}
+}
+
+func (m *memAttempts) GetAttempt(id string) (Attempt, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	attempt, ok := m.attempts[id]
+	return attempt, ok, nil
+}
+
+func (m *memAttempts) SetAttempt(attempt Attempt) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.attempts[attempt.ID] = attempt
+	return nil
+}
+
+func (m *memAttempts) PruneAttempts(t time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for id, attempt := range m.attempts {
+		if attempt.Expires.Before(t) {
+			delete(m.attempts, id)
+		}
+	}
+	return nil
+}
+
+// attempt records the outcome of the processing of a reservation
+func (e *Engine) attempt(id string, r *Reservation, state AttemptState) {
+	err := e.attempts.SetAttempt(Attempt{
+		ID:              id,
+		WorkloadVersion: r.WorkloadVersion,
+		State:           state,
+		Expires:         r.Expires(),
+		Time:            time.Now(),
+	})
+	if err != nil {
+		log.Error().Err(err).Str("id", id).Msg("failed to record provision attempt")
+	}
+}
+
+// duplicate returns true if the reservation must not be provisioned because
+// it has been decommissioned already or this version already failed
+func (e *Engine) duplicate(r *Reservation) (bool, error) {
+	attempt, ok, err := e.attempts.GetAttempt(r.ID)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	switch attempt.State {
+	case AttemptDecommissioned:
+		return true, nil
+	case AttemptFailed:
+		return r.WorkloadVersion <= attempt.WorkloadVersion, nil
+	}
+
+	// the cache knows what to do with the reservations already provisioned
+	return false, nil
+}
+
+// pruneAttempts forgets the reservations that expired more than attemptRetention ago
+func (e *Engine) pruneAttempts() {
+	if err := e.attempts.PruneAttempts(time.Now().Add(-attemptRetention)); err != nil {
+		log.Error().Err(err).Msg("failed to prune provision attempts")
+	}
+}
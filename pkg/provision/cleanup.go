@@ -1,9 +1,15 @@
 package provision
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
@@ -18,32 +24,124 @@ import (
 	"golang.org/x/net/context"
 )
 
+// defaultCleanupSchedule is when the janitor runs if not configured
+const defaultCleanupSchedule = "@midnight"
+
 var (
 	vdiskIDMatch = regexp.MustCompile(`^(\d+-\d+)`)
 	pubIPIDMatch = regexp.MustCompile(`^p-(\d+-1)$`)
 )
 
+// kinds of resources cleaned up by the janitor
+const (
+	cleanupZDBNamespace = "zdb-namespace"
+	cleanupZDBContainer = "zdb-container"
+	cleanupVM           = "vm"
+	cleanupVolume       = "volume"
+	cleanupVDisk        = "vdisk"
+	cleanupPublicIP     = "public-ip"
+)
+
 // Janitor structure
 type Janitor struct {
 	zbus zbus.Client
 
 	getter ReservationGetter
+
+	// dryRun only reports what would be removed
+	dryRun bool
+	// reports is the file the last report is written to
+	reports string
+
+	m    sync.Mutex
+	last *pkg.CleanupReport
 }
 
-// NewJanitor creates a new Janitor instance
-func NewJanitor(zbus zbus.Client, getter ReservationGetter) *Janitor {
+// NewJanitor creates a new Janitor instance. The report of the last clean up
+// is kept in the reports file, if set. In dry-run mode the janitor only reports
+// the resources it would remove
+func NewJanitor(zbus zbus.Client, getter ReservationGetter, reports string, dryRun bool) *Janitor {
 	return &Janitor{
-		zbus:   zbus,
-		getter: getter,
+		zbus:    zbus,
+		getter:  getter,
+		dryRun:  dryRun,
+		reports: reports,
+	}
+}
+
+// cleanup is a single run of the janitor
+type cleanup struct {
+	report pkg.CleanupReport
+}
+
+// keep records that a resource is kept
+func (c *cleanup) keep(kind, name, reason string, err error) {
+	item := pkg.CleanupItem{
+		Kind:   kind,
+		Name:   name,
+		Action: pkg.CleanupKept,
+		Reason: reason,
+	}
+	if err != nil {
+		item.Error = err.Error()
 	}
+
+	log.Debug().Str("kind", kind).Str("name", name).Str("reason", reason).Msg("keep resource")
+	c.report.Items = append(c.report.Items, item)
 }
 
-// CleanupResources cleans up unused resources
-func (j *Janitor) CleanupResources(ctx context.Context) error {
+// remove removes a resource with fn, unless the janitor runs in dry-run mode.
+// It returns false if the removal failed
+func (c *cleanup) remove(kind, name, reason string, fn func() error) bool {
+	item := pkg.CleanupItem{
+		Kind:   kind,
+		Name:   name,
+		Action: pkg.CleanupRemoved,
+		Reason: reason,
+	}
+
+	clog := log.With().Str("kind", kind).Str("name", name).Str("reason", reason).Logger()
+	if c.report.DryRun {
+		item.Action = pkg.CleanupWouldRemove
+		clog.Info().Msg("would delete resource")
+	} else if err := fn(); err != nil {
+		item.Action = pkg.CleanupFailed
+		item.Error = err.Error()
+		clog.Error().Err(err).Msg("failed to delete resource")
+	} else {
+		clog.Info().Msg("deleted resource")
+	}
+
+	c.report.Items = append(c.report.Items, item)
+	return item.Action != pkg.CleanupFailed
+}
+
+// CleanupResources cleans up unused resources and returns
+// the report of what has been removed and what has been kept
+func (j *Janitor) CleanupResources(ctx context.Context) (pkg.CleanupReport, error) {
+	c := &cleanup{
+		report: pkg.CleanupReport{
+			Started: time.Now(),
+			DryRun:  j.dryRun,
+			Items:   []pkg.CleanupItem{},
+		},
+	}
+
+	j.cleanupResources(ctx, c)
+
+	c.report.Finished = time.Now()
+	if err := j.save(c.report); err != nil {
+		return c.report, errors.Wrap(err, "failed to save clean up report")
+	}
+
+	return c.report, nil
+}
+
+func (j *Janitor) cleanupResources(ctx context.Context, c *cleanup) {
 	// - First remove all lingering zdb namespaces that has NO valid
 	// reservation. This will also decomission zdb containers that
 	// serves no namespaces anymore
-	if err := j.cleanupZdbContainers(ctx); err != nil {
+	if err := j.cleanupZdbContainers(ctx, c); err != nil {
 		log.Error().Err(err).Msg("zdb cleaner failed")
 		// we don't stop here. if we failed to clean zdb containers
 		// any lingering zdb container will end up in the protected
@@ -51,30 +149,96 @@ func (j *Janitor) CleanupResources(ctx context.Context) error {
 		// to clean what we can
 	}
 
-	if err := j.cleanupPublicIPs(ctx); err != nil {
+	if err := j.cleanupPublicIPs(ctx, c); err != nil {
 		log.Error().Err(err).Msg("ip cleaner failed")
 	}
 
 	// -2nd we clean up all lingering vms on the node
-	if err := j.cleanupVms(ctx); err != nil {
+	if err := j.cleanupVms(ctx, c); err != nil {
 		log.Error().Err(err).Msg("vm cleaner failed")
 	}
 
 	// - 3rd, we clean up all lingering volumes on the node
-	if err := j.cleanupVolumes(ctx); err != nil {
+	if err := j.cleanupVolumes(ctx, c); err != nil {
 		log.Error().Err(err).Msg("volume cleaner failed")
 	}
 
 	// - 4th, we clean up any lingering vdisks that are not being
 	// used.
-	if err := j.cleanupVdisks(ctx); err != nil {
+	if err := j.cleanupVdisks(ctx, c); err != nil {
 		log.Error().Err(err).Msg("virtual disks cleaner failed")
 	}
+}
 
-	return nil
+// save keeps the report as the last one
+func (j *Janitor) save(report pkg.CleanupReport) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	j.last = &report
+	if j.reports == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.reports), 0770); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so the last report
+	// is never lost if provisiond dies while writing it
+	tmp := j.reports + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, j.reports)
+}
+
+// LastReport returns the report of the last clean up, even if it
+// happened before provisiond restarted
+func (j *Janitor) LastReport() (pkg.CleanupReport, error) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	if j.last != nil {
+		return *j.last, nil
+	}
+
+	var report pkg.CleanupReport
+	if j.reports == "" {
+		return report, fmt.Errorf("no clean up has been done yet")
+	}
+
+	data, err := ioutil.ReadFile(j.reports)
+	if os.IsNotExist(err) {
+		return report, fmt.Errorf("no clean up has been done yet")
+	} else if err != nil {
+		return report, errors.Wrap(err, "failed to read clean up report")
+	}
+
+	if err := json.Unmarshal(data, &report); err != nil {
+		return report, errors.Wrap(err, "failed to decode clean up report")
+	}
+
+	j.last = &report
+	return report, nil
+}
+
+// LastCleanup implements pkg.Provision
+func (e *Engine) LastCleanup() (pkg.CleanupReport, error) {
+	if e.janitor == nil {
+		return pkg.CleanupReport{}, fmt.Errorf("janitor is not configured")
+	}
+
+	return e.janitor.LastReport()
 }
 
-func (j *Janitor) cleanupPublicIPs(ctx context.Context) error {
+func (j *Janitor) cleanupPublicIPs(ctx context.Context, c *cleanup) error {
 	//todo: use networkd to list public taps
 	links, err := netlink.LinkList()
 	if err != nil {
@@ -91,21 +255,22 @@ func (j *Janitor) cleanupPublicIPs(ctx context.Context) error {
 		toDelete, err := j.checkToDelete(id)
 		if err != nil {
 			log.Error().Err(err).Str("id", id).Msg("failed to check ip for delete")
+			c.keep(cleanupPublicIP, id, "check-failed", err)
+			continue
 		}
-		log.Debug().Bool("to-delete", toDelete).Str("id", id).Msg("vm reservation status")
 		if !toDelete {
+			c.keep(cleanupPublicIP, id, "active-reservation", nil)
 			continue
 		}
-		log.Debug().Str("id", id).Msg("deleting stall ip reservation")
-		if err := netd.RemovePubTap(id); err != nil {
-			log.Error().Err(err).Str("id", id).Msg("failed to delete public ip")
-		}
+		c.remove(cleanupPublicIP, id, "no-associated-reservation", func() error {
+			return netd.RemovePubTap(id)
+		})
 	}
 
 	return nil
 }
 
-func (j *Janitor) cleanupVms(ctx context.Context) error {
+func (j *Janitor) cleanupVms(ctx context.Context, c *cleanup) error {
 	vmd := stubs.NewVMModuleStub(j.zbus)
 	vms, err := vmd.List()
 	if err != nil {
@@ -115,15 +280,17 @@ func (j *Janitor) cleanupVms(ctx context.Context) error {
 		toDelete, err := j.checkToDelete(vm)
 		if err != nil {
 			log.Error().Err(err).Str("id", vm).Msg("failed to check vm for delete")
+			c.keep(cleanupVM, vm, "check-failed", err)
+			continue
 		}
-		log.Debug().Bool("to-delete", toDelete).Str("id", vm).Msg("vm reservation status")
 		if !toDelete {
+			c.keep(cleanupVM, vm, "active-reservation", nil)
 			continue
 		}
-		log.Debug().Str("id", vm).Msg("deleting stall vm reservation")
-		if err := vmd.Delete(vm); err != nil {
-			log.Error().Err(err).Str("id", vm).Msg("failed to delete vm")
-		}
+
+		c.remove(cleanupVM, vm, "no-associated-reservation", func() error {
+			return vmd.Delete(vm)
+		})
 	}
 
 	return nil
@@ -134,6 +301,10 @@ func (j *Janitor) checkToDelete(id string) (bool, error) {
 
 	reservation, err := j.getter.Get(id)
 	if err != nil {
+		if errors.Is(err, ErrReservationNotFound) {
+			return true, nil
+		}
+
 		var hErr client.HTTPError
 		if ok := errors.As(err, &hErr); ok {
 			resp := hErr.Response()
@@ -149,8 +320,9 @@ func (j *Janitor) checkToDelete(id string) (bool, error) {
 	return reservation.ToDelete, nil
 }
 
-func (j *Janitor) cleanupVdisks(ctx context.Context) error {
+func (j *Janitor) cleanupVdisks(ctx context.Context, c *cleanup) error {
 	stub := stubs.NewVDiskModuleStub(j.zbus)
+	vmd := stubs.NewVMModuleStub(j.zbus)
 
 	vdisks, err := stub.List()
 	if err != nil {
@@ -158,33 +330,43 @@ func (j *Janitor) cleanupVdisks(ctx context.Context) error {
 	}
 	for _, vdisk := range vdisks {
 		//fmt.Sscanf(str string, format string, a ...interface{})
-		gwid := vdiskIDMatch.FindString(vdisk.Name())
-		clog := log.With().Str("vdisk", vdisk.Name()).Str("id", gwid).Logger()
+		name := vdisk.Name()
+		gwid := vdiskIDMatch.FindString(name)
+		clog := log.With().Str("vdisk", name).Str("id", gwid).Logger()
 		if len(gwid) == 0 {
 			clog.Warn().Msg("vdisk has invalid id, skipping")
+			c.keep(cleanupVDisk, name, "invalid-id", nil)
 			continue
 		}
 
 		delete, err := j.checkToDelete(gwid)
 		if err != nil {
 			clog.Error().Err(err).Msg("failed to check vdisk reservation")
+			c.keep(cleanupVDisk, name, "check-failed", err)
 			continue
 		}
 
-		if delete {
-			clog.Info().Str("reason", "no-associated-reservation").Msg("delete vdisk")
-			if err := stub.Deallocate(vdisk.Name()); err != nil {
-				clog.Error().Err(err).Msg("failed to deallocate vdisk")
-			}
-		} else {
-			clog.Info().Msg("skipping vdisk")
+		if !delete {
+			c.keep(cleanupVDisk, name, "active-reservation", nil)
+			continue
 		}
+
+		// the disks of the virtual machines are only removed once
+		// they are detached, even if their reservation is gone
+		if vm, ok := vmd.DiskUser(vdisk.Path); ok {
+			c.keep(cleanupVDisk, name, "attached-to-vm", fmt.Errorf("disk is attached to virtual machine %s", vm))
+			continue
+		}
+
+		c.remove(cleanupVDisk, name, "no-associated-reservation", func() error {
+			return stub.Deallocate(name)
+		})
 	}
 
 	return nil
 }
 
-func (j *Janitor) cleanupVolumes(ctx context.Context) error {
+func (j *Janitor) cleanupVolumes(ctx context.Context, c *cleanup) error {
 	storaged := stubs.NewStorageModuleStub(j.zbus)
 	// We get a list with ALL volumes, that are being
 	// used by active containers. Note we don't check if
@@ -210,9 +392,14 @@ func (j *Janitor) cleanupVolumes(ctx context.Context) error {
 
 		clog.Debug().Msg("checking volume for clean up")
 
+		name := volume.Name
+		release := func() error {
+			return storaged.ReleaseFilesystem(name)
+		}
+
 		// - Is the volume protected
 		if _, ok := protected[volume.Path]; ok {
-			clog.Debug().Msg("volume is protected, skipping")
+			c.keep(cleanupVolume, name, "used-by-container", nil)
 			continue
 		}
 
@@ -220,30 +407,18 @@ func (j *Janitor) cleanupVolumes(ctx context.Context) error {
 			// if the fs is not used by any container and its name is 64 character long
 			// they are left over of old containers when flistd used to generate random names
 			// for the container root flist subvolumes
-			clog.Info().Str("reason", "legacy-root-fs").Msg("delete subvolume")
-			if err := storaged.ReleaseFilesystem(volume.Name); err != nil {
-				clog.Error().Err(err).Msg("failed to delete subvol")
-			}
-
+			c.remove(cleanupVolume, name, "legacy-root-fs", release)
 			continue
 		}
 
 		if strings.HasPrefix(volume.Name, storage.ZDBPoolPrefix) {
-			clog.Info().Str("reason", "unused-zdb").Msg("delete subvolume")
-			if err := storaged.ReleaseFilesystem(volume.Name); err != nil {
-				clog.Error().Err(err).Msg("failed to delete subvol")
-			}
-
+			c.remove(cleanupVolume, name, "unused-zdb", release)
 			continue
 		}
 
 		if volume.Name == "fcvms" {
 			// left over from testing during vm module development
-			clog.Info().Str("reason", "legacy-vm-fs").Msg("delete subvolume")
-			if err := storaged.ReleaseFilesystem(volume.Name); err != nil {
-				clog.Error().Err(err).Msg("failed to delete subvol")
-			}
-
+			c.remove(cleanupVolume, name, "legacy-vm-fs", release)
 			continue
 		}
 
@@ -255,23 +430,21 @@ func (j *Janitor) cleanupVolumes(ctx context.Context) error {
 		if err != nil {
 			//TODO: handle error here
 			clog.Error().Err(err).Msg("failed to check volume reservation")
+			c.keep(cleanupVolume, name, "check-failed", err)
 			continue
 		}
 
 		if delete {
-			clog.Info().Str("reason", "no-associated-reservation").Msg("delete subvolume")
-			if err := storaged.ReleaseFilesystem(volume.Name); err != nil {
-				clog.Error().Err(err).Msg("failed to delete subvolume")
-			}
+			c.remove(cleanupVolume, name, "no-associated-reservation", release)
 		} else {
-			clog.Info().Msg("skipping subvolume")
+			c.keep(cleanupVolume, name, "active-reservation", nil)
 		}
 	}
 
 	return nil
 }
 
-func (j *Janitor) cleanupZdbContainer(ctx context.Context, id string) error {
+func (j *Janitor) cleanupZdbContainer(ctx context.Context, c *cleanup, id string) error {
 	con, err := newZdbConnection(id)
 	if err != nil {
 		return err
@@ -296,16 +469,18 @@ func (j *Janitor) cleanupZdbContainer(ctx context.Context, id string) error {
 		toDelete, err := j.checkToDelete(namespace)
 		if err != nil {
 			log.Error().Err(err).Str("zdb-namespace", namespace).Msg("failed to check if we should keep namespace")
+			c.keep(cleanupZDBNamespace, namespace, "check-failed", err)
 			continue
 		}
 
 		if !toDelete {
+			c.keep(cleanupZDBNamespace, namespace, "active-reservation", nil)
 			continue
 		}
 
-		if err := con.DeleteNamespace(namespace); err != nil {
-			log.Error().Err(err).Str("zdb-namespace", namespace).Msg("failed to delete lingering zdb namespace")
-		}
+		c.remove(cleanupZDBNamespace, namespace, "no-associated-reservation", func() error {
+			return con.DeleteNamespace(namespace)
+		})
 
 		delete(mapped, namespace)
 	}
@@ -313,14 +488,21 @@ func (j *Janitor) cleanupZdbContainer(ctx context.Context, id string) error {
 	if len(mapped) > 0 {
 		// not all namespaces are deleted so we need to keep this
 		// container instance
+		c.keep(cleanupZDBContainer, id, "namespaces-in-use", nil)
 		return nil
 	}
 
 	// no more namespace to keep, so container can also go
-	return common.DeleteZdbContainer(pkg.ContainerID(id), j.zbus)
+	if !c.remove(cleanupZDBContainer, id, "no-namespace-left", func() error {
+		return common.DeleteZdbContainer(pkg.ContainerID(id), j.zbus)
+	}) {
+		return fmt.Errorf("failed to delete zdb container %s", id)
+	}
+
+	return nil
 }
 
-func (j *Janitor) cleanupZdbContainers(ctx context.Context) error {
+func (j *Janitor) cleanupZdbContainers(ctx context.Context, c *cleanup) error {
 	containerd := stubs.NewContainerModuleStub(j.zbus)
 
 	containers, err := containerd.List("zdb")
@@ -329,7 +511,7 @@ func (j *Janitor) cleanupZdbContainers(ctx context.Context) error {
 	}
 
 	for _, containerID := range containers {
-		if err := j.cleanupZdbContainer(ctx, string(containerID)); err != nil {
+		if err := j.cleanupZdbContainer(ctx, c, string(containerID)); err != nil {
 			log.Error().Err(err).Msg("failed to cleanup zdb container")
 		}
 	}
@@ -0,0 +1,94 @@
+package provision
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+func TestCleanupReport(t *testing.T) {
+	c := &cleanup{}
+
+	removed := 0
+	remove := func() error {
+		removed++
+		return nil
+	}
+
+	require.True(t, c.remove(cleanupVM, "1-1", "no-associated-reservation", remove))
+	require.False(t, c.remove(cleanupVolume, "2-1", "no-associated-reservation", func() error {
+		return fmt.Errorf("device busy")
+	}))
+	c.keep(cleanupVDisk, "3-1-vda", "check-failed", fmt.Errorf("explorer unreachable"))
+
+	require.Equal(t, 1, removed)
+	require.Equal(t, []pkg.CleanupItem{
+		{Kind: cleanupVM, Name: "1-1", Action: pkg.CleanupRemoved, Reason: "no-associated-reservation"},
+		{Kind: cleanupVolume, Name: "2-1", Action: pkg.CleanupFailed, Reason: "no-associated-reservation", Error: "device busy"},
+		{Kind: cleanupVDisk, Name: "3-1-vda", Action: pkg.CleanupKept, Reason: "check-failed", Error: "explorer unreachable"},
+	}, c.report.Items)
+}
+
+func TestCleanupDryRun(t *testing.T) {
+	c := &cleanup{report: pkg.CleanupReport{DryRun: true}}
+
+	require.True(t, c.remove(cleanupPublicIP, "1-1", "no-associated-reservation", func() error {
+		t.Fatal("nothing must be removed in dry-run mode")
+		return nil
+	}))
+	require.Equal(t, pkg.CleanupWouldRemove, c.report.Items[0].Action)
+}
+
+func TestJanitorLastReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "janitor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cleanup.json")
+	j := NewJanitor(nil, nil, path, true)
+
+	_, err = j.LastReport()
+	require.Error(t, err)
+
+	report := pkg.CleanupReport{
+		DryRun: true,
+		Items: []pkg.CleanupItem{
+			{Kind: cleanupVM, Name: "1-1", Action: pkg.CleanupWouldRemove, Reason: "no-associated-reservation"},
+		},
+	}
+	require.NoError(t, j.save(report))
+
+	// the report survives a restart
+	loaded, err := NewJanitor(nil, nil, path, true).LastReport()
+	require.NoError(t, err)
+	require.Equal(t, report.Items, loaded.Items)
+	require.True(t, loaded.DryRun)
+}
+
+type testGetter map[string]*Reservation
+
+func (g testGetter) Get(id string) (*Reservation, error) {
+	r, ok := g[id]
+	if !ok {
+		return nil, fmt.Errorf("reservation %s: %w", id, ErrReservationNotFound)
+	}
+	return r, nil
+}
+
+func TestJanitorCheckToDelete(t *testing.T) {
+	j := NewJanitor(nil, testGetter{
+		"1-1": {ID: "1-1"},
+		"2-1": {ID: "2-1", ToDelete: true},
+	}, "", true)
+
+	for id, expected := range map[string]bool{"1-1": false, "2-1": true, "3-1": true} {
+		toDelete, err := j.checkToDelete(id)
+		require.NoError(t, err)
+		require.Equal(t, expected, toDelete, id)
+	}
+}
@@ -2,39 +2,98 @@ package provision
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 
 	"github.com/pkg/errors"
 
-	"github.com/threefoldtech/zos/pkg"
 	"github.com/threefoldtech/zos/pkg/crypto"
 	"golang.org/x/crypto/ed25519"
 )
 
-// Sign creates a signature from all the field of the reservation
-// object and fill the Signature field
-func (r *Reservation) Sign(privateKey ed25519.PrivateKey) error {
+// Signing versions define which fields of a reservation are covered
+// by its signature
+const (
+	// SigningLegacy covers the node ID, user, type and data of the reservation.
+	// The ID is not covered since it used to be set by the explorer after
+	// the reservation was signed.
+	SigningLegacy = 0
+	// SigningV1 covers the ID, node ID, user, type, workload version,
+	// creation date, duration and data of the reservation
+	SigningV1 = 1
+	// SigningExplorer is used for reservations received from the explorer.
+	// The signature is the hex encoded signature of the SignatureChallenge
+	// computed by the explorer
+	SigningExplorer = 2
+)
+
+// deleteMarker prefixes the payload of the delete signatures so a
+// signature of a reservation can't be used as a delete request
+const deleteMarker = "delete"
+
+// UserKeyResolver is used to find the public key of the user that
+// signed a reservation. The errors returned when the key could not be
+// fetched must be transient (see IsTransient), any other error means
+// the user has no key and its reservations are rejected
+type UserKeyResolver interface {
+	PublicKey(userID string) (ed25519.PublicKey, error)
+}
+
+func (r *Reservation) signingPayload() ([]byte, error) {
 	buf := &bytes.Buffer{}
-	//FIME: Since the ID is only set when the reservation is sent to bcdb
-	// we cannot use it in the signature. This is a problem
 
-	_, err := buf.WriteString(r.NodeID)
-	if err != nil {
-		return err
+	switch r.SigningVersion {
+	case SigningLegacy:
+	case SigningV1:
+		if _, err := buf.WriteString(r.ID); err != nil {
+			return nil, err
+		}
+	case SigningExplorer:
+		if len(r.SignatureChallenge) == 0 {
+			return nil, fmt.Errorf("reservation has no signature challenge")
+		}
+		return r.SignatureChallenge, nil
+	default:
+		return nil, fmt.Errorf("unknown signing version %d", r.SigningVersion)
 	}
-	_, err = buf.WriteString(r.User)
-	if err != nil {
-		return err
+
+	if _, err := buf.WriteString(r.NodeID); err != nil {
+		return nil, err
 	}
-	_, err = buf.WriteString(string(r.Type))
-	if err != nil {
-		return err
+	if _, err := buf.WriteString(r.User); err != nil {
+		return nil, err
 	}
-	_, err = buf.Write(r.Data)
+	if _, err := buf.WriteString(string(r.Type)); err != nil {
+		return nil, err
+	}
+
+	if r.SigningVersion == SigningV1 {
+		for _, v := range []int64{int64(r.WorkloadVersion), r.Created.Unix(), int64(r.Duration)} {
+			if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if _, err := buf.Write(r.Data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Sign creates a signature from the fields of the reservation
+// covered by the latest signing version and fill the Signature field
+func (r *Reservation) Sign(privateKey ed25519.PrivateKey) error {
+	r.SigningVersion = SigningV1
+
+	payload, err := r.signingPayload()
 	if err != nil {
 		return err
 	}
 
-	signature, err := crypto.Sign(privateKey, buf.Bytes())
+	signature, err := crypto.Sign(privateKey, payload)
 	if err != nil {
 		return err
 	}
@@ -42,34 +101,48 @@ func (r *Reservation) Sign(privateKey ed25519.PrivateKey) error {
 	return nil
 }
 
-// Verify verifies the signature of the reservation
-func Verify(r *Reservation) error {
-	buf := &bytes.Buffer{}
-	//FIME: Since the ID is only set when the reservation is sent to bcdb
-	// we cannot use it in the signature. This is a problem
-
-	_, err := buf.WriteString(r.NodeID)
-	if err != nil {
-		return err
+// Verify verifies the signature of the reservation against the public key of the user
+func Verify(r *Reservation, publicKey ed25519.PublicKey) error {
+	if len(r.Signature) == 0 {
+		return fmt.Errorf("reservation is not signed")
 	}
 
-	_, err = buf.WriteString(r.User)
+	payload, err := r.signingPayload()
 	if err != nil {
 		return err
 	}
-	_, err = buf.WriteString(string(r.Type))
-	if err != nil {
-		return err
+
+	signature := r.Signature
+	if r.SigningVersion == SigningExplorer {
+		signature, err = hex.DecodeString(string(r.Signature))
+		if err != nil {
+			return errors.Wrap(err, "invalid signature format")
+		}
 	}
-	_, err = buf.Write(r.Data)
+
+	return crypto.Verify(publicKey, payload, signature)
+}
+
+func (r *Reservation) deletePayload() []byte {
+	return []byte(deleteMarker + r.NodeID + r.ID)
+}
+
+// SignDelete signs the request to decommission the reservation
+// and fill the DeleteSignature field
+func (r *Reservation) SignDelete(privateKey ed25519.PrivateKey) error {
+	signature, err := crypto.Sign(privateKey, r.deletePayload())
 	if err != nil {
 		return err
 	}
+	r.DeleteSignature = signature
+	return nil
+}
 
-	publicKey, err := crypto.KeyFromID(pkg.StrIdentifier(r.User))
-	if err != nil {
-		return errors.Wrap(err, "failed to extract public key from user ID")
+// VerifyDelete verifies the delete signature of the reservation against the public key of the user
+func VerifyDelete(r *Reservation, publicKey ed25519.PublicKey) error {
+	if len(r.DeleteSignature) == 0 {
+		return fmt.Errorf("delete request is not signed")
 	}
 
-	return crypto.Verify(publicKey, buf.Bytes(), r.Signature)
+	return crypto.Verify(publicKey, r.deletePayload(), r.DeleteSignature)
 }
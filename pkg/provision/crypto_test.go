@@ -1,48 +1,173 @@
 package provision
 
-// func TestVerifySignature(t *testing.T) {
-// 	keyPair, err := identity.GenerateKeyPair()
-// 	require.NoError(t, err)
-
-// 	data, err := json.Marshal(Volume{
-// 		Type: SSDDiskType,
-// 		Size: 20,
-// 	})
-// 	require.NoError(t, err)
-
-// 	r := &Reservation{
-// 		ID:     "reservationID",
-// 		NodeID: "node1",
-// 		User:   keyPair.Identity(),
-// 		Type:   ContainerReservation,
-// 		Data:   data,
-// 	}
-
-// 	err = r.Sign(keyPair.PrivateKey)
-// 	require.NoError(t, err)
-
-// 	err = Verify(r)
-// 	assert.NoError(t, err)
-
-// 	validSignature := make([]byte, len(r.Signature))
-// 	copy(validSignature, r.Signature)
-
-// 	// corrupt the signature
-// 	_, err = rand.Read(r.Signature)
-// 	require.NoError(t, err)
-
-// 	err = Verify(r)
-// 	assert.Error(t, err)
-
-// 	// restore signature
-// 	copy(r.Signature, validSignature)
-
-// 	// sanity test
-// 	err = Verify(r)
-// 	require.NoError(t, err)
-
-// 	// change the reservation
-// 	r.User = "attackerID"
-// 	err = Verify(r)
-// 	assert.Error(t, err)
-// }
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestVerifySignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	r := &Reservation{
+		ID:       "reservationID",
+		NodeID:   "node1",
+		User:     "user",
+		Type:     "volume",
+		Created:  time.Now(),
+		Duration: time.Hour,
+		Data:     []byte(`{"size": 20, "type": "SSD"}`),
+	}
+
+	err = Verify(r, public)
+	assert.Error(t, err, "reservation is not signed")
+
+	err = r.Sign(private)
+	require.NoError(t, err)
+	assert.Equal(t, SigningV1, r.SigningVersion)
+
+	err = Verify(r, public)
+	assert.NoError(t, err)
+
+	validSignature := make([]byte, len(r.Signature))
+	copy(validSignature, r.Signature)
+
+	// corrupt the signature
+	_, err = rand.Read(r.Signature)
+	require.NoError(t, err)
+
+	err = Verify(r, public)
+	assert.Error(t, err)
+
+	// restore signature
+	copy(r.Signature, validSignature)
+
+	// sanity test
+	err = Verify(r, public)
+	require.NoError(t, err)
+
+	// the ID and the version are covered by the signature
+	r.ID = "otherID"
+	err = Verify(r, public)
+	assert.Error(t, err)
+	r.ID = "reservationID"
+
+	r.WorkloadVersion = 1
+	err = Verify(r, public)
+	assert.Error(t, err)
+	r.WorkloadVersion = 0
+
+	// change the reservation
+	r.User = "attackerID"
+	err = Verify(r, public)
+	assert.Error(t, err)
+	r.User = "user"
+
+	// another key
+	other, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	err = Verify(r, other)
+	assert.Error(t, err)
+}
+
+func TestVerifySignatureLegacy(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	r := &Reservation{
+		ID:     "reservationID",
+		NodeID: "node1",
+		User:   "user",
+		Type:   "volume",
+		Data:   []byte(`{"size": 20, "type": "SSD"}`),
+	}
+
+	r.SigningVersion = SigningLegacy
+	payload, err := r.signingPayload()
+	require.NoError(t, err)
+	r.Signature = ed25519.Sign(private, payload)
+
+	err = Verify(r, public)
+	assert.NoError(t, err)
+
+	// the ID is not covered by legacy signatures
+	r.ID = "otherID"
+	err = Verify(r, public)
+	assert.NoError(t, err)
+
+	r.Data = []byte(`{"size": 2000, "type": "SSD"}`)
+	err = Verify(r, public)
+	assert.Error(t, err)
+
+	r.SigningVersion = 42
+	err = Verify(r, public)
+	assert.Error(t, err)
+}
+
+func TestVerifySignatureExplorer(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	challenge := []byte("challenge computed by the explorer")
+	r := &Reservation{
+		ID:                 "reservationID",
+		NodeID:             "node1",
+		User:               "user",
+		Type:               "volume",
+		SigningVersion:     SigningExplorer,
+		SignatureChallenge: challenge,
+		Signature:          []byte(hex.EncodeToString(ed25519.Sign(private, challenge))),
+	}
+
+	err = Verify(r, public)
+	assert.NoError(t, err)
+
+	r.SignatureChallenge = []byte("another challenge")
+	err = Verify(r, public)
+	assert.Error(t, err)
+
+	r.SignatureChallenge = nil
+	err = Verify(r, public)
+	assert.Error(t, err)
+
+	r.SignatureChallenge = challenge
+	r.Signature = []byte("not hex")
+	err = Verify(r, public)
+	assert.Error(t, err)
+}
+
+func TestVerifyDeleteSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	r := &Reservation{
+		ID:     "reservationID",
+		NodeID: "node1",
+		User:   "user",
+		Type:   "volume",
+		Data:   []byte(`{"size": 20, "type": "SSD"}`),
+	}
+
+	err = VerifyDelete(r, public)
+	assert.Error(t, err)
+
+	// the signature of the reservation is not a delete request
+	require.NoError(t, r.Sign(private))
+	r.DeleteSignature = r.Signature
+	err = VerifyDelete(r, public)
+	assert.Error(t, err)
+
+	require.NoError(t, r.SignDelete(private))
+	err = VerifyDelete(r, public)
+	assert.NoError(t, err)
+
+	r.ID = "otherID"
+	err = VerifyDelete(r, public)
+	assert.Error(t, err)
+}
@@ -8,11 +8,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v3"
 	"github.com/jbenet/go-base58"
-	"github.com/patrickmn/go-cache"
 	"github.com/robfig/cron/v3"
 	"github.com/shirou/gopsutil/mem"
 	"github.com/threefoldtech/zbus"
@@ -29,6 +29,10 @@ const (
 	minimunZosMemory = 2 * gib
 )
 
+const networkResourceType ReservationType = "network_resource"
+
+const defaultQueueSize = 100
+
 // Engine is the core of this package
 // The engine is responsible to manage provision and decomission of workloads on the system
 type Engine struct {
@@ -38,12 +42,32 @@ type Engine struct {
 	feedback       Feedbacker
 	provisioners   map[ReservationType]ProvisionerFunc
 	decomissioners map[ReservationType]DecomissionerFunc
+	updaters       map[ReservationType]UpdaterFunc
+	rollbacks      map[ReservationType]RollbackFunc
+	checkers       map[ReservationType]StatusCheckerFunc
+	suspenders     map[ReservationType]SuspenderFunc
+	resumers       map[ReservationType]ResumerFunc
+	journal        Journal
+	attempts       AttemptStore
 	signer         Signer
+	keys           UserKeyResolver
+	signing        map[int]bool
 	statser        Statser
+	capacity       CapacityChecker
 	zbusCl         zbus.Client
 	janitor        *Janitor
-
-	memCache            *cache.Cache
+	cleanupSpec    string
+	scheduler      *scheduler
+	statuses       *statusStore
+	events         *eventBroker
+	statusInterval time.Duration
+	retryDeadline  time.Duration
+	gracePeriod    time.Duration
+	expiryWarnings []time.Duration
+	warnings       *warningStore
+
+	// admission serialize the resources check of concurrent provisions
+	admission           sync.Mutex
 	reservedMemoryBytes uint64
 }
 
@@ -65,18 +89,87 @@ type EngineOps struct {
 	// Decomissioners contains the opposite function from Provisioners
 	// they are used to decomission workloads from the system
 	Decomissioners map[ReservationType]DecomissionerFunc
+	// Updaters are used to modify deployed workloads in place when a new
+	// version of their reservation is received
+	Updaters map[ReservationType]UpdaterFunc
+	// Journal records the steps taken while provisioning a reservation
+	// so they can be rolled back if provisiond dies halfway through.
+	// if not set, no journaling is done
+	Journal Journal
+	// Attempts keeps track of the reservations already processed so the same
+	// reservation is never provisioned twice nor after it was decommissioned.
+	// if not set, the attempts are only kept in memory
+	Attempts AttemptStore
+	// Rollbacks are used on start to undo the steps of the reservations
+	// that were not fully provisioned. If a type has no rollback function
+	// its decomissioner is used instead
+	Rollbacks map[ReservationType]RollbackFunc
+	// Checkers are used to periodically inspect the deployed workloads
+	// and report their state to the Feedback
+	Checkers map[ReservationType]StatusCheckerFunc
+	// StatusInterval is how often the deployed workloads are inspected
+	// default to 5 minutes
+	StatusInterval time.Duration
+	// RetryDeadline is how long the provision of a reservation that fails
+	// with a transient error (see IsTransient) is retried before the
+	// reservation is marked as failed. default to 10 minutes.
+	// Between two attempts the reservation is queued again, it doesn't hold
+	// a worker but still blocks the reservations that depend on it
+	RetryDeadline time.Duration
+	// GracePeriod is how long the workloads of the expired reservations are
+	// suspended before they are decommissioned. If the reservation is extended
+	// during the grace period its workload is resumed.
+	// if not set, the reservations are decommissioned as soon as they expire
+	GracePeriod time.Duration
+	// Suspenders are used to suspend the workloads of the expired reservations
+	// during the grace period. The types without suspender keep running until
+	// the grace period is over
+	Suspenders map[ReservationType]SuspenderFunc
+	// Resumers contains the opposite function from Suspenders
+	Resumers map[ReservationType]ResumerFunc
+	// ExpiryWarnings are how long before the expiration of a reservation
+	// a warning is sent to the Feedback. One warning is sent per threshold
+	ExpiryWarnings []time.Duration
 	// Signer is used to authenticate the result send to the source
 	Signer Signer
+	// Keys is used to find the public key of the users to verify
+	// the signature of the reservations
+	Keys UserKeyResolver
+	// SigningVersions are the signing versions accepted by the engine, the
+	// reservations signed with another version are rejected.
+	// default to SigningV1
+	SigningVersions []int
 	// Statser is responsible to keep track of how much workloads and resource units
 	// are reserved on the system running the engine
 	// After each provision/decomission the engine sends statistics update to the staster
 	Statser Statser
+	// Capacity is used on admission to check all the resources needed by
+	// a reservation. if not set, only the memory is checked
+	Capacity CapacityChecker
 	// ZbusCl is a client to Zbus
 	ZbusCl zbus.Client
 
 	// Janitor is used to clean up some of the resources that might be lingering on the node
 	// if not set, no cleaning up will be done
 	Janitor *Janitor
+	// CleanupSchedule is the cron spec of when the janitor runs,
+	// default to @midnight
+	CleanupSchedule string
+
+	// Workers is the number of reservations the engine processes concurrently
+	// default to 1
+	Workers int
+	// QueueSize is the max number of reservations the engine holds before
+	// they are done, queued or being processed. Once reached, no more
+	// reservations are read from the Source until one is done.
+	// default to 100
+	QueueSize int
+	// Order is used to make sure workloads of the same user are provisioned
+	// in the right order (network before container, etc...)
+	Order map[ReservationType]int
+	// LockKeys returns the resources touched by a reservation, reservations
+	// that share a resource are processed one after the other
+	LockKeys LockKeysFunc
 }
 
 // round the given value to the lowest gigabyte
@@ -87,10 +180,15 @@ func roundTotalMemory(t uint64) uint64 {
 // New creates a new engine. Once started, the engine
 // will continue processing all reservations from the reservation source
 // and try to apply them.
-// the default implementation is a single threaded worker. so it process
-// one reservation at a time. On error, the engine will log the error. and
-// continue to next reservation.
+// reservations are processed by a pool of opts.Workers workers. independent
+// reservations are processed concurrently while reservations that depends on
+// each other are processed in the order defined by opts.Order and opts.LockKeys.
+// On error, the engine will log the error. and continue to next reservation.
 func New(opts EngineOps) (*Engine, error) {
+	if opts.Keys == nil {
+		return nil, fmt.Errorf("a user key resolver is required to verify reservations")
+	}
+
 	memStats, err := mem.VirtualMemory()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed retrieve memory stats")
@@ -104,20 +202,67 @@ func New(opts EngineOps) (*Engine, error) {
 	)
 
 	reservedMemory = math.Ceil(reservedMemory/gib) * gib
-	return &Engine{
+	e := &Engine{
 		nodeID:              opts.NodeID,
 		source:              opts.Source,
 		cache:               opts.Cache,
 		feedback:            opts.Feedback,
 		provisioners:        opts.Provisioners,
 		decomissioners:      opts.Decomissioners,
+		updaters:            opts.Updaters,
+		rollbacks:           opts.Rollbacks,
+		checkers:            opts.Checkers,
+		statuses:            newStatusStore(),
+		events:              newEventBroker(),
+		statusInterval:      opts.StatusInterval,
+		retryDeadline:       opts.RetryDeadline,
+		suspenders:          opts.Suspenders,
+		resumers:            opts.Resumers,
+		gracePeriod:         opts.GracePeriod,
+		expiryWarnings:      sortThresholds(opts.ExpiryWarnings),
+		warnings:            newWarningStore(),
+		journal:             opts.Journal,
+		attempts:            opts.Attempts,
 		signer:              opts.Signer,
+		keys:                opts.Keys,
+		signing:             make(map[int]bool),
 		statser:             opts.Statser,
+		capacity:            opts.Capacity,
 		zbusCl:              opts.ZbusCl,
 		janitor:             opts.Janitor,
-		memCache:            cache.New(30*time.Minute, 30*time.Second),
+		cleanupSpec:         opts.CleanupSchedule,
 		reservedMemoryBytes: uint64(reservedMemory),
-	}, nil
+	}
+
+	if e.statusInterval <= 0 {
+		e.statusInterval = defaultStatusInterval
+	}
+
+	if e.attempts == nil {
+		e.attempts = newMemAttempts()
+	}
+
+	if e.retryDeadline <= 0 {
+		e.retryDeadline = defaultRetryDeadline
+	}
+
+	if e.cleanupSpec == "" {
+		e.cleanupSpec = defaultCleanupSchedule
+	}
+
+	if len(opts.SigningVersions) == 0 {
+		opts.SigningVersions = []int{SigningV1}
+	}
+	for _, version := range opts.SigningVersions {
+		e.signing[version] = true
+	}
+
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+
+	e.scheduler = newScheduler(opts.Workers, opts.QueueSize, opts.Order, opts.LockKeys, e.process)
+	return e, nil
 }
 
 // getUsableMemoryBytes returns the usable free memory. this takes
@@ -156,14 +301,20 @@ func (e *Engine) getUsableMemoryBytes() (uint64, uint64, error) {
 
 // Run starts reader reservation from the Source and handle them
 func (e *Engine) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	cReservation := e.source.Reservations(ctx)
 
-	isAllWorkloadsProcessed := false
-	// run a cron task that will fire the cleanup at midnight
+	// run a cron task that will fire the cleanup on schedule
 	cleanUp := make(chan struct{}, 2)
 	c := cron.New()
-	_, err := c.AddFunc("@midnight", func() {
-		cleanUp <- struct{}{}
+	_, err := c.AddFunc(e.cleanupSpec, func() {
+		select {
+		case cleanUp <- struct{}{}:
+		default:
+			// a clean up is pending already
+		}
 	})
 	if err != nil {
 		return fmt.Errorf("failed to setup cron task: %w", err)
@@ -172,6 +323,20 @@ func (e *Engine) Run(ctx context.Context) error {
 	c.Start()
 	defer c.Stop()
 
+	// make sure we don't leave while a reservation is half way provisioned
+	defer e.scheduler.stop()
+
+	// clean up what was left by the reservations being provisioned
+	// last time provisiond stopped, before anything else is deployed
+	e.recover(ctx)
+
+	// closed once all the history has been received
+	history := make(chan struct{})
+
+	go e.reconcile(ctx)
+	go e.warnExpiring(ctx)
+	go e.clean(ctx, history, cleanUp)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -181,76 +346,147 @@ func (e *Engine) Run(ctx context.Context) error {
 		case reservation, ok := <-cReservation:
 			if !ok {
 				log.Info().Msg("reservation source is emptied. stopping engine")
+				e.scheduler.drain(ctx)
 				return nil
 			}
 
 			if reservation.last {
-				isAllWorkloadsProcessed = true
-				// Trigger cleanup by sending a struct onto the channel
-				log.Debug().Msg("kicking clean up after redeploying history")
-				cleanUp <- struct{}{}
+				select {
+				case <-history:
+					// the history was received already
+				default:
+					close(history)
+				}
 				continue
 			}
 
-			expired := reservation.Expired()
-			slog := log.With().
-				Str("id", string(reservation.ID)).
-				Str("type", string(reservation.Type)).
-				Str("duration", fmt.Sprintf("%v", reservation.Duration)).
-				Str("tag", reservation.Tag.String()).
-				Bool("to-delete", reservation.ToDelete).
-				Bool("expired", expired).
-				Logger()
-
-			if expired || reservation.ToDelete {
-				slog.Info().Msg("start decommissioning reservation")
-				if err := e.decommission(ctx, &reservation.Reservation); err != nil {
-					log.Error().Err(err).Msgf("failed to decommission reservation %s", reservation.ID)
-					continue
-				}
-			} else {
-				slog.Info().Msg("start provisioning reservation")
-
-				//TODO:
-				// this is just a hack now to avoid having double provisioning
-				// other logs has been added in other places so we can find why
-				// the node keep receiving the same reservation twice
-				if _, ok := e.memCache.Get(reservation.ID); ok {
-					log.Debug().Str("id", reservation.ID).Msg("skipping reservation since it has just been processes!")
-					continue
-				}
+			e.scheduler.push(ctx, reservation)
+		}
+	}
+}
 
-				e.memCache.Set(reservation.ID, struct{}{}, cache.DefaultExpiration)
+// clean runs the janitor each time a clean up is kicked. The clean ups only
+// start once all the workloads from the cache/explorer have been processed
+func (e *Engine) clean(ctx context.Context, history <-chan struct{}, kick <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-history:
+	}
 
-				if err := e.provision(ctx, &reservation.Reservation); err != nil {
-					log.Error().Err(err).Msgf("failed to provision reservation %s", reservation.ID)
-					continue
-				}
-			}
+	// wait until all the history is actually deployed
+	e.scheduler.wait(ctx)
 
-			if err := e.updateStats(); err != nil {
-				log.Error().Err(err).Msg("failed to updated the capacity counters")
-			}
+	// the clean ups kicked while the history was deployed are
+	// covered by the one after it
+	for len(kick) > 0 {
+		<-kick
+	}
 
-		case <-cleanUp:
-			if !isAllWorkloadsProcessed {
-				// only allow cleanup triggered by the cron to run once
-				// we are sure all the workloads from the cache/explorer have been processed
-				log.Info().Msg("all workloads not yet processed, delay cleanup")
-				continue
-			}
-			log.Info().Msg("start cleaning up resources")
-			if e.janitor == nil {
-				log.Info().Msg("janitor is not configured, skipping clean up")
-				continue
+	log.Debug().Msg("kicking clean up after redeploying history")
+	e.cleanup(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-kick:
+			e.cleanup(ctx)
+		}
+	}
+}
+
+func (e *Engine) cleanup(ctx context.Context) {
+	e.pruneAttempts()
+
+	log.Info().Msg("start cleaning up resources")
+	if e.janitor == nil {
+		log.Info().Msg("janitor is not configured, skipping clean up")
+		return
+	}
+
+	// the janitor must not see resources of a reservation
+	// that is being provisioned and not cached yet
+	e.scheduler.wait(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	report, err := e.janitor.CleanupResources(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to cleanup resources")
+		return
+	}
+	log.Info().Int("resources", len(report.Items)).Bool("dry-run", report.DryRun).Msg("clean up done")
+}
+
+// process is called by the scheduler workers to process a single reservation job.
+// If the job failed with a transient error, it returns how long to wait
+// before the job is processed again
+func (e *Engine) process(ctx context.Context, reservation *ReservationJob) time.Duration {
+	ctx = withRetry(ctx, &reservation.retry)
+	expired := reservation.Expired()
+	slog := log.With().
+		Str("id", string(reservation.ID)).
+		Str("type", string(reservation.Type)).
+		Str("duration", fmt.Sprintf("%v", reservation.Duration)).
+		Str("tag", reservation.Tag.String()).
+		Bool("to-delete", reservation.ToDelete).
+		Bool("expired", expired).
+		Logger()
+
+	// a retried job has already been received
+	if !reservation.retry.retried() {
+		e.event(pkg.EventReceived, reservation.ID, reservation.Type, nil)
+	}
+
+	if reservation.ToDelete {
+		slog.Info().Msg("start decommissioning reservation")
+		if err := e.decommission(ctx, &reservation.Reservation); err != nil {
+			if delay, ok := retryDelay(err); ok {
+				return delay
 			}
+			log.Error().Err(err).Msgf("failed to decommission reservation %s", reservation.ID)
+			return 0
+		}
+	} else if expired {
+		slog.Info().Msg("start expiring reservation")
+		if err := e.expire(ctx, &reservation.Reservation); err != nil {
+			log.Error().Err(err).Msgf("failed to expire reservation %s", reservation.ID)
+			return 0
+		}
+	} else {
+		slog.Info().Msg("start provisioning reservation")
 
-			if err := e.janitor.CleanupResources(ctx); err != nil {
-				log.Error().Err(err).Msg("failed to cleanup resources")
-				continue
+		// reservations that share an ID are never processed concurrently
+		// so this can't race with another provision of the same reservation
+		duplicate, err := e.duplicate(&reservation.Reservation)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to check previous attempts of reservation %s", reservation.ID)
+			return 0
+		}
+		if duplicate {
+			slog.Info().Msg("reservation already failed or has been decommissioned, skipping")
+			return 0
+		}
+
+		// provision swaps the ID with the reference
+		id := reservation.ID
+		if err := e.provision(ctx, &reservation.Reservation); err != nil {
+			if delay, ok := retryDelay(err); ok {
+				return delay
 			}
+			log.Error().Err(err).Msgf("failed to provision reservation %s", id)
+			e.event(pkg.EventFailed, id, reservation.Type, err)
+			return 0
 		}
 	}
+
+	if err := e.updateStats(); err != nil {
+		log.Error().Err(err).Msg("failed to updated the capacity counters")
+	}
+
+	return 0
 }
 
 func (e *Engine) provision(ctx context.Context, r *Reservation) error {
@@ -258,6 +494,10 @@ func (e *Engine) provision(ctx context.Context, r *Reservation) error {
 		return errors.Wrapf(err, "failed validation of reservation")
 	}
 
+	if err := e.authenticate(ctx, r, e.verify); err != nil {
+		return err
+	}
+
 	if r.Reference != "" {
 		if err := e.migrateToPool(ctx, r); err != nil {
 			return err
@@ -265,6 +505,18 @@ func (e *Engine) provision(ctx context.Context, r *Reservation) error {
 	}
 
 	if cached, err := e.cache.Get(r.ID); err == nil {
+		// the reservation is not expired, so if the cached one is
+		// it has been extended
+		if cached.Suspended || r.Expires().After(cached.Expires()) {
+			if err := e.extend(ctx, r, cached); err != nil {
+				return err
+			}
+		}
+
+		if r.WorkloadVersion > cached.WorkloadVersion {
+			return e.update(ctx, r, cached)
+		}
+
 		log.Info().Str("id", r.ID).Msg("reservation have already been processed")
 		if cached.Result.IsNil() {
 			// this is probably an older reservation that is cached BEFORE
@@ -285,11 +537,43 @@ func (e *Engine) provision(ctx context.Context, r *Reservation) error {
 	// to ensure old reservation workload that are already running
 	// keeps running as it is, we use the reference as new workload ID
 	realID := r.ID
+
+	var returned interface{}
+	var provisionError error
+	if e.journal != nil {
+		// the entry is kept open while the reservation waits to be retried
+		// so the steps of all the attempts are rolled back if provisiond dies
+		retry := retryFrom(ctx)
+		if retry == nil || !retry.journaled {
+			if err := e.journal.Begin(r); err != nil {
+				return errors.Wrapf(err, "failed to add reservation %s to the journal", r.ID)
+			}
+		}
+		ctx = withJournal(ctx, e.journal, realID)
+		// past this point the workload is either cached or cleaned up
+		// by the provisioner, there is nothing to roll back anymore
+		defer func() {
+			if _, ok := retryDelay(provisionError); ok && retry != nil {
+				retry.journaled = true
+				return
+			}
+			if err := e.journal.Complete(realID); err != nil {
+				log.Error().Err(err).Str("id", realID).Msg("failed to complete journal entry")
+			}
+		}()
+	}
+
 	if r.Reference != "" {
 		r.ID = r.Reference
 	}
 
-	returned, provisionError := e.provisionForward(ctx, r)
+	e.event(pkg.EventProvisioning, realID, r.Type, nil)
+	returned, provisionError = e.provisionForward(ctx, r)
+	if _, ok := retryDelay(provisionError); ok {
+		// nothing to report yet, the reservation is processed again later
+		r.ID = realID
+		return provisionError
+	}
 
 	result, err := e.buildResult(realID, r.Type, provisionError, returned)
 	if err != nil {
@@ -310,6 +594,7 @@ func (e *Engine) provision(ctx context.Context, r *Reservation) error {
 		if err := e.feedback.Deleted(e.nodeID, realID); err != nil {
 			log.Error().Err(err).Msg("failed to mark failed reservation as deleted")
 		}
+		e.attempt(realID, r, AttemptFailed)
 
 		return provisionError
 	}
@@ -318,24 +603,30 @@ func (e *Engine) provision(ctx context.Context, r *Reservation) error {
 	r.ID = realID
 	r.Result = *result
 	if err := e.cache.Add(r); err != nil {
+		e.release(r)
 		return errors.Wrapf(err, "failed to cache reservation %s locally", r.ID)
 	}
+	e.event(pkg.EventProvisioned, r.ID, r.Type, nil)
+	e.attempt(r.ID, r, AttemptProvisioned)
+
+	// the units of the other types are already counted on admission
+	if r.Type != networkResourceType {
+		return nil
+	}
 
 	// If an update occurs on the network we don't increment the counter
-	if r.Type == "network_resource" {
-		nr := pkg.NetResource{}
-		if err := json.Unmarshal(r.Data, &nr); err != nil {
-			return fmt.Errorf("failed to unmarshal network from reservation: %w", err)
-		}
+	nr := pkg.NetResource{}
+	if err := json.Unmarshal(r.Data, &nr); err != nil {
+		return fmt.Errorf("failed to unmarshal network from reservation: %w", err)
+	}
 
-		uniqueID := NetworkID(r.User, nr.Name)
-		exists, err := e.cache.NetworkExists(string(uniqueID))
-		if err != nil {
-			return errors.Wrap(err, "failed to check if network exists")
-		}
-		if exists {
-			return nil
-		}
+	uniqueID := NetworkID(r.User, nr.Name)
+	exists, err := e.cache.NetworkExists(string(uniqueID))
+	if err != nil {
+		return errors.Wrap(err, "failed to check if network exists")
+	}
+	if exists {
+		return nil
 	}
 
 	if err := e.statser.Increment(r); err != nil {
@@ -351,17 +642,15 @@ func (e *Engine) provisionForward(ctx context.Context, r *Reservation) (interfac
 		return nil, fmt.Errorf("type of reservation not supported: %s", r.Type)
 	}
 
-	_, usable, err := e.getUsableMemoryBytes()
-	if err != nil {
-		return nil, err
-	}
-
-	if err := e.statser.CheckMemoryRequirements(r, usable); err != nil {
+	if err := e.admit(r); err != nil {
 		return nil, errors.Wrapf(err, "failed to apply provision")
 	}
 
-	returned, provisionError := fn(ctx, r)
+	returned, provisionError := e.retry(ctx, r, func() (interface{}, error) {
+		return fn(ctx, r)
+	})
 	if provisionError != nil {
+		e.release(r)
 		log.Error().
 			Err(provisionError).
 			Str("id", r.ID).
@@ -376,8 +665,233 @@ func (e *Engine) provisionForward(ctx context.Context, r *Reservation) (interfac
 	return returned, nil
 }
 
+// update modifies a deployed workload in place to match the new version
+// of its reservation. If the update fails, the workload is kept as it was
+func (e *Engine) update(ctx context.Context, r, current *Reservation) error {
+	log.Info().
+		Str("id", r.ID).
+		Int("from", current.WorkloadVersion).
+		Int("to", r.WorkloadVersion).
+		Msg("updating reservation")
+
+	// same as provision, the workload was created using the reference as ID
+	realID := r.ID
+	deployed := *current
+	if current.Reference != "" {
+		r.ID = current.Reference
+		deployed.ID = current.Reference
+	}
+
+	returned, updateError := e.updateForward(ctx, r, &deployed)
+	r.ID = realID
+	if _, ok := retryDelay(updateError); ok {
+		return updateError
+	}
+
+	result, err := e.buildResult(r.ID, r.Type, updateError, returned)
+	if err != nil {
+		return errors.Wrapf(err, "failed to build result object for reservation: %s", result.ID)
+	}
+	result.WorkloadVersion = r.WorkloadVersion
+
+	if err := e.reply(ctx, result); err != nil {
+		log.Error().Err(err).Msg("failed to send result to BCDB")
+	}
+
+	if updateError != nil {
+		return updateError
+	}
+
+	r.Result = *result
+	if err := e.cache.Update(r); err != nil {
+		return errors.Wrapf(err, "failed to update reservation %s in local cache", r.ID)
+	}
+	e.event(pkg.EventProvisioned, r.ID, r.Type, nil)
+
+	return nil
+}
+
+func (e *Engine) updateForward(ctx context.Context, r, current *Reservation) (interface{}, error) {
+	fn, ok := e.updaters[r.Type]
+	if !ok {
+		return nil, fmt.Errorf("update of reservation type %s is not supported", r.Type)
+	}
+
+	if r.Type != current.Type {
+		return nil, fmt.Errorf("cannot change type of reservation %s from %s to %s", r.ID, current.Type, r.Type)
+	}
+
+	if r.User != current.User {
+		return nil, fmt.Errorf("reservation %s is owned by another user", r.ID)
+	}
+
+	if err := e.admitUpdate(r, current); err != nil {
+		return nil, errors.Wrapf(err, "failed to apply update")
+	}
+	e.event(pkg.EventProvisioning, r.ID, r.Type, nil)
+
+	returned, updateError := e.retry(ctx, r, func() (interface{}, error) {
+		return fn(ctx, r, current)
+	})
+	if updateError != nil {
+		// the deployed version is kept
+		e.release(r)
+		log.Error().
+			Err(updateError).
+			Str("id", r.ID).
+			Msgf("failed to apply update")
+		return nil, updateError
+	}
+
+	e.release(current)
+	log.Info().
+		Str("result", fmt.Sprintf("%v", returned)).
+		Msgf("workload updated")
+
+	return returned, nil
+}
+
+// admitUpdate checks that the node has enough resources to replace the
+// deployed version current of a reservation with r, and counts the units
+// of r. The units of both versions stay counted until the update is done
+// and the caller releases the ones of the version that is not deployed,
+// so a concurrent provision can't take the units of either of them
+func (e *Engine) admitUpdate(r, current *Reservation) error {
+	e.admission.Lock()
+	defer e.admission.Unlock()
+
+	// the units of the deployed version are replaced by the new ones
+	e.release(current)
+	defer e.reserve(current)
+
+	if err := e.check(r); err != nil {
+		return err
+	}
+
+	e.reserve(r)
+	return nil
+}
+
+// admit checks that the node has enough resources to provision the
+// reservation and counts its units right away, so reservations that are
+// provisioned concurrently can't over commit the node.
+func (e *Engine) admit(r *Reservation) error {
+	e.admission.Lock()
+	defer e.admission.Unlock()
+
+	if err := e.check(r); err != nil {
+		return err
+	}
+
+	e.reserve(r)
+	return nil
+}
+
+// check makes sure the node has enough resources to provision the
+// reservation. It must be called with the admission lock held
+func (e *Engine) check(r *Reservation) error {
+	_, usable, err := e.getUsableMemoryBytes()
+	if err != nil {
+		return err
+	}
+
+	if err := e.statser.CheckMemoryRequirements(r, usable); err != nil {
+		return err
+	}
+
+	if err := e.statser.CheckQuota(r); err != nil {
+		return err
+	}
+
+	if e.capacity == nil {
+		return nil
+	}
+
+	return e.capacity.CanProvision(r)
+}
+
+// CanProvision implements pkg.Provision. It runs the same admission checks
+// as a real provision, without deploying nor reserving anything. If the
+// reservation is already deployed, it is checked as an update of the
+// deployed version
+func (e *Engine) CanProvision(info pkg.ReservationInfo) error {
+	r := reservationFromInfo(info)
+
+	if _, ok := e.provisioners[r.Type]; !ok {
+		return fmt.Errorf("type of reservation not supported: %s", r.Type)
+	}
+
+	// the expiration is only checked if the reservation already has a lifetime
+	if r.Duration != 0 {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+
+	e.admission.Lock()
+	defer e.admission.Unlock()
+
+	current, err := e.cache.Get(r.ID)
+	if err != nil {
+		// the workload is deployed using the reference as ID
+		if r.Reference != "" {
+			r.ID = r.Reference
+		}
+		return e.check(r)
+	}
+
+	if current.WorkloadVersion >= r.WorkloadVersion {
+		// nothing to provision
+		return nil
+	}
+
+	if _, ok := e.updaters[r.Type]; !ok {
+		return fmt.Errorf("update of reservation type %s is not supported", r.Type)
+	}
+
+	// same as an update, the units of the deployed version are swapped
+	// with the new one. they are counted back before anyone can see them
+	e.release(current)
+	defer e.reserve(current)
+
+	return e.check(r)
+}
+
+// reserve counts the units of the reservation in the statser
+func (e *Engine) reserve(r *Reservation) {
+	// network resources are only counted once per network
+	// this is done after the reservation is cached
+	if r.Type == networkResourceType {
+		return
+	}
+
+	if err := e.statser.Increment(r); err != nil {
+		log.Err(err).Str("reservation_id", r.ID).Msg("failed to increment workloads statistics")
+	}
+}
+
+// release undo the counting done by reserve
+func (e *Engine) release(r *Reservation) {
+	if r.Type == networkResourceType {
+		return
+	}
+
+	if err := e.statser.Decrement(r); err != nil {
+		log.Err(err).Str("reservation_id", r.ID).Msg("failed to decrement workloads statistics")
+	}
+}
+
 func (e *Engine) decommission(ctx context.Context, r *Reservation) error {
+	if err := e.authenticate(ctx, r, e.verify, e.verifyDelete); err != nil {
+		return err
+	}
 
+	return e.uninstall(ctx, r)
+}
+
+// uninstall decommissions a reservation without verifying its signature
+// it must only be used for decommissions initiated by the node itself
+func (e *Engine) uninstall(ctx context.Context, r *Reservation) error {
 	exists, err := e.cache.Exists(r.ID)
 	if err != nil {
 		return errors.Wrapf(err, "failed to check if reservation %s exists in cache", r.ID)
@@ -388,6 +902,9 @@ func (e *Engine) decommission(ctx context.Context, r *Reservation) error {
 		if err := e.feedback.Deleted(e.nodeID, r.ID); err != nil {
 			log.Error().Err(err).Str("id", r.ID).Msg("failed to mark reservation as deleted")
 		}
+		// a provision of this reservation received after
+		// the decommission must not deploy it
+		e.attempt(r.ID, r, AttemptDecommissioned)
 		return nil
 	}
 
@@ -423,6 +940,10 @@ func (e *Engine) decommission(ctx context.Context, r *Reservation) error {
 	if err := e.cache.Remove(r.ID); err != nil {
 		return errors.Wrapf(err, "failed to remove reservation %s from cache", r.ID)
 	}
+	e.statuses.remove(r.ID)
+	e.warnings.forget(r.ID)
+	e.event(pkg.EventDecommissioned, r.ID, r.Type, nil)
+	e.attempt(r.ID, r, AttemptDecommissioned)
 
 	if err := e.statser.Decrement(r); err != nil {
 		log.Err(err).Str("reservation_id", r.ID).Msg("failed to decrement workloads statistics")
@@ -435,6 +956,175 @@ func (e *Engine) decommission(ctx context.Context, r *Reservation) error {
 	return nil
 }
 
+// recover rolls back the steps taken by the reservations that were being
+// provisioned when provisiond died and provision them again from scratch
+func (e *Engine) recover(ctx context.Context) {
+	if e.journal == nil {
+		return
+	}
+
+	entries, err := e.journal.Incomplete()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read provisioning journal")
+		return
+	}
+
+	for _, entry := range entries {
+		r := entry.Reservation
+
+		// provisiond died after the reservation was cached but before its
+		// entry was completed, the workload is fully deployed
+		if cached, err := e.cache.Exists(r.ID); err != nil {
+			log.Error().Err(err).Str("id", r.ID).Msg("failed to check if reservation exists in cache")
+			continue
+		} else if cached {
+			log.Info().Str("id", r.ID).Msg("reservation was fully provisioned, nothing to roll back")
+			if err := e.journal.Complete(r.ID); err != nil {
+				log.Error().Err(err).Str("id", r.ID).Msg("failed to complete journal entry")
+			}
+			continue
+		}
+
+		log.Info().
+			Str("id", r.ID).
+			Strs("steps", entry.Steps).
+			Msg("rolling back partially provisioned reservation")
+
+		if err := e.rollback(ctx, &r, entry.Steps); err != nil {
+			// keep the entry so we try again on next start
+			log.Error().Err(err).Str("id", r.ID).Msg("failed to roll back reservation")
+			continue
+		}
+
+		if err := e.journal.Complete(r.ID); err != nil {
+			log.Error().Err(err).Str("id", r.ID).Msg("failed to complete journal entry")
+		}
+
+		if r.Expired() || r.ToDelete {
+			continue
+		}
+
+		e.scheduler.push(ctx, &ReservationJob{Reservation: r})
+	}
+}
+
+func (e *Engine) rollback(ctx context.Context, r *Reservation, steps []string) error {
+	if len(steps) == 0 {
+		return nil
+	}
+
+	// same as provision, the workload was created using the reference as ID
+	realID := r.ID
+	if r.Reference != "" {
+		r.ID = r.Reference
+	}
+	defer func() {
+		r.ID = realID
+	}()
+
+	if fn, ok := e.rollbacks[r.Type]; ok {
+		return fn(ctx, r, steps)
+	}
+
+	if fn, ok := e.decomissioners[r.Type]; ok {
+		return fn(ctx, r)
+	}
+
+	return nil
+}
+
+// authenticate runs the signature checks of the reservation. The checks are
+// retried while the public key of the user can't be fetched. The reservation
+// is rejected if one of its signatures is invalid, its user is unknown or the
+// key still can't be fetched once the retry deadline is reached
+func (e *Engine) authenticate(ctx context.Context, r *Reservation, checks ...func(r *Reservation) error) error {
+	_, err := e.retry(ctx, r, func() (interface{}, error) {
+		for _, check := range checks {
+			if err := check(r); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := retryDelay(err); ok {
+		return err
+	}
+
+	return e.reject(ctx, r, err)
+}
+
+// verify checks the signature of the reservation against the public key of its user
+func (e *Engine) verify(r *Reservation) error {
+	if !e.signing[r.SigningVersion] {
+		return fmt.Errorf("reservation %s is signed with signing version %d which is not accepted", r.ID, r.SigningVersion)
+	}
+
+	key, err := e.keys.PublicKey(r.User)
+	if err != nil {
+		// the resolver errors are transient if the key could not be fetched
+		return errors.Wrapf(err, "failed to get public key of user %s", r.User)
+	}
+
+	if err := Verify(r, key); err != nil {
+		return errors.Wrapf(err, "verification of reservation %s signature failed", r.ID)
+	}
+
+	return nil
+}
+
+// verifyDelete checks that the decommission of the reservation has been
+// requested by its user. The delete requests of the explorer reservations
+// are authenticated by the explorer itself
+func (e *Engine) verifyDelete(r *Reservation) error {
+	if r.SigningVersion == SigningExplorer {
+		return nil
+	}
+
+	key, err := e.keys.PublicKey(r.User)
+	if err != nil {
+		// the resolver errors are transient if the key could not be fetched
+		return errors.Wrapf(err, "failed to get public key of user %s", r.User)
+	}
+
+	if err := VerifyDelete(r, key); err != nil {
+		return errors.Wrapf(err, "verification of reservation %s delete signature failed", r.ID)
+	}
+
+	return nil
+}
+
+// reject informs the source that the reservation has been refused
+// because it could not be authenticated. the reservation is not processed
+func (e *Engine) reject(ctx context.Context, r *Reservation, reason error) error {
+	log.Warn().Err(reason).Str("id", r.ID).Msg("rejecting reservation")
+
+	result, err := e.buildResult(r.ID, r.Type, reason, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to build result object for reservation: %s", r.ID)
+	}
+	result.State = StateRejected
+	result.WorkloadVersion = r.WorkloadVersion
+
+	if err := e.reply(ctx, result); err != nil {
+		log.Error().Err(err).Msg("failed to send result to BCDB")
+	}
+
+	// we only mark the reservation as deleted if it was never deployed
+	// a forged delete request must not affect a running workload
+	if exists, err := e.cache.Exists(r.ID); err == nil && !exists {
+		if err := e.feedback.Deleted(e.nodeID, r.ID); err != nil {
+			log.Error().Err(err).Str("id", r.ID).Msg("failed to mark rejected reservation as deleted")
+		}
+	}
+
+	return reason
+}
+
 func (e *Engine) reply(ctx context.Context, result *Result) error {
 	log.Debug().Str("id", result.ID).Msg("sending reply for reservation")
 
@@ -461,7 +1151,7 @@ func (e *Engine) DecommissionCached(id string, reason string) error {
 		return errors.Wrapf(err, "failed to build result object for reservation: %s", id)
 	}
 
-	if err := e.decommission(ctx, r); err != nil {
+	if err := e.uninstall(ctx, r); err != nil {
 		log.Error().Err(err).Msgf("failed to update reservation result with failure: %s", id)
 	}
 
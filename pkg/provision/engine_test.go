@@ -1,5 +1,1098 @@
 package provision
 
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfexplorer/models/generated/directory"
+	"github.com/threefoldtech/zos/pkg"
+	"golang.org/x/crypto/ed25519"
+)
+
+type testSource struct {
+	jobs []*ReservationJob
+}
+
+func (s *testSource) Reservations(ctx context.Context) <-chan *ReservationJob {
+	ch := make(chan *ReservationJob)
+	go func() {
+		defer close(ch)
+		for _, job := range s.jobs {
+			select {
+			case ch <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+type testCache struct {
+	sync.Mutex
+	reservations map[string]*Reservation
+}
+
+func newTestCache() *testCache {
+	return &testCache{reservations: make(map[string]*Reservation)}
+}
+
+func (c *testCache) Add(r *Reservation) error {
+	c.Lock()
+	defer c.Unlock()
+	c.reservations[r.ID] = r
+	return nil
+}
+
+func (c *testCache) Update(r *Reservation) error {
+	return c.Add(r)
+}
+
+func (c *testCache) Get(id string) (*Reservation, error) {
+	c.Lock()
+	defer c.Unlock()
+	r, ok := c.reservations[id]
+	if !ok {
+		return nil, fmt.Errorf("reservation %s not found", id)
+	}
+	return r, nil
+}
+
+func (c *testCache) List() ([]*Reservation, error) {
+	c.Lock()
+	defer c.Unlock()
+	var reservations []*Reservation
+	for _, r := range c.reservations {
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+func (c *testCache) Remove(id string) error {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.reservations, id)
+	return nil
+}
+
+func (c *testCache) Exists(id string) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.reservations[id]
+	return ok, nil
+}
+
+func (c *testCache) NetworkExists(id string) (bool, error) {
+	return false, nil
+}
+
+func (c *testCache) Sync(Statser) error {
+	return nil
+}
+
+type testFeedback struct {
+	sync.Mutex
+	results  []*Result
+	deleted  []string
+	statuses []pkg.WorkloadStatus
+	warnings []pkg.ExpiryWarning
+}
+
+func (f *testFeedback) Feedback(nodeID string, r *Result) error {
+	f.Lock()
+	defer f.Unlock()
+	f.results = append(f.results, r)
+	return nil
+}
+
+func (f *testFeedback) Deleted(nodeID, id string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.deleted = append(f.deleted, id)
+	return nil
+}
+
+func (f *testFeedback) UpdateStats(nodeID string, w directory.WorkloadAmount, u directory.ResourceAmount) error {
+	return nil
+}
+
+func (f *testFeedback) UpdateStatus(nodeID string, status pkg.WorkloadStatus) error {
+	f.Lock()
+	defer f.Unlock()
+	f.statuses = append(f.statuses, status)
+	return nil
+}
+
+func (f *testFeedback) ExpiryWarning(nodeID string, warning pkg.ExpiryWarning) error {
+	f.Lock()
+	defer f.Unlock()
+	f.warnings = append(f.warnings, warning)
+	return nil
+}
+
+type testSigner struct{}
+
+func (testSigner) Sign(b []byte) ([]byte, error) {
+	return []byte("signature"), nil
+}
+
+type testStatser struct{}
+
+func (testStatser) Increment(r *Reservation) error { return nil }
+func (testStatser) Decrement(r *Reservation) error { return nil }
+func (testStatser) CurrentUnits() directory.ResourceAmount {
+	return directory.ResourceAmount{}
+}
+func (testStatser) CurrentWorkloads() directory.WorkloadAmount {
+	return directory.WorkloadAmount{}
+}
+func (testStatser) CheckMemoryRequirements(r *Reservation, totalMemAvailable uint64) error {
+	return nil
+}
+func (testStatser) CheckQuota(r *Reservation) error {
+	return nil
+}
+
+// testKeys resolves the same key for all the users
+type testKeys struct {
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func newTestKeys() *testKeys {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	return &testKeys{public: public, private: private}
+}
+
+func (k *testKeys) PublicKey(userID string) (ed25519.PublicKey, error) {
+	return k.public, nil
+}
+
+var keys = newTestKeys()
+
+func sign(job *ReservationJob) *ReservationJob {
+	if err := job.Reservation.Sign(keys.private); err != nil {
+		panic(err)
+	}
+	if job.ToDelete {
+		if err := job.Reservation.SignDelete(keys.private); err != nil {
+			panic(err)
+		}
+	}
+	return job
+}
+
+func testReservation(id, user string, typ ReservationType) *ReservationJob {
+	return sign(&ReservationJob{
+		Reservation: Reservation{
+			ID:       id,
+			User:     user,
+			Type:     typ,
+			Created:  time.Now(),
+			Duration: time.Hour,
+		},
+	})
+}
+
+func TestEngineConcurrentProvision(t *testing.T) {
+	require := require.New(t)
+
+	tr := tracker{delay: 100 * time.Millisecond}
+	provisioner := func(ctx context.Context, r *Reservation) (interface{}, error) {
+		tr.handle(ctx, &ReservationJob{Reservation: *r})
+		return nil, nil
+	}
+
+	source := &testSource{}
+	for i := 0; i < 4; i++ {
+		source.jobs = append(source.jobs, testReservation(fmt.Sprintf("%d-1", i), fmt.Sprint(i), "container"))
+	}
+	// same user, must wait for the network
+	source.jobs = append(source.jobs,
+		testReservation("10-1", "user", "network"),
+		testReservation("10-2", "user", "container"),
+	)
+
+	cache := newTestCache()
+	feedback := &testFeedback{}
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   source,
+		Cache:    cache,
+		Feedback: feedback,
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"network":   provisioner,
+			"container": provisioner,
+		},
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+		Workers: 4,
+		Order: map[ReservationType]int{
+			"network":   1,
+			"container": 5,
+		},
+	})
+	require.NoError(err)
+
+	require.NoError(engine.Run(context.Background()))
+
+	require.Len(tr.done, 6)
+	require.Len(feedback.results, 6)
+	require.Len(cache.reservations, 6)
+	require.True(tr.max > 1)
+	require.True(tr.before("done:10-1", "started:10-2"))
+}
+
+func TestEngineUpdate(t *testing.T) {
+	require := require.New(t)
+
+	v0 := testReservation("1-1", "user", "volume")
+	v1 := testReservation("1-1", "user", "volume")
+	v1.WorkloadVersion = 1
+	sign(v1)
+	// not supported, deployed workload is kept
+	other := testReservation("2-1", "user", "container")
+	otherV1 := testReservation("2-1", "user", "container")
+	otherV1.WorkloadVersion = 1
+	sign(otherV1)
+
+	var updated []int
+	cache := newTestCache()
+	feedback := &testFeedback{}
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   &testSource{jobs: []*ReservationJob{v0, other, v1, otherV1}},
+		Cache:    cache,
+		Feedback: feedback,
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"volume":    func(ctx context.Context, r *Reservation) (interface{}, error) { return nil, nil },
+			"container": func(ctx context.Context, r *Reservation) (interface{}, error) { return nil, nil },
+		},
+		Updaters: map[ReservationType]UpdaterFunc{
+			"volume": func(ctx context.Context, r, current *Reservation) (interface{}, error) {
+				updated = append(updated, current.WorkloadVersion, r.WorkloadVersion)
+				return nil, nil
+			},
+		},
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+	})
+	require.NoError(err)
+
+	require.NoError(engine.Run(context.Background()))
+
+	require.Equal([]int{0, 1}, updated)
+	require.Equal(1, cache.reservations["1-1"].WorkloadVersion)
+	require.Equal(0, cache.reservations["2-1"].WorkloadVersion)
+	require.Empty(feedback.deleted)
+
+	require.Len(feedback.results, 4)
+	require.Equal(1, feedback.results[2].WorkloadVersion)
+	require.Equal(StateOk, feedback.results[2].State)
+	require.Equal(StateError, feedback.results[3].State)
+}
+
+// unitsStatser counts WorkloadVersion+1 units for each reservation
+type unitsStatser struct {
+	testStatser
+	sync.Mutex
+	used int
+}
+
+func (s *unitsStatser) Increment(r *Reservation) error {
+	s.Lock()
+	defer s.Unlock()
+	s.used += r.WorkloadVersion + 1
+	return nil
+}
+
+func (s *unitsStatser) Decrement(r *Reservation) error {
+	s.Lock()
+	defer s.Unlock()
+	s.used -= r.WorkloadVersion + 1
+	return nil
+}
+
+// CanProvision refuses the reservations that would use more than 3 units
+func (s *unitsStatser) CanProvision(r *Reservation) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.used+r.WorkloadVersion+1 > 3 {
+		return fmt.Errorf("not enough resources")
+	}
+	return nil
+}
+
+func TestEngineUpdateUnits(t *testing.T) {
+	require := require.New(t)
+
+	v0 := testReservation("1-1", "user", "volume")
+	v1 := testReservation("1-1", "user", "volume")
+	v1.WorkloadVersion = 1
+	sign(v1)
+
+	run := func(fail bool) (during, after int) {
+		statser := &unitsStatser{}
+		engine, err := New(EngineOps{
+			NodeID:   "node",
+			Source:   &testSource{jobs: []*ReservationJob{v0, v1}},
+			Cache:    newTestCache(),
+			Feedback: &testFeedback{},
+			Provisioners: map[ReservationType]ProvisionerFunc{
+				"volume": func(ctx context.Context, r *Reservation) (interface{}, error) { return nil, nil },
+			},
+			Updaters: map[ReservationType]UpdaterFunc{
+				"volume": func(ctx context.Context, r, current *Reservation) (interface{}, error) {
+					statser.Lock()
+					during = statser.used
+					statser.Unlock()
+					if fail {
+						return nil, fmt.Errorf("update failed")
+					}
+					return nil, nil
+				},
+			},
+			Signer:   testSigner{},
+			Statser:  statser,
+			Capacity: statser,
+			Keys:     keys,
+		})
+		require.NoError(err)
+		require.NoError(engine.Run(context.Background()))
+		return during, statser.used
+	}
+
+	// the units of both versions are counted during the update
+	during, after := run(false)
+	require.Equal(3, during)
+	require.Equal(2, after)
+
+	// the units of the deployed version are kept if the update fails
+	during, after = run(true)
+	require.Equal(3, during)
+	require.Equal(1, after)
+}
+
+func TestEngineExtendUpdate(t *testing.T) {
+	require := require.New(t)
+
+	v0 := testReservation("1-1", "user", "volume")
+	v0.Data = json.RawMessage(`{"size": 1}`)
+	sign(v0)
+	// extended and modified at once
+	v1 := testReservation("1-1", "user", "volume")
+	v1.Duration = 2 * time.Hour
+	v1.Data = json.RawMessage(`{"size": 2}`)
+	v1.WorkloadVersion = 1
+	sign(v1)
+	// modified without a new version
+	tampered := testReservation("1-1", "user", "volume")
+	tampered.Duration = 3 * time.Hour
+	tampered.Data = json.RawMessage(`{"size": 3}`)
+	sign(tampered)
+
+	run := func(fail bool, jobs ...*ReservationJob) *Reservation {
+		cache := newTestCache()
+		engine, err := New(EngineOps{
+			NodeID:   "node",
+			Source:   &testSource{jobs: jobs},
+			Cache:    cache,
+			Feedback: &testFeedback{},
+			Provisioners: map[ReservationType]ProvisionerFunc{
+				"volume": func(ctx context.Context, r *Reservation) (interface{}, error) { return nil, nil },
+			},
+			Updaters: map[ReservationType]UpdaterFunc{
+				"volume": func(ctx context.Context, r, current *Reservation) (interface{}, error) {
+					if fail {
+						return nil, fmt.Errorf("update failed")
+					}
+					return nil, nil
+				},
+			},
+			Signer:  testSigner{},
+			Statser: testStatser{},
+			Keys:    keys,
+		})
+		require.NoError(err)
+		require.NoError(engine.Run(context.Background()))
+
+		cached, err := cache.Get("1-1")
+		require.NoError(err)
+		return cached
+	}
+
+	// the new expiration is stored with the new workload
+	cached := run(false, v0, v1)
+	require.Equal(v1.Expires(), cached.Expires())
+	require.Equal(v1.Data, cached.Data)
+	require.Equal(v1.Signature, cached.Signature)
+
+	// the cached reservation is kept whole if the update fails
+	for _, cached := range []*Reservation{run(true, v0, v1), run(false, v0, tampered)} {
+		require.Equal(v0.Expires(), cached.Expires())
+		require.Equal(v0.Data, cached.Data)
+		require.Equal(v0.Signature, cached.Signature)
+	}
+}
+
+func TestEngineUpdateReference(t *testing.T) {
+	require := require.New(t)
+
+	// the workload of a reservation that replaced another one
+	// is deployed using the reference as ID
+	v0 := testReservation("2-1", "user", "volume")
+	v0.Reference = "1-1"
+	sign(v0)
+	v1 := testReservation("2-1", "user", "volume")
+	v1.Reference = "1-1"
+	v1.WorkloadVersion = 1
+	sign(v1)
+
+	var provisioned, updated []string
+	cache := newTestCache()
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   &testSource{jobs: []*ReservationJob{v0, v1}},
+		Cache:    cache,
+		Feedback: &testFeedback{},
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"volume": func(ctx context.Context, r *Reservation) (interface{}, error) {
+				provisioned = append(provisioned, r.ID)
+				return nil, nil
+			},
+		},
+		Updaters: map[ReservationType]UpdaterFunc{
+			"volume": func(ctx context.Context, r, current *Reservation) (interface{}, error) {
+				updated = append(updated, current.ID, r.ID)
+				return nil, nil
+			},
+		},
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+	})
+	require.NoError(err)
+
+	require.NoError(engine.Run(context.Background()))
+
+	require.Equal([]string{"1-1"}, provisioned)
+	require.Equal([]string{"1-1", "1-1"}, updated)
+	require.Len(cache.reservations, 1)
+	require.Equal(1, cache.reservations["2-1"].WorkloadVersion)
+}
+
+func TestEngineRejectUnsigned(t *testing.T) {
+	require := require.New(t)
+
+	unsigned := testReservation("1-1", "user", "volume")
+	unsigned.Signature = nil
+	tampered := testReservation("2-1", "user", "volume")
+	tampered.User = "attacker"
+
+	provisioned := 0
+	cache := newTestCache()
+	feedback := &testFeedback{}
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   &testSource{jobs: []*ReservationJob{unsigned, tampered}},
+		Cache:    cache,
+		Feedback: feedback,
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"volume": func(ctx context.Context, r *Reservation) (interface{}, error) {
+				provisioned++
+				return nil, nil
+			},
+		},
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+		Workers: 1,
+	})
+	require.NoError(err)
+
+	require.NoError(engine.Run(context.Background()))
+
+	require.Equal(0, provisioned)
+	require.Empty(cache.reservations)
+	require.Len(feedback.results, 2)
+	for _, result := range feedback.results {
+		require.Equal(StateRejected, result.State)
+	}
+	require.ElementsMatch([]string{"1-1", "2-1"}, feedback.deleted)
+}
+
+func TestEngineRejectUnsignedDelete(t *testing.T) {
+	require := require.New(t)
+
+	deployed := testReservation("1-1", "user", "volume")
+	// a delete request is not authenticated by the signature of the reservation
+	forged := testReservation("1-1", "user", "volume")
+	forged.ToDelete = true
+	forged.DeleteSignature = nil
+	// nor by the delete signature of another reservation
+	other := testReservation("2-1", "user", "volume")
+	other.ToDelete = true
+	sign(other)
+	replayed := testReservation("1-1", "user", "volume")
+	replayed.ToDelete = true
+	replayed.DeleteSignature = other.DeleteSignature
+	deleted := testReservation("1-1", "user", "volume")
+	deleted.ToDelete = true
+	sign(deleted)
+
+	decommissioned := 0
+	cache := newTestCache()
+	feedback := &testFeedback{}
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   &testSource{jobs: []*ReservationJob{deployed, forged, replayed, deleted}},
+		Cache:    cache,
+		Feedback: feedback,
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"volume": func(ctx context.Context, r *Reservation) (interface{}, error) {
+				return nil, nil
+			},
+		},
+		Decomissioners: map[ReservationType]DecomissionerFunc{
+			"volume": func(ctx context.Context, r *Reservation) error {
+				decommissioned++
+				return nil
+			},
+		},
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+		Workers: 1,
+	})
+	require.NoError(err)
+	require.NoError(engine.Run(context.Background()))
+
+	rejected := 0
+	for _, result := range feedback.results {
+		if result.State == StateRejected {
+			rejected++
+		}
+	}
+	require.Equal(2, rejected)
+	require.Equal(1, decommissioned)
+	require.Empty(cache.reservations)
+	require.Equal([]string{"1-1"}, feedback.deleted)
+}
+
+// flakyKeys fails to fetch the key of a user a number of times,
+// a negative number of failures never fetches the key
+type flakyKeys struct {
+	failures map[string]int
+}
+
+func (k *flakyKeys) PublicKey(userID string) (ed25519.PublicKey, error) {
+	if userID == "unknown" {
+		return nil, fmt.Errorf("unknown user %s", userID)
+	}
+	if k.failures[userID] != 0 {
+		k.failures[userID]--
+		return nil, Transient(fmt.Errorf("phonebook is unreachable"))
+	}
+	return keys.public, nil
+}
+
+func TestEngineKeysUnavailable(t *testing.T) {
+	require := require.New(t)
+
+	original := retryInterval
+	retryInterval = time.Millisecond
+	defer func() {
+		retryInterval = original
+	}()
+
+	provisioned := 0
+	cache := newTestCache()
+	feedback := &testFeedback{}
+	engine, err := New(EngineOps{
+		NodeID: "node",
+		Source: &testSource{jobs: []*ReservationJob{
+			testReservation("1-1", "back", "volume"),
+			testReservation("2-1", "down", "volume"),
+			testReservation("3-1", "unknown", "volume"),
+		}},
+		Cache:    cache,
+		Feedback: feedback,
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"volume": func(ctx context.Context, r *Reservation) (interface{}, error) {
+				provisioned++
+				return nil, nil
+			},
+		},
+		RetryDeadline: 100 * time.Millisecond,
+		Signer:        testSigner{},
+		Statser:       testStatser{},
+		Keys:          &flakyKeys{failures: map[string]int{"back": 2, "down": -1}},
+		Workers:       1,
+	})
+	require.NoError(err)
+
+	require.NoError(engine.Run(context.Background()))
+
+	require.Equal(1, provisioned)
+	require.Contains(cache.reservations, "1-1")
+	// the reservations of an unknown user or whose key can't be
+	// fetched before the retry deadline are rejected
+	rejected := map[string]bool{}
+	for _, result := range feedback.results {
+		if result.State == StateRejected {
+			rejected[result.ID] = true
+		}
+	}
+	require.Equal(map[string]bool{"2-1": true, "3-1": true}, rejected)
+	require.ElementsMatch([]string{"2-1", "3-1"}, feedback.deleted)
+}
+
+func TestEngineSigningVersions(t *testing.T) {
+	require := require.New(t)
+
+	legacy := testReservation("1-1", "user", "volume")
+	legacy.SigningVersion = SigningLegacy
+	payload, err := legacy.signingPayload()
+	require.NoError(err)
+	legacy.Signature = ed25519.Sign(keys.private, payload)
+
+	challenge := []byte("challenge")
+	explorer := testReservation("2-1", "user", "volume")
+	explorer.SigningVersion = SigningExplorer
+	explorer.SignatureChallenge = challenge
+	explorer.Signature = []byte(hex.EncodeToString(ed25519.Sign(keys.private, challenge)))
+
+	run := func(versions []int, jobs ...*ReservationJob) []string {
+		var provisioned []string
+		engine, err := New(EngineOps{
+			NodeID:   "node",
+			Source:   &testSource{jobs: jobs},
+			Cache:    newTestCache(),
+			Feedback: &testFeedback{},
+			Provisioners: map[ReservationType]ProvisionerFunc{
+				"volume": func(ctx context.Context, r *Reservation) (interface{}, error) {
+					provisioned = append(provisioned, r.ID)
+					return nil, nil
+				},
+			},
+			Signer:          testSigner{},
+			Statser:         testStatser{},
+			Keys:            keys,
+			SigningVersions: versions,
+			Workers:         1,
+		})
+		require.NoError(err)
+		require.NoError(engine.Run(context.Background()))
+		return provisioned
+	}
+
+	// only the latest signing version is accepted by default
+	require.Empty(run(nil, legacy, explorer))
+	require.Equal([]string{"3-1"}, run(nil, testReservation("3-1", "user", "volume")))
+
+	require.Equal([]string{"1-1"}, run([]int{SigningV1, SigningLegacy}, legacy, explorer))
+	require.Equal([]string{"2-1"}, run([]int{SigningExplorer}, legacy, explorer))
+}
+
+type testJournal struct {
+	sync.Mutex
+	entries map[string]*JournalEntry
+}
+
+func newTestJournal() *testJournal {
+	return &testJournal{entries: make(map[string]*JournalEntry)}
+}
+
+func (j *testJournal) Begin(r *Reservation) error {
+	j.Lock()
+	defer j.Unlock()
+	j.entries[r.ID] = &JournalEntry{Reservation: *r, Started: time.Now()}
+	return nil
+}
+
+func (j *testJournal) Step(id string, step string) error {
+	j.Lock()
+	defer j.Unlock()
+	entry, ok := j.entries[id]
+	if !ok {
+		return fmt.Errorf("no journal entry for %s", id)
+	}
+	entry.Steps = append(entry.Steps, step)
+	return nil
+}
+
+func (j *testJournal) Complete(id string) error {
+	j.Lock()
+	defer j.Unlock()
+	delete(j.entries, id)
+	return nil
+}
+
+func (j *testJournal) Incomplete() ([]*JournalEntry, error) {
+	j.Lock()
+	defer j.Unlock()
+	var entries []*JournalEntry
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func TestEngineJournal(t *testing.T) {
+	require := require.New(t)
+
+	journal := newTestJournal()
+	var steps []string
+	provisioner := func(ctx context.Context, r *Reservation) (interface{}, error) {
+		for _, step := range []string{"network", "flist", "container"} {
+			if err := Step(ctx, step); err != nil {
+				return nil, err
+			}
+			journal.Lock()
+			steps = append(steps, journal.entries[r.ID].Steps...)
+			journal.Unlock()
+		}
+		return nil, nil
+	}
+
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   &testSource{jobs: []*ReservationJob{testReservation("1-1", "user", "container")}},
+		Cache:    newTestCache(),
+		Feedback: &testFeedback{},
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"container": provisioner,
+		},
+		Journal: journal,
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+	})
+	require.NoError(err)
+
+	require.NoError(engine.Run(context.Background()))
+
+	// each step is recorded before it's taken
+	require.Equal([]string{"network", "network", "flist", "network", "flist", "container"}, steps)
+	require.Empty(journal.entries)
+}
+
+func TestEngineRecover(t *testing.T) {
+	require := require.New(t)
+
+	// provisiond died while provisioning these reservations
+	journal := newTestJournal()
+	crashed := testReservation("1-1", "user", "container")
+	expired := testReservation("2-1", "user", "container")
+	expired.Created = time.Now().Add(-2 * time.Hour)
+	sign(expired)
+	failing := testReservation("3-1", "user", "container")
+	volume := testReservation("4-1", "user", "volume")
+	// died after caching the reservation, before completing its entry
+	deployed := testReservation("5-1", "user", "container")
+
+	for id, job := range map[string]*ReservationJob{"1-1": crashed, "2-1": expired, "3-1": failing, "4-1": volume, "5-1": deployed} {
+		require.NoError(journal.Begin(&job.Reservation))
+		require.NoError(journal.Step(id, "network"))
+		require.NoError(journal.Step(id, "flist"))
+	}
+
+	var (
+		m              sync.Mutex
+		rolledBack     = make(map[string][]string)
+		decommissioned []string
+		provisioned    []string
+	)
+
+	cache := newTestCache()
+	require.NoError(cache.Add(&deployed.Reservation))
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   &testSource{},
+		Cache:    cache,
+		Feedback: &testFeedback{},
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"container": func(ctx context.Context, r *Reservation) (interface{}, error) {
+				m.Lock()
+				defer m.Unlock()
+				provisioned = append(provisioned, r.ID)
+				return nil, nil
+			},
+			"volume": func(ctx context.Context, r *Reservation) (interface{}, error) {
+				return nil, nil
+			},
+		},
+		Decomissioners: map[ReservationType]DecomissionerFunc{
+			"volume": func(ctx context.Context, r *Reservation) error {
+				m.Lock()
+				defer m.Unlock()
+				decommissioned = append(decommissioned, r.ID)
+				return nil
+			},
+		},
+		Rollbacks: map[ReservationType]RollbackFunc{
+			"container": func(ctx context.Context, r *Reservation, steps []string) error {
+				m.Lock()
+				defer m.Unlock()
+				if r.ID == "3-1" {
+					return fmt.Errorf("network is gone")
+				}
+				rolledBack[r.ID] = steps
+				return nil
+			},
+		},
+		Journal: journal,
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+	})
+	require.NoError(err)
+
+	require.NoError(engine.Run(context.Background()))
+
+	require.Equal(map[string][]string{
+		"1-1": {"network", "flist"},
+		"2-1": {"network", "flist"},
+	}, rolledBack)
+	// types without rollback are decommissioned
+	require.Equal([]string{"4-1"}, decommissioned)
+
+	// the crashed reservations are provisioned again, except the expired one
+	require.ElementsMatch([]string{"1-1"}, provisioned)
+	require.Contains(cache.reservations, "1-1")
+	require.Contains(cache.reservations, "4-1")
+	// the fully provisioned reservation is left untouched
+	require.NotContains(rolledBack, "5-1")
+	require.Contains(cache.reservations, "5-1")
+
+	// the failed rollback is tried again on next start
+	require.Len(journal.entries, 1)
+	require.Contains(journal.entries, "3-1")
+}
+
+func TestEngineStatus(t *testing.T) {
+	require := require.New(t)
+
+	state := pkg.WorkloadRunning
+	var (
+		reason      error
+		unreachable bool
+	)
+	checker := func(ctx context.Context, r *Reservation) (pkg.WorkloadState, error) {
+		if unreachable {
+			// the zbus stubs panic when the module can't be reached
+			panic(io.EOF)
+		}
+		return state, reason
+	}
+
+	cache := newTestCache()
+	feedback := &testFeedback{}
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   &testSource{jobs: []*ReservationJob{testReservation("1-1", "user", "container"), testReservation("2-1", "user", "volume")}},
+		Cache:    cache,
+		Feedback: feedback,
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"container": func(ctx context.Context, r *Reservation) (interface{}, error) { return nil, nil },
+			"volume":    func(ctx context.Context, r *Reservation) (interface{}, error) { return nil, nil },
+		},
+		Checkers: map[ReservationType]StatusCheckerFunc{
+			"container": checker,
+		},
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+	})
+	require.NoError(err)
+	require.NoError(engine.Run(context.Background()))
+
+	ctx := context.Background()
+	require.NoError(engine.checkStatuses(ctx))
+	require.Len(feedback.statuses, 1)
+	require.Equal("1-1", feedback.statuses[0].ID)
+	require.Equal(pkg.WorkloadRunning, feedback.statuses[0].State)
+
+	// nothing changed, nothing is reported
+	require.NoError(engine.checkStatuses(ctx))
+	require.Len(feedback.statuses, 1)
+
+	state, reason = pkg.WorkloadStopped, fmt.Errorf("container is not running")
+	require.NoError(engine.checkStatuses(ctx))
+	require.Len(feedback.statuses, 2)
+	require.Equal(pkg.WorkloadStopped, feedback.statuses[1].State)
+	require.Equal("container is not running", feedback.statuses[1].LastError)
+
+	statuses := engine.statuses.list()
+	require.Len(statuses, 1)
+	require.Equal(pkg.WorkloadStopped, statuses[0].State)
+
+	// the workload is checked again next time if its module can't be reached
+	unreachable = true
+	require.NoError(engine.checkStatuses(ctx))
+	require.Len(feedback.statuses, 2)
+	require.Len(engine.statuses.list(), 1)
+	unreachable = false
+
+	// decommissioned workloads have no status anymore
+	require.NoError(cache.Remove("1-1"))
+	require.NoError(engine.checkStatuses(ctx))
+	require.Empty(engine.statuses.list())
+}
+
+func TestEngineGracePeriod(t *testing.T) {
+	require := require.New(t)
+
+	var suspended, resumed, decommissioned []string
+	cache := newTestCache()
+	feedback := &testFeedback{}
+	run := func(jobs ...*ReservationJob) {
+		engine, err := New(EngineOps{
+			NodeID:   "node",
+			Source:   &testSource{jobs: jobs},
+			Cache:    cache,
+			Feedback: feedback,
+			Decomissioners: map[ReservationType]DecomissionerFunc{
+				"container": func(ctx context.Context, r *Reservation) error {
+					decommissioned = append(decommissioned, r.ID)
+					return nil
+				},
+			},
+			Suspenders: map[ReservationType]SuspenderFunc{
+				"container": func(ctx context.Context, r *Reservation) error {
+					suspended = append(suspended, r.ID)
+					return nil
+				},
+			},
+			Resumers: map[ReservationType]ResumerFunc{
+				"container": func(ctx context.Context, r *Reservation) error {
+					resumed = append(resumed, r.ID)
+					return nil
+				},
+			},
+			GracePeriod: time.Hour,
+			Signer:      testSigner{},
+			Statser:     testStatser{},
+			Keys:        keys,
+		})
+		require.NoError(err)
+		require.NoError(engine.Run(context.Background()))
+	}
+
+	expired := func(id string, ago time.Duration) *ReservationJob {
+		job := testReservation(id, "user", "container")
+		job.Created = time.Now().Add(-ago).Add(-job.Duration)
+		return sign(job)
+	}
+
+	// in grace period
+	inGrace := expired("1-1", 10*time.Minute)
+	// grace period is over
+	over := expired("2-1", 2*time.Hour)
+	for _, job := range []*ReservationJob{inGrace, over} {
+		r := job.Reservation
+		// copies cached before the signing version existed
+		r.SigningVersion = SigningLegacy
+		require.NoError(cache.Add(&r))
+	}
+	// the expiration doesn't need a delete request from the user
+	over.SigningVersion = SigningLegacy
+	over.Signature = nil
+
+	run(inGrace, over, inGrace)
+	require.Equal([]string{"1-1"}, suspended, "suspended only once")
+	require.Equal([]string{"2-1"}, decommissioned)
+	require.Equal([]string{"2-1"}, feedback.deleted)
+	require.Len(feedback.warnings, 1)
+	require.Equal("1-1", feedback.warnings[0].ID)
+	require.True(feedback.warnings[0].Suspended)
+	require.Equal(inGrace.Expires().Add(time.Hour), feedback.warnings[0].GraceEnds)
+
+	cached, err := cache.Get("1-1")
+	require.NoError(err)
+	require.True(cached.Suspended)
+
+	// extending the reservation resumes the workload
+	extended := testReservation("1-1", "user", "container")
+	run(extended)
+	require.Equal([]string{"1-1"}, resumed)
+	require.Equal([]string{"2-1"}, decommissioned)
+
+	cached, err = cache.Get("1-1")
+	require.NoError(err)
+	require.False(cached.Suspended)
+	require.Equal(extended.Expires(), cached.Expires())
+
+	// the old expired copy of the reservation doesn't affect the extended one
+	run(inGrace)
+	require.Equal([]string{"1-1"}, suspended)
+	require.Equal([]string{"2-1"}, decommissioned)
+}
+
+func TestEngineExpiryWarnings(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	cache := newTestCache()
+	for _, r := range []*Reservation{
+		{ID: "1-1", Type: "container", Created: now, Duration: 30 * time.Minute},
+		{ID: "2-1", Type: "container", Created: now, Duration: 10 * time.Hour},
+		{ID: "3-1", Type: "container", Created: now, Duration: 48 * time.Hour},
+	} {
+		require.NoError(cache.Add(r))
+	}
+
+	feedback := &testFeedback{}
+	engine, err := New(EngineOps{
+		Cache:          cache,
+		Feedback:       feedback,
+		ExpiryWarnings: []time.Duration{time.Hour, 24 * time.Hour},
+		Keys:           keys,
+	})
+	require.NoError(err)
+
+	ids := func() []string {
+		var ids []string
+		for _, warning := range feedback.warnings {
+			ids = append(ids, warning.ID)
+		}
+		return ids
+	}
+
+	require.NoError(engine.sendWarnings())
+	require.ElementsMatch([]string{"1-1", "2-1"}, ids())
+
+	// a warning is sent once per threshold
+	require.NoError(engine.sendWarnings())
+	require.Len(feedback.warnings, 2)
+
+	cache.reservations["2-1"].Duration = 30 * time.Minute
+	require.NoError(engine.sendWarnings())
+	require.Equal([]string{"2-1"}, ids()[2:])
+
+	// extended reservations are warned again when they cross a threshold
+	cache.reservations["1-1"].Duration = 48 * time.Hour
+	require.NoError(engine.sendWarnings())
+	require.Len(feedback.warnings, 3)
+
+	cache.reservations["1-1"].Duration = 10 * time.Hour
+	require.NoError(engine.sendWarnings())
+	require.Equal([]string{"1-1"}, ids()[3:])
+}
+
 // func TestEngine(t *testing.T) {
 // 	td, err := ioutil.TempDir("", "")
 // 	require.NoError(t, err)
@@ -68,3 +1161,297 @@ package provision
 // 	assert.EqualValues(t, 1, workloads.ZDBNamespace)
 // 	assert.EqualValues(t, 0, workloads.K8sVM)
 // }
+
+// testCapacity refuses the reservations of the full user
+type testCapacity struct {
+	checked []string
+}
+
+func (c *testCapacity) CanProvision(r *Reservation) error {
+	c.checked = append(c.checked, r.ID)
+	if r.User == "full" {
+		return fmt.Errorf("not enough resources")
+	}
+	return nil
+}
+
+func TestEngineCapacity(t *testing.T) {
+	require := require.New(t)
+
+	var provisioned []string
+	provisioner := func(ctx context.Context, r *Reservation) (interface{}, error) {
+		provisioned = append(provisioned, r.ID)
+		return nil, nil
+	}
+
+	capacity := &testCapacity{}
+	cache := newTestCache()
+	feedback := &testFeedback{}
+	engine, err := New(EngineOps{
+		NodeID: "node",
+		Source: &testSource{jobs: []*ReservationJob{
+			testReservation("1-1", "user", "container"),
+			testReservation("2-1", "full", "container"),
+		}},
+		Cache:    cache,
+		Feedback: feedback,
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"container": provisioner,
+		},
+		Signer:   testSigner{},
+		Statser:  testStatser{},
+		Capacity: capacity,
+		Keys:     keys,
+	})
+	require.NoError(err)
+
+	require.NoError(engine.Run(context.Background()))
+
+	require.Equal([]string{"1-1"}, provisioned)
+	require.Equal([]string{"1-1", "2-1"}, capacity.checked)
+	require.Len(feedback.results, 2)
+	require.Equal(StateError, feedback.results[1].State)
+	require.Equal([]string{"2-1"}, feedback.deleted)
+
+	// dry run, nothing is provisioned
+	capacity.checked = nil
+	info := testReservation("3-1", "full", "container").info()
+	require.Error(engine.CanProvision(info))
+	info.User = "user"
+	require.NoError(engine.CanProvision(info))
+	require.Equal([]string{"3-1", "3-1"}, capacity.checked)
+
+	info.Type = "unknown"
+	require.Error(engine.CanProvision(info))
+
+	// already deployed, nothing to check
+	capacity.checked = nil
+	require.NoError(engine.CanProvision(cache.reservations["1-1"].info()))
+	require.Empty(capacity.checked)
+
+	require.Equal([]string{"1-1"}, provisioned)
+	require.Len(cache.reservations, 1)
+}
+
+func TestEngineEvents(t *testing.T) {
+	require := require.New(t)
+
+	deployed := testReservation("1-1", "user", "container")
+	failing := testReservation("2-1", "user", "container")
+	deleted := testReservation("1-1", "user", "container")
+	deleted.ToDelete = true
+	sign(deleted)
+
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   &testSource{jobs: []*ReservationJob{deployed, failing, deleted}},
+		Cache:    newTestCache(),
+		Feedback: &testFeedback{},
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"container": func(ctx context.Context, r *Reservation) (interface{}, error) {
+				if r.ID == "2-1" {
+					return nil, fmt.Errorf("no flist")
+				}
+				return nil, nil
+			},
+		},
+		Decomissioners: map[ReservationType]DecomissionerFunc{
+			"container": func(ctx context.Context, r *Reservation) error { return nil },
+		},
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+	})
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := engine.Events(ctx)
+
+	require.NoError(engine.Run(context.Background()))
+	cancel()
+
+	var received []string
+	for event := range events {
+		require.Equal("container", event.Type)
+		received = append(received, fmt.Sprintf("%s:%s", event.ID, event.Event))
+		if event.Event == pkg.EventFailed {
+			require.Contains(event.Error, "no flist")
+		}
+	}
+
+	require.Equal([]string{
+		"1-1:received",
+		"1-1:provisioning",
+		"1-1:provisioned",
+		"2-1:received",
+		"2-1:provisioning",
+		"2-1:failed",
+		"1-1:received",
+		"1-1:decommissioned",
+	}, received)
+}
+
+func TestEngineEventsRetry(t *testing.T) {
+	require := require.New(t)
+
+	original := retryInterval
+	retryInterval = time.Millisecond
+	defer func() {
+		retryInterval = original
+	}()
+
+	attempts := 0
+	engine, err := New(EngineOps{
+		NodeID:   "node",
+		Source:   &testSource{jobs: []*ReservationJob{testReservation("1-1", "user", "container")}},
+		Cache:    newTestCache(),
+		Feedback: &testFeedback{},
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"container": func(ctx context.Context, r *Reservation) (interface{}, error) {
+				attempts++
+				if attempts < 3 {
+					return nil, Transient(fmt.Errorf("hub is unreachable"))
+				}
+				return nil, nil
+			},
+		},
+		Signer:  testSigner{},
+		Statser: testStatser{},
+		Keys:    keys,
+	})
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := engine.Events(ctx)
+
+	require.NoError(engine.Run(context.Background()))
+	cancel()
+
+	var received int
+	for event := range events {
+		if event.Event == pkg.EventReceived {
+			received++
+		}
+	}
+
+	require.Equal(3, attempts)
+	require.Equal(1, received, "a retried reservation is received once")
+}
+
+func TestEngineRetry(t *testing.T) {
+	require := require.New(t)
+
+	original := retryInterval
+	retryInterval = time.Millisecond
+	defer func() {
+		retryInterval = original
+	}()
+
+	attempts := make(map[string]int)
+	provisioner := func(ctx context.Context, r *Reservation) (interface{}, error) {
+		attempts[r.ID]++
+		switch r.ID {
+		case "1-1":
+			// hub is back after a couple of attempts
+			if attempts[r.ID] < 3 {
+				return nil, Transient(fmt.Errorf("hub is unreachable"))
+			}
+			return nil, nil
+		case "2-1":
+			return nil, fmt.Errorf("flist not found")
+		default:
+			return nil, Transient(fmt.Errorf("hub is unreachable"))
+		}
+	}
+
+	cache := newTestCache()
+	feedback := &testFeedback{}
+	engine, err := New(EngineOps{
+		NodeID: "node",
+		Source: &testSource{jobs: []*ReservationJob{
+			testReservation("1-1", "user", "container"),
+			testReservation("2-1", "user", "container"),
+			testReservation("3-1", "user", "container"),
+		}},
+		Cache:    cache,
+		Feedback: feedback,
+		Provisioners: map[ReservationType]ProvisionerFunc{
+			"container": provisioner,
+		},
+		RetryDeadline: 100 * time.Millisecond,
+		Signer:        testSigner{},
+		Statser:       testStatser{},
+		Keys:          keys,
+	})
+	require.NoError(err)
+
+	require.NoError(engine.Run(context.Background()))
+
+	require.Equal(3, attempts["1-1"])
+	require.Equal(1, attempts["2-1"], "permanent errors are not retried")
+	require.True(attempts["3-1"] > 1)
+
+	require.Len(cache.reservations, 1)
+	require.Contains(cache.reservations, "1-1")
+	require.ElementsMatch([]string{"2-1", "3-1"}, feedback.deleted)
+}
+
+func TestEngineIdempotency(t *testing.T) {
+	require := require.New(t)
+
+	var provisioned []string
+	cache := newTestCache()
+	attempts := newMemAttempts()
+	feedback := &testFeedback{}
+	run := func(jobs ...*ReservationJob) {
+		engine, err := New(EngineOps{
+			NodeID:   "node",
+			Source:   &testSource{jobs: jobs},
+			Cache:    cache,
+			Attempts: attempts,
+			Feedback: feedback,
+			Provisioners: map[ReservationType]ProvisionerFunc{
+				"container": func(ctx context.Context, r *Reservation) (interface{}, error) {
+					provisioned = append(provisioned, r.ID)
+					if r.ID == "2-1" {
+						return nil, fmt.Errorf("flist not found")
+					}
+					return nil, nil
+				},
+			},
+			Decomissioners: map[ReservationType]DecomissionerFunc{
+				"container": func(ctx context.Context, r *Reservation) error { return nil },
+			},
+			Signer:  testSigner{},
+			Statser: testStatser{},
+			Keys:    keys,
+		})
+		require.NoError(err)
+		require.NoError(engine.Run(context.Background()))
+	}
+
+	deployed := testReservation("1-1", "user", "container")
+	failing := testReservation("2-1", "user", "container")
+	deleted := testReservation("1-1", "user", "container")
+	deleted.ToDelete = true
+	sign(deleted)
+	// delete received before the provision, from another source
+	early := testReservation("3-1", "user", "container")
+	early.ToDelete = true
+	sign(early)
+
+	run(deployed, failing, failing, deleted, early)
+	require.Equal([]string{"1-1", "2-1"}, provisioned)
+
+	// after a restart, with the attempts kept in the store
+	run(deployed, failing, testReservation("3-1", "user", "container"))
+	require.Equal([]string{"1-1", "2-1"}, provisioned)
+	require.Empty(cache.reservations)
+
+	// a new version of the failed reservation is provisioned again
+	fixed := testReservation("2-1", "user", "container")
+	fixed.WorkloadVersion = 1
+	sign(fixed)
+	run(fixed)
+	require.Equal([]string{"1-1", "2-1", "2-1"}, provisioned)
+}
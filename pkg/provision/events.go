@@ -0,0 +1,81 @@
+package provision
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+// eventBufferSize is how many events are kept for a subscriber that is
+// not reading fast enough. Once full, new events are dropped for it
+const eventBufferSize = 128
+
+// eventBroker fans out the provisioning events to all the subscribers
+type eventBroker struct {
+	sync.Mutex
+	subscribers map[chan pkg.ProvisionEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[chan pkg.ProvisionEvent]struct{})}
+}
+
+func (b *eventBroker) subscribe() chan pkg.ProvisionEvent {
+	b.Lock()
+	defer b.Unlock()
+
+	ch := make(chan pkg.ProvisionEvent, eventBufferSize)
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan pkg.ProvisionEvent) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.subscribers, ch)
+	close(ch)
+}
+
+// publish never blocks, the provisioning must not wait for the subscribers
+func (b *eventBroker) publish(event pkg.ProvisionEvent) {
+	b.Lock()
+	defer b.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Warn().Str("id", event.ID).Str("event", string(event.Event)).Msg("event subscriber is too slow, dropping event")
+		}
+	}
+}
+
+// event publishes a provisioning event for the reservation id
+func (e *Engine) event(event pkg.ProvisionEventType, id string, typ ReservationType, err error) {
+	ev := pkg.ProvisionEvent{
+		Event: event,
+		ID:    id,
+		Type:  string(typ),
+		Time:  time.Now(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	e.events.publish(ev)
+}
+
+// Events implements pkg.Provision. The stream ends when ctx is canceled
+func (e *Engine) Events(ctx context.Context) <-chan pkg.ProvisionEvent {
+	ch := e.events.subscribe()
+	go func() {
+		<-ctx.Done()
+		e.events.unsubscribe(ch)
+	}()
+
+	return ch
+}
@@ -6,8 +6,10 @@ import (
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/rs/zerolog/log"
 	"github.com/threefoldtech/tfexplorer/client"
 	"github.com/threefoldtech/tfexplorer/models/generated/directory"
+	"github.com/threefoldtech/zos/pkg"
 	"github.com/threefoldtech/zos/pkg/provision"
 )
 
@@ -79,3 +81,27 @@ func (e *Feedback) UpdateStats(nodeID string, w directory.WorkloadAmount, u dire
 		return backoff.Permanent(err)
 	}, e.strategy)
 }
+
+// UpdateStatus implements provision.Feedbacker
+// the explorer has no endpoint to receive the state of a deployed
+// workload yet, so the status is only logged
+func (e *Feedback) UpdateStatus(nodeID string, status pkg.WorkloadStatus) error {
+	log.Debug().
+		Str("id", status.ID).
+		Str("state", string(status.State)).
+		Msg("workload status not sent, not supported by the explorer")
+	return nil
+}
+
+// ExpiryWarning implements provision.Feedbacker
+// the explorer has no endpoint to notify the users yet,
+// so the warning is only logged
+func (e *Feedback) ExpiryWarning(nodeID string, warning pkg.ExpiryWarning) error {
+	log.Info().
+		Str("id", warning.ID).
+		Time("expires", warning.Expires).
+		Time("grace-ends", warning.GraceEnds).
+		Bool("suspended", warning.Suspended).
+		Msg("reservation is expiring")
+	return nil
+}
@@ -0,0 +1,53 @@
+package explorer
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfexplorer/client"
+	"github.com/threefoldtech/tfexplorer/schema"
+	"github.com/threefoldtech/zos/pkg/crypto"
+	"golang.org/x/crypto/ed25519"
+)
+
+// KeyResolver is an implementation of the provision.UserKeyResolver
+// that gets the users public key from the TFExplorer phonebook
+type KeyResolver struct {
+	client *client.Client
+	keys   *cache.Cache
+}
+
+// NewKeyResolver creates a KeyResolver
+func NewKeyResolver(cl *client.Client) *KeyResolver {
+	return &KeyResolver{
+		client: cl,
+		keys:   cache.New(30*time.Minute, time.Minute),
+	}
+}
+
+// PublicKey implements provision.UserKeyResolver
+func (k *KeyResolver) PublicKey(userID string) (ed25519.PublicKey, error) {
+	if key, ok := k.keys.Get(userID); ok {
+		return key.(ed25519.PublicKey), nil
+	}
+
+	tid, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid user id '%s'", userID)
+	}
+
+	user, err := k.client.Phonebook.Get(schema.ID(tid))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get user %s from the phonebook", userID)
+	}
+
+	key, err := crypto.KeyFromHex(user.Pubkey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid public key for user %s", userID)
+	}
+
+	k.keys.Set(userID, key, cache.DefaultExpiration)
+	return key, nil
+}
@@ -0,0 +1,312 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+// warningInterval is how often the cached reservations are checked
+// to send the expiry warnings
+const warningInterval = time.Minute
+
+// inGrace returns true if the reservation expired but
+// its grace period is not over yet
+func (e *Engine) inGrace(r *Reservation) bool {
+	if e.gracePeriod <= 0 {
+		return false
+	}
+
+	return time.Now().Before(r.Expires().Add(e.gracePeriod))
+}
+
+// expire is called for the reservations that are past their expiration.
+// During the grace period the workload is only suspended, after that
+// the reservation is decommissioned.
+// The expiration is decided by the node, so the workload is uninstalled
+// without asking the user for a delete request
+func (e *Engine) expire(ctx context.Context, r *Reservation) error {
+	cached, err := e.cache.Get(r.ID)
+	if err != nil {
+		// not deployed, uninstall takes care of informing the source
+		return e.uninstall(ctx, r)
+	}
+
+	if !cached.Expired() {
+		log.Debug().Str("id", r.ID).Msg("reservation has been extended, skipping expiration")
+		return nil
+	}
+
+	if e.inGrace(cached) {
+		return e.suspend(ctx, cached)
+	}
+
+	if !cached.Suspended {
+		// the expiration is only announced once, when the workload is suspended
+		e.event(pkg.EventExpired, cached.ID, cached.Type, nil)
+	}
+
+	return e.uninstall(ctx, cached)
+}
+
+// suspend suspends the workload of an expired reservation instead of
+// decommissioning it, so it can be resumed if the reservation is extended
+func (e *Engine) suspend(ctx context.Context, cached *Reservation) error {
+	if cached.Suspended {
+		return nil
+	}
+
+	fn, ok := e.suspenders[cached.Type]
+	if !ok {
+		// workloads that can't be suspended keep running until the grace period is over
+		return nil
+	}
+
+	log.Info().Str("id", cached.ID).Msg("reservation expired, suspending workload")
+
+	// same as provision, the workload was created using the reference as ID
+	workload := *cached
+	if cached.Reference != "" {
+		workload.ID = cached.Reference
+	}
+
+	// the suspenders call the modules over zbus, which panics if they can't be reached
+	if _, err := safeCall(func() (interface{}, error) {
+		return nil, fn(ctx, &workload)
+	}); err != nil {
+		return errors.Wrapf(err, "failed to suspend workload of reservation %s", cached.ID)
+	}
+
+	cached.Suspended = true
+	if err := e.cache.Update(cached); err != nil {
+		return errors.Wrapf(err, "failed to mark reservation %s as suspended", cached.ID)
+	}
+	e.event(pkg.EventExpired, cached.ID, cached.Type, nil)
+
+	if err := e.feedback.ExpiryWarning(e.nodeID, e.warning(cached)); err != nil {
+		log.Error().Err(err).Str("id", cached.ID).Msg("failed to send expiry warning")
+	}
+
+	return nil
+}
+
+// resume restarts the suspended workload of a reservation that has been extended
+func (e *Engine) resume(ctx context.Context, cached *Reservation) error {
+	fn, ok := e.resumers[cached.Type]
+	if !ok {
+		return nil
+	}
+
+	log.Info().Str("id", cached.ID).Msg("reservation extended, resuming workload")
+
+	workload := *cached
+	if cached.Reference != "" {
+		workload.ID = cached.Reference
+	}
+
+	if _, err := safeCall(func() (interface{}, error) {
+		return nil, fn(ctx, &workload)
+	}); err != nil {
+		return errors.Wrapf(err, "failed to resume workload of reservation %s", cached.ID)
+	}
+
+	cached.Suspended = false
+	if err := e.cache.Update(cached); err != nil {
+		return errors.Wrapf(err, "failed to mark reservation %s as resumed", cached.ID)
+	}
+
+	e.warnings.forget(cached.ID)
+	return nil
+}
+
+// extend replaces the expiration of the cached reservation with the one of r
+// and resumes the workload if it was suspended.
+// If r also modifies the workload, its expiration is only stored
+// along with the new workload once it's updated
+func (e *Engine) extend(ctx context.Context, r, cached *Reservation) error {
+	if cached.Suspended {
+		if err := e.resume(ctx, cached); err != nil {
+			return err
+		}
+	}
+
+	// the signature of r covers its workload, it can't be kept
+	// with the workload of the cached reservation
+	if r.WorkloadVersion != cached.WorkloadVersion || !bytes.Equal(r.Data, cached.Data) {
+		return nil
+	}
+
+	if !r.Expires().After(cached.Expires()) {
+		return nil
+	}
+
+	log.Info().
+		Str("id", r.ID).
+		Time("from", cached.Expires()).
+		Time("to", r.Expires()).
+		Msg("reservation extended")
+
+	cached.Created = r.Created
+	cached.Duration = r.Duration
+	cached.Signature = r.Signature
+	cached.SigningVersion = r.SigningVersion
+	cached.SignatureChallenge = r.SignatureChallenge
+	if err := e.cache.Update(cached); err != nil {
+		return errors.Wrapf(err, "failed to extend reservation %s", r.ID)
+	}
+
+	e.warnings.forget(cached.ID)
+	return nil
+}
+
+func (e *Engine) warning(r *Reservation) pkg.ExpiryWarning {
+	return pkg.ExpiryWarning{
+		ID:        r.ID,
+		Type:      string(r.Type),
+		Expires:   r.Expires(),
+		GraceEnds: r.Expires().Add(e.gracePeriod),
+		Suspended: r.Suspended,
+	}
+}
+
+// warnExpiring sends the expiry warnings every warning interval
+// until the context is canceled
+func (e *Engine) warnExpiring(ctx context.Context) {
+	if len(e.expiryWarnings) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(warningInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := e.sendWarnings(); err != nil {
+			log.Error().Err(err).Msg("failed to send expiry warnings")
+		}
+	}
+}
+
+// sendWarnings sends a warning for each reservation that crossed a warning
+// threshold since the last time it was warned
+func (e *Engine) sendWarnings() error {
+	reservations, err := e.cache.List()
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[string]struct{})
+	for _, r := range reservations {
+		if r.ToDelete || r.Suspended {
+			continue
+		}
+		ids[r.ID] = struct{}{}
+
+		left := time.Until(r.Expires())
+		threshold, ok := e.threshold(left)
+		if !ok {
+			// the reservation might have been extended
+			e.warnings.forget(r.ID)
+			continue
+		}
+
+		if !e.warnings.warned(r.ID, threshold) {
+			continue
+		}
+
+		log.Info().
+			Str("id", r.ID).
+			Time("expires", r.Expires()).
+			Msg("reservation is about to expire")
+
+		if err := e.feedback.ExpiryWarning(e.nodeID, e.warning(r)); err != nil {
+			log.Error().Err(err).Str("id", r.ID).Msg("failed to send expiry warning")
+		}
+	}
+
+	e.warnings.keep(ids)
+	return nil
+}
+
+// threshold returns the smallest warning threshold that is
+// larger than the time left before the reservation expires
+func (e *Engine) threshold(left time.Duration) (time.Duration, bool) {
+	for _, threshold := range e.expiryWarnings {
+		if left <= threshold {
+			return threshold, true
+		}
+	}
+
+	return 0, false
+}
+
+// warningStore keeps the last warning threshold crossed by each reservation
+type warningStore struct {
+	sync.Mutex
+	thresholds map[string]time.Duration
+}
+
+func newWarningStore() *warningStore {
+	return &warningStore{thresholds: make(map[string]time.Duration)}
+}
+
+// warned records the threshold crossed by the reservation. It returns
+// true if no warning was sent yet for this threshold
+func (s *warningStore) warned(id string, threshold time.Duration) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	previous, ok := s.thresholds[id]
+	if ok && previous <= threshold {
+		return false
+	}
+
+	s.thresholds[id] = threshold
+	return true
+}
+
+func (s *warningStore) forget(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.thresholds, id)
+}
+
+// keep forgets all the reservations not in ids
+func (s *warningStore) keep(ids map[string]struct{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	for id := range s.thresholds {
+		if _, ok := ids[id]; !ok {
+			delete(s.thresholds, id)
+		}
+	}
+}
+
+// sortThresholds returns the warning thresholds from the smallest to the largest
+func sortThresholds(thresholds []time.Duration) []time.Duration {
+	sorted := make([]time.Duration, 0, len(thresholds))
+	for _, threshold := range thresholds {
+		if threshold > 0 {
+			sorted = append(sorted, threshold)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	return sorted
+}
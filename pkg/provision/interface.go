@@ -2,9 +2,11 @@ package provision
 
 import (
 	"context"
+	"errors"
 
 	"github.com/threefoldtech/tfexplorer/models/generated/directory"
 	"github.com/threefoldtech/tfexplorer/models/generated/workloads"
+	"github.com/threefoldtech/zos/pkg"
 )
 
 // ReservationSource interface. The source
@@ -21,12 +23,38 @@ type ReservationGetter interface {
 	Get(gwid string) (*Reservation, error)
 }
 
+// ErrReservationNotFound is returned by the ReservationGetter
+// of the sources that don't know the reservation
+var ErrReservationNotFound = errors.New("reservation not found")
+
 // ProvisionerFunc is the function called by the Engine to provision a workload
 type ProvisionerFunc func(ctx context.Context, reservation *Reservation) (interface{}, error)
 
 // DecomissionerFunc is the function called by the Engine to decomission a workload
 type DecomissionerFunc func(ctx context.Context, reservation *Reservation) error
 
+// UpdaterFunc is the function called by the Engine to modify an already deployed
+// workload in place. It receives the new version of the reservation and the
+// currently deployed one
+type UpdaterFunc func(ctx context.Context, reservation, current *Reservation) (interface{}, error)
+
+// StatusCheckerFunc is the function called periodically by the Engine to
+// inspect a deployed workload. The error explains why the workload is not running
+type StatusCheckerFunc func(ctx context.Context, reservation *Reservation) (pkg.WorkloadState, error)
+
+// SuspenderFunc is the function called by the Engine when a reservation expires
+// to suspend its workload during the grace period without losing its data
+type SuspenderFunc func(ctx context.Context, reservation *Reservation) error
+
+// ResumerFunc is the function called by the Engine to resume a suspended
+// workload when its reservation is extended during the grace period
+type ResumerFunc func(ctx context.Context, reservation *Reservation) error
+
+// LockKeysFunc returns the keys of the resources (network, volume, etc...)
+// touched by a reservation. The engine never processes two reservations
+// that share a key at the same time. The reservation ID is always used as a key
+type LockKeysFunc func(r *Reservation) []string
+
 // ReservationConverterFunc is used to convert from the explorer workloads type into the
 // internal Reservation type
 type ReservationConverterFunc func(w workloads.Workloader) (*Reservation, error)
@@ -38,19 +66,29 @@ type ResultConverterFunc func(result Result) (*workloads.Result, error)
 // some reservations
 type ReservationCache interface {
 	Add(r *Reservation) error
+	Update(r *Reservation) error
 	Get(id string) (*Reservation, error)
+	List() ([]*Reservation, error)
 	Remove(id string) error
 	Exists(id string) (bool, error)
 	NetworkExists(id string) (bool, error)
 	Sync(Statser) error
 }
 
+// ReservationFinder is implemented by the caches that can
+// look up reservations without going over all of them
+type ReservationFinder interface {
+	Find(filter pkg.ReservationFilter) ([]*Reservation, error)
+}
+
 // Feedbacker defines the method that needs to be implemented
 // to send the provision result to BCDB
 type Feedbacker interface {
 	Feedback(nodeID string, r *Result) error
 	Deleted(nodeID, id string) error
 	UpdateStats(nodeID string, w directory.WorkloadAmount, u directory.ResourceAmount) error
+	UpdateStatus(nodeID string, status pkg.WorkloadStatus) error
+	ExpiryWarning(nodeID string, warning pkg.ExpiryWarning) error
 }
 
 // Signer interface is used to sign reservation result before
@@ -68,4 +106,14 @@ type Statser interface {
 	CurrentUnits() directory.ResourceAmount
 	CurrentWorkloads() directory.WorkloadAmount
 	CheckMemoryRequirements(r *Reservation, totalMemAvailable uint64) error
+	// CheckQuota makes sure the reservation doesn't exceed the
+	// quota of its user
+	CheckQuota(r *Reservation) error
+}
+
+// CapacityChecker is used by the provision Engine to make sure a reservation
+// is valid and the node has enough resources to provision it before starting
+// the deployment. CanProvision must not have any side effect
+type CapacityChecker interface {
+	CanProvision(r *Reservation) error
 }
@@ -0,0 +1,62 @@
+package provision
+
+import (
+	"context"
+	"time"
+)
+
+// JournalEntry is the record of a reservation that started provisioning
+// along with the steps that have been taken so far
+type JournalEntry struct {
+	Reservation Reservation `json:"reservation"`
+	Started     time.Time   `json:"started"`
+	// Steps are the name of the steps started in the order they were taken
+	Steps []string `json:"steps"`
+}
+
+// Journal is a write-ahead log of the steps taken while provisioning
+// workloads. Entries that are not completed when the engine starts
+// belong to reservations that were being provisioned when provisiond died
+type Journal interface {
+	// Begin starts a new entry for the reservation, replacing any previous one
+	Begin(r *Reservation) error
+	// Step records that a step of the provisioning of reservation id is
+	// about to be taken
+	Step(id string, step string) error
+	// Complete removes the entry of the reservation
+	Complete(id string) error
+	// Incomplete returns all the entries that have not been completed
+	Incomplete() ([]*JournalEntry, error)
+}
+
+// RollbackFunc is called by the engine on start to undo the steps recorded
+// for a reservation that was not fully provisioned. Steps can be recorded
+// before they actually happened, so a RollbackFunc must not fail if the
+// resource of a step does not exist
+type RollbackFunc func(ctx context.Context, reservation *Reservation, steps []string) error
+
+type journalKey struct{}
+
+type journalRecorder struct {
+	journal Journal
+	id      string
+}
+
+// withJournal returns a context that records the provisioning steps of
+// reservation id in journal
+func withJournal(ctx context.Context, journal Journal, id string) context.Context {
+	return context.WithValue(ctx, journalKey{}, journalRecorder{journal: journal, id: id})
+}
+
+// Step records in the journal that a step is about to be taken while
+// provisioning the reservation of ctx. It must be called before the step
+// is executed so it can be rolled back if provisiond dies in the middle of it.
+// If the engine has no journal, Step does nothing
+func Step(ctx context.Context, step string) error {
+	recorder, ok := ctx.Value(journalKey{}).(journalRecorder)
+	if !ok {
+		return nil
+	}
+
+	return recorder.journal.Step(recorder.id, step)
+}
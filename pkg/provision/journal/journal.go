@@ -0,0 +1,206 @@
+// Package journal implements the provisioning journal of the provision engine
+// on top of the filesystem.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+// errPartial is returned when provisiond died while the header of
+// an entry was written. No step was taken for such an entry
+var errPartial = fmt.Errorf("partial journal entry")
+
+// header is the first line of a journal file
+type header struct {
+	Reservation provision.Reservation `json:"reservation"`
+	Started     time.Time             `json:"started"`
+}
+
+// record is the line appended to a journal file for each step
+type record struct {
+	Step string    `json:"step"`
+	Time time.Time `json:"time"`
+}
+
+// Fs is a provisioning journal that keeps one file per reservation
+// being provisioned. Each file is made of one JSON object per line, the
+// reservation first, then one line per step. Lines are synced to disk
+// before the step is taken
+type Fs struct {
+	m    sync.Mutex
+	root string
+}
+
+var _ provision.Journal = (*Fs)(nil)
+
+// NewFSJournal creates a journal that stores its entries under root
+func NewFSJournal(root string) (*Fs, error) {
+	if err := os.MkdirAll(root, 0770); err != nil {
+		return nil, errors.Wrapf(err, "failed to create journal directory %s", root)
+	}
+
+	return &Fs{root: root}, nil
+}
+
+func (j *Fs) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, "/\\") || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid reservation id '%s'", id)
+	}
+
+	return filepath.Join(j.root, id), nil
+}
+
+func (j *Fs) append(path string, flags int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, flags|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// Begin implements provision.Journal
+func (j *Fs) Begin(r *provision.Reservation) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	path, err := j.path(r.ID)
+	if err != nil {
+		return err
+	}
+
+	return j.append(path, os.O_CREATE|os.O_TRUNC, header{
+		Reservation: *r,
+		Started:     time.Now(),
+	})
+}
+
+// Step implements provision.Journal
+func (j *Fs) Step(id string, step string) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	path, err := j.path(id)
+	if err != nil {
+		return err
+	}
+
+	// no O_CREATE, a step without an entry would be impossible to roll back
+	if err := j.append(path, os.O_APPEND, record{Step: step, Time: time.Now()}); err != nil {
+		return errors.Wrapf(err, "failed to record step %s of reservation %s", step, id)
+	}
+
+	return nil
+}
+
+// Complete implements provision.Journal
+func (j *Fs) Complete(id string) error {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	path, err := j.path(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Incomplete implements provision.Journal
+func (j *Fs) Incomplete() ([]*provision.JournalEntry, error) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	infos, err := ioutil.ReadDir(j.root)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*provision.JournalEntry, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(j.root, info.Name())
+		entry, err := j.load(path)
+		if err == errPartial {
+			log.Warn().Str("file", info.Name()).Msg("discarding partial journal entry")
+			if err := os.Remove(path); err != nil {
+				log.Error().Err(err).Str("file", info.Name()).Msg("failed to remove journal entry")
+			}
+			continue
+		} else if err != nil {
+			log.Error().Err(err).Str("file", info.Name()).Msg("failed to load journal entry")
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (j *Fs) load(path string) (*provision.JournalEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+
+	if !scanner.Scan() {
+		return nil, errPartial
+	}
+
+	var h header
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+		return nil, errPartial
+	}
+
+	entry := &provision.JournalEntry{
+		Reservation: h.Reservation,
+		Started:     h.Started,
+		Steps:       []string{},
+	}
+
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// provisiond died while writing this line, the step
+			// was not started since lines are written before the step
+			break
+		}
+		entry.Steps = append(entry.Steps, rec.Step)
+	}
+
+	return entry, scanner.Err()
+}
@@ -0,0 +1,97 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestJournal(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "journal")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	j, err := NewFSJournal(root)
+	require.NoError(err)
+
+	r := &provision.Reservation{
+		ID:   "1-1",
+		User: "user",
+		Type: "container",
+		Data: []byte(`{"flist": "https://hub.grid.tf/tf-official-apps/ubuntu.flist"}`),
+	}
+
+	require.NoError(j.Begin(r))
+	require.NoError(j.Step(r.ID, "network"))
+	require.NoError(j.Step(r.ID, "flist"))
+
+	require.NoError(j.Begin(&provision.Reservation{ID: "2-1", Type: "volume"}))
+	require.NoError(j.Complete("2-1"))
+
+	require.Error(j.Step("3-1", "network"), "step of unknown reservation")
+	require.Error(j.Begin(&provision.Reservation{ID: "../1-1"}))
+
+	// simulate a restart
+	j, err = NewFSJournal(root)
+	require.NoError(err)
+
+	entries, err := j.Incomplete()
+	require.NoError(err)
+	require.Len(entries, 1)
+	require.Equal(r.ID, entries[0].Reservation.ID)
+	require.Equal(r.Data, entries[0].Reservation.Data)
+	require.Equal([]string{"network", "flist"}, entries[0].Steps)
+
+	// a new provisioning of the same reservation starts from scratch
+	require.NoError(j.Begin(r))
+	entries, err = j.Incomplete()
+	require.NoError(err)
+	require.Len(entries, 1)
+	require.Empty(entries[0].Steps)
+
+	require.NoError(j.Complete(r.ID))
+	require.NoError(j.Complete(r.ID))
+
+	entries, err = j.Incomplete()
+	require.NoError(err)
+	require.Empty(entries)
+}
+
+func TestJournalPartialWrite(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "journal")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	j, err := NewFSJournal(root)
+	require.NoError(err)
+
+	require.NoError(j.Begin(&provision.Reservation{ID: "1-1", Type: "container"}))
+	require.NoError(j.Step("1-1", "network"))
+
+	// provisiond died while writing the second step
+	f, err := os.OpenFile(filepath.Join(root, "1-1"), os.O_APPEND|os.O_WRONLY, 0660)
+	require.NoError(err)
+	_, err = f.WriteString(`{"step": "fli`)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	// provisiond died while writing the header of another entry
+	require.NoError(ioutil.WriteFile(filepath.Join(root, "2-1"), []byte(`{"reservation": {"id": "2`), 0660))
+
+	entries, err := j.Incomplete()
+	require.NoError(err)
+	require.Len(entries, 1)
+	require.Equal("1-1", entries[0].Reservation.ID)
+	require.Equal([]string{"network"}, entries[0].Steps)
+
+	_, err = os.Stat(filepath.Join(root, "2-1"))
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,50 @@
+package provision
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg/crypto"
+	"golang.org/x/crypto/ed25519"
+)
+
+type fileKeyResolver struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewFileKeyResolver creates a UserKeyResolver that loads the users public keys
+// from a json file that maps user IDs to hex encoded public keys
+func NewFileKeyResolver(path string) (UserKeyResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var encoded map[string]string
+	if err := json.NewDecoder(f).Decode(&encoded); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode keys file %s", path)
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(encoded))
+	for user, h := range encoded {
+		key, err := crypto.KeyFromHex(h)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key for user %s", user)
+		}
+		keys[user] = key
+	}
+
+	return &fileKeyResolver{keys: keys}, nil
+}
+
+func (f *fileKeyResolver) PublicKey(userID string) (ed25519.PublicKey, error) {
+	key, ok := f.keys[userID]
+	if !ok {
+		return nil, fmt.Errorf("unknown user %s", userID)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,226 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Handler returns the http handler of the local API
+//
+// POST   /reservations             send a new reservation (or a new version of it)
+// GET    /reservations/{id}        get a reservation
+// DELETE /reservations/{id}        ask the node to decommission a reservation, the body is a signed deleteRequest
+// GET    /reservations/{id}/result get the result of a reservation
+// GET    /reservations/{id}/status get the state of a deployed workload
+// GET    /reservations/{id}/expiry get the last expiry warning of a reservation
+// GET    /stats                    get the last statistics reported by the node
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reservations", s.handleReservations)
+	mux.HandleFunc("/reservations/", s.handleReservation)
+	mux.HandleFunc("/stats", s.handleStats)
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("failed to write response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+}
+
+// deleteRequest is the body of a DELETE /reservations/{id} request
+type deleteRequest struct {
+	// Signature of the user over the delete request, see provision.Reservation.SignDelete
+	Signature []byte `json:"signature"`
+}
+
+func (s *Server) handleReservations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	var reservation provision.Reservation
+	if err := json.NewDecoder(r.Body).Decode(&reservation); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to decode reservation: %w", err))
+		return
+	}
+
+	if err := s.validate(&reservation); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if current, ok := s.get(reservation.ID); ok && reservation.WorkloadVersion <= current.WorkloadVersion {
+		writeError(w, http.StatusConflict, fmt.Errorf("reservation %s version %d already exists", reservation.ID, current.WorkloadVersion))
+		return
+	}
+
+	// the local reservations are always signed with the latest scheme
+	// the signing version and challenge are never taken from the client
+	reservation.SigningVersion = provision.SigningV1
+	reservation.SignatureChallenge = nil
+	reservation.ToDelete = false
+	reservation.DeleteSignature = nil
+	reservation.Result = provision.Result{}
+
+	// forged reservations are refused before they replace the last
+	// accepted version of the reservation and its result
+	if status, err := s.verify(&reservation, provision.Verify); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	if err := s.push(&reservation); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, reservation)
+}
+
+func (s *Server) validate(r *provision.Reservation) error {
+	if r.ID == "" {
+		return fmt.Errorf("reservation id is required")
+	}
+
+	if strings.ContainsAny(r.ID, "/\\") || strings.HasPrefix(r.ID, ".") {
+		return fmt.Errorf("invalid reservation id '%s'", r.ID)
+	}
+
+	if r.Type == "" {
+		return fmt.Errorf("reservation type is required")
+	}
+
+	if r.NodeID != s.nodeID {
+		return fmt.Errorf("reservation is for node '%s' not for this node", r.NodeID)
+	}
+
+	if len(r.Signature) == 0 {
+		return fmt.Errorf("reservation is not signed")
+	}
+
+	return nil
+}
+
+// verify checks the signature of the reservation with fn against the public key
+// of its user. It returns the http status to reply with if the check fails
+func (s *Server) verify(r *provision.Reservation, fn func(*provision.Reservation, ed25519.PublicKey) error) (int, error) {
+	key, err := s.keys.PublicKey(r.User)
+	if err != nil {
+		return http.StatusForbidden, fmt.Errorf("failed to get public key of user %s: %w", r.User, err)
+	}
+
+	if err := fn(r, key); err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return 0, nil
+}
+
+func (s *Server) handleReservation(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/reservations/"), "/")
+	id := parts[0]
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		reservation, ok := s.get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("reservation %s not found", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, reservation)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		reservation, ok := s.get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("reservation %s not found", id))
+			return
+		}
+
+		var request deleteRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to decode delete request: %w", err))
+			return
+		}
+
+		if len(request.Signature) == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("delete request is not signed"))
+			return
+		}
+
+		// the signature is verified again by the engine before the
+		// reservation is decommissioned
+		reservation.ToDelete = true
+		reservation.DeleteSignature = request.Signature
+		if status, err := s.verify(reservation, provision.VerifyDelete); err != nil {
+			writeError(w, status, err)
+			return
+		}
+
+		if err := s.push(reservation); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, reservation)
+
+	case len(parts) == 2 && parts[1] == "result" && r.Method == http.MethodGet:
+		result, err := s.store.result(id)
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no result for reservation %s", id))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case len(parts) == 2 && parts[1] == "status" && r.Method == http.MethodGet:
+		status, ok := s.status(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no status for reservation %s", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+
+	case len(parts) == 2 && parts[1] == "expiry" && r.Method == http.MethodGet:
+		warning, ok := s.warning(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no expiry warning for reservation %s", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, warning)
+
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	s.m.RLock()
+	stats := s.stats
+	s.m.RUnlock()
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,314 @@
+// Package local implements a reservation source and feedbacker driven over a
+// local HTTP API. It allows to run provisiond without the TFExplorer, for
+// air-gapped nodes or to drive nodes from a custom orchestrator.
+package local
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/tfexplorer/models/generated/directory"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+// Stats is the last statistics reported by the provision engine
+type Stats struct {
+	Workloads directory.WorkloadAmount `json:"workloads"`
+	Resources directory.ResourceAmount `json:"resources"`
+}
+
+// Server is a reservation source and feedbacker that is driven over a local
+// HTTP API instead of the TFExplorer. It implements both
+// the provision.ReservationPoller and provision.Feedbacker interfaces
+// so it can be used with provision.PollSource.
+type Server struct {
+	m      sync.RWMutex
+	store  *store
+	nodeID string
+	keys   provision.UserKeyResolver
+	order  map[provision.ReservationType]int
+
+	seq      uint64
+	entries  map[string]*entry
+	stats    Stats
+	statuses map[string]pkg.WorkloadStatus
+	warnings map[string]pkg.ExpiryWarning
+
+	// changed is closed and replaced every time a reservation is received
+	changed chan struct{}
+	// wait is the max time a call to Poll blocks waiting for new reservations
+	wait time.Duration
+}
+
+// NewServer creates a new local server that stores its state under root.
+// keys is used to verify the signature of the reservations and delete requests
+// before they are accepted. provisionOrder is used to order the reservation
+// before sending them to the engine
+func NewServer(root string, nodeID string, keys provision.UserKeyResolver, provisionOrder map[provision.ReservationType]int) (*Server, error) {
+	store, err := newStore(root)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := store.entries()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load reservations")
+	}
+
+	s := &Server{
+		store:    store,
+		nodeID:   nodeID,
+		keys:     keys,
+		order:    provisionOrder,
+		entries:  make(map[string]*entry),
+		statuses: make(map[string]pkg.WorkloadStatus),
+		warnings: make(map[string]pkg.ExpiryWarning),
+		changed:  make(chan struct{}),
+		wait:     10 * time.Second,
+	}
+
+	for _, e := range entries {
+		s.entries[e.Reservation.ID] = e
+		if e.Seq > s.seq {
+			s.seq = e.Seq
+		}
+	}
+
+	return s, nil
+}
+
+// Listen creates a listener from an address of the form
+// unix:///path/to/socket or tcp://host:port
+func Listen(address string) (net.Listener, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid listen address '%s'", address)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if err := os.Remove(u.Path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", u.Path)
+	case "tcp":
+		return net.Listen("tcp", u.Host)
+	default:
+		return nil, fmt.Errorf("unsupported listen address scheme '%s'", u.Scheme)
+	}
+}
+
+// Serve serves the API on the listener until the context is canceled
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	server := http.Server{Handler: s.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close local reservation server")
+		}
+	}()
+
+	if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// push records a new version of a reservation and wakes up pollers
+func (s *Server) push(r *provision.Reservation) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	e := &entry{
+		Seq:         s.seq + 1,
+		Reservation: *r,
+	}
+
+	if err := s.store.setEntry(e); err != nil {
+		return errors.Wrapf(err, "failed to store reservation %s", r.ID)
+	}
+
+	s.seq = e.Seq
+	s.entries[r.ID] = e
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	return nil
+}
+
+func (s *Server) get(id string) (*provision.Reservation, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, false
+	}
+
+	r := e.Reservation
+	return &r, true
+}
+
+// Get implements provision.ReservationGetter. A delete request is not
+// reported until the engine verified it and decommissioned the reservation
+// so the janitor never removes the resources of a reservation on a forged request
+func (s *Server) Get(id string) (*provision.Reservation, error) {
+	r, ok := s.get(id)
+	if !ok {
+		return nil, errors.Wrapf(provision.ErrReservationNotFound, "reservation %s", id)
+	}
+
+	r.ToDelete = false
+	return r, nil
+}
+
+// Poll implements provision.ReservationPoller. It returns all the
+// reservations that changed since from. If nothing changed, it blocks
+// until a reservation is received or the wait time is over.
+func (s *Server) Poll(nodeID pkg.Identifier, from uint64) ([]*provision.Reservation, uint64, error) {
+	timeout := time.After(s.wait)
+	for {
+		s.m.RLock()
+		entries := make([]*entry, 0)
+		for _, e := range s.entries {
+			if e.Seq >= from {
+				entries = append(entries, e)
+			}
+		}
+		last := s.seq
+		changed := s.changed
+		s.m.RUnlock()
+
+		if len(entries) > 0 {
+			return s.sorted(entries), last, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			if from > 0 {
+				last = from - 1
+			}
+			return nil, last, nil
+		}
+	}
+}
+
+func (s *Server) sorted(entries []*entry) []*provision.Reservation {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+
+	result := make([]*provision.Reservation, 0, len(entries))
+	for _, e := range entries {
+		r := e.Reservation
+		result = append(result, &r)
+	}
+
+	if s.order != nil {
+		// sorts the workloads in the oder they need to be processed by provisiond
+		sort.SliceStable(result, func(i int, j int) bool {
+			return s.order[result[i].Type] < s.order[result[j].Type]
+		})
+	}
+
+	return result
+}
+
+// Feedback implements provision.Feedbacker
+func (s *Server) Feedback(nodeID string, r *provision.Result) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.store.setResult(r)
+}
+
+// Deleted implements provision.Feedbacker
+func (s *Server) Deleted(nodeID, id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// keep the reason why a reservation failed or has been rejected
+	result, err := s.store.result(id)
+	if err != nil || (result.State != provision.StateError && result.State != provision.StateRejected) {
+		deleted := &provision.Result{
+			ID:      id,
+			State:   provision.StateDeleted,
+			Created: time.Now(),
+		}
+		if e, ok := s.entries[id]; ok {
+			deleted.Type = e.Reservation.Type
+		}
+
+		if err := s.store.setResult(deleted); err != nil {
+			return err
+		}
+	}
+
+	// the reservation is gone, no need to send it again
+	// to the engine after a reboot
+	delete(s.entries, id)
+	delete(s.statuses, id)
+	delete(s.warnings, id)
+	return s.store.removeEntry(id)
+}
+
+// UpdateStats implements provision.Feedbacker
+func (s *Server) UpdateStats(nodeID string, w directory.WorkloadAmount, u directory.ResourceAmount) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.stats = Stats{
+		Workloads: w,
+		Resources: u,
+	}
+
+	return nil
+}
+
+// UpdateStatus implements provision.Feedbacker
+func (s *Server) UpdateStatus(nodeID string, status pkg.WorkloadStatus) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.statuses[status.ID] = status
+	return nil
+}
+
+func (s *Server) status(id string) (pkg.WorkloadStatus, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	status, ok := s.statuses[id]
+	return status, ok
+}
+
+// ExpiryWarning implements provision.Feedbacker
+func (s *Server) ExpiryWarning(nodeID string, warning pkg.ExpiryWarning) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.warnings[warning.ID] = warning
+	return nil
+}
+
+func (s *Server) warning(id string) (pkg.ExpiryWarning, bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	warning, ok := s.warnings[id]
+	return warning, ok
+}
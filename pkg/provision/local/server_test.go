@@ -0,0 +1,226 @@
+package local
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"golang.org/x/crypto/ed25519"
+)
+
+// testKeys resolves the same key for all the users
+type testKeys struct {
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	return &testKeys{public: public, private: private}
+}
+
+func (k *testKeys) PublicKey(userID string) (ed25519.PublicKey, error) {
+	return k.public, nil
+}
+
+func (k *testKeys) sign(t *testing.T, r provision.Reservation) provision.Reservation {
+	require.NoError(t, r.Sign(k.private))
+	return r
+}
+
+func (k *testKeys) deleteRequest(t *testing.T, r provision.Reservation) *bytes.Buffer {
+	require.NoError(t, r.SignDelete(k.private))
+	data, err := json.Marshal(deleteRequest{Signature: r.DeleteSignature})
+	require.NoError(t, err)
+	return bytes.NewBuffer(data)
+}
+
+func post(t *testing.T, url string, r provision.Reservation) *http.Response {
+	data, err := json.Marshal(r)
+	require.NoError(t, err)
+	resp, err := http.Post(url+"/reservations", "application/json", bytes.NewBuffer(data))
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	require := require.New(t)
+	root, err := ioutil.TempDir("", "local")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	order := map[provision.ReservationType]int{
+		"network":   1,
+		"container": 2,
+	}
+
+	keys := newTestKeys(t)
+	server, err := NewServer(root, "node", keys, order)
+	require.NoError(err)
+	server.wait = 10 * time.Millisecond
+
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	reservation := keys.sign(t, provision.Reservation{
+		ID:     "1-1",
+		NodeID: "node",
+		User:   "user",
+		Type:   "container",
+	})
+
+	// not signed
+	unsigned := reservation
+	unsigned.Signature = nil
+	require.Equal(400, post(t, srv.URL, unsigned).StatusCode)
+
+	// wrong node
+	other := reservation
+	other.NodeID = "other"
+	require.Equal(400, post(t, srv.URL, other).StatusCode)
+
+	require.Equal(202, post(t, srv.URL, reservation).StatusCode)
+	// same version twice
+	require.Equal(409, post(t, srv.URL, reservation).StatusCode)
+
+	// not signed by the user
+	forged := reservation
+	forged.WorkloadVersion = 1
+	require.Equal(401, post(t, srv.URL, forged).StatusCode)
+
+	network := reservation
+	network.ID = "1-2"
+	network.Type = "network"
+	network = keys.sign(t, network)
+	require.Equal(202, post(t, srv.URL, network).StatusCode)
+
+	id := pkg.StrIdentifier("node")
+	reservations, last, err := server.Poll(id, 0)
+	require.NoError(err)
+	require.EqualValues(2, last)
+	require.Len(reservations, 2)
+	require.Equal("1-2", reservations[0].ID)
+	require.Equal("1-1", reservations[1].ID)
+
+	// nothing new
+	reservations, last, err = server.Poll(id, 3)
+	require.NoError(err)
+	require.EqualValues(2, last)
+	require.Len(reservations, 0)
+
+	require.NoError(server.Feedback("node", &provision.Result{ID: "1-1", State: provision.StateOk}))
+	resp, err := srv.Client().Get(srv.URL + "/reservations/1-1/result")
+	require.NoError(err)
+	var result provision.Result
+	require.NoError(json.NewDecoder(resp.Body).Decode(&result))
+	resp.Body.Close()
+	require.Equal(provision.StateOk, result.State)
+
+	req, err := srv.Client().Get(srv.URL + "/reservations/2-1/result")
+	require.NoError(err)
+	req.Body.Close()
+	require.Equal(404, req.StatusCode)
+
+	// delete the reservation, the request must be signed
+	request, err := http.NewRequest(http.MethodDelete, srv.URL+"/reservations/1-1", bytes.NewBufferString(`{}`))
+	require.NoError(err)
+	resp, err = srv.Client().Do(request)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(400, resp.StatusCode)
+
+	// a delete request signed by someone else is refused
+	request, err = http.NewRequest(http.MethodDelete, srv.URL+"/reservations/1-1", bytes.NewBufferString(`{"signature": "c2lnbmF0dXJl"}`))
+	require.NoError(err)
+	resp, err = srv.Client().Do(request)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(401, resp.StatusCode)
+
+	// the forged requests didn't replace the accepted reservation nor its result
+	accepted, err := server.Get("1-1")
+	require.NoError(err)
+	require.Equal(0, accepted.WorkloadVersion)
+	reservations, last, err = server.Poll(id, 3)
+	require.NoError(err)
+	require.EqualValues(2, last)
+	require.Len(reservations, 0)
+
+	request, err = http.NewRequest(http.MethodDelete, srv.URL+"/reservations/1-1", keys.deleteRequest(t, reservation))
+	require.NoError(err)
+	resp, err = srv.Client().Do(request)
+	require.NoError(err)
+	resp.Body.Close()
+	require.Equal(202, resp.StatusCode)
+
+	reservations, last, err = server.Poll(id, 3)
+	require.NoError(err)
+	require.EqualValues(3, last)
+	require.Len(reservations, 1)
+	require.True(reservations[0].ToDelete)
+	require.NoError(provision.VerifyDelete(reservations[0], keys.public))
+
+	// the delete request is not verified yet
+	pending, err := server.Get("1-1")
+	require.NoError(err)
+	require.False(pending.ToDelete)
+
+	require.NoError(server.Deleted("node", "1-1"))
+	_, err = server.Get("1-1")
+	require.True(errors.Is(err, provision.ErrReservationNotFound))
+
+	// state is reloaded from disk
+	server, err = NewServer(root, "node", keys, order)
+	require.NoError(err)
+	server.wait = 10 * time.Millisecond
+
+	reservations, _, err = server.Poll(id, 0)
+	require.NoError(err)
+	require.Len(reservations, 1)
+	require.Equal("1-2", reservations[0].ID)
+
+	deleted, err := server.store.result("1-1")
+	require.NoError(err)
+	require.Equal(provision.StateDeleted, deleted.State)
+}
+
+func TestServerSigningVersion(t *testing.T) {
+	require := require.New(t)
+	root, err := ioutil.TempDir("", "local")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	keys := newTestKeys(t)
+	server, err := NewServer(root, "node", keys, nil)
+	require.NoError(err)
+
+	srv := httptest.NewServer(server.Handler())
+	defer srv.Close()
+
+	// the signing scheme can't be chosen by the client
+	reservation := keys.sign(t, provision.Reservation{
+		ID:     "1-1",
+		NodeID: "node",
+		User:   "user",
+		Type:   "container",
+	})
+	reservation.SigningVersion = provision.SigningExplorer
+	reservation.SignatureChallenge = []byte("challenge")
+	require.Equal(202, post(t, srv.URL, reservation).StatusCode)
+
+	stored, err := server.Get("1-1")
+	require.NoError(err)
+	require.Equal(provision.SigningV1, stored.SigningVersion)
+	require.Empty(stored.SignatureChallenge)
+}
@@ -0,0 +1,117 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+// entry is a reservation received over the API along with
+// the sequence number of the last time it changed
+type entry struct {
+	Seq         uint64                `json:"seq"`
+	Reservation provision.Reservation `json:"reservation"`
+}
+
+// store keeps the received reservations and the results
+// on disk so they survive a restart of the node
+type store struct {
+	root string
+}
+
+func newStore(root string) (*store, error) {
+	s := &store{root: root}
+	for _, dir := range []string{s.reservations(), s.results()} {
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return nil, errors.Wrapf(err, "failed to create directory %s", dir)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *store) reservations() string {
+	return filepath.Join(s.root, "reservations")
+}
+
+func (s *store) results() string {
+	return filepath.Join(s.root, "results")
+}
+
+func (s *store) write(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a partial file
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0660); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (s *store) read(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func (s *store) setEntry(e *entry) error {
+	return s.write(filepath.Join(s.reservations(), e.Reservation.ID), e)
+}
+
+func (s *store) removeEntry(id string) error {
+	err := os.Remove(filepath.Join(s.reservations(), id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *store) entries() ([]*entry, error) {
+	infos, err := ioutil.ReadDir(s.reservations())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*entry, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) == ".tmp" {
+			continue
+		}
+
+		var e entry
+		if err := s.read(filepath.Join(s.reservations(), info.Name()), &e); err != nil {
+			return nil, fmt.Errorf("failed to load reservation %s: %w", info.Name(), err)
+		}
+
+		entries = append(entries, &e)
+	}
+
+	return entries, nil
+}
+
+func (s *store) setResult(r *provision.Result) error {
+	return s.write(filepath.Join(s.results(), r.ID), r)
+}
+
+func (s *store) result(id string) (*provision.Result, error) {
+	var r provision.Result
+	if err := s.read(filepath.Join(s.results(), id), &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
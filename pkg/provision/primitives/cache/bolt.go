@@ -0,0 +1,509 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/app"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/provision/primitives"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// reservations holds the reservations by ID
+	bucketReservations = []byte("reservations")
+	// types holds a bucket per reservation type with the IDs of the reservations
+	bucketTypes = []byte("types")
+	// users holds a bucket per user with the IDs of the reservations
+	bucketUsers = []byte("users")
+	// networks holds a bucket per network ID with the IDs of the network reservations
+	bucketNetworks = []byte("networks")
+	// expiry holds the IDs of the reservations prefixed by their expiration time
+	bucketExpiry = []byte("expiry")
+	// attempts holds the last provision attempt of the reservations by ID
+	bucketAttempts = []byte("attempts")
+)
+
+// Bolt is a reservation cache using an embedded bolt database as backend.
+// All the changes are done in a transaction and the reservations are indexed
+// by type, user, network and expiration time
+type Bolt struct {
+	db *bolt.DB
+}
+
+var (
+	_ provision.ReservationCache = (*Bolt)(nil)
+	_ provision.AttemptStore     = (*Bolt)(nil)
+)
+
+// NewBoltStore creates a reservation cache stored in the bolt database at path.
+// If the directory fsRoot of a filesystem cache exists, its reservations
+// are migrated to the new store and the directory is renamed
+func NewBoltStore(path string, fsRoot string) (*Bolt, error) {
+	store, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.migrate(fsRoot); err != nil {
+		store.Close()
+		return nil, errors.Wrap(err, "failed to migrate reservation cache")
+	}
+
+	if app.IsFirstBoot("provisiond") {
+		log.Info().Msg("first boot, empty reservation cache")
+		if err := store.removeAllButPersistent(); err != nil {
+			store.Close()
+			return nil, err
+		}
+
+		if err := app.MarkBooted("provisiond"); err != nil {
+			store.Close()
+			return nil, errors.Wrap(err, "fail to mark provisiond as booted")
+		}
+	}
+
+	return store, nil
+}
+
+func openBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0660, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open reservation cache %s", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketReservations, bucketTypes, bucketUsers, bucketNetworks, bucketExpiry, bucketAttempts} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to initialize reservation cache")
+	}
+
+	return &Bolt{db: db}, nil
+}
+
+// migrate copies the reservations of the filesystem cache at root in a
+// single transaction, then renames root so the migration only happens once
+func (s *Bolt) migrate(root string) error {
+	if root == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	fs := &Fs{root: root}
+	reservations, err := fs.list()
+	if err != nil {
+		return err
+	}
+
+	log.Info().Int("count", len(reservations)).Msg("migrating reservation cache")
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, r := range reservations {
+			// a previous migration might have been interrupted before
+			// root was renamed, so overwrite what is there
+			if err := s.put(tx, r); err != nil {
+				return errors.Wrapf(err, "failed to migrate reservation %s", r.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(root, root+".migrated")
+}
+
+func (s *Bolt) removeAllButPersistent() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		reservations, err := s.list(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range reservations {
+			if r.Type == primitives.VolumeReservation {
+				continue
+			}
+
+			log.Info().Str("id", r.ID).Msg("removing reservation from cache")
+			if err := s.remove(tx, r.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// expiryKey is the key of a reservation in the expiry index
+// the keys are sorted by expiration time
+func expiryKey(r *provision.Reservation) []byte {
+	expires := r.Expires().Unix()
+	if expires < 0 {
+		expires = 0
+	}
+
+	key := make([]byte, 8, 8+len(r.ID))
+	binary.BigEndian.PutUint64(key, uint64(expires))
+	return append(key, []byte(r.ID)...)
+}
+
+// networkKey returns the network ID of a network reservation
+func networkKey(r *provision.Reservation) ([]byte, bool, error) {
+	if r.Type != primitives.NetworkReservation {
+		return nil, false, nil
+	}
+
+	nr := pkg.NetResource{}
+	if err := json.Unmarshal(r.Data, &nr); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal network from reservation: %w", err)
+	}
+
+	return []byte(provision.NetworkID(r.User, nr.Name)), true, nil
+}
+
+// indexes returns the index buckets and keys that point to the reservation
+func (s *Bolt) indexes(r *provision.Reservation) ([][2][]byte, error) {
+	indexes := [][2][]byte{
+		{bucketTypes, []byte(r.Type)},
+		{bucketUsers, []byte(r.User)},
+	}
+
+	network, ok, err := networkKey(r)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		indexes = append(indexes, [2][]byte{bucketNetworks, network})
+	}
+
+	return indexes, nil
+}
+
+func (s *Bolt) put(tx *bolt.Tx, r *provision.Reservation) error {
+	// drop the indexes of the previous version of the reservation
+	if err := s.remove(tx, r.ID); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	id := []byte(r.ID)
+	if err := tx.Bucket(bucketReservations).Put(id, data); err != nil {
+		return err
+	}
+
+	indexes, err := s.indexes(r)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		bucket, err := tx.Bucket(index[0]).CreateBucketIfNotExists(index[1])
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(id, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(bucketExpiry).Put(expiryKey(r), id)
+}
+
+func (s *Bolt) remove(tx *bolt.Tx, id string) error {
+	r, err := s.get(tx, id)
+	if err != nil {
+		// nothing to remove
+		return nil
+	}
+
+	indexes, err := s.indexes(r)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		parent := tx.Bucket(index[0])
+		bucket := parent.Bucket(index[1])
+		if bucket == nil {
+			continue
+		}
+		if err := bucket.Delete([]byte(id)); err != nil {
+			return err
+		}
+		// don't keep empty buckets around
+		if k, _ := bucket.Cursor().First(); k == nil {
+			if err := parent.DeleteBucket(index[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Bucket(bucketExpiry).Delete(expiryKey(r)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketReservations).Delete([]byte(id))
+}
+
+func (s *Bolt) get(tx *bolt.Tx, id string) (*provision.Reservation, error) {
+	data := tx.Bucket(bucketReservations).Get([]byte(id))
+	if data == nil {
+		return nil, fmt.Errorf("reservation %s not found", id)
+	}
+
+	var r provision.Reservation
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode reservation %s", id)
+	}
+
+	return &r, nil
+}
+
+func (s *Bolt) list(tx *bolt.Tx) ([]*provision.Reservation, error) {
+	var reservations []*provision.Reservation
+	err := tx.Bucket(bucketReservations).ForEach(func(k, v []byte) error {
+		var r provision.Reservation
+		if err := json.Unmarshal(v, &r); err != nil {
+			return errors.Wrapf(err, "failed to decode reservation %s", k)
+		}
+		reservations = append(reservations, &r)
+		return nil
+	})
+
+	return reservations, err
+}
+
+// lookup returns the reservations listed in the index bucket
+func (s *Bolt) lookup(tx *bolt.Tx, index []byte, key string) ([]*provision.Reservation, error) {
+	bucket := tx.Bucket(index).Bucket([]byte(key))
+	if bucket == nil {
+		return nil, nil
+	}
+
+	var reservations []*provision.Reservation
+	err := bucket.ForEach(func(k, v []byte) error {
+		r, err := s.get(tx, string(v))
+		if err != nil {
+			return err
+		}
+		reservations = append(reservations, r)
+		return nil
+	})
+
+	return reservations, err
+}
+
+// Add a reservation to the store
+func (s *Bolt) Add(r *provision.Reservation) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketReservations).Get([]byte(r.ID)) != nil {
+			return fmt.Errorf("reservation %s already in the store", r.ID)
+		}
+
+		return s.put(tx, r)
+	})
+}
+
+// Update overwrites a reservation already in the store
+func (s *Bolt) Update(r *provision.Reservation) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, r)
+	})
+}
+
+// Get retrieves a specific reservation using its ID
+// if returns a non nil error if the reservation is not present in the store
+func (s *Bolt) Get(id string) (r *provision.Reservation, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		r, err = s.get(tx, id)
+		return err
+	})
+
+	return r, err
+}
+
+// List returns all the reservations in the store
+func (s *Bolt) List() (reservations []*provision.Reservation, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		reservations, err = s.list(tx)
+		return err
+	})
+
+	return reservations, err
+}
+
+// Find returns the reservations that match the filter
+// using the type and user indexes
+func (s *Bolt) Find(filter pkg.ReservationFilter) (reservations []*provision.Reservation, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		switch {
+		case filter.Type != "":
+			reservations, err = s.lookup(tx, bucketTypes, filter.Type)
+		case filter.User != "":
+			reservations, err = s.lookup(tx, bucketUsers, filter.User)
+		default:
+			reservations, err = s.list(tx)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matching := reservations[:0]
+	for _, r := range reservations {
+		if provision.Matches(filter, r) {
+			matching = append(matching, r)
+		}
+	}
+
+	return matching, nil
+}
+
+// Remove a reservation from the store
+func (s *Bolt) Remove(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.remove(tx, id)
+	})
+}
+
+// Exists checks if the reservation ID is in the store
+func (s *Bolt) Exists(id string) (exists bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(bucketReservations).Get([]byte(id)) != nil
+		return nil
+	})
+
+	return exists, err
+}
+
+// NetworkExists exists checks if a network exists in cache already
+func (s *Bolt) NetworkExists(id string) (exists bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(bucketNetworks).Bucket([]byte(id)) != nil
+		return nil
+	})
+
+	return exists, err
+}
+
+// GetExpired returns all id the the reservations that are expired
+// at the time of the function call
+func (s *Bolt) GetExpired() (reservations []*provision.Reservation, err error) {
+	now := make([]byte, 8)
+	binary.BigEndian.PutUint64(now, uint64(time.Now().Unix()))
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketExpiry).Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], now) <= 0; k, v = c.Next() {
+			r, err := s.get(tx, string(v))
+			if err != nil {
+				return err
+			}
+
+			if r.Expired() {
+				reservations = append(reservations, r)
+			}
+		}
+		return nil
+	})
+
+	return reservations, err
+}
+
+// GetAttempt implements provision.AttemptStore
+func (s *Bolt) GetAttempt(id string) (attempt provision.Attempt, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketAttempts).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+
+		ok = true
+		return json.Unmarshal(data, &attempt)
+	})
+
+	return attempt, ok, err
+}
+
+// SetAttempt implements provision.AttemptStore
+func (s *Bolt) SetAttempt(attempt provision.Attempt) error {
+	data, err := json.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAttempts).Put([]byte(attempt.ID), data)
+	})
+}
+
+// PruneAttempts implements provision.AttemptStore
+func (s *Bolt) PruneAttempts(t time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAttempts)
+
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var attempt provision.Attempt
+			if err := json.Unmarshal(v, &attempt); err != nil {
+				return errors.Wrapf(err, "failed to decode attempt %s", k)
+			}
+
+			if attempt.Expires.Before(t) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// keys can't be deleted while iterating
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Sync update the statser with all the reservation present in the cache
+func (s *Bolt) Sync(statser provision.Statser) error {
+	reservations, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	return incrementCounters(reservations, statser)
+}
+
+// Close makes sure the backend of the store is closed properly
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
@@ -154,7 +154,12 @@ func (s *Fs) Sync(statser provision.Statser) error {
 	s.RLock()
 	defer s.RUnlock()
 
-	return s.incrementCounters(statser)
+	reservations, err := s.list()
+	if err != nil {
+		return err
+	}
+
+	return incrementCounters(reservations, statser)
 }
 
 // Add a reservation to the store
@@ -162,6 +167,11 @@ func (s *Fs) Add(r *provision.Reservation) error {
 	return s.add(r, false)
 }
 
+// Update overwrites a reservation already in the store
+func (s *Fs) Update(r *provision.Reservation) error {
+	return s.add(r, true)
+}
+
 // Add a reservation to the store
 func (s *Fs) add(r *provision.Reservation, update bool) error {
 	s.Lock()
@@ -173,7 +183,9 @@ func (s *Fs) add(r *provision.Reservation, update bool) error {
 	}
 
 	flags := os.O_CREATE | os.O_WRONLY
-	if !update {
+	if update {
+		flags |= os.O_TRUNC
+	} else {
 		flags |= os.O_EXCL
 	}
 	f, err := os.OpenFile(filepath.Join(s.root, r.ID), flags, 0660)
@@ -310,6 +322,11 @@ func (s *Fs) NetworkExists(id string) (bool, error) {
 	return false, nil
 }
 
+// List returns all the reservations in the store
+func (s *Fs) List() ([]*provision.Reservation, error) {
+	return s.list()
+}
+
 func (s *Fs) list() ([]*provision.Reservation, error) {
 	s.RLock()
 	defer s.RUnlock()
@@ -337,14 +354,9 @@ func (s *Fs) list() ([]*provision.Reservation, error) {
 
 // incrementCounters will increment counters for all workloads
 // for network workloads it will only increment those that have a unique name
-func (s *Fs) incrementCounters(statser provision.Statser) error {
+func incrementCounters(reservations []*provision.Reservation, statser provision.Statser) error {
 	uniqueNetworkReservations := make(map[pkg.NetID]*provision.Reservation)
 
-	reservations, err := s.list()
-	if err != nil {
-		return err
-	}
-
 	for _, r := range reservations {
 		if r.Expired() || r.Result.State != provision.StateOk {
 			continue
@@ -106,3 +106,35 @@ func TestLocalStore(t *testing.T) {
 		})
 	}
 }
+
+func TestLocalStoreUpdate(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	s := &Fs{
+		root: root,
+	}
+
+	r := &provision.Reservation{
+		ID:       "1-1",
+		Created:  time.Now().UTC().Round(time.Second),
+		Duration: time.Hour,
+		Data:     json.RawMessage(`{"size": 10, "type": "ssd", "padding": "some long content"}`),
+		Type:     "volume",
+		User:     "1",
+	}
+
+	require.NoError(t, s.Add(r))
+	require.Error(t, s.Add(r))
+
+	updated := *r
+	updated.WorkloadVersion = 1
+	updated.Data = json.RawMessage(`{"size":20,"type":"ssd"}`)
+	require.NoError(t, s.Update(&updated))
+
+	actual, err := s.Get(r.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, actual.WorkloadVersion)
+	assert.Equal(t, updated.Data, actual.Data)
+}
@@ -0,0 +1,277 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+type countingStatser struct {
+	provision.Statser
+	counted []string
+}
+
+func (c *countingStatser) Increment(r *provision.Reservation) error {
+	c.counted = append(c.counted, r.ID)
+	return nil
+}
+
+type testStore interface {
+	provision.ReservationCache
+	GetExpired() ([]*provision.Reservation, error)
+}
+
+func ids(reservations []*provision.Reservation) []string {
+	var ids []string
+	for _, r := range reservations {
+		ids = append(ids, r.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func testReservations(t *testing.T) []*provision.Reservation {
+	network, err := json.Marshal(pkg.NetResource{Name: "tf_devnet"})
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Round(time.Second)
+	ok := provision.Result{State: provision.StateOk, Created: now}
+	return []*provision.Reservation{
+		{ID: "1-1", User: "1", Type: "network", Data: network, Created: now, Duration: time.Hour, Result: ok},
+		{ID: "2-1", User: "1", Type: "network", Data: network, Created: now, Duration: time.Hour, Result: ok},
+		{ID: "3-1", User: "1", Type: "container", Data: json.RawMessage(`{}`), Created: now, Duration: time.Hour, Result: ok},
+		{ID: "4-1", User: "2", Type: "volume", Data: json.RawMessage(`{}`), Created: now.Add(-time.Hour), Duration: time.Minute, Result: ok},
+		{ID: "5-1", User: "2", Type: "container", Data: json.RawMessage(`{}`), Created: now, Duration: time.Hour},
+	}
+}
+
+// testReservationCache runs the same scenario against all the cache backends
+func testReservationCache(t *testing.T, s testStore) {
+	require := require.New(t)
+
+	reservations := testReservations(t)
+	for _, r := range reservations {
+		require.NoError(s.Add(r))
+	}
+	require.Error(s.Add(reservations[0]), "duplicate reservation")
+
+	actual, err := s.Get("3-1")
+	require.NoError(err)
+	require.Equal(reservations[2].Created, actual.Created)
+	require.Equal(reservations[2].Duration, actual.Duration)
+	require.Equal("1", actual.User)
+
+	_, err = s.Get("foo")
+	require.Error(err)
+
+	exists, err := s.Exists("3-1")
+	require.NoError(err)
+	require.True(exists)
+
+	exists, err = s.Exists("foo")
+	require.NoError(err)
+	require.False(exists)
+
+	all, err := s.List()
+	require.NoError(err)
+	require.Equal([]string{"1-1", "2-1", "3-1", "4-1", "5-1"}, ids(all))
+
+	expired, err := s.GetExpired()
+	require.NoError(err)
+	require.Equal([]string{"4-1"}, ids(expired))
+
+	exists, err = s.NetworkExists(string(provision.NetworkID("1", "tf_devnet")))
+	require.NoError(err)
+	require.True(exists)
+
+	exists, err = s.NetworkExists(string(provision.NetworkID("2", "tf_devnet")))
+	require.NoError(err)
+	require.False(exists)
+
+	// the network is only counted once, the expired and failed reservations are skipped
+	var statser countingStatser
+	require.NoError(s.Sync(&statser))
+	require.Len(statser.counted, 2)
+	require.Contains(statser.counted, "3-1")
+
+	updated := *reservations[4]
+	updated.WorkloadVersion = 1
+	updated.Created = updated.Created.Add(-2 * time.Hour)
+	require.NoError(s.Update(&updated))
+
+	actual, err = s.Get("5-1")
+	require.NoError(err)
+	require.Equal(1, actual.WorkloadVersion)
+
+	expired, err = s.GetExpired()
+	require.NoError(err)
+	require.Equal([]string{"4-1", "5-1"}, ids(expired))
+
+	// the network still exists as long as one of its reservations is there
+	require.NoError(s.Remove("1-1"))
+	exists, err = s.NetworkExists(string(provision.NetworkID("1", "tf_devnet")))
+	require.NoError(err)
+	require.True(exists)
+
+	require.NoError(s.Remove("2-1"))
+	exists, err = s.NetworkExists(string(provision.NetworkID("1", "tf_devnet")))
+	require.NoError(err)
+	require.False(exists)
+
+	require.NoError(s.Remove("foo"), "removing a missing reservation")
+
+	all, err = s.List()
+	require.NoError(err)
+	require.Equal([]string{"3-1", "4-1", "5-1"}, ids(all))
+}
+
+func TestReservationCache(t *testing.T) {
+	t.Run("fs", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(root)
+
+		testReservationCache(t, &Fs{root: root})
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "")
+		require.NoError(t, err)
+		defer os.RemoveAll(root)
+
+		s, err := openBolt(filepath.Join(root, "reservations.db"))
+		require.NoError(t, err)
+		defer s.Close()
+
+		testReservationCache(t, s)
+	})
+}
+
+func TestBoltFind(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	s, err := openBolt(filepath.Join(root, "reservations.db"))
+	require.NoError(err)
+	defer s.Close()
+
+	for _, r := range testReservations(t) {
+		require.NoError(s.Add(r))
+	}
+
+	found, err := s.Find(pkg.ReservationFilter{Type: "container"})
+	require.NoError(err)
+	require.Equal([]string{"3-1", "5-1"}, ids(found))
+
+	found, err = s.Find(pkg.ReservationFilter{User: "2"})
+	require.NoError(err)
+	require.Equal([]string{"4-1", "5-1"}, ids(found))
+
+	found, err = s.Find(pkg.ReservationFilter{Type: "container", User: "2"})
+	require.NoError(err)
+	require.Equal([]string{"5-1"}, ids(found))
+
+	found, err = s.Find(pkg.ReservationFilter{Type: "zdb"})
+	require.NoError(err)
+	require.Empty(found)
+
+	require.NoError(s.Remove("5-1"))
+	found, err = s.Find(pkg.ReservationFilter{User: "2"})
+	require.NoError(err)
+	require.Equal([]string{"4-1"}, ids(found))
+}
+
+func TestBoltMigrate(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	fsRoot := filepath.Join(root, "reservations")
+	require.NoError(os.Mkdir(fsRoot, 0770))
+
+	fs := &Fs{root: fsRoot}
+	reservations := testReservations(t)
+	for _, r := range reservations {
+		require.NoError(fs.Add(r))
+	}
+
+	s, err := openBolt(filepath.Join(root, "reservations.db"))
+	require.NoError(err)
+	defer s.Close()
+
+	require.NoError(s.migrate(fsRoot))
+
+	all, err := s.List()
+	require.NoError(err)
+	require.Equal(ids(reservations), ids(all))
+
+	exists, err := s.NetworkExists(string(provision.NetworkID("1", "tf_devnet")))
+	require.NoError(err)
+	require.True(exists)
+
+	_, err = os.Stat(fsRoot)
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(fsRoot + ".migrated")
+	require.NoError(err)
+
+	// the migration only happens once
+	require.NoError(s.migrate(fsRoot))
+	all, err = s.List()
+	require.NoError(err)
+	require.Len(all, len(reservations))
+}
+
+func TestBoltAttempts(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "reservations.db")
+	s, err := openBolt(path)
+	require.NoError(err)
+
+	_, ok, err := s.GetAttempt("1-1")
+	require.NoError(err)
+	require.False(ok)
+
+	now := time.Now()
+	require.NoError(s.SetAttempt(provision.Attempt{ID: "1-1", State: provision.AttemptFailed, Expires: now.Add(-time.Hour)}))
+	require.NoError(s.SetAttempt(provision.Attempt{ID: "2-1", State: provision.AttemptDecommissioned, Expires: now.Add(time.Hour)}))
+
+	// attempts survive a restart
+	require.NoError(s.Close())
+	s, err = openBolt(path)
+	require.NoError(err)
+	defer s.Close()
+
+	attempt, ok, err := s.GetAttempt("1-1")
+	require.NoError(err)
+	require.True(ok)
+	require.Equal(provision.AttemptFailed, attempt.State)
+
+	require.NoError(s.PruneAttempts(now))
+
+	_, ok, err = s.GetAttempt("1-1")
+	require.NoError(err)
+	require.False(ok)
+
+	attempt, ok, err = s.GetAttempt("2-1")
+	require.NoError(err)
+	require.True(ok)
+	require.Equal(provision.AttemptDecommissioned, attempt.State)
+}
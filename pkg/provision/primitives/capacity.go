@@ -0,0 +1,330 @@
+package primitives
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/threefoldtech/zbus"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/stubs"
+)
+
+// Capacity checks that a reservation is valid and that the node has enough
+// free resources to provision it. It implements provision.CapacityChecker
+type Capacity struct {
+	counters *Counters
+	cache    interface {
+		List() ([]*provision.Reservation, error)
+	}
+	storage interface {
+		Total(kind pkg.DeviceType) (uint64, error)
+	}
+	network interface {
+		PublicIPv4Support() bool
+		WireguardPorts() ([]uint, error)
+	}
+	cpus func() (uint64, error)
+}
+
+// NewCapacity creates a capacity checker that compares the units counted by
+// counters with the total capacity of the node
+func NewCapacity(counters *Counters, cache provision.ReservationCache, zbus zbus.Client) *Capacity {
+	return &Capacity{
+		counters: counters,
+		cache:    cache,
+		storage:  stubs.NewStorageModuleStub(zbus),
+		network:  stubs.NewNetworkerStub(zbus),
+		cpus:     totalCPUs,
+	}
+}
+
+func totalCPUs() (uint64, error) {
+	n, err := cpu.Counts(true)
+	return uint64(n), err
+}
+
+// CanProvision implements provision.CapacityChecker. The memory is not
+// checked here since the engine already does it with CheckMemoryRequirements
+func (c *Capacity) CanProvision(r *provision.Reservation) error {
+	if err := validateReservation(r); err != nil {
+		return errors.Wrapf(err, "invalid reservation %s", r.ID)
+	}
+
+	if err := c.checkUnits(r); err != nil {
+		return err
+	}
+
+	switch r.Type {
+	case NetworkReservation, NetworkResourceReservation:
+		return c.checkWireguardPort(r)
+	case PublicIPReservation:
+		return c.checkPublicIP(r)
+	case KubernetesReservation, VirtualMachineReservation:
+		return c.checkVMPublicIP(r)
+	}
+
+	return nil
+}
+
+// validateReservation decodes the reservation data and validates it the same
+// way the provisioner of its type does
+func validateReservation(r *provision.Reservation) error {
+	switch r.Type {
+	case ContainerReservation:
+		var config Container
+		if err := json.Unmarshal(r.Data, &config); err != nil {
+			return errors.Wrap(err, "failed to decode reservation schema")
+		}
+		return validateContainerConfig(config)
+	case VolumeReservation:
+		var config Volume
+		if err := json.Unmarshal(r.Data, &config); err != nil {
+			return errors.Wrap(err, "failed to decode reservation schema")
+		}
+		return validateDiskType(config.Type)
+	case ZDBReservation:
+		var config ZDB
+		if err := json.Unmarshal(r.Data, &config); err != nil {
+			return errors.Wrap(err, "failed to decode reservation schema")
+		}
+		return validateDiskType(config.DiskType)
+	case NetworkReservation, NetworkResourceReservation:
+		var nr pkg.NetResource
+		if err := json.Unmarshal(r.Data, &nr); err != nil {
+			return fmt.Errorf("failed to unmarshal network from reservation: %w", err)
+		}
+		return nr.Valid()
+	case KubernetesReservation:
+		var config Kubernetes
+		if err := json.Unmarshal(r.Data, &config); err != nil {
+			return errors.Wrap(err, "failed to decode reservation schema")
+		}
+		return config.Validate()
+	case VirtualMachineReservation:
+		var config VM
+		if err := json.Unmarshal(r.Data, &config); err != nil {
+			return errors.Wrap(err, "failed to decode reservation schema")
+		}
+		return config.Validate()
+	case PublicIPReservation:
+		var config PublicIP
+		if err := json.Unmarshal(r.Data, &config); err != nil {
+			return errors.Wrap(err, "failed to decode reservation schema")
+		}
+		return config.Valid()
+	case SnapshotReservation:
+		var config Snapshot
+		if err := json.Unmarshal(r.Data, &config); err != nil {
+			return errors.Wrap(err, "failed to decode reservation schema")
+		}
+		return config.Valid()
+	case DiskReservation:
+		var config Disk
+		if err := json.Unmarshal(r.Data, &config); err != nil {
+			return errors.Wrap(err, "failed to decode reservation schema")
+		}
+		return config.Valid()
+	}
+
+	return nil
+}
+
+func validateDiskType(kind pkg.DeviceType) error {
+	if kind != pkg.SSDDevice && kind != pkg.HDDDevice {
+		return fmt.Errorf("unsupported disk type '%s'", kind)
+	}
+
+	return nil
+}
+
+// requestedUnits returns the units used by the reservation once deployed
+func requestedUnits(r *provision.Reservation) (resourceUnits, error) {
+	switch r.Type {
+	case VolumeReservation:
+		return processVolume(r)
+	case ContainerReservation:
+		return processContainer(r)
+	case ZDBReservation:
+		return processZdb(r)
+	case KubernetesReservation:
+		return processKubernetes(r)
+	case VirtualMachineReservation:
+		return processVM(r)
+	case SnapshotReservation:
+		return processSnapshot(r)
+	case DiskReservation:
+		return processDisk(r)
+	}
+
+	return resourceUnits{}, nil
+}
+
+// checkUnits makes sure the CPU, SSD and HDD units requested by the reservation
+// plus the ones already reserved don't exceed the capacity of the node
+func (c *Capacity) checkUnits(r *provision.Reservation) error {
+	u, err := requestedUnits(r)
+	if err != nil {
+		return err
+	}
+
+	// the cpus are only limited once the farmer sets an overcommit ratio, the
+	// nodes could reserve more cpus than they have before the ratio existed
+	if u.CRU != 0 && c.counters.policy.CPUOvercommit > 0 {
+		cpus, err := c.cpus()
+		if err != nil {
+			return errors.Wrap(err, "failed to get number of cpus")
+		}
+		// the farmer can allow more virtual cpus than the node has
+		total := c.counters.policy.cpus(cpus)
+		if c.counters.CRU.Current()+u.CRU > total {
+			return fmt.Errorf("not enough free cpus, %d requested, %d used of %d", u.CRU, c.counters.CRU.Current(), total)
+		}
+	}
+
+	if err := c.checkStorage(pkg.SSDDevice, u.SRU, c.counters.SRU.Current()); err != nil {
+		return err
+	}
+
+	return c.checkStorage(pkg.HDDDevice, u.HRU, c.counters.HRU.Current())
+}
+
+func (c *Capacity) checkStorage(kind pkg.DeviceType, requested, used uint64) error {
+	if requested == 0 {
+		return nil
+	}
+
+	total, err := c.storage.Total(kind)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get total %s storage", kind)
+	}
+
+	if used+requested > total {
+		return fmt.Errorf("not enough free %s storage, %d GiB requested, %d GiB used of %d GiB", kind, requested/gib, used/gib, total/gib)
+	}
+
+	return nil
+}
+
+// checkWireguardPort makes sure the wireguard listen port of the network
+// resource is free, unless it is already used by the deployed network
+// resource of the same network
+func (c *Capacity) checkWireguardPort(r *provision.Reservation) error {
+	var nr pkg.NetResource
+	if err := json.Unmarshal(r.Data, &nr); err != nil {
+		return fmt.Errorf("failed to unmarshal network from reservation: %w", err)
+	}
+
+	reservations, err := c.cache.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list cached reservations")
+	}
+
+	netID := provision.NetworkID(r.User, nr.Name)
+	for _, deployed := range reservations {
+		if deployed.Type != NetworkReservation && deployed.Type != NetworkResourceReservation {
+			continue
+		}
+
+		var current pkg.NetResource
+		if err := json.Unmarshal(deployed.Data, &current); err != nil {
+			continue
+		}
+
+		if provision.NetworkID(deployed.User, current.Name) == netID && current.WGListenPort == nr.WGListenPort {
+			return nil
+		}
+	}
+
+	ports, err := c.network.WireguardPorts()
+	if err != nil {
+		return errors.Wrap(err, "failed to list used wireguard ports")
+	}
+
+	for _, port := range ports {
+		if port == uint(nr.WGListenPort) {
+			return fmt.Errorf("wireguard listen port %d already in use", port)
+		}
+	}
+
+	return nil
+}
+
+// checkPublicIP makes sure the node supports public IPs and that the IP
+// is not used by another reservation
+func (c *Capacity) checkPublicIP(r *provision.Reservation) error {
+	if !c.network.PublicIPv4Support() {
+		return errors.New("public ip is not supported on this node")
+	}
+
+	var config PublicIP
+	if err := json.Unmarshal(r.Data, &config); err != nil {
+		return errors.Wrap(err, "failed to decode reservation schema")
+	}
+
+	reservations, err := c.cache.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list cached reservations")
+	}
+
+	for _, deployed := range reservations {
+		if deployed.Type != PublicIPReservation || deployed.ID == r.ID {
+			continue
+		}
+
+		var used PublicIP
+		if err := json.Unmarshal(deployed.Data, &used); err != nil {
+			return errors.Wrapf(err, "failed to decode reservation %s", deployed.ID)
+		}
+
+		if used.IP.IP.Equal(config.IP.IP) {
+			return fmt.Errorf("public ip %s already used by reservation %s", config.IP.IP, deployed.ID)
+		}
+	}
+
+	return nil
+}
+
+// checkVMPublicIP makes sure the public IP attached to a virtual machine
+// is not attached to another machine already
+func (c *Capacity) checkVMPublicIP(r *provision.Reservation) error {
+	var config VM
+	if err := json.Unmarshal(r.Data, &config); err != nil {
+		return errors.Wrap(err, "failed to decode reservation schema")
+	}
+
+	if config.PublicIP == 0 {
+		return nil
+	}
+
+	if !c.network.PublicIPv4Support() {
+		return errors.New("public ip is not supported on this node")
+	}
+
+	reservations, err := c.cache.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list cached reservations")
+	}
+
+	for _, deployed := range reservations {
+		if deployed.ID == r.ID {
+			continue
+		}
+		if deployed.Type != KubernetesReservation && deployed.Type != VirtualMachineReservation {
+			continue
+		}
+
+		var used VM
+		if err := json.Unmarshal(deployed.Data, &used); err != nil {
+			return errors.Wrapf(err, "failed to decode reservation %s", deployed.ID)
+		}
+
+		if used.PublicIP == config.PublicIP {
+			return fmt.Errorf("public ip %s already attached to reservation %s", pubIPResID(config.PublicIP), deployed.ID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package primitives
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/network/types"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+type capacityMock struct {
+	reservations []*provision.Reservation
+	ports        []uint
+	publicIP     bool
+}
+
+func (m *capacityMock) List() ([]*provision.Reservation, error) {
+	return m.reservations, nil
+}
+
+func (m *capacityMock) Total(kind pkg.DeviceType) (uint64, error) {
+	switch kind {
+	case pkg.SSDDevice:
+		return 100 * gib, nil
+	case pkg.HDDDevice:
+		return 1000 * gib, nil
+	}
+	return 0, fmt.Errorf("kind %+v unknown", kind)
+}
+
+func (m *capacityMock) PublicIPv4Support() bool {
+	return m.publicIP
+}
+
+func (m *capacityMock) WireguardPorts() ([]uint, error) {
+	return m.ports, nil
+}
+
+func newCapacity(m *capacityMock) *Capacity {
+	return &Capacity{
+		counters: &Counters{},
+		cache:    m,
+		storage:  m,
+		network:  m,
+		cpus:     func() (uint64, error) { return 4, nil },
+	}
+}
+
+func capacityReservation(t *testing.T, id string, typ provision.ReservationType, data interface{}) *provision.Reservation {
+	bytes, err := json.Marshal(data)
+	require.NoError(t, err)
+	return &provision.Reservation{ID: id, User: "user", Type: typ, Data: bytes}
+}
+
+func TestCapacityUnits(t *testing.T) {
+	c := newCapacity(&capacityMock{})
+
+	volume := func(size uint64, kind pkg.DeviceType) *provision.Reservation {
+		return capacityReservation(t, "1-1", VolumeReservation, Volume{Size: size, Type: kind})
+	}
+
+	require.NoError(t, c.CanProvision(volume(100, pkg.SSDDevice)))
+	require.Error(t, c.CanProvision(volume(101, pkg.SSDDevice)))
+	require.NoError(t, c.CanProvision(volume(1000, pkg.HDDDevice)))
+	require.Error(t, c.CanProvision(volume(10, "nvme")))
+
+	c.counters.SRU.Increment(90 * gib)
+	require.NoError(t, c.CanProvision(volume(10, pkg.SSDDevice)))
+	require.Error(t, c.CanProvision(volume(11, pkg.SSDDevice)))
+
+	vm := capacityReservation(t, "2-1", VirtualMachineReservation, VM{Size: 1, NetworkID: "net", IP: net.ParseIP("10.1.1.2")})
+	c.counters.SRU.Decrement(90 * gib)
+	c.counters.CRU.Increment(3)
+	require.NoError(t, c.CanProvision(vm))
+	c.counters.CRU.Increment(1)
+	// the cpus are not limited without overcommit ratio
+	require.NoError(t, c.CanProvision(vm))
+	c.counters.policy.CPUOvercommit = 1
+	require.Error(t, c.CanProvision(vm))
+}
+
+func TestCapacityValidate(t *testing.T) {
+	c := newCapacity(&capacityMock{})
+
+	container := Container{
+		FList: "https://hub.grid.tf/tf-official-apps/ubuntu.flist",
+		Network: Network{
+			NetworkID: "net",
+			IPs:       []net.IP{net.ParseIP("10.1.1.2")},
+		},
+		Capacity: ContainerCapacity{CPU: 1, Memory: 512},
+	}
+	require.NoError(t, c.CanProvision(capacityReservation(t, "1-1", ContainerReservation, container)))
+
+	container.FList = ""
+	require.Error(t, c.CanProvision(capacityReservation(t, "1-1", ContainerReservation, container)))
+
+	vm := VM{Size: 20, IP: net.ParseIP("10.1.1.2")}
+	require.Error(t, c.CanProvision(capacityReservation(t, "2-1", VirtualMachineReservation, vm)))
+
+	r := &provision.Reservation{ID: "3-1", Type: ZDBReservation, Data: json.RawMessage("not json")}
+	require.Error(t, c.CanProvision(r))
+}
+
+func TestCapacityWireguardPort(t *testing.T) {
+	m := &capacityMock{
+		ports: []uint{6000},
+	}
+	c := newCapacity(m)
+
+	nr := pkg.NetResource{
+		Name:           "net",
+		NetID:          "net",
+		NetworkIPRange: types.MustParseIPNet("10.1.0.0/16"),
+		NodeID:         "node",
+		Subnet:         types.MustParseIPNet("10.1.1.0/24"),
+		WGPrivateKey:   "key",
+		WGPublicKey:    "key",
+		WGListenPort:   6000,
+	}
+	r := capacityReservation(t, "1-1", NetworkResourceReservation, nr)
+	require.Error(t, c.CanProvision(r))
+
+	// the network resource is deployed with the port, its updates keep it
+	m.reservations = append(m.reservations, r)
+	require.NoError(t, c.CanProvision(r))
+	updated := *r
+	updated.WorkloadVersion = 1
+	require.NoError(t, c.CanProvision(&updated))
+	require.NoError(t, c.CanProvision(capacityReservation(t, "2-1", NetworkResourceReservation, nr)))
+
+	// the network of another user can't take it
+	other := capacityReservation(t, "3-1", NetworkResourceReservation, nr)
+	other.User = "other"
+	require.Error(t, c.CanProvision(other))
+
+	// nor another network of the user
+	nr.Name = "other"
+	require.Error(t, c.CanProvision(capacityReservation(t, "4-1", NetworkResourceReservation, nr)))
+
+	nr.WGListenPort = 6001
+	require.NoError(t, c.CanProvision(capacityReservation(t, "4-1", NetworkResourceReservation, nr)))
+}
+
+func TestCapacityPublicIP(t *testing.T) {
+	m := &capacityMock{}
+	c := newCapacity(m)
+
+	ip := func(id, value string) *provision.Reservation {
+		return capacityReservation(t, id, PublicIPReservation, PublicIP{
+			IP: net.IPNet{IP: net.ParseIP(value), Mask: net.CIDRMask(24, 32)},
+		})
+	}
+
+	require.Error(t, c.CanProvision(ip("1-1", "185.69.166.10")))
+
+	m.publicIP = true
+	m.reservations = append(m.reservations, ip("1-1", "185.69.166.10"))
+	require.NoError(t, c.CanProvision(ip("1-1", "185.69.166.10")))
+	require.Error(t, c.CanProvision(ip("2-1", "185.69.166.10")))
+	require.NoError(t, c.CanProvision(ip("2-1", "185.69.166.11")))
+
+	vm := func(id string) *provision.Reservation {
+		return capacityReservation(t, id, KubernetesReservation, Kubernetes{
+			VM: VM{Size: 1, NetworkID: "net", IP: net.ParseIP("10.1.1.2"), PublicIP: 1},
+		})
+	}
+
+	m.reservations = append(m.reservations, vm("3-1"))
+	require.NoError(t, c.CanProvision(vm("3-1")))
+	require.Error(t, c.CanProvision(vm("4-1")))
+}
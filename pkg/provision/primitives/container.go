@@ -212,6 +212,10 @@ func (p *Provisioner) containerProvisionImpl(ctx context.Context, reservation *p
 	for i, ip := range config.Network.IPs {
 		ips[i] = ip.String()
 	}
+	if err = provision.Step(ctx, stepNetwork); err != nil {
+		return ContainerResult{}, err
+	}
+
 	var join pkg.Member
 	join, err = networkMgr.Join(netID, containerID, pkg.ContainerNetworkConfig{
 		IPs:         ips,
@@ -248,10 +252,14 @@ func (p *Provisioner) containerProvisionImpl(ctx context.Context, reservation *p
 		rootfsMntOpt = pkg.DefaultMountOptions
 	}
 
+	if err = provision.Step(ctx, stepFList); err != nil {
+		return ContainerResult{}, err
+	}
+
 	var mnt string
 	mnt, err = flistClient.NamedMount(provision.FilesystemName(*reservation), config.FList, config.FlistStorage, rootfsMntOpt)
 	if err != nil {
-		return ContainerResult{}, err
+		return ContainerResult{}, flistError(err)
 	}
 
 	var elevated = false
@@ -297,6 +305,10 @@ func (p *Provisioner) containerProvisionImpl(ctx context.Context, reservation *p
 		}
 	}()
 
+	if err = provision.Step(ctx, stepContainer); err != nil {
+		return ContainerResult{}, err
+	}
+
 	var id pkg.ContainerID
 	id, err = containerClient.Run(
 		tenantNS,
@@ -289,6 +289,12 @@ func WireguardToProvisionType(p workloads.WireguardPeer) (pkg.Peer, error) {
 	return peer, nil
 }
 
+// challenger is implemented by the explorer workloads that can
+// compute the payload signed by the customer
+type challenger interface {
+	SignatureChallenge() ([]byte, error)
+}
+
 // WorkloadToProvisionType converts from the explorer type to the internal provision.Reservation
 func WorkloadToProvisionType(w workloads.Workloader) (*provision.Reservation, error) {
 	nextAction := w.GetNextAction()
@@ -302,7 +308,21 @@ func WorkloadToProvisionType(w workloads.Workloader) (*provision.Reservation, er
 		ToDelete:  nextAction == workloads.NextActionDelete || nextAction == workloads.NextActionDeleted,
 		Reference: w.GetReference(),
 		Result:    resultFromSchemaType(w.GetResult()),
-		Version:   w.GetVersion(),
+		// the explorer has no workload versions, WorkloadVersion is left to 0
+		// and the workloads are never updated in place
+		Version: w.GetVersion(),
+
+		SigningVersion: provision.SigningExplorer,
+	}
+
+	// the customer signature is computed by the explorer
+	// over the challenge of the workload
+	if c, ok := w.(challenger); ok {
+		challenge, err := c.SignatureChallenge()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to compute workload signature challenge")
+		}
+		reservation.SignatureChallenge = challenge
 	}
 
 	var (
@@ -383,12 +403,18 @@ func ResultToSchemaType(r provision.Result) (*workloads.Result, error) {
 		return nil, fmt.Errorf("unknown reservation type: %s", r.Type)
 	}
 
+	state := workloads.ResultStateEnum(r.State)
+	if r.State == provision.StateRejected {
+		// the explorer has no rejected state
+		state = workloads.ResultStateError
+	}
+
 	result := workloads.Result{
 		Category:   rType,
 		WorkloadId: r.ID,
 		DataJson:   r.Data,
 		Signature:  r.Signature,
-		State:      workloads.ResultStateEnum(r.State),
+		State:      state,
 		Message:    r.Error,
 		Epoch:      schema.Date{Time: r.Created},
 	}
@@ -3,6 +3,7 @@ package primitives
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 	"sync/atomic"
 
 	"github.com/pkg/errors"
@@ -68,6 +69,19 @@ type Counters struct {
 	HRU CounterUint64 // HDD storage in bytes
 	MRU CounterUint64 // Memory storage in bytes
 	CRU CounterUint64 // CPU count absolute
+
+	policy Policy
+	mu     sync.Mutex
+	users  map[string]*usage
+}
+
+// NewCounters creates counters that enforce the resources policy
+// set by the farmer. The zero value Counters has no quota and no overcommit
+func NewCounters(policy Policy) *Counters {
+	return &Counters{
+		policy: policy,
+		users:  make(map[string]*usage),
+	}
 }
 
 // CurrentWorkloads return the number of each workloads provisioned on the system
@@ -123,6 +137,10 @@ func (c *Counters) Increment(r *provision.Reservation) error {
 	case VirtualMachineReservation:
 		c.vms.Increment(1)
 		u, err = processVM(r)
+	case SnapshotReservation:
+		u, err = processSnapshot(r)
+	case DiskReservation:
+		u, err = processDisk(r)
 	case NetworkReservation, NetworkResourceReservation:
 		c.networks.Increment(1)
 		u = resourceUnits{}
@@ -139,6 +157,7 @@ func (c *Counters) Increment(r *provision.Reservation) error {
 	c.MRU.Increment(u.MRU)
 	c.SRU.Increment(u.SRU)
 	c.HRU.Increment(u.HRU)
+	c.account(r, u, true)
 
 	return nil
 }
@@ -167,6 +186,10 @@ func (c *Counters) Decrement(r *provision.Reservation) error {
 	case VirtualMachineReservation:
 		c.vms.Decrement(1)
 		u, err = processVM(r)
+	case SnapshotReservation:
+		u, err = processSnapshot(r)
+	case DiskReservation:
+		u, err = processDisk(r)
 	case NetworkReservation, NetworkResourceReservation:
 		c.networks.Decrement(1)
 		u = resourceUnits{}
@@ -183,6 +206,7 @@ func (c *Counters) Decrement(r *provision.Reservation) error {
 	c.MRU.Decrement(u.MRU)
 	c.SRU.Decrement(u.SRU)
 	c.HRU.Decrement(u.HRU)
+	c.account(r, u, false)
 
 	return nil
 }
@@ -247,6 +271,35 @@ func processVolume(r *provision.Reservation) (u resourceUnits, err error) {
 	return u, nil
 }
 
+func processSnapshot(r *provision.Reservation) (u resourceUnits, err error) {
+	var snapshot Snapshot
+	if err = json.Unmarshal(r.Data, &snapshot); err != nil {
+		return u, err
+	}
+
+	// snapshot.Size is in GiB
+	switch snapshot.DiskType {
+	case pkg.SSDDevice:
+		u.SRU = snapshot.Size * gib
+	case pkg.HDDDevice:
+		u.HRU = snapshot.Size * gib
+	}
+
+	return u, nil
+}
+
+func processDisk(r *provision.Reservation) (u resourceUnits, err error) {
+	var disk Disk
+	if err = json.Unmarshal(r.Data, &disk); err != nil {
+		return u, err
+	}
+
+	// disk.Size is in GiB, virtual disks are on SSD
+	u.SRU = disk.Size * gib
+
+	return u, nil
+}
+
 func processContainer(r *provision.Reservation) (u resourceUnits, err error) {
 	var cont Container
 	if err = json.Unmarshal(r.Data, &cont); err != nil {
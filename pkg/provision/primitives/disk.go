@@ -0,0 +1,178 @@
+package primitives
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/stubs"
+)
+
+// Disk is a virtual disk that can be attached to the virtual machines
+// of its user. It is kept when the virtual machines are decommissioned
+type Disk struct {
+	// Size of the disk in GiB
+	Size uint64 `json:"size"`
+}
+
+// Valid checks the disk schema
+func (d Disk) Valid() error {
+	if d.Size == 0 {
+		return fmt.Errorf("disk size is required")
+	}
+
+	return nil
+}
+
+// DiskResult is the information return to the BCDB
+// after deploying a disk
+type DiskResult struct {
+	ID string `json:"disk_id"`
+}
+
+func (p *Provisioner) diskProvision(ctx context.Context, reservation *provision.Reservation) (interface{}, error) {
+	return p.diskProvisionImpl(ctx, reservation)
+}
+
+func (p *Provisioner) diskProvisionImpl(ctx context.Context, reservation *provision.Reservation) (DiskResult, error) {
+	var config Disk
+	if err := json.Unmarshal(reservation.Data, &config); err != nil {
+		return DiskResult{}, errors.Wrap(err, "failed to decode reservation schema")
+	}
+
+	if err := config.Valid(); err != nil {
+		return DiskResult{}, err
+	}
+
+	storage := stubs.NewVDiskModuleStub(p.zbus)
+	name := provision.FilesystemName(*reservation)
+	result := DiskResult{ID: reservation.ID}
+
+	if storage.Exists(name) {
+		log.Info().Str("id", reservation.ID).Msg("disk already deployed")
+		return result, nil
+	}
+
+	// the size of a vdisk is in MiB
+	if _, err := storage.Allocate(name, int64(config.Size*1024), ""); err != nil {
+		return result, errors.Wrap(err, "failed to allocate disk")
+	}
+
+	return result, nil
+}
+
+// diskDecommission removes the disk. A disk still listed by a virtual
+// machine is not removed, it must be detached from the machine first
+func (p *Provisioner) diskDecommission(ctx context.Context, reservation *provision.Reservation) error {
+	var (
+		storage = stubs.NewVDiskModuleStub(p.zbus)
+		name    = provision.FilesystemName(*reservation)
+	)
+
+	reservations, err := p.cache.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list reservations")
+	}
+
+	if vms := vmsUsingDisk(reservations, reservation.ID); len(vms) > 0 {
+		ids := make([]string, len(vms))
+		for i, vm := range vms {
+			ids[i] = vm.ID
+		}
+		return fmt.Errorf("disk %s is attached to virtual machines %s, detach it before removing it", reservation.ID, strings.Join(ids, ", "))
+	}
+
+	if !storage.Exists(name) {
+		return nil
+	}
+
+	if err := storage.Deallocate(name); err != nil {
+		return errors.Wrapf(err, "failed to remove disk %s", name)
+	}
+
+	return nil
+}
+
+// vmsUsingDisk returns the virtual machines reservations that have
+// the disk id attached
+func vmsUsingDisk(reservations []*provision.Reservation, id string) []*provision.Reservation {
+	var vms []*provision.Reservation
+	for _, r := range reservations {
+		if r.Type != VirtualMachineReservation {
+			continue
+		}
+
+		var config VM
+		if err := json.Unmarshal(r.Data, &config); err != nil {
+			continue
+		}
+
+		for _, disk := range config.Disks {
+			if disk == id {
+				vms = append(vms, r)
+				break
+			}
+		}
+	}
+
+	return vms
+}
+
+// vmDisks returns the disks of the disk reservations ids, the
+// reservations must belong to user
+func (p *Provisioner) vmDisks(user string, ids []string) ([]pkg.VMDisk, error) {
+	storage := stubs.NewVDiskModuleStub(p.zbus)
+
+	disks := make([]pkg.VMDisk, 0, len(ids))
+	for _, id := range ids {
+		reservation, err := p.cache.Get(id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to retrieve disk %s", id)
+		}
+
+		if reservation.Type != DiskReservation || reservation.User != user {
+			return nil, fmt.Errorf("cannot attach disk %s, user %s is not the owner of it", id, user)
+		}
+
+		info, err := storage.Inspect(provision.FilesystemName(*reservation))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find disk %s", id)
+		}
+
+		disks = append(disks, pkg.VMDisk{Path: info.Path})
+	}
+
+	return disks, nil
+}
+
+// vmDiskChanges returns the disks to detach and attach to go from
+// the disks of the deployed vm to the disks of the new version
+func vmDiskChanges(deployed, config []string) (detach, attach []string) {
+	contains := func(ids []string, id string) bool {
+		for _, i := range ids {
+			if i == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, id := range deployed {
+		if !contains(config, id) {
+			detach = append(detach, id)
+		}
+	}
+
+	for _, id := range config {
+		if !contains(deployed, id) {
+			attach = append(attach, id)
+		}
+	}
+
+	return detach, attach
+}
@@ -0,0 +1,107 @@
+package primitives
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestDiskUnits(t *testing.T) {
+	require.Error(t, Disk{}.Valid())
+	require.NoError(t, Disk{Size: 10}.Valid())
+
+	r := capacityReservation(t, "1-1", DiskReservation, Disk{Size: 10})
+	u, err := processDisk(r)
+	require.NoError(t, err)
+	require.Equal(t, resourceUnits{SRU: 10 * gib}, u)
+
+	require.Equal(t, []string{"1-1"}, LockKeys(r))
+}
+
+func TestVMDisks(t *testing.T) {
+	vm := VM{
+		Size:      1,
+		NetworkID: "net",
+		IP:        net.ParseIP("10.0.0.2"),
+		Disks:     []string{"2-1", "3-1"},
+	}
+	require.NoError(t, vm.Validate())
+
+	r := capacityReservation(t, "1-1", VirtualMachineReservation, vm)
+	require.Equal(t, []string{
+		"network:" + string(provision.NetworkID("user", "net")),
+		"2-1",
+		"3-1",
+	}, LockKeys(r))
+
+	k8s := Kubernetes{VM: vm}
+	require.Error(t, k8s.Validate())
+
+	vm.Disks = []string{"2-1", "2-1"}
+	require.Error(t, vm.Validate())
+
+	vm.Disks = []string{""}
+	require.Error(t, vm.Validate())
+}
+
+func TestVMsUsingDisk(t *testing.T) {
+	vm := func(id string, disks ...string) *provision.Reservation {
+		return capacityReservation(t, id, VirtualMachineReservation, VM{Size: 1, Disks: disks})
+	}
+
+	reservations := []*provision.Reservation{
+		vm("1-1", "4-1"),
+		vm("2-1", "5-1", "4-1"),
+		vm("3-1"),
+		capacityReservation(t, "4-1", DiskReservation, Disk{Size: 10}),
+	}
+
+	using := vmsUsingDisk(reservations, "4-1")
+	require.Len(t, using, 2)
+	require.Equal(t, "1-1", using[0].ID)
+	require.Equal(t, "2-1", using[1].ID)
+
+	require.Empty(t, vmsUsingDisk(reservations, "6-1"))
+}
+
+func TestVMDiskChanges(t *testing.T) {
+	detach, attach := vmDiskChanges([]string{"1-1", "2-1"}, []string{"2-1", "3-1"})
+	require.Equal(t, []string{"1-1"}, detach)
+	require.Equal(t, []string{"3-1"}, attach)
+
+	detach, attach = vmDiskChanges(nil, nil)
+	require.Empty(t, detach)
+	require.Empty(t, attach)
+
+	// the disks of a vm can change with its size
+	deployed := VM{Size: 1, NetworkID: "net", IP: net.ParseIP("10.0.0.2"), Disks: []string{"1-1"}}
+	config := deployed
+	config.Disks = []string{"2-1"}
+	_, _, err := vmResize(config, deployed)
+	require.NoError(t, err)
+}
+
+type listCache struct {
+	provision.ReservationCache
+	reservations []*provision.Reservation
+}
+
+func (c *listCache) List() ([]*provision.Reservation, error) {
+	return c.reservations, nil
+}
+
+func TestDiskDecommissionAttached(t *testing.T) {
+	disk := capacityReservation(t, "4-1", DiskReservation, Disk{Size: 10})
+	cache := &listCache{reservations: []*provision.Reservation{
+		capacityReservation(t, "1-1", VirtualMachineReservation, VM{Size: 1, Disks: []string{"4-1"}}),
+		disk,
+	}}
+	p := &Provisioner{cache: cache}
+
+	err := p.diskDecommission(context.Background(), disk)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1-1")
+}
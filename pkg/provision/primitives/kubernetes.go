@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"regexp"
 	"strings"
 	"time"
 
@@ -19,6 +20,20 @@ import (
 type KubernetesResult struct {
 	ID string `json:"id"`
 	IP string `json:"ip"`
+	// IPs of the VM in all the private networks it is attached to
+	IPs []string `json:"ips,omitempty"`
+	// YggdrasilIP of the VM if it is attached to the yggdrasil network
+	YggdrasilIP string `json:"yggdrasil_ip,omitempty"`
+}
+
+func (r *KubernetesResult) setNetworks(cfg VM, taps vmTaps) {
+	for _, network := range cfg.Attachments() {
+		r.IPs = append(r.IPs, network.IP.String())
+	}
+
+	if cfg.YggdrasilIP {
+		r.YggdrasilIP = taps.ygg.IP.IP.String()
+	}
 }
 
 // KubernetesCustomSize type
@@ -47,19 +62,78 @@ type Kubernetes struct {
 // const k3osFlistURL = "https://hub.grid.tf/tf-official-apps/k3os.flist"
 const k3osFlistURL = "https://hub.grid.tf/lee/k3os-ch.flist"
 
+// k3osFlistPrefix is the prefix of the name the k3os flist is mounted under
+const k3osFlistPrefix = "k8s"
+
 func (p *Provisioner) kubernetesProvision(ctx context.Context, reservation *provision.Reservation) (interface{}, error) {
 	return p.kubernetesProvisionImpl(ctx, reservation)
 }
 
-func ensureFList(flister pkg.Flister, url string) (string, error) {
+// ensureFList mounts the flist at url under the name prefix:hash, so the
+// flists of different workload types never share a mount. If expected is
+// set, the hash of the mounted flist must match it, otherwise the flist is
+// unmounted. If the flist is still mounted under one of the legacy prefixes,
+// that mount is used instead so the workloads deployed before the prefix
+// changed don't mount it twice
+func ensureFList(flister pkg.Flister, prefix, url string, expected string, legacy ...string) (string, error) {
 	hash, err := flister.FlistHash(url)
 	if err != nil {
-		return "", err
+		return "", flistError(err)
+	}
+
+	name := fmt.Sprintf("%s:%s", prefix, hash)
+	for _, old := range legacy {
+		mounted := fmt.Sprintf("%s:%s", old, hash)
+		if _, err := flister.HashFromRootPath(mounted); err == nil {
+			name = mounted
+			break
+		}
+	}
+	// a mount used by other workloads is never unmounted
+	_, err = flister.HashFromRootPath(name)
+	existed := err == nil
+
+	path, err := flister.NamedMount(name, url, "", pkg.ReadOnlyMountOptions)
+	if err != nil {
+		return "", flistError(err)
 	}
 
-	name := fmt.Sprintf("k8s:%s", hash)
+	if expected == "" {
+		return path, nil
+	}
+
+	// the hub can change the flist between the two calls, so the hash
+	// is checked on the flist that is actually mounted
+	mounted, err := flister.HashFromRootPath(name)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to get the hash of flist %s", url)
+	} else if !strings.EqualFold(mounted, expected) {
+		err = fmt.Errorf("flist %s has hash %s, expected %s", url, mounted, expected)
+	} else {
+		return path, nil
+	}
+
+	if !existed {
+		if uerr := flister.NamedUmount(name); uerr != nil {
+			log.Error().Err(uerr).Str("name", name).Msg("failed to unmount flist")
+		}
+	}
+
+	return "", err
+}
+
+// flistUnreachable matches the errors flistd reports when the hub can't be
+// reached or fails to answer. flistd errors are only sent as text over zbus
+var flistUnreachable = regexp.MustCompile(`dial tcp|i/o timeout|connection refused|connection reset|no such host|Client\.Timeout exceeded|TLS handshake timeout|response: 5\d\d|fail to download flist: 5\d\d`)
+
+// flistError marks the failure to mount an flist as transient if
+// flistd could not reach the hub
+func flistError(err error) error {
+	if flistUnreachable.MatchString(err.Error()) {
+		return provision.Transient(err)
+	}
 
-	return flister.NamedMount(name, url, "", pkg.ReadOnlyMountOptions)
+	return err
 }
 
 func (p *Provisioner) kubernetesProvisionImpl(ctx context.Context, reservation *provision.Reservation) (result KubernetesResult, err error) {
@@ -87,19 +161,6 @@ func (p *Provisioner) kubernetesProvisionImpl(ctx context.Context, reservation *
 	if err = config.Validate(); err != nil {
 		return result, err
 	}
-	netID := provision.NetworkID(reservation.User, string(config.NetworkID))
-
-	// check if the network tap already exists
-	// if it does, it's most likely that a vm with the same network id and node id already exists
-	// this will cause the reservation to fail
-	exists, err := network.TapExists(netID)
-	if err != nil {
-		return result, errors.Wrap(err, "could not check if tap device exists")
-	}
-
-	if exists {
-		return result, errors.New("another vm with same network already exists")
-	}
 
 	// check if public ipv4 is supported, should this be requested
 	if config.PublicIP != 0 && !network.PublicIPv4Support() {
@@ -107,7 +168,7 @@ func (p *Provisioner) kubernetesProvisionImpl(ctx context.Context, reservation *
 	}
 
 	result.ID = reservation.ID
-	result.IP = config.IP.String()
+	result.IP = config.Attachments()[0].IP.String()
 
 	cpu, memory, disk, err := vmSize(config.VM)
 	if err != nil {
@@ -119,13 +180,16 @@ func (p *Provisioner) kubernetesProvisionImpl(ctx context.Context, reservation *
 		return result, nil
 	}
 
-	imagePath, err := ensureFList(flist, k3osFlistURL)
+	imagePath, err := ensureFList(flist, k3osFlistPrefix, k3osFlistURL, "")
 	if err != nil {
 		return result, errors.Wrap(err, "could not mount k3os flist")
 	}
 
 	var diskPath string
 	diskName := fmt.Sprintf("%s-%s", provision.FilesystemName(*reservation), "vda")
+	if err = provision.Step(ctx, stepDisk); err != nil {
+		return result, err
+	}
 	if storage.Exists(diskName) {
 		needsInstall = false
 		info, err := storage.Inspect(diskName)
@@ -146,37 +210,28 @@ func (p *Provisioner) kubernetesProvisionImpl(ctx context.Context, reservation *
 		}
 	}()
 
-	var iface string
-	iface, err = network.SetupTap(netID)
-	if err != nil {
-		return result, errors.Wrap(err, "could not set up tap device")
-	}
-
 	defer func() {
 		if err != nil {
-			_ = network.RemoveTap(netID)
+			_ = removeVMTaps(network, reservation, config.VM)
 		}
 	}()
 
-	var pubIface string
-	if config.PublicIP != 0 {
-		pubIface, err = network.SetupPubTap(pubIPResID(config.PublicIP))
-		if err != nil {
-			return result, errors.Wrap(err, "could not set up tap device for public network")
-		}
-
-		defer func() {
-			if err != nil {
-				_ = network.RemovePubTap(pubIPResID(config.PublicIP))
-			}
-		}()
+	var taps vmTaps
+	taps, err = p.setupVMTaps(ctx, reservation, config.VM)
+	if err != nil {
+		return result, err
 	}
 
 	var netInfo pkg.VMNetworkInfo
-	netInfo, err = p.buildNetworkInfo(ctx, reservation.Version, reservation.User, iface, pubIface, config.VM)
+	netInfo, err = p.buildNetworkInfo(ctx, reservation.Version, reservation.User, taps, config.VM)
 	if err != nil {
 		return result, errors.Wrap(err, "could not generate network info")
 	}
+	result.setNetworks(config.VM, taps)
+
+	if err = provision.Step(ctx, stepVM); err != nil {
+		return result, err
+	}
 
 	if needsInstall {
 		if err = p.kubernetesInstall(ctx, reservation.ID, cpu, memory, diskPath, imagePath, netInfo, config); err != nil {
@@ -308,6 +363,14 @@ func (k *Kubernetes) Validate() error {
 		return err
 	}
 
+	if k.CloudInit != nil {
+		return errors.New("cloud-init is not supported by kubernetes vms")
+	}
+
+	if len(k.Disks) != 0 {
+		return errors.New("disks can't be attached to kubernetes vms")
+	}
+
 	if strings.ContainsAny(k.PlainClusterSecret, " \t\r\n\f") {
 		return errors.New("cluster secret shouldn't contain whitespace chars")
 	}
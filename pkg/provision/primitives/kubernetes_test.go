@@ -0,0 +1,91 @@
+package primitives
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestFlistError(t *testing.T) {
+	for _, msg := range []string{
+		`Get "https://hub.grid.tf/tf-official-apps/ubuntu.flist.md5": dial tcp 185.69.166.120:443: connect: connection refused`,
+		`Get "https://hub.grid.tf/tf-official-apps/ubuntu.flist": net/http: request canceled (Client.Timeout exceeded while awaiting headers)`,
+		`Get "https://hub.grid.tf/tf-official-apps/ubuntu.flist": dial tcp: lookup hub.grid.tf: no such host`,
+		"fail to fetch hash, response: 502",
+		"fail to download flist: 503 Service Unavailable",
+	} {
+		require.True(t, provision.IsTransient(flistError(fmt.Errorf(msg))), msg)
+	}
+
+	for _, msg := range []string{
+		"fail to fetch hash, response: 404",
+		"fail to download flist: 404 Not Found",
+		"invalid mount option, missing disk type and/or size",
+	} {
+		require.False(t, provision.IsTransient(flistError(fmt.Errorf(msg))), msg)
+	}
+}
+
+// testFlister knows the flists mounted by name. The hub reports hash
+// but the flists are mounted with the hash served
+type testFlister struct {
+	pkg.Flister
+	hash    string
+	served  string
+	mounted map[string]string
+}
+
+func (f *testFlister) FlistHash(url string) (string, error) {
+	return f.hash, nil
+}
+
+func (f *testFlister) HashFromRootPath(name string) (string, error) {
+	hash, ok := f.mounted[name]
+	if !ok {
+		return "", fmt.Errorf("%s not found", name)
+	}
+	return hash, nil
+}
+
+func (f *testFlister) NamedMount(name, url, storage string, opts pkg.MountOptions) (string, error) {
+	if _, ok := f.mounted[name]; !ok {
+		f.mounted[name] = f.served
+	}
+	return "/mnt/" + name, nil
+}
+
+func (f *testFlister) NamedUmount(name string) error {
+	delete(f.mounted, name)
+	return nil
+}
+
+func TestEnsureFList(t *testing.T) {
+	require := require.New(t)
+	flister := &testFlister{hash: "abc", served: "abc", mounted: map[string]string{}}
+
+	path, err := ensureFList(flister, vmFlistPrefix, "url", "ABC", vmLegacyFlistPrefix)
+	require.NoError(err)
+	require.Equal("/mnt/vm:abc", path)
+
+	// a mount used by another workload is kept
+	_, err = ensureFList(flister, vmFlistPrefix, "url", "other", vmLegacyFlistPrefix)
+	require.Error(err)
+	require.Contains(flister.mounted, "vm:abc")
+
+	// the hub served another flist than the one it reported
+	flister.mounted = map[string]string{}
+	flister.served = "def"
+	_, err = ensureFList(flister, vmFlistPrefix, "url", "abc", vmLegacyFlistPrefix)
+	require.Error(err)
+	require.Empty(flister.mounted)
+
+	// a vm deployed before the vm prefix keeps its mount
+	flister.mounted = map[string]string{"k8s:abc": "abc"}
+	path, err = ensureFList(flister, vmFlistPrefix, "url", "", vmLegacyFlistPrefix)
+	require.NoError(err)
+	require.Equal("/mnt/k8s:abc", path)
+	require.Len(flister.mounted, 1)
+}
@@ -41,6 +41,26 @@ func (p *Provisioner) networkProvision(ctx context.Context, reservation *provisi
 	return nil, p.networkProvisionImpl(ctx, reservation)
 }
 
+// networkUpdate applies changes (peers, wireguard port, etc...) to
+// an existing network resource
+func (p *Provisioner) networkUpdate(ctx context.Context, reservation, current *provision.Reservation) (interface{}, error) {
+	var nr, deployed pkg.NetResource
+	if err := json.Unmarshal(reservation.Data, &nr); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal network from reservation: %w", err)
+	}
+
+	if err := json.Unmarshal(current.Data, &deployed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal network from reservation: %w", err)
+	}
+
+	if nr.Name != deployed.Name {
+		return nil, fmt.Errorf("cannot rename network %s to %s", deployed.Name, nr.Name)
+	}
+
+	// creating an existing network resource updates it in place
+	return nil, p.networkProvisionImpl(ctx, reservation)
+}
+
 func (p *Provisioner) networkDecommission(ctx context.Context, reservation *provision.Reservation) error {
 	mgr := stubs.NewNetworkerStub(p.zbus)
 
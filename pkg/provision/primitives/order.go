@@ -1,6 +1,11 @@
 package primitives
 
-import "github.com/threefoldtech/zos/pkg/provision"
+import (
+	"encoding/json"
+
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
 
 const (
 	// ContainerReservation type
@@ -21,6 +26,10 @@ const (
 	PublicIPReservation provision.ReservationType = "public_ip"
 	// VirtualMachineReservation type
 	VirtualMachineReservation provision.ReservationType = "virtual_machine"
+	// SnapshotReservation type
+	SnapshotReservation provision.ReservationType = "snapshot"
+	// DiskReservation type
+	DiskReservation provision.ReservationType = "disk"
 )
 
 // ProvisionOrder is used to sort the workload type
@@ -31,8 +40,61 @@ var ProvisionOrder = map[provision.ReservationType]int{
 	NetworkResourceReservation: 2,
 	ZDBReservation:             3,
 	VolumeReservation:          4,
+	DiskReservation:            4,
 	ContainerReservation:       5,
 	PublicIPReservation:        6,
 	KubernetesReservation:      7,
 	VirtualMachineReservation:  8,
+	SnapshotReservation:        9,
+}
+
+// LockKeys returns the resources touched by a reservation so the provision
+// engine never processes two reservations that share a resource (the same
+// network, volume or public ip) at the same time
+func LockKeys(r *provision.Reservation) []string {
+	var keys []string
+
+	network := func(name string) {
+		if name == "" {
+			return
+		}
+		keys = append(keys, "network:"+string(provision.NetworkID(r.User, name)))
+	}
+
+	switch r.Type {
+	case NetworkReservation, NetworkResourceReservation:
+		var nr pkg.NetResource
+		if err := json.Unmarshal(r.Data, &nr); err == nil {
+			network(nr.Name)
+		}
+	case ContainerReservation:
+		var container Container
+		if err := json.Unmarshal(r.Data, &container); err == nil {
+			network(string(container.Network.NetworkID))
+			for _, mount := range container.Mounts {
+				keys = append(keys, mount.VolumeID)
+			}
+		}
+	case KubernetesReservation, VirtualMachineReservation:
+		// the kubernetes reservation inlines the VM fields
+		var vm VM
+		if err := json.Unmarshal(r.Data, &vm); err == nil {
+			for _, attachment := range vm.Attachments() {
+				network(string(attachment.NetworkID))
+			}
+			if vm.PublicIP != 0 {
+				keys = append(keys, pubIPResID(vm.PublicIP))
+			}
+			keys = append(keys, vm.Disks...)
+		}
+	case DiskReservation:
+		keys = append(keys, r.ID)
+	case SnapshotReservation:
+		var snapshot Snapshot
+		if err := json.Unmarshal(r.Data, &snapshot); err == nil && snapshot.Source != "" {
+			keys = append(keys, snapshot.Source)
+		}
+	}
+
+	return keys
 }
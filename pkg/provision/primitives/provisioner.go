@@ -15,6 +15,11 @@ type Provisioner struct {
 
 	Provisioners    map[provision.ReservationType]provision.ProvisionerFunc
 	Decommissioners map[provision.ReservationType]provision.DecomissionerFunc
+	Updaters        map[provision.ReservationType]provision.UpdaterFunc
+	Rollbacks       map[provision.ReservationType]provision.RollbackFunc
+	Checkers        map[provision.ReservationType]provision.StatusCheckerFunc
+	Suspenders      map[provision.ReservationType]provision.SuspenderFunc
+	Resumers        map[provision.ReservationType]provision.ResumerFunc
 }
 
 // NewProvisioner creates a new 0-OS provisioner
@@ -33,6 +38,8 @@ func NewProvisioner(cache provision.ReservationCache, zbus zbus.Client) *Provisi
 		KubernetesReservation:      p.kubernetesProvision,
 		PublicIPReservation:        p.publicIPProvision,
 		VirtualMachineReservation:  p.virtualMachineProvision,
+		SnapshotReservation:        p.snapshotProvision,
+		DiskReservation:            p.diskProvision,
 	}
 	p.Decommissioners = map[provision.ReservationType]provision.DecomissionerFunc{
 		ContainerReservation:       p.containerDecommission,
@@ -44,6 +51,40 @@ func NewProvisioner(cache provision.ReservationCache, zbus zbus.Client) *Provisi
 		KubernetesReservation:      p.vmDecomission,
 		PublicIPReservation:        p.publicIPDecomission,
 		VirtualMachineReservation:  p.vmDecomission,
+		SnapshotReservation:        p.snapshotDecommission,
+		DiskReservation:            p.diskDecommission,
+	}
+	p.Updaters = map[provision.ReservationType]provision.UpdaterFunc{
+		VolumeReservation:          p.volumeUpdate,
+		NetworkReservation:         p.networkUpdate,
+		NetworkResourceReservation: p.networkUpdate,
+		ZDBReservation:             p.zdbUpdate,
+		VirtualMachineReservation:  p.vmUpdate,
+	}
+	p.Rollbacks = map[provision.ReservationType]provision.RollbackFunc{
+		ContainerReservation:      p.containerRollback,
+		ZDBReservation:            p.zdbRollback,
+		KubernetesReservation:     p.vmRollback,
+		VirtualMachineReservation: p.vmRollback,
+		SnapshotReservation:       p.snapshotRollback,
+	}
+	p.Checkers = map[provision.ReservationType]provision.StatusCheckerFunc{
+		ContainerReservation:      p.containerStatus,
+		ZDBReservation:            p.zdbStatus,
+		KubernetesReservation:     p.vmStatus,
+		VirtualMachineReservation: p.vmStatus,
+	}
+	p.Suspenders = map[provision.ReservationType]provision.SuspenderFunc{
+		ContainerReservation:      p.containerSuspend,
+		ZDBReservation:            p.zdbSuspend,
+		KubernetesReservation:     p.vmSuspend,
+		VirtualMachineReservation: p.vmSuspend,
+	}
+	p.Resumers = map[provision.ReservationType]provision.ResumerFunc{
+		ContainerReservation:      p.containerResume,
+		ZDBReservation:            p.zdbResume,
+		KubernetesReservation:     p.vmResume,
+		VirtualMachineReservation: p.vmResume,
 	}
 
 	return p
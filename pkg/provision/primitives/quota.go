@@ -0,0 +1,178 @@
+package primitives
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+// Quota limits the resources a single user can reserve on the node.
+// Zero values mean no limit
+type Quota struct {
+	// Containers is the max number of containers
+	Containers uint64 `toml:"containers"`
+	// MRU is the max amount of memory in GiB
+	MRU uint64 `toml:"mru"`
+	// SRU is the max amount of SSD storage in GiB
+	SRU uint64 `toml:"sru"`
+	// HRU is the max amount of HDD storage in GiB
+	HRU uint64 `toml:"hru"`
+}
+
+// Policy is the resources policy set by the farmer
+type Policy struct {
+	// CPUOvercommit is the number of virtual cpus that can be reserved
+	// for each cpu of the node. if not set, the cpus are not limited
+	CPUOvercommit float64 `toml:"cpu_overcommit"`
+	// Default is the quota of the users that have no quota of their own
+	Default Quota `toml:"default"`
+	// Users are the quotas of specific users, by user ID
+	Users map[string]Quota `toml:"users"`
+}
+
+// LoadPolicy loads the resources policy from a toml file
+func LoadPolicy(path string) (Policy, error) {
+	var policy Policy
+
+	f, err := os.Open(path)
+	if err != nil {
+		return policy, errors.Wrap(err, "failed to open policy file")
+	}
+	defer f.Close()
+
+	if _, err := toml.DecodeReader(f, &policy); err != nil {
+		return policy, errors.Wrapf(err, "failed to decode policy file %s", path)
+	}
+
+	if policy.CPUOvercommit < 0 {
+		return policy, fmt.Errorf("invalid cpu overcommit ratio %f", policy.CPUOvercommit)
+	}
+
+	return policy, nil
+}
+
+// quota returns the quota of a user
+func (p *Policy) quota(user string) Quota {
+	if quota, ok := p.Users[user]; ok {
+		return quota
+	}
+
+	return p.Default
+}
+
+// cpus returns the number of cpus that can be reserved
+// on a node with total cpus
+func (p *Policy) cpus(total uint64) uint64 {
+	if p.CPUOvercommit <= 0 {
+		return total
+	}
+
+	return uint64(float64(total) * p.CPUOvercommit)
+}
+
+// usage is what a single user reserved on the node
+type usage struct {
+	containers uint64
+	mru        uint64
+	sru        uint64
+	hru        uint64
+}
+
+// QuotaError is returned when a reservation exceeds the quota of its user
+type QuotaError struct {
+	User     string
+	Resource string
+	Limit    uint64
+}
+
+func (e QuotaError) Error() string {
+	return fmt.Sprintf("quota of user %s exceeded, limited to %d %s on this node", e.User, e.Limit, e.Resource)
+}
+
+// CheckQuota makes sure the reservation doesn't exceed the quota of its user
+func (c *Counters) CheckQuota(r *provision.Reservation) error {
+	quota := c.policy.quota(r.User)
+	if quota == (Quota{}) {
+		return nil
+	}
+
+	requested, err := requestedUnits(r)
+	if err != nil {
+		return err
+	}
+
+	var used usage
+	c.mu.Lock()
+	if u, ok := c.users[r.User]; ok {
+		used = *u
+	}
+	c.mu.Unlock()
+
+	if quota.Containers != 0 && r.Type == ContainerReservation && used.containers+1 > quota.Containers {
+		return QuotaError{User: r.User, Resource: "containers", Limit: quota.Containers}
+	}
+
+	if quota.MRU != 0 && used.mru+requested.MRU > quota.MRU*gib {
+		return QuotaError{User: r.User, Resource: "GiB of memory", Limit: quota.MRU}
+	}
+
+	if quota.SRU != 0 && used.sru+requested.SRU > quota.SRU*gib {
+		return QuotaError{User: r.User, Resource: "GiB of SSD storage", Limit: quota.SRU}
+	}
+
+	if quota.HRU != 0 && used.hru+requested.HRU > quota.HRU*gib {
+		return QuotaError{User: r.User, Resource: "GiB of HDD storage", Limit: quota.HRU}
+	}
+
+	return nil
+}
+
+// account adds (or removes if add is false) the units of a reservation
+// to the usage of its user
+func (c *Counters) account(r *provision.Reservation, u resourceUnits, add bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.users == nil {
+		c.users = make(map[string]*usage)
+	}
+
+	used, ok := c.users[r.User]
+	if !ok {
+		used = &usage{}
+		c.users[r.User] = used
+	}
+
+	var containers uint64
+	if r.Type == ContainerReservation {
+		containers = 1
+	}
+
+	if add {
+		used.containers += containers
+		used.mru += u.MRU
+		used.sru += u.SRU
+		used.hru += u.HRU
+		return
+	}
+
+	used.containers = sub(used.containers, containers)
+	used.mru = sub(used.mru, u.MRU)
+	used.sru = sub(used.sru, u.SRU)
+	used.hru = sub(used.hru, u.HRU)
+
+	if *used == (usage{}) {
+		delete(c.users, r.User)
+	}
+}
+
+// sub is a - b without going below 0
+func sub(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
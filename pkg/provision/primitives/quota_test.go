@@ -0,0 +1,97 @@
+package primitives
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.toml")
+	err = ioutil.WriteFile(path, []byte(`
+cpu_overcommit = 2.5
+
+[default]
+containers = 2
+mru = 4
+
+[users.42]
+sru = 100
+`), 0644)
+	require.NoError(t, err)
+
+	policy, err := LoadPolicy(path)
+	require.NoError(t, err)
+	require.Equal(t, 2.5, policy.CPUOvercommit)
+	require.Equal(t, Quota{Containers: 2, MRU: 4}, policy.quota("1"))
+	require.Equal(t, Quota{SRU: 100}, policy.quota("42"))
+	require.Equal(t, uint64(10), policy.cpus(4))
+
+	_, err = LoadPolicy(filepath.Join(dir, "missing.toml"))
+	require.Error(t, err)
+}
+
+func TestCountersQuota(t *testing.T) {
+	counters := NewCounters(Policy{
+		Default: Quota{Containers: 1, MRU: 4},
+		Users: map[string]Quota{
+			"vip": {},
+		},
+	})
+
+	container := func(id, user string, memory uint64) *provision.Reservation {
+		r := capacityReservation(t, id, ContainerReservation, Container{
+			Capacity: ContainerCapacity{CPU: 1, Memory: memory},
+		})
+		r.User = user
+		return r
+	}
+
+	first := container("1-1", "user", 1024)
+	require.NoError(t, counters.CheckQuota(first))
+	require.NoError(t, counters.Increment(first))
+
+	err := counters.CheckQuota(container("2-1", "user", 1024))
+	require.Error(t, err)
+	require.IsType(t, QuotaError{}, err)
+
+	// no limit for this user
+	require.NoError(t, counters.CheckQuota(container("3-1", "vip", 1024)))
+
+	vm := capacityReservation(t, "4-1", VirtualMachineReservation, VM{Size: 1, IP: net.ParseIP("10.1.1.2")})
+	vm.User = "user"
+	require.NoError(t, counters.CheckQuota(vm))
+
+	// 1G of the container + 2G (and overhead) of the vm
+	require.NoError(t, counters.Increment(vm))
+	vm.ID = "5-1"
+	require.Error(t, counters.CheckQuota(vm))
+
+	require.NoError(t, counters.Decrement(first))
+	require.NoError(t, counters.CheckQuota(container("2-1", "user", 512)))
+
+	volume := capacityReservation(t, "6-1", VolumeReservation, Volume{Size: 1000, Type: pkg.SSDDevice})
+	volume.User = "user"
+	require.NoError(t, counters.CheckQuota(volume))
+}
+
+func TestCapacityCPUOvercommit(t *testing.T) {
+	c := newCapacity(&capacityMock{})
+	c.counters = NewCounters(Policy{CPUOvercommit: 2})
+
+	vm := capacityReservation(t, "1-1", VirtualMachineReservation, VM{Size: 1, NetworkID: "net", IP: net.ParseIP("10.1.1.2")})
+	c.counters.CRU.Increment(7)
+	require.NoError(t, c.CanProvision(vm))
+	c.counters.CRU.Increment(1)
+	require.Error(t, c.CanProvision(vm))
+}
@@ -0,0 +1,197 @@
+package primitives
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/stubs"
+)
+
+// steps recorded in the provisioning journal. Each step is recorded
+// before it is taken, so undoing a step must succeed even if the step
+// never actually happened
+const (
+	// stepNetwork joins the network of the user
+	stepNetwork = "network"
+	// stepFList mounts the root flist of a container
+	stepFList = "flist"
+	// stepContainer starts the container
+	stepContainer = "container"
+	// stepDisk allocates the disk of a virtual machine
+	stepDisk = "disk"
+	// stepTap creates the tap devices of the private networks of a virtual machine
+	stepTap = "tap"
+	// stepPubTap creates the tap device of the public ip of a virtual machine
+	stepPubTap = "pubtap"
+	// stepPubIPv6Tap creates the tap device of the public ipv6 of a virtual machine
+	stepPubIPv6Tap = "pub6tap"
+	// stepYggTap creates the tap device of the yggdrasil network of a virtual machine
+	stepYggTap = "yggtap"
+	// stepVM starts a virtual machine
+	stepVM = "vm"
+	// stepAllocate allocates the storage of a 0-db namespace
+	stepAllocate = "allocate"
+	// stepZDBContainer starts the 0-db container hosting a namespace
+	stepZDBContainer = "zdb-container"
+	// stepNamespace creates a 0-db namespace
+	stepNamespace = "namespace"
+	// stepSnapshot takes the snapshots of a volume or of the disks of a virtual machine
+	stepSnapshot = "snapshot"
+)
+
+// rollbacker undoes the steps of partially provisioned workloads. It only
+// holds the small part of the modules needed to undo the steps
+type rollbacker struct {
+	containers interface {
+		Delete(ns string, id pkg.ContainerID) error
+	}
+	flists interface {
+		NamedUmount(name string) error
+	}
+	network interface {
+		vmTapRemover
+		Leave(networkdID pkg.NetID, containerID string) error
+	}
+	vdisks interface {
+		Deallocate(name string) error
+	}
+	vms interface {
+		Delete(name string) error
+	}
+	// zdb removes a namespace and its container if it was the last one
+	zdb provision.DecomissionerFunc
+}
+
+func (p *Provisioner) rollbacker() *rollbacker {
+	return &rollbacker{
+		containers: stubs.NewContainerModuleStub(p.zbus),
+		flists:     stubs.NewFlisterStub(p.zbus),
+		network:    stubs.NewNetworkerStub(p.zbus),
+		vdisks:     stubs.NewVDiskModuleStub(p.zbus),
+		vms:        stubs.NewVMModuleStub(p.zbus),
+		zdb:        p.zdbDecommission,
+	}
+}
+
+func (p *Provisioner) containerRollback(ctx context.Context, reservation *provision.Reservation, steps []string) error {
+	return p.rollbacker().container(reservation, steps)
+}
+
+func (p *Provisioner) vmRollback(ctx context.Context, reservation *provision.Reservation, steps []string) error {
+	return p.rollbacker().vm(reservation, steps)
+}
+
+func (p *Provisioner) zdbRollback(ctx context.Context, reservation *provision.Reservation, steps []string) error {
+	return p.rollbacker().namespace(ctx, reservation, steps)
+}
+
+// undo calls the undo function of each step in the reverse order they were
+// taken. All the steps are undone even if some of them fail
+func undo(steps []string, fns map[string]func() error) error {
+	var result error
+	for i := len(steps) - 1; i >= 0; i-- {
+		fn, ok := fns[steps[i]]
+		if !ok {
+			log.Warn().Str("step", steps[i]).Msg("no rollback for step")
+			continue
+		}
+
+		if err := fn(); err != nil {
+			log.Error().Err(err).Str("step", steps[i]).Msg("failed to roll back step")
+			result = errors.Wrapf(err, "failed to roll back step %s", steps[i])
+		}
+	}
+
+	return result
+}
+
+// ignoreNotFound hides the errors returned by the modules when the
+// resource of a step does not exist, meaning the step never happened
+func ignoreNotFound(err error) error {
+	if err == nil || os.IsNotExist(err) || strings.Contains(err.Error(), "not found") {
+		return nil
+	}
+
+	return err
+}
+
+func (r *rollbacker) container(reservation *provision.Reservation, steps []string) error {
+	var config Container
+	if err := json.Unmarshal(reservation.Data, &config); err != nil {
+		return err
+	}
+
+	var (
+		tenantNS    = fmt.Sprintf("ns%s", reservation.User)
+		containerID = reservation.ID
+		netID       = provision.NetworkID(reservation.User, string(config.Network.NetworkID))
+	)
+
+	return undo(steps, map[string]func() error{
+		stepNetwork: func() error {
+			return ignoreNotFound(r.network.Leave(netID, containerID))
+		},
+		stepFList: func() error {
+			return ignoreNotFound(r.flists.NamedUmount(provision.FilesystemName(*reservation)))
+		},
+		stepContainer: func() error {
+			return ignoreNotFound(r.containers.Delete(tenantNS, pkg.ContainerID(containerID)))
+		},
+	})
+}
+
+// vm rolls back both virtual machines and kubernetes VMs
+func (r *rollbacker) vm(reservation *provision.Reservation, steps []string) error {
+	// the kubernetes reservation embeds the VM fields we need
+	var config VM
+	if err := json.Unmarshal(reservation.Data, &config); err != nil {
+		return err
+	}
+
+	diskName := fmt.Sprintf("%s-%s", provision.FilesystemName(*reservation), "vda")
+
+	return undo(steps, map[string]func() error{
+		stepDisk: func() error {
+			return ignoreNotFound(r.vdisks.Deallocate(diskName))
+		},
+		stepTap: func() error {
+			var result error
+			for _, attachment := range config.Attachments() {
+				netID := provision.NetworkID(reservation.User, string(attachment.NetworkID))
+				if err := ignoreNotFound(r.network.RemoveTap(netID, reservation.ID)); err != nil {
+					result = err
+				}
+			}
+			return result
+		},
+		stepPubTap: func() error {
+			return ignoreNotFound(r.network.RemovePubTap(pubIPResID(config.PublicIP)))
+		},
+		stepPubIPv6Tap: func() error {
+			return ignoreNotFound(r.network.RemovePubIPv6Tap(reservation.ID))
+		},
+		stepYggTap: func() error {
+			return ignoreNotFound(r.network.RemoveYggTap(reservation.ID))
+		},
+		stepVM: func() error {
+			return ignoreNotFound(r.vms.Delete(reservation.ID))
+		},
+	})
+}
+
+func (r *rollbacker) namespace(ctx context.Context, reservation *provision.Reservation, steps []string) error {
+	if len(steps) == 0 {
+		return nil
+	}
+
+	// the decommission takes care of all the steps at once, it only deletes
+	// the namespace if it exists and the container once it has no namespace left
+	return r.zdb(ctx, reservation)
+}
@@ -0,0 +1,276 @@
+package primitives
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+// modulesMock records the calls done by the rollbacker
+type modulesMock struct {
+	calls []string
+}
+
+func (m *modulesMock) record(format string, args ...interface{}) error {
+	m.calls = append(m.calls, fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (m *modulesMock) Delete(ns string, id pkg.ContainerID) error {
+	return m.record("container.delete %s %s", ns, id)
+}
+
+func (m *modulesMock) NamedUmount(name string) error {
+	return m.record("flist.umount %s", name)
+}
+
+func (m *modulesMock) Leave(networkID pkg.NetID, containerID string) error {
+	return m.record("network.leave %s %s", networkID, containerID)
+}
+
+func (m *modulesMock) RemoveTap(networkID pkg.NetID, name string) error {
+	return m.record("network.removetap %s %s", networkID, name)
+}
+
+func (m *modulesMock) RemovePubTap(id string) error {
+	return m.record("network.removepubtap %s", id)
+}
+
+func (m *modulesMock) RemovePubIPv6Tap(name string) error {
+	return m.record("network.removepub6tap %s", name)
+}
+
+func (m *modulesMock) RemoveYggTap(name string) error {
+	return m.record("network.removeyggtap %s", name)
+}
+
+func (m *modulesMock) Deallocate(name string) error {
+	return m.record("vdisk.deallocate %s", name)
+}
+
+type vmMock struct {
+	*modulesMock
+}
+
+func (m vmMock) Delete(name string) error {
+	return m.record("vm.delete %s", name)
+}
+
+func newRollbacker(m *modulesMock) *rollbacker {
+	return &rollbacker{
+		containers: m,
+		flists:     m,
+		network:    m,
+		vdisks:     m,
+		vms:        vmMock{m},
+		zdb: func(ctx context.Context, r *provision.Reservation) error {
+			return m.record("zdb.decommission %s", r.ID)
+		},
+	}
+}
+
+func reverse(calls []string) []string {
+	reversed := make([]string, 0, len(calls))
+	for i := len(calls) - 1; i >= 0; i-- {
+		reversed = append(reversed, calls[i])
+	}
+	return reversed
+}
+
+// crashAtEachStep calls rollback as if provisiond died right after
+// recording each step and checks only the recorded steps are undone
+func crashAtEachStep(t *testing.T, steps []string, undos []string, rollback func(r *rollbacker, steps []string) error) {
+	require.Len(t, undos, len(steps))
+
+	for i := 0; i <= len(steps); i++ {
+		t.Run(fmt.Sprintf("crash after %d steps", i), func(t *testing.T) {
+			m := &modulesMock{}
+			err := rollback(newRollbacker(m), steps[:i])
+			require.NoError(t, err)
+
+			expected := reverse(undos[:i])
+			if len(expected) == 0 {
+				require.Empty(t, m.calls)
+			} else {
+				require.Equal(t, expected, m.calls)
+			}
+		})
+	}
+}
+
+func TestContainerRollback(t *testing.T) {
+	data, err := json.Marshal(Container{
+		FList: "https://hub.grid.tf/tf-official-apps/ubuntu.flist",
+		Network: Network{
+			NetworkID: "net",
+			IPs:       []net.IP{net.ParseIP("10.0.0.2")},
+		},
+	})
+	require.NoError(t, err)
+
+	r := &provision.Reservation{
+		ID:   "1-1",
+		User: "user",
+		Type: ContainerReservation,
+		Data: data,
+	}
+	netID := provision.NetworkID(r.User, "net")
+
+	crashAtEachStep(t,
+		[]string{stepNetwork, stepFList, stepContainer},
+		[]string{
+			fmt.Sprintf("network.leave %s 1-1", netID),
+			"flist.umount 1-1",
+			"container.delete nsuser 1-1",
+		},
+		func(rb *rollbacker, steps []string) error {
+			return rb.container(r, steps)
+		},
+	)
+}
+
+func TestVMRollback(t *testing.T) {
+	data, err := json.Marshal(VM{
+		Size:      1,
+		NetworkID: "net",
+		IP:        net.ParseIP("10.0.0.2"),
+		PublicIP:  12,
+		Name:      "ubuntu",
+	})
+	require.NoError(t, err)
+
+	r := &provision.Reservation{
+		ID:   "1-1",
+		User: "user",
+		Type: VirtualMachineReservation,
+		Data: data,
+	}
+	netID := provision.NetworkID(r.User, "net")
+
+	crashAtEachStep(t,
+		[]string{stepDisk, stepTap, stepPubTap, stepVM},
+		[]string{
+			"vdisk.deallocate 1-1-vda",
+			fmt.Sprintf("network.removetap %s 1-1", netID),
+			fmt.Sprintf("network.removepubtap %s", pubIPResID(12)),
+			"vm.delete 1-1",
+		},
+		func(rb *rollbacker, steps []string) error {
+			return rb.vm(r, steps)
+		},
+	)
+}
+
+func TestVMRollbackNetworks(t *testing.T) {
+	data, err := json.Marshal(VM{
+		Size:      1,
+		NetworkID: "net",
+		IP:        net.ParseIP("10.0.0.2"),
+		Networks: []VMNetwork{
+			{NetworkID: "other", IP: net.ParseIP("10.1.0.2")},
+		},
+		PublicIP6:   true,
+		YggdrasilIP: true,
+		Name:        "ubuntu",
+	})
+	require.NoError(t, err)
+
+	r := &provision.Reservation{
+		ID:   "1-1",
+		User: "user",
+		Type: VirtualMachineReservation,
+		Data: data,
+	}
+
+	m := &modulesMock{}
+	err = newRollbacker(m).vm(r, []string{stepDisk, stepTap, stepPubIPv6Tap, stepYggTap, stepVM})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"vm.delete 1-1",
+		"network.removeyggtap 1-1",
+		"network.removepub6tap 1-1",
+		fmt.Sprintf("network.removetap %s 1-1", provision.NetworkID(r.User, "net")),
+		fmt.Sprintf("network.removetap %s 1-1", provision.NetworkID(r.User, "other")),
+		"vdisk.deallocate 1-1-vda",
+	}, m.calls)
+}
+
+func TestKubernetesRollback(t *testing.T) {
+	data, err := json.Marshal(Kubernetes{
+		VM: VM{
+			Size:      1,
+			NetworkID: "net",
+			IP:        net.ParseIP("10.0.0.2"),
+		},
+		ClusterSecret: "secret",
+	})
+	require.NoError(t, err)
+
+	r := &provision.Reservation{
+		ID:   "1-1",
+		User: "user",
+		Type: KubernetesReservation,
+		Data: data,
+	}
+	netID := provision.NetworkID(r.User, "net")
+
+	crashAtEachStep(t,
+		[]string{stepDisk, stepTap, stepVM},
+		[]string{
+			"vdisk.deallocate 1-1-vda",
+			fmt.Sprintf("network.removetap %s 1-1", netID),
+			"vm.delete 1-1",
+		},
+		func(rb *rollbacker, steps []string) error {
+			return rb.vm(r, steps)
+		},
+	)
+}
+
+func TestZDBRollback(t *testing.T) {
+	r := &provision.Reservation{
+		ID:   "1-1",
+		User: "user",
+		Type: ZDBReservation,
+	}
+
+	for i, steps := range [][]string{
+		{},
+		{stepAllocate},
+		{stepAllocate, stepZDBContainer},
+		{stepAllocate, stepZDBContainer, stepNamespace},
+	} {
+		t.Run(fmt.Sprintf("crash after %d steps", i), func(t *testing.T) {
+			m := &modulesMock{}
+			err := newRollbacker(m).namespace(context.Background(), r, steps)
+			require.NoError(t, err)
+
+			if len(steps) == 0 {
+				require.Empty(t, m.calls)
+			} else {
+				require.Equal(t, []string{"zdb.decommission 1-1"}, m.calls)
+			}
+		})
+	}
+}
+
+func TestRollbackContinueOnError(t *testing.T) {
+	var calls []string
+	err := undo([]string{"a", "b", "c"}, map[string]func() error{
+		"a": func() error { calls = append(calls, "a"); return nil },
+		"b": func() error { calls = append(calls, "b"); return fmt.Errorf("failed") },
+		"c": func() error { calls = append(calls, "c"); return nil },
+	})
+
+	require.Error(t, err)
+	require.Equal(t, []string{"c", "b", "a"}, calls)
+
+	require.NoError(t, ignoreNotFound(fmt.Errorf("container 1-1 not found")))
+	require.Error(t, ignoreNotFound(fmt.Errorf("connection refused")))
+}
@@ -0,0 +1,599 @@
+package primitives
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/stubs"
+	"golang.org/x/sys/unix"
+)
+
+// snapshotChunkSize is the size of the values written to a 0-db target,
+// 0-db refuses values bigger than 8MiB
+const snapshotChunkSize = 4 * mib
+
+// SnapshotTargetType is where a snapshot is exported to
+type SnapshotTargetType string
+
+const (
+	// SnapshotTargetZDB exports the snapshot to a 0-db namespace
+	SnapshotTargetZDB SnapshotTargetType = "zdb"
+	// SnapshotTargetFile exports the snapshot to a file in a volume of the user
+	SnapshotTargetFile SnapshotTargetType = "file"
+)
+
+// SnapshotTarget is where the snapshots are exported once taken
+type SnapshotTarget struct {
+	Type SnapshotTargetType `json:"type"`
+
+	// Address of the 0-db as host:port
+	Address string `json:"address"`
+	// Namespace is the 0-db namespace the snapshots are written to
+	Namespace string `json:"namespace"`
+	// Password of the namespace, encrypted the same way as the
+	// password of a zdb reservation
+	Password string `json:"password"`
+
+	// VolumeID is the volume the snapshots are written to
+	VolumeID string `json:"volume_id"`
+	// Path is the directory in the volume where the snapshots are written
+	Path string `json:"path"`
+
+	PlainPassword string `json:"-"`
+}
+
+// Snapshot takes a point in time copy of a workload storage
+type Snapshot struct {
+	// Source is the ID of the workload to snapshot, a volume
+	// or a virtual machine
+	Source string `json:"source"`
+	// Size in GiB reserved for the snapshot. The snapshot shares
+	// its data with its source, but it can grow up to the size of
+	// the source once the source is modified
+	Size uint64 `json:"size"`
+	// DiskType is the type of disk of the source
+	DiskType pkg.DeviceType `json:"disk_type"`
+	// Target is optional, if set the snapshots are exported to it
+	Target *SnapshotTarget `json:"target,omitempty"`
+}
+
+// Valid checks the snapshot schema
+func (s Snapshot) Valid() error {
+	if s.Source == "" {
+		return fmt.Errorf("snapshot source is required")
+	}
+
+	if s.Size == 0 {
+		return fmt.Errorf("snapshot size is required")
+	}
+
+	if err := validateDiskType(s.DiskType); err != nil {
+		return err
+	}
+
+	if s.Target == nil {
+		return nil
+	}
+
+	switch s.Target.Type {
+	case SnapshotTargetZDB:
+		if s.Target.Address == "" || s.Target.Namespace == "" {
+			return fmt.Errorf("0-db target requires an address and a namespace")
+		}
+	case SnapshotTargetFile:
+		if s.Target.VolumeID == "" {
+			return fmt.Errorf("file target requires a volume")
+		}
+	default:
+		return fmt.Errorf("unsupported snapshot target '%s'", s.Target.Type)
+	}
+
+	return nil
+}
+
+// SnapshotInfo describes a single snapshot
+type SnapshotInfo struct {
+	// Name of the snapshot, it is the name of the volume or
+	// the disk holding the snapshot
+	Name string `json:"name"`
+	// Source is the name of the snapshotted volume or disk
+	Source string `json:"source"`
+	// Size of the source in bytes
+	Size uint64 `json:"size"`
+	// Exported is where the snapshot has been exported to,
+	// the 0-db key or the path of the file in the target volume
+	Exported string `json:"exported,omitempty"`
+	Created  int64  `json:"created"`
+}
+
+// SnapshotResult is the information return to the BCDB
+// after taking a snapshot
+type SnapshotResult struct {
+	Snapshots []SnapshotInfo `json:"snapshots"`
+}
+
+func (p *Provisioner) snapshotProvision(ctx context.Context, reservation *provision.Reservation) (interface{}, error) {
+	return p.snapshotProvisionImpl(ctx, reservation)
+}
+
+func (p *Provisioner) snapshotProvisionImpl(ctx context.Context, reservation *provision.Reservation) (result SnapshotResult, err error) {
+	var config Snapshot
+	if err := json.Unmarshal(reservation.Data, &config); err != nil {
+		return result, errors.Wrap(err, "failed to decode reservation schema")
+	}
+
+	if err := config.Valid(); err != nil {
+		return result, err
+	}
+
+	source, err := p.cache.Get(config.Source)
+	if err != nil {
+		return result, errors.Wrapf(err, "failed to retrieve the source workload %s", config.Source)
+	}
+
+	if source.User != reservation.User {
+		return result, fmt.Errorf("cannot snapshot workload %s, user %s is not the owner of it", config.Source, reservation.User)
+	}
+
+	if config.Target != nil && config.Target.Type == SnapshotTargetZDB {
+		config.Target.PlainPassword, err = decryptSecret(config.Target.Password, reservation.User, reservation.Version, p.zbus)
+		if err != nil {
+			return result, errors.Wrap(err, "failed to decrypt namespace password")
+		}
+	}
+
+	if err = provision.Step(ctx, stepSnapshot); err != nil {
+		return result, err
+	}
+
+	defer func() {
+		if err != nil {
+			if err := p.snapshotDecommission(ctx, reservation); err != nil {
+				log.Error().Err(err).Str("id", reservation.ID).Msg("failed to clean up snapshots")
+			}
+		}
+	}()
+
+	var exports []snapshotExport
+	switch source.Type {
+	case VolumeReservation:
+		result.Snapshots, exports, err = p.snapshotVolume(reservation, source, config)
+	case VirtualMachineReservation, KubernetesReservation:
+		result.Snapshots, exports, err = p.snapshotDisks(reservation, source, config)
+	default:
+		err = fmt.Errorf("cannot snapshot workload %s of type %s", source.ID, source.Type)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	if config.Target == nil {
+		return result, nil
+	}
+
+	for i, export := range exports {
+		result.Snapshots[i].Exported, err = p.snapshotExport(ctx, reservation, config.Target, export)
+		if err != nil {
+			return result, errors.Wrapf(err, "failed to export snapshot %s", result.Snapshots[i].Name)
+		}
+	}
+
+	return result, nil
+}
+
+// snapshotExport is a snapshot to export, open returns a stream of the
+// snapshot content
+type snapshotExport struct {
+	name string
+	open func(ctx context.Context) (io.ReadCloser, error)
+}
+
+func (p *Provisioner) snapshotVolume(reservation, source *provision.Reservation, config Snapshot) ([]SnapshotInfo, []snapshotExport, error) {
+	var volume Volume
+	if err := json.Unmarshal(source.Data, &volume); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode volume schema")
+	}
+
+	if volume.Type != config.DiskType {
+		return nil, nil, fmt.Errorf("volume %s is on %s disks, not %s", source.ID, volume.Type, config.DiskType)
+	}
+
+	if volume.Size > config.Size {
+		return nil, nil, fmt.Errorf("snapshot size %d GiB is smaller than the volume size %d GiB", config.Size, volume.Size)
+	}
+
+	storage := stubs.NewStorageModuleStub(p.zbus)
+
+	name := provision.FilesystemName(*reservation)
+	fs, err := storage.Path(name)
+	if err != nil {
+		fs, err = storage.SnapshotFilesystem(provision.FilesystemName(*source), name)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		log.Info().Str("id", reservation.ID).Msg("snapshot already taken")
+	}
+
+	info := SnapshotInfo{
+		Name:    fs.Name,
+		Source:  provision.FilesystemName(*source),
+		Size:    volume.Size * gib,
+		Created: time.Now().Unix(),
+	}
+
+	export := snapshotExport{
+		name: fs.Name,
+		open: func(ctx context.Context) (io.ReadCloser, error) {
+			return btrfsSend(ctx, fs.Path)
+		},
+	}
+
+	return []SnapshotInfo{info}, []snapshotExport{export}, nil
+}
+
+// snapshotDisks takes a snapshot of each disk of a virtual machine
+func (p *Provisioner) snapshotDisks(reservation, source *provision.Reservation, config Snapshot) ([]SnapshotInfo, []snapshotExport, error) {
+	if config.DiskType != pkg.SSDDevice {
+		return nil, nil, fmt.Errorf("virtual machines disks are on %s disks, not %s", pkg.SSDDevice, config.DiskType)
+	}
+
+	storage := stubs.NewVDiskModuleStub(p.zbus)
+
+	disks, err := storage.List()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list virtual disks")
+	}
+
+	prefix := provision.FilesystemName(*source) + "-"
+	var (
+		total   uint64
+		sources []pkg.VDisk
+	)
+	for _, disk := range disks {
+		if strings.HasPrefix(disk.Name(), prefix) {
+			sources = append(sources, disk)
+			total += uint64(disk.Size)
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil, nil, fmt.Errorf("virtual machine %s has no disks", source.ID)
+	}
+
+	if total > config.Size*gib {
+		return nil, nil, fmt.Errorf("snapshot size %d GiB is smaller than the disks size %d GiB", config.Size, total/gib)
+	}
+
+	var (
+		infos   []SnapshotInfo
+		exports []snapshotExport
+	)
+	for _, disk := range sources {
+		// the snapshot disk keeps the disk suffix of the source (vda, ...)
+		name := provision.FilesystemName(*reservation) + "-" + strings.TrimPrefix(disk.Name(), prefix)
+
+		snapshot, err := storage.Inspect(name)
+		if err != nil {
+			snapshot, err = storage.Snapshot(disk.Name(), name)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to snapshot disk %s", disk.Name())
+			}
+		}
+
+		infos = append(infos, SnapshotInfo{
+			Name:    name,
+			Source:  disk.Name(),
+			Size:    uint64(disk.Size),
+			Created: time.Now().Unix(),
+		})
+
+		path := snapshot.Path
+		exports = append(exports, snapshotExport{
+			name: name,
+			open: func(ctx context.Context) (io.ReadCloser, error) {
+				return os.Open(path)
+			},
+		})
+	}
+
+	return infos, exports, nil
+}
+
+// btrfsSend streams a read-only subvolume
+func btrfsSend(ctx context.Context, path string) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, "btrfs", "send", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "failed to send subvolume %s", path)
+	}
+
+	return &cmdReader{ReadCloser: stdout, cmd: cmd, stderr: &stderr}, nil
+}
+
+// cmdReader reads the output of a command, Close fails if the command failed
+type cmdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (r *cmdReader) Close() error {
+	// drain the output so the command is not stuck writing
+	_, _ = io.Copy(ioutil.Discard, r.ReadCloser)
+	if err := r.cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "%s failed: %s", strings.Join(r.cmd.Args, " "), r.stderr.String())
+	}
+
+	return nil
+}
+
+// snapshotExport writes the snapshot to the target and returns where it was written
+func (p *Provisioner) snapshotExport(ctx context.Context, reservation *provision.Reservation, target *SnapshotTarget, export snapshotExport) (string, error) {
+	reader, err := export.open(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// the export can take a long time, it must stop when provisiond stops
+	content := &ctxReader{ctx: ctx, r: reader}
+
+	var location string
+	switch target.Type {
+	case SnapshotTargetZDB:
+		location, err = exportZDB(ctx, content, target, export.name)
+	case SnapshotTargetFile:
+		location, err = p.exportFile(content, reservation, target, export.name)
+	default:
+		err = fmt.Errorf("unsupported snapshot target '%s'", target.Type)
+	}
+
+	// the reader must be closed to know if the whole snapshot was read
+	if cerr := reader.Close(); err == nil {
+		err = cerr
+	}
+
+	if ctx.Err() != nil {
+		// the export is done again once provisiond is back
+		return "", provision.Transient(errors.Wrap(ctx.Err(), "snapshot export interrupted"))
+	}
+
+	return location, err
+}
+
+// ctxReader stops reading once its context is canceled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+// exportFile writes the snapshot to a file in a volume of the user
+func (p *Provisioner) exportFile(r io.Reader, reservation *provision.Reservation, target *SnapshotTarget, name string) (string, error) {
+	volume, err := p.cache.Get(target.VolumeID)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to retrieve the target volume %s", target.VolumeID)
+	}
+
+	if volume.User != reservation.User || volume.Type != VolumeReservation {
+		return "", fmt.Errorf("cannot use volume %s, user %s is not the owner of it", target.VolumeID, reservation.User)
+	}
+
+	fs, err := stubs.NewStorageModuleStub(p.zbus).Path(provision.FilesystemName(*volume))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to find target volume %s", target.VolumeID)
+	}
+
+	file, location, err := createExportFile(fs.Path, target.Path, name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return "", err
+	}
+
+	return location, file.Sync()
+}
+
+// createExportFile creates the file name in the directory dir of the volume
+// at root and returns it with its location in the volume. The content of the
+// volume belongs to the user, so the path is resolved one component at a
+// time without following symlinks and it can't escape the volume root
+func createExportFile(root, dir, name string) (*os.File, string, error) {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return nil, "", fmt.Errorf("invalid snapshot name '%s'", name)
+	}
+
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to open volume %s", root)
+	}
+
+	dir = filepath.Clean("/" + dir)
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" {
+			continue
+		}
+
+		if err := unix.Mkdirat(fd, part, 0755); err != nil && err != unix.EEXIST {
+			unix.Close(fd)
+			return nil, "", errors.Wrapf(err, "failed to create directory %s", dir)
+		}
+
+		next, err := unix.Openat(fd, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to open directory %s", dir)
+		}
+		fd = next
+	}
+	defer unix.Close(fd)
+
+	location := filepath.Join(dir, name)
+	filefd, err := unix.Openat(fd, name, unix.O_WRONLY|unix.O_CREAT|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0644)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to create %s", location)
+	}
+	file := os.NewFile(uintptr(filefd), filepath.Join(root, location))
+
+	// a hard link would make us overwrite a file outside of the volume
+	var stat unix.Stat_t
+	if err := unix.Fstat(filefd, &stat); err != nil {
+		file.Close()
+		return nil, "", err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG || stat.Nlink > 1 {
+		file.Close()
+		return nil, "", fmt.Errorf("%s is not a regular file", location)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, "", err
+	}
+
+	return file, location, nil
+}
+
+// exportZDB writes the snapshot to a 0-db namespace in chunks of
+// snapshotChunkSize. The chunks are stored under the keys name.0, name.1, ...
+// and the key name holds the number of chunks and the size of the snapshot
+func exportZDB(ctx context.Context, r io.Reader, target *SnapshotTarget, name string) (string, error) {
+	con, err := redis.Dial("tcp", target.Address,
+		redis.DialConnectTimeout(10*time.Second),
+		redis.DialWriteTimeout(30*time.Second),
+		redis.DialReadTimeout(30*time.Second),
+	)
+	if err != nil {
+		return "", provision.Transient(errors.Wrapf(err, "failed to connect to 0-db %s", target.Address))
+	}
+	defer con.Close()
+
+	// closing the connection interrupts the request in flight
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			con.Close()
+		case <-done:
+		}
+	}()
+
+	args := []interface{}{target.Namespace}
+	if target.PlainPassword != "" {
+		args = append(args, target.PlainPassword)
+	}
+	if _, err := con.Do("SELECT", args...); err != nil {
+		return "", errors.Wrapf(err, "failed to select namespace %s", target.Namespace)
+	}
+
+	return name, writeChunks(r, name, func(key string, value []byte) error {
+		_, err := con.Do("SET", key, value)
+		return err
+	})
+}
+
+// snapshotManifest is the value of the key of a snapshot in a 0-db target
+type snapshotManifest struct {
+	Chunks int    `json:"chunks"`
+	Size   uint64 `json:"size"`
+}
+
+// writeChunks splits r in chunks and stores them with set
+func writeChunks(r io.Reader, name string, set func(key string, value []byte) error) error {
+	var manifest snapshotManifest
+	buf := make([]byte, snapshotChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := set(fmt.Sprintf("%s.%d", name, manifest.Chunks), buf[:n]); err != nil {
+				return errors.Wrapf(err, "failed to write chunk %d", manifest.Chunks)
+			}
+			manifest.Chunks++
+			manifest.Size += uint64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	value, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	return set(name, value)
+}
+
+func (p *Provisioner) snapshotDecommission(ctx context.Context, reservation *provision.Reservation) error {
+	var (
+		storage = stubs.NewStorageModuleStub(p.zbus)
+		vdisks  = stubs.NewVDiskModuleStub(p.zbus)
+		name    = provision.FilesystemName(*reservation)
+	)
+
+	// the source may be gone already, so both kinds of snapshots are removed
+	if err := storage.ReleaseFilesystem(name); err != nil {
+		return errors.Wrapf(err, "failed to remove snapshot %s", name)
+	}
+
+	disks, err := vdisks.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list virtual disks")
+	}
+
+	for _, disk := range disks {
+		if !strings.HasPrefix(disk.Name(), name+"-") {
+			continue
+		}
+
+		if err := vdisks.Deallocate(disk.Name()); err != nil {
+			return errors.Wrapf(err, "failed to remove snapshot %s", disk.Name())
+		}
+	}
+
+	return nil
+}
+
+func (p *Provisioner) snapshotRollback(ctx context.Context, reservation *provision.Reservation, steps []string) error {
+	if len(steps) == 0 {
+		return nil
+	}
+
+	// the decommission removes whatever snapshot has been taken
+	return p.snapshotDecommission(ctx, reservation)
+}
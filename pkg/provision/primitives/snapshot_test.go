@@ -0,0 +1,191 @@
+package primitives
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestSnapshotValid(t *testing.T) {
+	snapshot := Snapshot{Source: "1-1", Size: 10, DiskType: pkg.SSDDevice}
+	require.NoError(t, snapshot.Valid())
+
+	snapshot.Target = &SnapshotTarget{Type: SnapshotTargetZDB, Address: "10.1.1.2:9900"}
+	require.Error(t, snapshot.Valid())
+	snapshot.Target.Namespace = "backup"
+	require.NoError(t, snapshot.Valid())
+
+	snapshot.Target = &SnapshotTarget{Type: SnapshotTargetFile}
+	require.Error(t, snapshot.Valid())
+	snapshot.Target.VolumeID = "2-1"
+	require.NoError(t, snapshot.Valid())
+
+	snapshot.Target.Type = "s3"
+	require.Error(t, snapshot.Valid())
+
+	require.Error(t, Snapshot{Size: 10, DiskType: pkg.SSDDevice}.Valid())
+	require.Error(t, Snapshot{Source: "1-1", DiskType: pkg.SSDDevice}.Valid())
+	require.Error(t, Snapshot{Source: "1-1", Size: 10, DiskType: "nvme"}.Valid())
+}
+
+func TestSnapshotCounters(t *testing.T) {
+	counters := NewCounters(Policy{
+		Default: Quota{HRU: 100},
+	})
+
+	snapshot := capacityReservation(t, "1-1", SnapshotReservation, Snapshot{
+		Source:   "2-1",
+		Size:     60,
+		DiskType: pkg.HDDDevice,
+	})
+
+	require.NoError(t, counters.CheckQuota(snapshot))
+	require.NoError(t, counters.Increment(snapshot))
+	require.Equal(t, 60*gib, counters.HRU.Current())
+	require.Equal(t, uint64(0), counters.SRU.Current())
+
+	snapshot.ID = "3-1"
+	err := counters.CheckQuota(snapshot)
+	require.Error(t, err)
+	require.IsType(t, QuotaError{}, err)
+
+	require.NoError(t, counters.Decrement(snapshot))
+	require.Equal(t, uint64(0), counters.HRU.Current())
+	require.NoError(t, counters.CheckQuota(snapshot))
+}
+
+func TestSnapshotLockKeys(t *testing.T) {
+	r := capacityReservation(t, "1-1", SnapshotReservation, Snapshot{Source: "2-1"})
+	require.Equal(t, []string{"2-1"}, LockKeys(r))
+}
+
+func TestCreateExportFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "volume")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	outside, err := ioutil.TempDir("", "host")
+	require.NoError(t, err)
+	defer os.RemoveAll(outside)
+
+	file, location, err := createExportFile(root, "backups", "1-1")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Equal(t, "/backups/1-1", location)
+	require.FileExists(t, filepath.Join(root, "backups", "1-1"))
+
+	// the path can't escape the volume
+	file, location, err = createExportFile(root, "../../../etc", "1-1-vda")
+	require.NoError(t, err)
+	_, err = file.WriteString("snapshot")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Equal(t, "/etc/1-1-vda", location)
+	require.FileExists(t, filepath.Join(root, "etc", "1-1-vda"))
+
+	// an existing file is overwritten
+	file, _, err = createExportFile(root, "/etc", "1-1-vda")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	data, err := ioutil.ReadFile(filepath.Join(root, "etc", "1-1-vda"))
+	require.NoError(t, err)
+	require.Empty(t, data)
+
+	_, location, err = createExportFile(root, "", "1-1")
+	require.NoError(t, err)
+	require.Equal(t, "/1-1", location)
+
+	// the symlinks planted by the user are not followed
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+	_, _, err = createExportFile(root, "link", "1-1")
+	require.Error(t, err)
+	_, _, err = createExportFile(root, "link/backups", "1-1")
+	require.Error(t, err)
+
+	host := filepath.Join(outside, "file")
+	require.NoError(t, ioutil.WriteFile(host, []byte("host"), 0644))
+	require.NoError(t, os.Symlink(host, filepath.Join(root, "backups", "2-1")))
+	_, _, err = createExportFile(root, "backups", "2-1")
+	require.Error(t, err)
+
+	require.NoError(t, os.Link(host, filepath.Join(root, "backups", "3-1")))
+	_, _, err = createExportFile(root, "backups", "3-1")
+	require.Error(t, err)
+
+	entries, err := ioutil.ReadDir(outside)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	data, err = ioutil.ReadFile(host)
+	require.NoError(t, err)
+	require.Equal(t, "host", string(data))
+}
+
+func TestWriteChunks(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, int(2*snapshotChunkSize+10))
+
+	stored := make(map[string][]byte)
+	err := writeChunks(bytes.NewReader(data), "1-1", func(key string, value []byte) error {
+		stored[key] = append([]byte{}, value...)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, stored, 4)
+	require.Len(t, stored["1-1.0"], int(snapshotChunkSize))
+	require.Len(t, stored["1-1.2"], 10)
+
+	var manifest snapshotManifest
+	require.NoError(t, json.Unmarshal(stored["1-1"], &manifest))
+	require.Equal(t, snapshotManifest{Chunks: 3, Size: uint64(len(data))}, manifest)
+
+	err = writeChunks(bytes.NewReader(data), "1-1", func(key string, value []byte) error {
+		return fmt.Errorf("namespace is full")
+	})
+	require.Error(t, err)
+}
+
+func TestSnapshotExportCanceled(t *testing.T) {
+	require := require.New(t)
+
+	// a 0-db that never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer listener.Close()
+	go func() {
+		con, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer con.Close()
+		_, _ = io.Copy(ioutil.Discard, con)
+	}()
+
+	target := &SnapshotTarget{Type: SnapshotTargetZDB, Address: listener.Addr().String(), Namespace: "backup"}
+	export := snapshotExport{
+		name: "snapshot",
+		open: func(ctx context.Context) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(make([]byte, 10))), nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	var p Provisioner
+	_, err = p.snapshotExport(ctx, &provision.Reservation{ID: "1-1"}, target, export)
+	require.Error(err)
+	require.True(provision.IsTransient(err))
+	require.Less(int64(time.Since(started)), int64(10*time.Second))
+}
@@ -0,0 +1,132 @@
+package primitives
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/stubs"
+)
+
+// inspector finds the state of deployed workloads. It only holds the
+// small part of the modules needed to inspect the workloads
+type inspector struct {
+	containers interface {
+		Inspect(ns string, id pkg.ContainerID) (pkg.Container, error)
+	}
+	vms interface {
+		Inspect(name string) (pkg.VMInfo, error)
+		Exists(name string) bool
+	}
+	network interface {
+		TapExists(networkID pkg.NetID, name string) (bool, error)
+	}
+	allocations interface {
+		Find(namespace string) (pkg.Allocation, error)
+	}
+}
+
+func (p *Provisioner) inspector() *inspector {
+	return &inspector{
+		containers:  stubs.NewContainerModuleStub(p.zbus),
+		vms:         stubs.NewVMModuleStub(p.zbus),
+		network:     stubs.NewNetworkerStub(p.zbus),
+		allocations: stubs.NewZDBAllocaterStub(p.zbus),
+	}
+}
+
+func (p *Provisioner) containerStatus(ctx context.Context, reservation *provision.Reservation) (pkg.WorkloadState, error) {
+	return p.inspector().container(reservation)
+}
+
+func (p *Provisioner) vmStatus(ctx context.Context, reservation *provision.Reservation) (pkg.WorkloadState, error) {
+	return p.inspector().vm(reservation)
+}
+
+func (p *Provisioner) zdbStatus(ctx context.Context, reservation *provision.Reservation) (pkg.WorkloadState, error) {
+	return p.inspector().namespace(reservation)
+}
+
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "not found")
+}
+
+func (i *inspector) container(reservation *provision.Reservation) (pkg.WorkloadState, error) {
+	tenantNS := fmt.Sprintf("ns%s", reservation.User)
+
+	_, err := i.containers.Inspect(tenantNS, pkg.ContainerID(reservation.ID))
+	if err != nil && isNotFound(err) {
+		return pkg.WorkloadStopped, errors.Wrap(err, "container is not running")
+	} else if err != nil {
+		return pkg.WorkloadDegraded, errors.Wrap(err, "failed to inspect container")
+	}
+
+	return pkg.WorkloadRunning, nil
+}
+
+// vm inspects both virtual machines and kubernetes VMs
+func (i *inspector) vm(reservation *provision.Reservation) (pkg.WorkloadState, error) {
+	// the kubernetes reservation embeds the VM fields we need
+	var config VM
+	if err := json.Unmarshal(reservation.Data, &config); err != nil {
+		return pkg.WorkloadDegraded, errors.Wrap(err, "failed to decode reservation schema")
+	}
+
+	if _, err := i.vms.Inspect(reservation.ID); err != nil {
+		// the vm module restarts the machines it still has a config for
+		if i.vms.Exists(reservation.ID) {
+			return pkg.WorkloadRestarting, errors.Wrap(err, "vm is not running")
+		}
+		return pkg.WorkloadStopped, errors.Wrap(err, "vm is not running")
+	}
+
+	for _, attachment := range config.Attachments() {
+		netID := provision.NetworkID(reservation.User, string(attachment.NetworkID))
+		exists, err := i.network.TapExists(netID, reservation.ID)
+		if err == nil && !exists {
+			// the VMs deployed before a network could have multiple
+			// taps use the tap of the network that has no owner
+			exists, err = i.network.TapExists(netID, "")
+		}
+		if err != nil {
+			return pkg.WorkloadDegraded, errors.Wrap(err, "failed to check vm tap device")
+		}
+		if !exists {
+			return pkg.WorkloadDegraded, fmt.Errorf("tap device of network %s is missing", attachment.NetworkID)
+		}
+	}
+
+	return pkg.WorkloadRunning, nil
+}
+
+func (i *inspector) namespace(reservation *provision.Reservation) (pkg.WorkloadState, error) {
+	allocation, err := i.allocations.Find(reservation.ID)
+	if err != nil {
+		return pkg.WorkloadStopped, errors.Wrap(err, "failed to find namespace storage")
+	}
+
+	containerID := pkg.ContainerID(allocation.VolumeID)
+	if _, err := i.containers.Inspect(zdbContainerNS, containerID); err != nil {
+		return pkg.WorkloadStopped, errors.Wrapf(err, "0-db container %s is not running", containerID)
+	}
+
+	zdbCl := zdbConnection(containerID)
+	defer zdbCl.Close()
+	if err := zdbCl.Connect(); err != nil {
+		return pkg.WorkloadDegraded, errors.Wrapf(err, "failed to connect to 0-db: %s", containerID)
+	}
+
+	exists, err := zdbCl.Exist(reservation.ID)
+	if err != nil {
+		return pkg.WorkloadDegraded, errors.Wrapf(err, "failed to check namespace in 0-db: %s", containerID)
+	}
+	if !exists {
+		return pkg.WorkloadDegraded, fmt.Errorf("namespace is missing from 0-db %s", containerID)
+	}
+
+	return pkg.WorkloadRunning, nil
+}
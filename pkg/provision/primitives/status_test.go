@@ -0,0 +1,183 @@
+package primitives
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/zdb"
+)
+
+type inspectorMock struct {
+	containers map[string]bool
+	vms        map[string]bool
+	configs    map[string]bool
+	// taps are indexed by network/name
+	taps map[string]bool
+}
+
+func (m *inspectorMock) Inspect(ns string, id pkg.ContainerID) (pkg.Container, error) {
+	if !m.containers[fmt.Sprintf("%s/%s", ns, id)] {
+		return pkg.Container{}, fmt.Errorf("container %s not found", id)
+	}
+	return pkg.Container{Name: string(id)}, nil
+}
+
+func (m *inspectorMock) TapExists(networkID pkg.NetID, name string) (bool, error) {
+	return m.taps[fmt.Sprintf("%s/%s", networkID, name)], nil
+}
+
+func (m *inspectorMock) Find(namespace string) (pkg.Allocation, error) {
+	if namespace != "1-1" {
+		return pkg.Allocation{}, fmt.Errorf("namespace %s not found", namespace)
+	}
+	return pkg.Allocation{VolumeID: "zdb-volume"}, nil
+}
+
+type vmInspectorMock struct {
+	*inspectorMock
+}
+
+func (m vmInspectorMock) Inspect(name string) (pkg.VMInfo, error) {
+	if !m.vms[name] {
+		return pkg.VMInfo{}, fmt.Errorf("vm %s is not running", name)
+	}
+	return pkg.VMInfo{}, nil
+}
+
+func (m vmInspectorMock) Exists(name string) bool {
+	return m.configs[name]
+}
+
+func newInspector(m *inspectorMock) *inspector {
+	return &inspector{
+		containers:  m,
+		vms:         vmInspectorMock{m},
+		network:     m,
+		allocations: m,
+	}
+}
+
+func TestContainerStatus(t *testing.T) {
+	m := &inspectorMock{containers: map[string]bool{"nsuser/1-1": true}}
+	i := newInspector(m)
+
+	state, err := i.container(&provision.Reservation{ID: "1-1", User: "user"})
+	require.NoError(t, err)
+	require.Equal(t, pkg.WorkloadRunning, state)
+
+	state, err = i.container(&provision.Reservation{ID: "2-1", User: "user"})
+	require.Error(t, err)
+	require.Equal(t, pkg.WorkloadStopped, state)
+}
+
+func TestVMStatus(t *testing.T) {
+	data, err := json.Marshal(VM{
+		NetworkID: "net",
+		IP:        net.ParseIP("10.0.0.2"),
+		Networks: []VMNetwork{
+			{NetworkID: "other", IP: net.ParseIP("10.1.0.2")},
+		},
+	})
+	require.NoError(t, err)
+	tap := func(network, name string) string {
+		return fmt.Sprintf("%s/%s", provision.NetworkID("user", network), name)
+	}
+
+	tests := []struct {
+		name    string
+		mock    inspectorMock
+		state   pkg.WorkloadState
+		healthy bool
+	}{
+		{
+			name:    "running",
+			mock:    inspectorMock{vms: map[string]bool{"1-1": true}, taps: map[string]bool{tap("net", "1-1"): true, tap("other", "1-1"): true}},
+			state:   pkg.WorkloadRunning,
+			healthy: true,
+		},
+		{
+			name:    "running with legacy tap",
+			mock:    inspectorMock{vms: map[string]bool{"1-1": true}, taps: map[string]bool{tap("net", ""): true, tap("other", "1-1"): true}},
+			state:   pkg.WorkloadRunning,
+			healthy: true,
+		},
+		{
+			name:  "tap missing",
+			mock:  inspectorMock{vms: map[string]bool{"1-1": true}, taps: map[string]bool{tap("net", "1-1"): true}},
+			state: pkg.WorkloadDegraded,
+		},
+		{
+			name:  "restarting",
+			mock:  inspectorMock{configs: map[string]bool{"1-1": true}},
+			state: pkg.WorkloadRestarting,
+		},
+		{
+			name:  "stopped",
+			mock:  inspectorMock{},
+			state: pkg.WorkloadStopped,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := test.mock
+			state, err := newInspector(&mock).vm(&provision.Reservation{ID: "1-1", User: "user", Data: data})
+			require.Equal(t, test.state, state)
+			if test.healthy {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+type zdbMock struct {
+	zdb.Client
+	namespaces map[string]bool
+}
+
+func (z *zdbMock) Connect() error { return nil }
+func (z *zdbMock) Close() error   { return nil }
+func (z *zdbMock) Exist(name string) (bool, error) {
+	return z.namespaces[name], nil
+}
+
+func TestZDBStatus(t *testing.T) {
+	original := zdbConnection
+	defer func() {
+		zdbConnection = original
+	}()
+
+	namespaces := map[string]bool{"1-1": true}
+	zdbConnection = func(id pkg.ContainerID) zdb.Client {
+		return &zdbMock{namespaces: namespaces}
+	}
+
+	m := &inspectorMock{containers: map[string]bool{"zdb/zdb-volume": true}}
+	i := newInspector(m)
+	r := &provision.Reservation{ID: "1-1", User: "user"}
+
+	state, err := i.namespace(r)
+	require.NoError(t, err)
+	require.Equal(t, pkg.WorkloadRunning, state)
+
+	delete(namespaces, "1-1")
+	state, err = i.namespace(r)
+	require.Error(t, err)
+	require.Equal(t, pkg.WorkloadDegraded, state)
+
+	m.containers = nil
+	state, err = i.namespace(r)
+	require.Error(t, err)
+	require.Equal(t, pkg.WorkloadStopped, state)
+
+	state, err = i.namespace(&provision.Reservation{ID: "2-1", User: "user"})
+	require.Error(t, err)
+	require.Equal(t, pkg.WorkloadStopped, state)
+}
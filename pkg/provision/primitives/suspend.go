@@ -0,0 +1,102 @@
+package primitives
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/stubs"
+)
+
+// suspender suspends and resumes the workloads of the reservations in
+// their grace period. It only holds the small part of the modules needed
+type suspender struct {
+	containers interface {
+		Pause(ns string, id pkg.ContainerID) error
+		Resume(ns string, id pkg.ContainerID) error
+	}
+	vms interface {
+		Stop(name string) error
+		Start(name string) error
+	}
+	allocations interface {
+		Find(namespace string) (pkg.Allocation, error)
+	}
+}
+
+func (p *Provisioner) suspender() *suspender {
+	return &suspender{
+		containers:  stubs.NewContainerModuleStub(p.zbus),
+		vms:         stubs.NewVMModuleStub(p.zbus),
+		allocations: stubs.NewZDBAllocaterStub(p.zbus),
+	}
+}
+
+func (p *Provisioner) containerSuspend(ctx context.Context, reservation *provision.Reservation) error {
+	return p.suspender().container(reservation, true)
+}
+
+func (p *Provisioner) containerResume(ctx context.Context, reservation *provision.Reservation) error {
+	return p.suspender().container(reservation, false)
+}
+
+func (p *Provisioner) vmSuspend(ctx context.Context, reservation *provision.Reservation) error {
+	return p.suspender().vm(reservation, true)
+}
+
+func (p *Provisioner) vmResume(ctx context.Context, reservation *provision.Reservation) error {
+	return p.suspender().vm(reservation, false)
+}
+
+func (p *Provisioner) zdbSuspend(ctx context.Context, reservation *provision.Reservation) error {
+	return p.suspender().namespace(reservation, true)
+}
+
+func (p *Provisioner) zdbResume(ctx context.Context, reservation *provision.Reservation) error {
+	return p.suspender().namespace(reservation, false)
+}
+
+// container pauses or resumes all the processes of the container
+func (s *suspender) container(reservation *provision.Reservation, suspend bool) error {
+	tenantNS := fmt.Sprintf("ns%s", reservation.User)
+	containerID := pkg.ContainerID(reservation.ID)
+
+	if suspend {
+		return errors.Wrapf(s.containers.Pause(tenantNS, containerID), "failed to pause container %s", containerID)
+	}
+
+	return errors.Wrapf(s.containers.Resume(tenantNS, containerID), "failed to resume container %s", containerID)
+}
+
+// vm stops or starts the machine, its disks and tap devices are kept
+// so the machine boots again with the same data
+func (s *suspender) vm(reservation *provision.Reservation, suspend bool) error {
+	if suspend {
+		return errors.Wrapf(s.vms.Stop(reservation.ID), "failed to stop vm %s", reservation.ID)
+	}
+
+	return errors.Wrapf(s.vms.Start(reservation.ID), "failed to start vm %s", reservation.ID)
+}
+
+// namespace makes the namespace read-only while it is suspended
+func (s *suspender) namespace(reservation *provision.Reservation, suspend bool) error {
+	allocation, err := s.allocations.Find(reservation.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to find namespace storage")
+	}
+
+	containerID := pkg.ContainerID(allocation.VolumeID)
+	zdbCl := zdbConnection(containerID)
+	defer zdbCl.Close()
+	if err := zdbCl.Connect(); err != nil {
+		return errors.Wrapf(err, "failed to connect to 0-db: %s", containerID)
+	}
+
+	if err := zdbCl.NamespaceSetLock(reservation.ID, suspend); err != nil {
+		return errors.Wrapf(err, "failed to change lock of namespace in 0-db: %s", containerID)
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package primitives
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/zdb"
+)
+
+type suspenderMock struct {
+	paused  map[string]bool
+	stopped map[string]bool
+}
+
+func (m *suspenderMock) Pause(ns string, id pkg.ContainerID) error {
+	m.paused[fmt.Sprintf("%s/%s", ns, id)] = true
+	return nil
+}
+
+func (m *suspenderMock) Resume(ns string, id pkg.ContainerID) error {
+	delete(m.paused, fmt.Sprintf("%s/%s", ns, id))
+	return nil
+}
+
+func (m *suspenderMock) Stop(name string) error {
+	if name != "1-1" {
+		return fmt.Errorf("machine '%s' does not exist", name)
+	}
+	m.stopped[name] = true
+	return nil
+}
+
+func (m *suspenderMock) Start(name string) error {
+	delete(m.stopped, name)
+	return nil
+}
+
+func (m *suspenderMock) Find(namespace string) (pkg.Allocation, error) {
+	return pkg.Allocation{VolumeID: "zdb-volume"}, nil
+}
+
+func newSuspender(m *suspenderMock) *suspender {
+	return &suspender{
+		containers:  m,
+		vms:         m,
+		allocations: m,
+	}
+}
+
+func TestContainerSuspend(t *testing.T) {
+	m := &suspenderMock{paused: make(map[string]bool)}
+	s := newSuspender(m)
+	r := &provision.Reservation{ID: "1-1", User: "user"}
+
+	require.NoError(t, s.container(r, true))
+	require.True(t, m.paused["nsuser/1-1"])
+
+	require.NoError(t, s.container(r, false))
+	require.Empty(t, m.paused)
+}
+
+func TestVMSuspend(t *testing.T) {
+	m := &suspenderMock{stopped: make(map[string]bool)}
+	s := newSuspender(m)
+
+	require.NoError(t, s.vm(&provision.Reservation{ID: "1-1"}, true))
+	require.True(t, m.stopped["1-1"])
+
+	require.NoError(t, s.vm(&provision.Reservation{ID: "1-1"}, false))
+	require.Empty(t, m.stopped)
+
+	require.Error(t, s.vm(&provision.Reservation{ID: "2-1"}, true))
+}
+
+type zdbLockMock struct {
+	zdb.Client
+	locked map[string]bool
+}
+
+func (z *zdbLockMock) Connect() error { return nil }
+func (z *zdbLockMock) Close() error   { return nil }
+func (z *zdbLockMock) NamespaceSetLock(name string, lock bool) error {
+	z.locked[name] = lock
+	return nil
+}
+
+func TestZDBSuspend(t *testing.T) {
+	original := zdbConnection
+	defer func() {
+		zdbConnection = original
+	}()
+
+	locked := make(map[string]bool)
+	zdbConnection = func(id pkg.ContainerID) zdb.Client {
+		return &zdbLockMock{locked: locked}
+	}
+
+	s := newSuspender(&suspenderMock{})
+	r := &provision.Reservation{ID: "1-1", User: "user"}
+
+	require.NoError(t, s.namespace(r, true))
+	require.True(t, locked["1-1"])
+
+	require.NoError(t, s.namespace(r, false))
+	require.False(t, locked["1-1"])
+}
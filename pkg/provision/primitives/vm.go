@@ -5,14 +5,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 	"github.com/threefoldtech/tfexplorer/schema"
 	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/container/stats"
 	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/storage/image"
 	"github.com/threefoldtech/zos/pkg/stubs"
 )
 
@@ -29,12 +35,24 @@ type VM struct {
 	Size int64 `json:"size"`
 
 	Custom VMCustomSize `json:"custom_size"`
+	// MaxCRU and MaxMRU (optional) are the vCpu and memory in GiB the vm can
+	// be resized to without restarting it. They default to the size of the vm
+	MaxCRU int64   `json:"max_cru"`
+	MaxMRU float64 `json:"max_mru"`
 	// NetworkID of the network namepsace in which to run the VM. The network
 	// must be provisioned previously.
 	NetworkID pkg.NetID `json:"network_id"`
 	// IP of the VM. The IP must be part of the subnet available in the network
 	// resource defined by the networkID on this node
 	IP net.IP `json:"ip"`
+	// Networks are more private networks to attach the VM to, next to the one
+	// defined by NetworkID. The VM gets an interface in each of them, in order
+	Networks []VMNetwork `json:"networks"`
+	// PublicIP6 attaches the VM to the public network of the node, the VM
+	// gets its public IPv6 with slaac
+	PublicIP6 bool `json:"public_ip6"`
+	// YggdrasilIP attaches the VM to the yggdrasil network
+	YggdrasilIP bool `json:"yggdrasil_ip"`
 
 	SSHKeys []string `json:"ssh_keys"`
 	// PublicIP points to a reservation for a public ip
@@ -42,21 +60,84 @@ type VM struct {
 
 	// A name of a predefined list of VMs
 	Name string `json:"name"`
+	// FList is the url of a custom image to use instead of a predefined one
+	// Docs: docs/vms/readme.md
+	FList string `json:"flist"`
+	// FListHash (optional) is the md5 the flist must have, the VM is not
+	// deployed if the flist changed
+	FListHash string `json:"flist_hash"`
+
+	// CloudInit configuration of the VM (optional)
+	CloudInit *VMCloudInit `json:"cloud_init,omitempty"`
+
+	// Stats backends the metrics of the VM are pushed to
+	Stats []stats.Stats `json:"stats,omitempty"`
+
+	// Disks are the IDs of the disk reservations attached to the VM after
+	// its root disk, in order. The disks must belong to the user of the VM
+	Disks []string `json:"disks,omitempty"`
 }
 
-// VMInfo kernel initrd and the raw disk path of the vm
+// VMCloudInit is the cloud-init configuration passed to the VM
+// through a NoCloud seed disk
+type VMCloudInit struct {
+	// UserData is the content of the user-data file
+	UserData string `json:"user_data"`
+	// MetaData is the content of the meta-data file, if empty the
+	// reservation id is used as instance id and hostname
+	MetaData string `json:"meta_data"`
+	// NetworkConfig is the content of the network-config file
+	NetworkConfig string `json:"network_config"`
+}
+
+// maxCloudInitSize is the maximum size of all the cloud-init files together
+const maxCloudInitSize = 512 * 1024
+
+// VMNetwork is a private network a VM is attached to
+type VMNetwork struct {
+	// NetworkID of the network namepsace. The network must be provisioned previously.
+	NetworkID pkg.NetID `json:"network_id"`
+	// IP of the VM in this network. The IP must be part of the subnet available
+	// in the network resource on this node
+	IP net.IP `json:"ip"`
+}
+
+// Attachments returns all the private networks the VM is attached to,
+// the network defined by NetworkID comes first
+func (k VM) Attachments() []VMNetwork {
+	var networks []VMNetwork
+	if k.NetworkID != "" {
+		networks = append(networks, VMNetwork{NetworkID: k.NetworkID, IP: k.IP})
+	}
+
+	return append(networks, k.Networks...)
+}
+
+// VMInfo kernel initrd and the disk image path of the vm
 type VMInfo struct {
 	Initrd    string
 	Kernel    string
 	ImagePath string
+	// Image is the format and disk size of the image
+	Image image.Info
 }
 
+// vmImages are the names the disk image of a vm flist can have
+var vmImages = []string{"image.raw", "image.qcow2"}
+
 // VMREPO in which all the vm flists are stored
 const VMREPO = "https://hub.grid.tf/tf-official-vms/"
 
 // VMTAG the tag of the vm images
 const VMTAG = "latest"
 
+// vmFlistPrefix is the prefix of the names the vm flists are mounted under
+const vmFlistPrefix = "vm"
+
+// vmLegacyFlistPrefix is the prefix the vm flists were mounted under
+// before they got their own
+const vmLegacyFlistPrefix = k3osFlistPrefix
+
 func (p *Provisioner) virtualMachineProvision(ctx context.Context, reservation *provision.Reservation) (interface{}, error) {
 	return p.virtualMachineProvisionImpl(ctx, reservation)
 }
@@ -78,27 +159,13 @@ func (p *Provisioner) virtualMachineProvisionImpl(ctx context.Context, reservati
 		return result, err
 	}
 
-	netID := provision.NetworkID(reservation.User, string(config.NetworkID))
-
-	// check if the network tap already exists
-	// if it does, it's most likely that a vm with the same network id and node id already exists
-	// this will cause the reservation to fail
-	exists, err := network.TapExists(netID)
-	if err != nil {
-		return result, errors.Wrap(err, "could not check if tap device exists")
-	}
-
-	if exists {
-		return result, errors.New("another vm with same network already exists")
-	}
-
 	// check if public ipv4 is supported, should this be requested
 	if config.PublicIP != 0 && !network.PublicIPv4Support() {
 		return result, errors.New("public ipv4 is requested, but not supported on this node")
 	}
 
 	result.ID = reservation.ID
-	result.IP = config.IP.String()
+	result.IP = config.Attachments()[0].IP.String()
 
 	cpu, memory, disk, err := vmSize(config)
 	if err != nil {
@@ -110,18 +177,28 @@ func (p *Provisioner) virtualMachineProvisionImpl(ctx context.Context, reservati
 		return result, nil
 	}
 
-	flistName := VMREPO + strings.ToLower(config.Name) + "-" + VMTAG + ".flist"
-	imagePath, err := ensureFList(flist, flistName)
+	imagePath, err := ensureFList(flist, vmFlistPrefix, config.flistURL(), config.FListHash, vmLegacyFlistPrefix)
 	if err != nil {
-		return result, errors.Wrap(err, "could not mount k3os flist")
+		return result, errors.Wrap(err, "could not mount vm flist")
 	}
 	imageInfo, err := constructImageInfo(imagePath)
 	if err != nil {
 		return result, err
 	}
+	if imageInfo.Image.Size > disk*1024*1024 {
+		return result, fmt.Errorf("the vm image needs a disk of %d MiB, the vm size only has %d MiB", imageInfo.Image.Size/(1024*1024), disk)
+	}
+
+	disks, err := p.vmDisks(reservation.User, config.Disks)
+	if err != nil {
+		return result, err
+	}
 
 	var diskPath string
 	diskName := fmt.Sprintf("%s-%s", provision.FilesystemName(*reservation), "vda")
+	if err = provision.Step(ctx, stepDisk); err != nil {
+		return result, err
+	}
 	if storage.Exists(diskName) {
 		info, err := storage.Inspect(diskName)
 		if err != nil {
@@ -141,42 +218,36 @@ func (p *Provisioner) virtualMachineProvisionImpl(ctx context.Context, reservati
 		}
 	}()
 
-	var iface string
-	iface, err = network.SetupTap(netID)
-	if err != nil {
-		return result, errors.Wrap(err, "could not set up tap device")
-	}
-
 	defer func() {
 		if err != nil {
-			_ = network.RemoveTap(netID)
+			_ = removeVMTaps(network, reservation, config)
 		}
 	}()
 
-	var pubIface string
-	if config.PublicIP != 0 {
-		pubIface, err = network.SetupPubTap(pubIPResID(config.PublicIP))
-		if err != nil {
-			return result, errors.Wrap(err, "could not set up tap device for public network")
-		}
-
-		defer func() {
-			if err != nil {
-				_ = network.RemovePubTap(pubIPResID(config.PublicIP))
-			}
-		}()
+	var taps vmTaps
+	taps, err = p.setupVMTaps(ctx, reservation, config)
+	if err != nil {
+		return result, err
 	}
 
 	var netInfo pkg.VMNetworkInfo
-	netInfo, err = p.buildNetworkInfo(ctx, reservation.Version, reservation.User, iface, pubIface, config)
+	netInfo, err = p.buildNetworkInfo(ctx, reservation.Version, reservation.User, taps, config)
 	if err != nil {
 		return result, errors.Wrap(err, "could not generate network info")
 	}
+	result.setNetworks(config, taps)
+
 	cmdline, err := constructCMDLine(config)
 	if err != nil {
 		return result, err
 	}
-	err = p.vmRun(ctx, reservation.ID, cpu, memory, diskPath, imageInfo, cmdline, netInfo)
+	if err = provision.Step(ctx, stepVM); err != nil {
+		return result, err
+	}
+
+	// installed disk first
+	disks = append([]pkg.VMDisk{{Path: diskPath}}, disks...)
+	err = p.vmRun(ctx, reservation.ID, cpu, memory, disks, imageInfo, cmdline, netInfo, config)
 	if err != nil {
 		// attempt to delete the vm, should the process still be lingering
 		vm.Delete(reservation.ID)
@@ -185,12 +256,10 @@ func (p *Provisioner) virtualMachineProvisionImpl(ctx context.Context, reservati
 	return result, err
 }
 
-func (p *Provisioner) vmRun(ctx context.Context, name string, cpu uint8, memory uint64, diskPath string, imageInfo VMInfo, cmdline string, networkInfo pkg.VMNetworkInfo) error {
+func (p *Provisioner) vmRun(ctx context.Context, name string, cpu uint8, memory uint64, disks []pkg.VMDisk, imageInfo VMInfo, cmdline string, networkInfo pkg.VMNetworkInfo, config VM) error {
 	vm := stubs.NewVMModuleStub(p.zbus)
 
-	disks := make([]pkg.VMDisk, 1)
-	// installed disk
-	disks[0] = pkg.VMDisk{Path: diskPath, ReadOnly: false, Root: false}
+	maxCPU, maxMemory := vmMaxSize(config, cpu, memory)
 	vmObj := pkg.VM{
 		Name:        name,
 		CPU:         cpu,
@@ -200,11 +269,127 @@ func (p *Provisioner) vmRun(ctx context.Context, name string, cpu uint8, memory
 		InitrdImage: imageInfo.Initrd,
 		KernelArgs:  cmdline,
 		Disks:       disks,
+		MaxCPU:      maxCPU,
+		MaxMemory:   int64(maxMemory),
+		Stats:       config.Stats,
+	}
+
+	if cloudInit := config.CloudInit; cloudInit != nil {
+		vmObj.CloudInit = &pkg.CloudInit{
+			UserData:      cloudInit.UserData,
+			MetaData:      cloudInit.MetaData,
+			NetworkConfig: cloudInit.NetworkConfig,
+		}
 	}
 
 	return vm.Run(vmObj)
 }
 
+// vmUpdate resizes a deployed vm and attaches or detaches its disks
+func (p *Provisioner) vmUpdate(ctx context.Context, reservation, current *provision.Reservation) (interface{}, error) {
+	return p.vmUpdateImpl(ctx, reservation, current)
+}
+
+// vmUpdateImpl changes the vCpu, memory and disks of a deployed vm
+// without restarting it. Nothing else of the vm can be changed
+func (p *Provisioner) vmUpdateImpl(ctx context.Context, reservation, current *provision.Reservation) (result KubernetesResult, err error) {
+	var (
+		vm = stubs.NewVMModuleStub(p.zbus)
+
+		config, deployed VM
+	)
+
+	if err := json.Unmarshal(reservation.Data, &config); err != nil {
+		return result, errors.Wrap(err, "failed to decode reservation schema")
+	}
+
+	if err := json.Unmarshal(current.Data, &deployed); err != nil {
+		return result, errors.Wrap(err, "failed to decode reservation schema")
+	}
+
+	if err := config.Validate(); err != nil {
+		return result, err
+	}
+
+	cpu, memory, err := vmResize(config, deployed)
+	if err != nil {
+		return result, err
+	}
+
+	if err := json.Unmarshal(current.Result.Data, &result); err != nil {
+		return result, errors.Wrap(err, "failed to decode the result of the deployed vm")
+	}
+
+	if err := vm.Resize(reservation.ID, cpu, int64(memory)); err != nil {
+		return result, errors.Wrap(err, "failed to resize vm")
+	}
+
+	detach, attach := vmDiskChanges(deployed.Disks, config.Disks)
+	// the disks are detached first so a disk can be moved to
+	// another vm of the user
+	for _, id := range detach {
+		disks, err := p.vmDisks(reservation.User, []string{id})
+		if err != nil {
+			// the disk is gone with its reservation
+			log.Warn().Err(err).Str("id", reservation.ID).Str("disk", id).Msg("disk not found, skip detaching it")
+			continue
+		}
+
+		if err := vm.DetachDisk(reservation.ID, disks[0].Path); err != nil {
+			return result, errors.Wrapf(err, "failed to detach disk %s", id)
+		}
+	}
+
+	disks, err := p.vmDisks(reservation.User, attach)
+	if err != nil {
+		return result, err
+	}
+
+	for i, disk := range disks {
+		if err := vm.AttachDisk(reservation.ID, disk); err != nil {
+			return result, errors.Wrapf(err, "failed to attach disk %s", attach[i])
+		}
+	}
+
+	return result, nil
+}
+
+// vmResize checks that only the size and the disks changed between the
+// deployed vm and its new version, and returns the new vCpu and memory in MiB
+func vmResize(config, deployed VM) (cpu uint8, memory uint64, err error) {
+	cpu, memory, disk, err := vmSize(config)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not interpret vm size")
+	}
+
+	deployedCPU, deployedMemory, deployedDisk, err := vmSize(deployed)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not interpret deployed vm size")
+	}
+
+	if disk != deployedDisk {
+		return 0, 0, fmt.Errorf("cannot change the disk size of the vm from %d MiB to %d MiB", deployedDisk, disk)
+	}
+
+	maxCPU, maxMemory := vmMaxSize(deployed, deployedCPU, deployedMemory)
+	if cpu > maxCPU || memory > maxMemory {
+		return 0, 0, fmt.Errorf("cannot resize the vm above %d vcpu and %d MiB of memory", maxCPU, maxMemory)
+	}
+
+	if memory < deployedMemory {
+		return 0, 0, fmt.Errorf("cannot shrink the memory of the vm from %d MiB to %d MiB", deployedMemory, memory)
+	}
+
+	// apart from its size and disks, the vm must stay the same
+	config.Size, config.Custom = deployed.Size, deployed.Custom
+	config.Disks = deployed.Disks
+	if !reflect.DeepEqual(config, deployed) {
+		return 0, 0, errors.New("cannot change the vm configuration, only its size and disks can be updated")
+	}
+
+	return cpu, memory, nil
+}
+
 func constructCMDLine(config VM) (string, error) {
 	cmdline := "root=/dev/vda rw console=ttyS0 reboot=k panic=1"
 	for _, key := range config.SSHKeys {
@@ -217,20 +402,61 @@ func constructCMDLine(config VM) (string, error) {
 	return cmdline, nil
 }
 
+// constructImageInfo checks the layout of a vm flist. It must have a kernel,
+// a disk image in raw or qcow2 format, and optionally an initrd
 func constructImageInfo(imagePath string) (VMInfo, error) {
-	initrd := ""
-	if _, err := os.Stat(imagePath + "/initrd"); err == nil {
-		initrd = imagePath + "/initrd"
+	regular := func(path string) error {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !stat.Mode().IsRegular() || stat.Size() == 0 {
+			return fmt.Errorf("%s is not a regular file or is empty", filepath.Base(path))
+		}
+		return nil
+	}
+
+	var info VMInfo
+	initrd := filepath.Join(imagePath, "initrd")
+	if _, err := os.Stat(initrd); err == nil {
+		if err := regular(initrd); err != nil {
+			return VMInfo{}, errors.Wrap(err, "invalid initrd")
+		}
+		info.Initrd = initrd
 	}
-	kernel := imagePath + "/kernel"
-	if _, err := os.Stat(kernel); err != nil {
+
+	info.Kernel = filepath.Join(imagePath, "kernel")
+	if err := regular(info.Kernel); err != nil {
 		return VMInfo{}, errors.Wrap(err, "couldn't stat kernel")
 	}
-	image := imagePath + "/image.raw"
-	if _, err := os.Stat(image); err != nil {
-		return VMInfo{}, errors.Wrap(err, "couldn't stat image.raw")
+
+	for _, name := range vmImages {
+		path := filepath.Join(imagePath, name)
+		if _, err := os.Stat(path); err == nil {
+			info.ImagePath = path
+			break
+		}
+	}
+	if info.ImagePath == "" {
+		return VMInfo{}, fmt.Errorf("couldn't find the disk image, it must be one of %s", strings.Join(vmImages, ", "))
+	}
+
+	var err error
+	info.Image, err = image.Inspect(info.ImagePath)
+	if err != nil {
+		return VMInfo{}, errors.Wrap(err, "invalid disk image")
+	}
+
+	return info, nil
+}
+
+// flistURL returns the url of the flist of the vm image
+func (k *VM) flistURL() string {
+	if k.FList != "" {
+		return k.FList
 	}
-	return VMInfo{Initrd: initrd, Kernel: kernel, ImagePath: image}, nil
+
+	return VMREPO + strings.ToLower(k.Name) + "-" + VMTAG + ".flist"
 }
 
 // Validate validates the vm config, name, ip, size, and ssh keys
@@ -240,17 +466,63 @@ func (k *VM) Validate() error {
 		return errors.New("the name must consist of alphanumeric characters, dot, and dash ony")
 	}
 
-	if k.IP.To4() == nil && k.IP.To16() == nil {
-		return errors.New("invalid IP")
+	if k.FList != "" {
+		u, err := url.Parse(k.FList)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("the flist must be an http or https url")
+		}
+	}
+	if matched, _ := regexp.MatchString("^[0-9a-fA-F]*$", k.FListHash); !matched || (k.FListHash != "" && len(k.FListHash) != 32) {
+		return errors.New("the flist hash must be an md5 hex digest")
+	}
+
+	networks := k.Attachments()
+	if len(networks) == 0 {
+		return errors.New("the vm must be attached to at least one network")
+	}
+	seen := make(map[pkg.NetID]struct{}, len(networks))
+	for _, network := range networks {
+		if network.NetworkID == "" {
+			return errors.New("network id is required")
+		}
+		if network.IP.To4() == nil && network.IP.To16() == nil {
+			return fmt.Errorf("invalid IP for network %s", network.NetworkID)
+		}
+		if _, ok := seen[network.NetworkID]; ok {
+			return fmt.Errorf("the vm is attached twice to network %s", network.NetworkID)
+		}
+		seen[network.NetworkID] = struct{}{}
 	}
 	if k.Size != -1 && (k.Size < 1 || k.Size > 18) {
 		return errors.New("unsupported vm size %d, only size -1, and 1 to 18 are supported")
 	}
+	if k.MaxCRU < 0 || k.MaxCRU > 32 {
+		return errors.New("the max vcpu of the vm must be between 0 and 32")
+	}
+	if k.MaxMRU < 0 {
+		return errors.New("the max memory of the vm can't be negative")
+	}
 	for _, key := range k.SSHKeys {
 		trimmed := strings.TrimSpace(key)
 		if strings.ContainsAny(trimmed, "\t\r\n\f\"") {
 			return errors.New("ssh keys can't contain intermediate whitespace chars other than white space")
 		}
 	}
+	disks := make(map[string]struct{}, len(k.Disks))
+	for _, disk := range k.Disks {
+		if disk == "" {
+			return errors.New("disk id is required")
+		}
+		if _, ok := disks[disk]; ok {
+			return fmt.Errorf("disk %s is attached twice to the vm", disk)
+		}
+		disks[disk] = struct{}{}
+	}
+	if k.CloudInit != nil {
+		size := len(k.CloudInit.UserData) + len(k.CloudInit.MetaData) + len(k.CloudInit.NetworkConfig)
+		if size > maxCloudInitSize {
+			return fmt.Errorf("cloud-init configuration is too large, it can't exceed %d bytes", maxCloudInitSize)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,213 @@
+package primitives
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg/provision"
+	"github.com/threefoldtech/zos/pkg/storage/image"
+)
+
+func TestVMAttachments(t *testing.T) {
+	vm := VM{
+		Size:      1,
+		NetworkID: "net",
+		IP:        net.ParseIP("10.0.0.2"),
+		Networks: []VMNetwork{
+			{NetworkID: "other", IP: net.ParseIP("10.1.0.2")},
+		},
+	}
+	require.NoError(t, vm.Validate())
+	require.Equal(t, []VMNetwork{
+		{NetworkID: "net", IP: net.ParseIP("10.0.0.2")},
+		{NetworkID: "other", IP: net.ParseIP("10.1.0.2")},
+	}, vm.Attachments())
+
+	// the networks list is enough on its own
+	vm.NetworkID = ""
+	vm.IP = nil
+	require.NoError(t, vm.Validate())
+	require.Len(t, vm.Attachments(), 1)
+
+	vm.Networks = append(vm.Networks, VMNetwork{NetworkID: "other", IP: net.ParseIP("10.1.0.3")})
+	require.Error(t, vm.Validate())
+
+	vm.Networks = []VMNetwork{{NetworkID: "other"}}
+	require.Error(t, vm.Validate())
+
+	vm.Networks = nil
+	require.Error(t, vm.Validate())
+}
+
+func TestVMCloudInit(t *testing.T) {
+	vm := VM{
+		Size:      1,
+		NetworkID: "net",
+		IP:        net.ParseIP("10.0.0.2"),
+		CloudInit: &VMCloudInit{UserData: "#cloud-config\n"},
+	}
+	require.NoError(t, vm.Validate())
+
+	vm.CloudInit.UserData = strings.Repeat("a", maxCloudInitSize+1)
+	require.Error(t, vm.Validate())
+
+	k8s := Kubernetes{VM: vm}
+	k8s.CloudInit.UserData = "#cloud-config\n"
+	require.Error(t, k8s.Validate())
+}
+
+func TestVMFList(t *testing.T) {
+	vm := VM{Size: 1, NetworkID: "net", IP: net.ParseIP("10.0.0.2"), Name: "Ubuntu-20.04"}
+	require.NoError(t, vm.Validate())
+	require.Equal(t, VMREPO+"ubuntu-20.04-latest.flist", vm.flistURL())
+
+	vm.FList = "https://hub.grid.tf/team/appliance.flist"
+	vm.FListHash = "2d9a4e1b3c0f5a6b7c8d9e0f1a2b3c4d"
+	require.NoError(t, vm.Validate())
+	require.Equal(t, vm.FList, vm.flistURL())
+
+	vm.FListHash = "not-a-hash"
+	require.Error(t, vm.Validate())
+
+	vm.FListHash = ""
+	vm.FList = "file:///etc/passwd"
+	require.Error(t, vm.Validate())
+}
+
+func TestVMResize(t *testing.T) {
+	deployed := VM{
+		Size:      -1,
+		Custom:    VMCustomSize{CRU: 2, MRU: 2, SRU: 50},
+		MaxCRU:    4,
+		MaxMRU:    8,
+		NetworkID: "net",
+		IP:        net.ParseIP("10.0.0.2"),
+	}
+
+	config := deployed
+	config.Custom = VMCustomSize{CRU: 4, MRU: 4.5, SRU: 50}
+	cpu, memory, err := vmResize(config, deployed)
+	require.NoError(t, err)
+	require.Equal(t, uint8(4), cpu)
+	require.Equal(t, uint64(4608), memory)
+
+	// switching to a predefined size with the same disk is a resize too
+	config = deployed
+	config.Size = 17
+	_, _, err = vmResize(config, deployed)
+	require.NoError(t, err)
+
+	config = deployed
+	config.Custom.CRU = 5
+	_, _, err = vmResize(config, deployed)
+	require.Error(t, err)
+
+	config = deployed
+	config.Custom.MRU = 1
+	_, _, err = vmResize(config, deployed)
+	require.Error(t, err)
+
+	config = deployed
+	config.Custom.SRU = 100
+	_, _, err = vmResize(config, deployed)
+	require.Error(t, err)
+
+	config = deployed
+	config.IP = net.ParseIP("10.0.0.3")
+	_, _, err = vmResize(config, deployed)
+	require.Error(t, err)
+
+	// without a max size, a vm can't grow
+	deployed.MaxCRU, deployed.MaxMRU = 0, 0
+	config = deployed
+	config.Custom.CRU = 3
+	_, _, err = vmResize(config, deployed)
+	require.Error(t, err)
+}
+
+func TestConstructImageInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vm-flist")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data []byte) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+
+	_, err = constructImageInfo(dir)
+	require.Error(t, err)
+
+	write("kernel", []byte("kernel"))
+	_, err = constructImageInfo(dir)
+	require.Error(t, err, "the disk image is missing")
+
+	qcow2 := make([]byte, 512)
+	copy(qcow2, []byte{'Q', 'F', 'I', 0xfb})
+	write("image.qcow2", qcow2)
+	info, err := constructImageInfo(dir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "kernel"), info.Kernel)
+	require.Equal(t, filepath.Join(dir, "image.qcow2"), info.ImagePath)
+	require.Equal(t, image.FormatQCOW2, info.Image.Format)
+	require.Empty(t, info.Initrd)
+
+	// raw images are preferred
+	write("image.raw", make([]byte, 1024))
+	write("initrd", []byte("initrd"))
+	info, err = constructImageInfo(dir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "image.raw"), info.ImagePath)
+	require.Equal(t, image.Info{Format: image.FormatRaw, Size: 1024}, info.Image)
+	require.Equal(t, filepath.Join(dir, "initrd"), info.Initrd)
+
+	write("kernel", nil)
+	_, err = constructImageInfo(dir)
+	require.Error(t, err)
+}
+
+func TestVMLockKeys(t *testing.T) {
+	r := capacityReservation(t, "1-1", VirtualMachineReservation, VM{
+		NetworkID: "net",
+		IP:        net.ParseIP("10.0.0.2"),
+		Networks: []VMNetwork{
+			{NetworkID: "other", IP: net.ParseIP("10.1.0.2")},
+		},
+		PublicIP: 12,
+	})
+
+	require.Equal(t, []string{
+		"network:" + string(provision.NetworkID("user", "net")),
+		"network:" + string(provision.NetworkID("user", "other")),
+		pubIPResID(12),
+	}, LockKeys(r))
+}
+
+func TestRemoveVMTaps(t *testing.T) {
+	r := &provision.Reservation{ID: "1-1", User: "user"}
+	cfg := VM{
+		NetworkID: "net",
+		IP:        net.ParseIP("10.0.0.2"),
+		Networks: []VMNetwork{
+			{NetworkID: "other", IP: net.ParseIP("10.1.0.2")},
+		},
+		PublicIP:    12,
+		PublicIP6:   true,
+		YggdrasilIP: true,
+	}
+
+	m := &modulesMock{}
+	require.NoError(t, removeVMTaps(m, r, cfg))
+	require.Equal(t, []string{
+		fmt.Sprintf("network.removetap %s 1-1", provision.NetworkID(r.User, "net")),
+		fmt.Sprintf("network.removetap %s 1-1", provision.NetworkID(r.User, "other")),
+		fmt.Sprintf("network.removepubtap %s", pubIPResID(12)),
+		"network.removepub6tap 1-1",
+		"network.removeyggtap 1-1",
+	}, m.calls)
+}
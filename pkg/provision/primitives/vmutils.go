@@ -23,6 +23,23 @@ type VMCustomSize struct {
 	SRU float64 `json:"sru"`
 }
 
+// vmTaps are the tap devices of a VM
+type vmTaps struct {
+	// private are the taps of the private networks, in the order of the attachments
+	private []string
+	public  string
+	public6 string
+	ygg     pkg.YggTap
+}
+
+// vmTapRemover removes the tap devices of a VM
+type vmTapRemover interface {
+	RemoveTap(networkID pkg.NetID, name string) error
+	RemovePubTap(pubIPReservationID string) error
+	RemovePubIPv6Tap(name string) error
+	RemoveYggTap(name string) error
+}
+
 func (p *Provisioner) vmDecomission(ctx context.Context, reservation *provision.Reservation) error {
 	var (
 		storage = stubs.NewVDiskModuleStub(p.zbus)
@@ -40,17 +57,26 @@ func (p *Provisioner) vmDecomission(ctx context.Context, reservation *provision.
 		return errors.Wrapf(err, "failed to delete vm %s", reservation.ID)
 	}
 
-	netID := provision.NetworkID(reservation.User, string(cfg.NetworkID))
-	if err := network.RemoveTap(netID); err != nil {
-		return errors.Wrap(err, "could not clean up tap device")
-	}
+	// the VMs deployed before a network could have multiple taps
+	// use the tap of the network that has no owner
+	for _, attachment := range cfg.Attachments() {
+		netID := provision.NetworkID(reservation.User, string(attachment.NetworkID))
+		exists, err := network.TapExists(netID, reservation.ID)
+		if err != nil {
+			return errors.Wrap(err, "could not check if tap device exists")
+		}
 
-	if cfg.PublicIP != 0 {
-		if err := network.RemovePubTap(pubIPResID(cfg.PublicIP)); err != nil {
-			return errors.Wrap(err, "could not clean up public tap device")
+		if !exists {
+			if err := network.RemoveTap(netID, ""); err != nil {
+				return errors.Wrap(err, "could not clean up tap device")
+			}
 		}
 	}
 
+	if err := removeVMTaps(network, reservation, cfg); err != nil {
+		return err
+	}
+
 	if err := storage.Deallocate(fmt.Sprintf("%s-%s", reservation.ID, "vda")); err != nil {
 		return errors.Wrap(err, "could not remove vDisk")
 	}
@@ -58,42 +84,134 @@ func (p *Provisioner) vmDecomission(ctx context.Context, reservation *provision.
 	return nil
 }
 
-func (p *Provisioner) buildNetworkInfo(ctx context.Context, rversion int, userID string, iface string, pubIface string, cfg VM) (pkg.VMNetworkInfo, error) {
+// setupVMTaps creates a tap device for each network the VM is attached to. The
+// taps already created are not removed on error, this is left to the caller
+func (p *Provisioner) setupVMTaps(ctx context.Context, reservation *provision.Reservation, cfg VM) (taps vmTaps, err error) {
 	network := stubs.NewNetworkerStub(p.zbus)
 
-	netID := provision.NetworkID(userID, string(cfg.NetworkID))
-	subnet, err := network.GetSubnet(netID)
-	if err != nil {
-		return pkg.VMNetworkInfo{}, errors.Wrapf(err, "could not get network resource subnet")
+	if err = provision.Step(ctx, stepTap); err != nil {
+		return taps, err
 	}
 
-	if !subnet.Contains(cfg.IP) {
-		return pkg.VMNetworkInfo{}, fmt.Errorf("IP %s is not part of local nr subnet %s", cfg.IP.String(), subnet.String())
+	for _, attachment := range cfg.Attachments() {
+		netID := provision.NetworkID(reservation.User, string(attachment.NetworkID))
+
+		var tap string
+		tap, err = network.SetupTap(netID, reservation.ID)
+		if err != nil {
+			return taps, errors.Wrapf(err, "could not set up tap device for network %s", attachment.NetworkID)
+		}
+		taps.private = append(taps.private, tap)
 	}
 
-	privNet, err := network.GetNet(netID)
-	if err != nil {
-		return pkg.VMNetworkInfo{}, errors.Wrapf(err, "could not get network range")
+	if cfg.PublicIP != 0 {
+		if err = provision.Step(ctx, stepPubTap); err != nil {
+			return taps, err
+		}
+
+		taps.public, err = network.SetupPubTap(pubIPResID(cfg.PublicIP))
+		if err != nil {
+			return taps, errors.Wrap(err, "could not set up tap device for public network")
+		}
 	}
 
-	addrCIDR := net.IPNet{
-		IP:   cfg.IP,
-		Mask: subnet.Mask,
+	if cfg.PublicIP6 {
+		if err = provision.Step(ctx, stepPubIPv6Tap); err != nil {
+			return taps, err
+		}
+
+		taps.public6, err = network.SetupPubIPv6Tap(reservation.ID)
+		if err != nil {
+			return taps, errors.Wrap(err, "could not set up tap device for public ipv6")
+		}
 	}
 
-	gw4, gw6, err := network.GetDefaultGwIP(netID)
-	if err != nil {
-		return pkg.VMNetworkInfo{}, errors.Wrap(err, "could not get network resource default gateway")
+	if cfg.YggdrasilIP {
+		if err = provision.Step(ctx, stepYggTap); err != nil {
+			return taps, err
+		}
+
+		taps.ygg, err = network.SetupYggTap(reservation.ID)
+		if err != nil {
+			return taps, errors.Wrap(err, "could not set up tap device for yggdrasil network")
+		}
 	}
 
-	privIP6, err := network.GetIPv6From4(netID, cfg.IP)
-	if err != nil {
-		return pkg.VMNetworkInfo{}, errors.Wrap(err, "could not convert private ipv4 to ipv6")
+	return taps, nil
+}
+
+// removeVMTaps removes all the tap devices of the VM, even if removing
+// some of them fails. The last error is returned
+func removeVMTaps(network vmTapRemover, reservation *provision.Reservation, cfg VM) error {
+	var result error
+	for _, attachment := range cfg.Attachments() {
+		netID := provision.NetworkID(reservation.User, string(attachment.NetworkID))
+		if err := network.RemoveTap(netID, reservation.ID); err != nil {
+			result = errors.Wrapf(err, "could not clean up tap device of network %s", attachment.NetworkID)
+		}
+	}
+
+	if cfg.PublicIP != 0 {
+		if err := network.RemovePubTap(pubIPResID(cfg.PublicIP)); err != nil {
+			result = errors.Wrap(err, "could not clean up public tap device")
+		}
+	}
+
+	if cfg.PublicIP6 {
+		if err := network.RemovePubIPv6Tap(reservation.ID); err != nil {
+			result = errors.Wrap(err, "could not clean up public ipv6 tap device")
+		}
+	}
+
+	if cfg.YggdrasilIP {
+		if err := network.RemoveYggTap(reservation.ID); err != nil {
+			result = errors.Wrap(err, "could not clean up yggdrasil tap device")
+		}
 	}
 
+	return result
+}
+
+func (p *Provisioner) buildNetworkInfo(ctx context.Context, rversion int, userID string, taps vmTaps, cfg VM) (pkg.VMNetworkInfo, error) {
+	network := stubs.NewNetworkerStub(p.zbus)
+
 	networkInfo := pkg.VMNetworkInfo{
-		Ifaces: []pkg.VMIface{{
-			Tap:            iface,
+		Nameservers: []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1"), net.ParseIP("2001:4860:4860::8888")},
+	}
+
+	for i, attachment := range cfg.Attachments() {
+		netID := provision.NetworkID(userID, string(attachment.NetworkID))
+		subnet, err := network.GetSubnet(netID)
+		if err != nil {
+			return pkg.VMNetworkInfo{}, errors.Wrapf(err, "could not get network resource subnet")
+		}
+
+		if !subnet.Contains(attachment.IP) {
+			return pkg.VMNetworkInfo{}, fmt.Errorf("IP %s is not part of local nr subnet %s", attachment.IP.String(), subnet.String())
+		}
+
+		privNet, err := network.GetNet(netID)
+		if err != nil {
+			return pkg.VMNetworkInfo{}, errors.Wrapf(err, "could not get network range")
+		}
+
+		addrCIDR := net.IPNet{
+			IP:   attachment.IP,
+			Mask: subnet.Mask,
+		}
+
+		gw4, gw6, err := network.GetDefaultGwIP(netID)
+		if err != nil {
+			return pkg.VMNetworkInfo{}, errors.Wrap(err, "could not get network resource default gateway")
+		}
+
+		privIP6, err := network.GetIPv6From4(netID, attachment.IP)
+		if err != nil {
+			return pkg.VMNetworkInfo{}, errors.Wrap(err, "could not convert private ipv4 to ipv6")
+		}
+
+		networkInfo.Ifaces = append(networkInfo.Ifaces, pkg.VMIface{
+			Tap:            taps.private[i],
 			MAC:            "", // rely on static IP configuration so we don't care here
 			IP4AddressCIDR: addrCIDR,
 			IP4GatewayIP:   net.IP(gw4),
@@ -101,8 +219,7 @@ func (p *Provisioner) buildNetworkInfo(ctx context.Context, rversion int, userID
 			IP6AddressCIDR: privIP6,
 			IP6GatewayIP:   gw6,
 			Public:         false,
-		}},
-		Nameservers: []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("1.1.1.1"), net.ParseIP("2001:4860:4860::8888")},
+		})
 	}
 
 	// from this reservation version on we deploy new VM's with the custom boot script for IP
@@ -124,7 +241,7 @@ func (p *Provisioner) buildNetworkInfo(ctx context.Context, rversion int, userID
 		mac := ifaceutil.HardwareAddrFromInputBytes([]byte(fmt.Sprintf("%d-1", cfg.PublicIP)))
 
 		iface := pkg.VMIface{
-			Tap:            pubIface,
+			Tap:            taps.public,
 			MAC:            mac.String(), // mac so we always get the same IPv6 from slaac
 			IP4AddressCIDR: pubIP,
 			IP4GatewayIP:   pubGw,
@@ -136,6 +253,28 @@ func (p *Provisioner) buildNetworkInfo(ctx context.Context, rversion int, userID
 		networkInfo.Ifaces = append(networkInfo.Ifaces, iface)
 	}
 
+	if cfg.PublicIP6 {
+		// the macvtap only lets the traffic of its own mac through, this needs
+		// to be the same as how the network module sets it up
+		mac := ifaceutil.HardwareAddrFromInputBytes([]byte(taps.public6))
+
+		networkInfo.Ifaces = append(networkInfo.Ifaces, pkg.VMIface{
+			Tap:    taps.public6,
+			MAC:    mac.String(),
+			Public: true,
+		})
+	}
+
+	if cfg.YggdrasilIP {
+		networkInfo.Ifaces = append(networkInfo.Ifaces, pkg.VMIface{
+			Tap:            taps.ygg.Name,
+			MAC:            taps.ygg.HW.String(),
+			IP6AddressCIDR: taps.ygg.IP,
+			IP6GatewayIP:   taps.ygg.Gateway,
+			Yggdrasil:      true,
+		})
+	}
+
 	return networkInfo, nil
 }
 
@@ -251,6 +390,20 @@ func vmSize(vm VM) (cpu uint8, memory uint64, storage uint64, err error) {
 	return 0, 0, 0, fmt.Errorf("unsupported vm size %d, only size -1, and 1 to 18 are supported", vm.Size)
 }
 
+// vmMaxSize returns the vCpu's and memory in MiB a vm of the given
+// size can be resized to while running
+func vmMaxSize(vm VM, cpu uint8, memory uint64) (uint8, uint64) {
+	maxCPU, maxMemory := cpu, memory
+	if vm.MaxCRU > int64(cpu) {
+		maxCPU = uint8(vm.MaxCRU)
+	}
+	if max := uint64(vm.MaxMRU * 1024); max > memory {
+		maxMemory = max
+	}
+
+	return maxCPU, maxMemory
+}
+
 func pubIPResID(reservationID schema.ID) string {
 	// TODO: should this change in the actual reservation?
 	return fmt.Sprintf("%d-1", reservationID)
@@ -3,6 +3,7 @@ package primitives
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 
 	"github.com/rs/zerolog/log"
 	"github.com/threefoldtech/zos/pkg"
@@ -58,6 +59,34 @@ func (p *Provisioner) volumeProvision(ctx context.Context, reservation *provisio
 	return p.volumeProvisionImpl(ctx, reservation)
 }
 
+func (p *Provisioner) volumeUpdateImpl(ctx context.Context, reservation, current *provision.Reservation) (VolumeResult, error) {
+	var config, deployed Volume
+	if err := json.Unmarshal(reservation.Data, &config); err != nil {
+		return VolumeResult{}, err
+	}
+
+	if err := json.Unmarshal(current.Data, &deployed); err != nil {
+		return VolumeResult{}, err
+	}
+
+	if config.Type != deployed.Type {
+		return VolumeResult{}, fmt.Errorf("cannot change disk type of volume from %s to %s", deployed.Type, config.Type)
+	}
+
+	storageClient := stubs.NewStorageModuleStub(p.zbus)
+
+	_, err := storageClient.UpdateFilesystem(provision.FilesystemName(*reservation), config.Size*gigabyte)
+
+	return VolumeResult{
+		ID: reservation.ID,
+	}, err
+}
+
+// volumeUpdate resizes a deployed volume
+func (p *Provisioner) volumeUpdate(ctx context.Context, reservation, current *provision.Reservation) (interface{}, error) {
+	return p.volumeUpdateImpl(ctx, reservation, current)
+}
+
 func (p *Provisioner) volumeDecommission(ctx context.Context, reservation *provision.Reservation) error {
 	storageClient := stubs.NewStorageModuleStub(p.zbus)
 
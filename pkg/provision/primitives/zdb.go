@@ -73,6 +73,10 @@ func (p *Provisioner) zdbProvisionImpl(ctx context.Context, reservation *provisi
 
 	// if we reached here, we need to create the 0-db namespace
 	log.Debug().Msg("allocating storage for namespace")
+	if err := provision.Step(ctx, stepAllocate); err != nil {
+		return ZDBResult{}, err
+	}
+
 	allocation, err := storage.Allocate(nsID, config.DiskType, config.Size*gigabyte, config.Mode)
 	if err != nil {
 		return ZDBResult{}, errors.Wrap(err, "failed to allocate storage")
@@ -80,6 +84,10 @@ func (p *Provisioner) zdbProvisionImpl(ctx context.Context, reservation *provisi
 
 	containerID := pkg.ContainerID(allocation.VolumeID)
 
+	if err := provision.Step(ctx, stepZDBContainer); err != nil {
+		return ZDBResult{}, err
+	}
+
 	cont, err := p.ensureZdbContainer(ctx, allocation, config.Mode)
 	if err != nil {
 		return ZDBResult{}, errors.Wrapf(err, "failed to ensure zdb containe running")
@@ -91,6 +99,10 @@ func (p *Provisioner) zdbProvisionImpl(ctx context.Context, reservation *provisi
 	}
 	log.Warn().Msgf("ip for zdb containers %s", containerIPs)
 
+	if err := provision.Step(ctx, stepNamespace); err != nil {
+		return ZDBResult{}, err
+	}
+
 	// this call will actually configure the namespace in zdb and set the password
 	if err := p.createZDBNamespace(containerID, nsID, config); err != nil {
 		return ZDBResult{}, errors.Wrap(err, "failed to create zdb namespace")
@@ -356,6 +368,98 @@ func (p *Provisioner) createZDBNamespace(containerID pkg.ContainerID, nsID strin
 	return nil
 }
 
+func (p *Provisioner) zdbUpdate(ctx context.Context, reservation, current *provision.Reservation) (interface{}, error) {
+	return p.zdbUpdateImpl(ctx, reservation, current)
+}
+
+// zdbCheckUpdate makes sure the namespace can be changed in place from
+// deployed to config. The namespace stays on the volume it is allocated on,
+// so its mode and disk type can't change, and 0-db can't remove the password
+// of a namespace. The size is checked against the volume by the storage module
+func zdbCheckUpdate(config, deployed ZDB) error {
+	if config.Mode != deployed.Mode {
+		return fmt.Errorf("cannot change mode of namespace from %s to %s", deployed.Mode, config.Mode)
+	}
+
+	if config.DiskType != deployed.DiskType {
+		return fmt.Errorf("cannot change disk type of namespace from %s to %s", deployed.DiskType, config.DiskType)
+	}
+
+	if config.Password == "" && deployed.Password != "" {
+		return fmt.Errorf("cannot remove the password of namespace, set a new one instead")
+	}
+
+	return nil
+}
+
+// zdbUpdateImpl changes the password, visibility or size of a deployed namespace
+func (p *Provisioner) zdbUpdateImpl(ctx context.Context, reservation, current *provision.Reservation) (ZDBResult, error) {
+	var (
+		storage = stubs.NewZDBAllocaterStub(p.zbus)
+
+		nsID             = reservation.ID
+		config, deployed ZDB
+	)
+
+	if err := json.Unmarshal(reservation.Data, &config); err != nil {
+		return ZDBResult{}, errors.Wrap(err, "failed to decode reservation schema")
+	}
+
+	if err := json.Unmarshal(current.Data, &deployed); err != nil {
+		return ZDBResult{}, errors.Wrap(err, "failed to decode reservation schema")
+	}
+
+	if err := zdbCheckUpdate(config, deployed); err != nil {
+		return ZDBResult{}, err
+	}
+
+	var err error
+	config.PlainPassword, err = decryptSecret(config.Password, reservation.User, reservation.Version, p.zbus)
+	if err != nil {
+		return ZDBResult{}, errors.Wrap(err, "failed to decrypt namespace password")
+	}
+
+	allocation, err := storage.Find(nsID)
+	if err != nil {
+		return ZDBResult{}, errors.Wrapf(err, "failed to find namespace %s", nsID)
+	}
+
+	if config.Size != deployed.Size {
+		log.Info().Str("namespace", nsID).Uint64("from", deployed.Size).Uint64("to", config.Size).Msg("resizing namespace")
+		if _, err := storage.Resize(nsID, config.Size*gigabyte); err != nil {
+			return ZDBResult{}, errors.Wrapf(err, "failed to resize namespace %s", nsID)
+		}
+	}
+
+	cont, err := p.ensureZdbContainer(ctx, allocation, config.Mode)
+	if err != nil {
+		return ZDBResult{}, errors.Wrapf(err, "failed to ensure zdb containe running")
+	}
+
+	containerIPs, err := p.waitZDBIPs(ctx, nwmod.ZDBIface, cont.Network.Namespace)
+	if err != nil {
+		return ZDBResult{}, errors.Wrap(err, "failed to find IP address on zdb0 interface")
+	}
+
+	// the namespace already exists, this only applies the new password, visibility and size
+	containerID := pkg.ContainerID(allocation.VolumeID)
+	if err := p.createZDBNamespace(containerID, nsID, config); err != nil {
+		return ZDBResult{}, errors.Wrap(err, "failed to update zdb namespace")
+	}
+
+	return ZDBResult{
+		Namespace: nsID,
+		IPs: func() []string {
+			ips := make([]string, len(containerIPs))
+			for i, ip := range containerIPs {
+				ips[i] = ip.String()
+			}
+			return ips
+		}(),
+		Port: zdbPort,
+	}, nil
+}
+
 func (p *Provisioner) zdbDecommission(ctx context.Context, reservation *provision.Reservation) error {
 	var (
 		storage       = stubs.NewZDBAllocaterStub(p.zbus)
@@ -389,8 +493,16 @@ func (p *Provisioner) zdbDecommission(ctx context.Context, reservation *provisio
 		return errors.Wrapf(err, "failed to connect to 0-db: %s", containerID)
 	}
 
-	if err := zdbCl.DeleteNamespace(nsID); err != nil {
-		return errors.Wrapf(err, "failed to delete namespace in 0-db: %s", containerID)
+	// the namespace might not exist if its provisioning was interrupted
+	exists, err := zdbCl.Exist(nsID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check if namespace exists in 0-db: %s", containerID)
+	}
+
+	if exists {
+		if err := zdbCl.DeleteNamespace(nsID); err != nil {
+			return errors.Wrapf(err, "failed to delete namespace in 0-db: %s", containerID)
+		}
 	}
 
 	ns, err := zdbCl.Namespaces()
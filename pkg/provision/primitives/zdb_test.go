@@ -3,6 +3,9 @@ package primitives
 import (
 	"net"
 	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
 )
 
 func Test_isYgg(t *testing.T) {
@@ -37,3 +40,39 @@ func Test_isYgg(t *testing.T) {
 		})
 	}
 }
+
+func TestZDBCheckUpdate(t *testing.T) {
+	deployed := ZDB{Size: 10, Mode: pkg.ZDBModeSeq, Password: "secret", DiskType: pkg.SSDDevice}
+
+	config := deployed
+	config.Password = "other"
+	config.Public = true
+	require.NoError(t, zdbCheckUpdate(config, deployed))
+
+	config = deployed
+	config.Mode = pkg.ZDBModeUser
+	require.Error(t, zdbCheckUpdate(config, deployed))
+
+	config = deployed
+	config.DiskType = pkg.HDDDevice
+	require.Error(t, zdbCheckUpdate(config, deployed))
+
+	// the size is checked by the storage module
+	config = deployed
+	config.Size = 20
+	require.NoError(t, zdbCheckUpdate(config, deployed))
+
+	config = deployed
+	config.Size = 5
+	require.NoError(t, zdbCheckUpdate(config, deployed))
+
+	config = deployed
+	config.Password = ""
+	require.Error(t, zdbCheckUpdate(config, deployed))
+
+	// a password can be set on a namespace without one
+	deployed.Password = ""
+	config = deployed
+	config.Password = "secret"
+	require.NoError(t, zdbCheckUpdate(config, deployed))
+}
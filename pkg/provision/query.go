@@ -0,0 +1,130 @@
+package provision
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+func (r *Reservation) info() pkg.ReservationInfo {
+	return pkg.ReservationInfo{
+		ID:              r.ID,
+		NodeID:          r.NodeID,
+		User:            r.User,
+		Type:            string(r.Type),
+		Data:            r.Data,
+		Created:         r.Created,
+		Duration:        r.Duration,
+		Expires:         r.Expires(),
+		Reference:       r.Reference,
+		WorkloadVersion: r.WorkloadVersion,
+		Suspended:       r.Suspended,
+	}
+}
+
+func reservationFromInfo(info pkg.ReservationInfo) *Reservation {
+	return &Reservation{
+		ID:              info.ID,
+		NodeID:          info.NodeID,
+		User:            info.User,
+		Type:            ReservationType(info.Type),
+		Data:            info.Data,
+		Created:         info.Created,
+		Duration:        info.Duration,
+		Reference:       info.Reference,
+		WorkloadVersion: info.WorkloadVersion,
+	}
+}
+
+func (r *Result) info() pkg.ResultInfo {
+	return pkg.ResultInfo{
+		ID:              r.ID,
+		Type:            string(r.Type),
+		State:           r.State.String(),
+		Error:           r.Error,
+		Data:            r.Data,
+		Created:         r.Created,
+		WorkloadVersion: r.WorkloadVersion,
+	}
+}
+
+// Matches returns true if the reservation is selected by the filter
+func Matches(filter pkg.ReservationFilter, r *Reservation) bool {
+	if filter.Type != "" && filter.Type != string(r.Type) {
+		return false
+	}
+
+	if filter.User != "" && filter.User != r.User {
+		return false
+	}
+
+	expires := r.Expires()
+	if !filter.ExpiresAfter.IsZero() && expires.Before(filter.ExpiresAfter) {
+		return false
+	}
+
+	if !filter.ExpiresBefore.IsZero() && !expires.Before(filter.ExpiresBefore) {
+		return false
+	}
+
+	return true
+}
+
+// ListReservations implements pkg.Provision. The reservations are sorted by ID
+func (e *Engine) ListReservations(filter pkg.ReservationFilter) ([]pkg.ReservationInfo, error) {
+	if !filter.ExpiresAfter.IsZero() && !filter.ExpiresBefore.IsZero() && filter.ExpiresBefore.Before(filter.ExpiresAfter) {
+		return nil, fmt.Errorf("invalid expiry window, end is before start")
+	}
+
+	var (
+		reservations []*Reservation
+		err          error
+	)
+	if finder, ok := e.cache.(ReservationFinder); ok {
+		reservations, err = finder.Find(filter)
+	} else {
+		reservations, err = e.cache.List()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list cached reservations")
+	}
+
+	infos := make([]pkg.ReservationInfo, 0, len(reservations))
+	for _, r := range reservations {
+		if Matches(filter, r) {
+			infos = append(infos, r.info())
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos, nil
+}
+
+// GetReservation implements pkg.Provision
+func (e *Engine) GetReservation(id string) (pkg.ReservationInfo, error) {
+	r, err := e.cache.Get(id)
+	if err != nil {
+		return pkg.ReservationInfo{}, errors.Wrapf(err, "reservation %s not found", id)
+	}
+
+	return r.info(), nil
+}
+
+// GetResult implements pkg.Provision
+func (e *Engine) GetResult(id string) (pkg.ResultInfo, error) {
+	r, err := e.cache.Get(id)
+	if err != nil {
+		return pkg.ResultInfo{}, errors.Wrapf(err, "reservation %s not found", id)
+	}
+
+	if r.Result.IsNil() {
+		return pkg.ResultInfo{}, fmt.Errorf("reservation %s has no result", id)
+	}
+
+	return r.Result.info(), nil
+}
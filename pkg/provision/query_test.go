@@ -0,0 +1,81 @@
+package provision
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+func TestEngineQuery(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	cache := newTestCache()
+	for _, r := range []*Reservation{
+		{ID: "1-1", User: "1", Type: "container", Created: now, Duration: time.Hour},
+		{ID: "2-1", User: "1", Type: "volume", Created: now, Duration: 24 * time.Hour},
+		{ID: "3-1", User: "2", Type: "container", Created: now, Duration: 2 * time.Hour,
+			Result: Result{ID: "3-1", Type: "container", State: StateOk, Created: now, Data: []byte(`{"id": "3-1"}`)}},
+	} {
+		require.NoError(cache.Add(r))
+	}
+
+	engine := &Engine{cache: cache}
+
+	ids := func(infos []pkg.ReservationInfo) []string {
+		var ids []string
+		for _, info := range infos {
+			ids = append(ids, info.ID)
+		}
+		return ids
+	}
+
+	all, err := engine.ListReservations(pkg.ReservationFilter{})
+	require.NoError(err)
+	require.Equal([]string{"1-1", "2-1", "3-1"}, ids(all))
+	require.Equal(now.Add(time.Hour), all[0].Expires)
+
+	containers, err := engine.ListReservations(pkg.ReservationFilter{Type: "container"})
+	require.NoError(err)
+	require.Equal([]string{"1-1", "3-1"}, ids(containers))
+
+	user, err := engine.ListReservations(pkg.ReservationFilter{Type: "container", User: "1"})
+	require.NoError(err)
+	require.Equal([]string{"1-1"}, ids(user))
+
+	// expiring within the next 3 hours
+	expiring, err := engine.ListReservations(pkg.ReservationFilter{ExpiresBefore: now.Add(3 * time.Hour)})
+	require.NoError(err)
+	require.Equal([]string{"1-1", "3-1"}, ids(expiring))
+
+	window, err := engine.ListReservations(pkg.ReservationFilter{
+		ExpiresAfter:  now.Add(90 * time.Minute),
+		ExpiresBefore: now.Add(48 * time.Hour),
+	})
+	require.NoError(err)
+	require.Equal([]string{"2-1", "3-1"}, ids(window))
+
+	_, err = engine.ListReservations(pkg.ReservationFilter{
+		ExpiresAfter:  now.Add(time.Hour),
+		ExpiresBefore: now,
+	})
+	require.Error(err)
+
+	info, err := engine.GetReservation("2-1")
+	require.NoError(err)
+	require.Equal("volume", info.Type)
+	require.Equal("1", info.User)
+
+	_, err = engine.GetReservation("4-1")
+	require.Error(err)
+
+	result, err := engine.GetResult("3-1")
+	require.NoError(err)
+	require.Equal(StateOk.String(), result.State)
+	require.Equal(`{"id": "3-1"}`, string(result.Data))
+
+	_, err = engine.GetResult("1-1")
+	require.Error(err, "no result")
+}
@@ -32,12 +32,20 @@ type Reservation struct {
 	// Duration of the reservation
 	Duration time.Duration `json:"duration"`
 	// Signature is the signature to the reservation
-	// it contains all the field of this struct except the signature itself and the Result field
+	// the fields it covers depends on the SigningVersion
 	Signature []byte `json:"signature,omitempty"`
+	// SigningVersion is the version of the scheme used to sign the reservation
+	SigningVersion int `json:"signing_version"`
+	// SignatureChallenge is the payload signed by the user when the
+	// reservation is signed with SigningExplorer
+	SignatureChallenge []byte `json:"signature_challenge,omitempty"`
 
 	// This flag is set to true when a reservation needs to be deleted
 	// before its expiration time
 	ToDelete bool `json:"to_delete"`
+	// DeleteSignature is the signature of the user over the delete request
+	// of the reservation, see SignDelete
+	DeleteSignature []byte `json:"delete_signature,omitempty"`
 
 	// Tag object is mainly used for debugging.
 	Tag Tag `json:"-"`
@@ -50,6 +58,17 @@ type Reservation struct {
 	Result Result `json:"result"`
 
 	Version int `json:"version"`
+
+	// WorkloadVersion is incremented each time the user modifies the workload
+	// a reservation with a higher version than the deployed one is applied
+	// in place using the updater of its type.
+	// Only the local API sets it, the explorer workloads have no version
+	// and a modification on the explorer is a new workload
+	WorkloadVersion int `json:"workload_version"`
+
+	// Suspended is set by the node when the reservation expired and its
+	// workload is suspended during the grace period
+	Suspended bool `json:"suspended,omitempty"`
 }
 
 // AppendTag appends tags
@@ -100,23 +119,18 @@ func (r *Reservation) SplitID() (reservation uint64, workload uint64, err error)
 	return
 }
 
+// Expires returns the time when the reservation expires
+func (r *Reservation) Expires() time.Time {
+	return r.Created.Add(r.Duration)
+}
+
 // Expired returns a boolean depending if the reservation
 // has expire or not at the time of the function call
 func (r *Reservation) Expired() bool {
-	expire := r.Created.Add(r.Duration)
-	return time.Now().After(expire)
+	return time.Now().After(r.Expires())
 }
 
 func (r *Reservation) validate() error {
-	// TODO: during testnet phase seems we don't need to verify this
-	// if err := Verify(r); err != nil {
-	// 	log.Warn().
-	// 		Err(err).
-	// 		Str("id", string(r.ID)).
-	// 		Msg("verification of reservation signature failed")
-	// 	return errors.Wrapf(err, "verification of reservation %s signature failed", r.ID)
-	// }
-
 	if r.Duration <= 0 {
 		return fmt.Errorf("reservation %s has not duration", r.ID)
 	}
@@ -142,9 +156,15 @@ const (
 	StateOk = ResultState(workloads.ResultStateOK)
 	//StateDeleted constant
 	StateDeleted = ResultState(workloads.ResultStateDeleted)
+	// StateRejected is set when the node refused to process a reservation
+	// because its signature is not valid
+	StateRejected = ResultState(workloads.ResultStateDeleted + 1)
 )
 
 func (s ResultState) String() string {
+	if s == StateRejected {
+		return "rejected"
+	}
 	return workloads.ResultStateEnum(s).String()
 }
 
@@ -168,6 +188,8 @@ type Result struct {
 	// is generated by signing the bytes returned from call to Result.Bytes()
 	// and hex
 	Signature string `json:"signature"`
+	// WorkloadVersion is the version of the workload this result applies to
+	WorkloadVersion int `json:"workload_version"`
 }
 
 // IsNil checks if Result is the zero values
@@ -0,0 +1,199 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"time"
+
+	"github.com/cenkalti/backoff/v3"
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/tfexplorer/client"
+)
+
+const defaultRetryDeadline = 10 * time.Minute
+
+// retryInterval is the time to wait before the first retry
+// of a provision that failed with a transient error
+var retryInterval = 5 * time.Second
+
+// TransientError is an error that is expected to go away on its own,
+// like the hub or the explorer being temporarily unreachable.
+// The engine retries the provisions that fail with a transient error
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// Transient marks err as transient
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &TransientError{Err: err}
+}
+
+// IsTransient returns true if err is marked as transient or
+// is a network IO error or a 5XX response from the explorer
+func IsTransient(err error) bool {
+	var terr *TransientError
+	if ok := errors.As(err, &terr); ok {
+		return true
+	}
+
+	var perr *net.OpError
+	if ok := errors.As(err, &perr); ok {
+		// any network IO error
+		return true
+	}
+
+	var nerr net.Error
+	if ok := errors.As(err, &nerr); ok && nerr.Timeout() {
+		return true
+	}
+
+	var hErr client.HTTPError
+	if ok := errors.As(err, &hErr); ok {
+		return hErr.Response().StatusCode >= 500
+	}
+
+	return false
+}
+
+// retryState keeps track of the transient failures of a reservation
+// job between the times it is processed
+type retryState struct {
+	backoff *backoff.ExponentialBackOff
+	// journaled is set when the journal entry of the reservation is kept
+	// open while it waits to be processed again
+	journaled bool
+}
+
+// retried reports whether the job already failed with a transient error
+// and is being processed again
+func (s *retryState) retried() bool {
+	return s.backoff != nil
+}
+
+type retryKey struct{}
+
+// withRetry returns a context that keeps the transient failures
+// of the job being processed in state
+func withRetry(ctx context.Context, state *retryState) context.Context {
+	return context.WithValue(ctx, retryKey{}, state)
+}
+
+func retryFrom(ctx context.Context) *retryState {
+	state, _ := ctx.Value(retryKey{}).(*retryState)
+	return state
+}
+
+// retryError is returned when a provision failed with a transient error
+// and the reservation is processed again after delay
+type retryError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryError) Unwrap() error {
+	return e.err
+}
+
+// retryDelay returns how long to wait before processing the
+// reservation again if err is a retryError
+func retryDelay(err error) (time.Duration, bool) {
+	var rerr *retryError
+	if ok := errors.As(err, &rerr); ok {
+		return rerr.delay, true
+	}
+
+	return 0, false
+}
+
+// retry calls fn once. If fn fails with a transient error and the retry
+// deadline of the reservation is not reached yet, it returns a retryError
+// so the reservation is processed again later, without holding a worker
+// in the meantime. Otherwise it returns the result of fn
+func (e *Engine) retry(ctx context.Context, r *Reservation, fn func() (interface{}, error)) (interface{}, error) {
+	returned, err := safeCall(fn)
+	if err == nil || !IsTransient(err) {
+		return returned, err
+	}
+
+	state := retryFrom(ctx)
+	if state == nil {
+		// the reservation can't be queued again
+		return nil, err
+	}
+
+	if state.backoff == nil {
+		bo := backoff.NewExponentialBackOff()
+		bo.InitialInterval = retryInterval
+		bo.MaxInterval = time.Minute
+		bo.MaxElapsedTime = e.retryDeadline
+		state.backoff = bo
+	}
+
+	delay := state.backoff.NextBackOff()
+	if delay == backoff.Stop {
+		return nil, err
+	}
+
+	log.Warn().
+		Err(err).
+		Str("id", r.ID).
+		Str("retry-in", delay.String()).
+		Msg("transient failure, retrying")
+
+	return nil, &retryError{err: err, delay: delay}
+}
+
+// safeCall turns a panic of fn into an error. The zbus stubs panic when a
+// request can't be delivered to a module or times out, these failures are
+// transient. Any other panic is a bug, the provision fails right away
+func safeCall(fn func() (interface{}, error)) (returned interface{}, err error) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+
+		if perr, ok := p.(error); ok && isConnectionError(perr) {
+			err = Transient(fmt.Errorf("zbus request failed: %w", perr))
+			return
+		}
+
+		log.Error().Str("panic", fmt.Sprint(p)).Bytes("stack", debug.Stack()).Msg("provisioner panicked")
+		err = fmt.Errorf("unexpected failure: %v", p)
+	}()
+
+	return fn()
+}
+
+// isConnectionError returns true if err is an error of the zbus client
+// while reaching the broker or waiting for the response of a module
+func isConnectionError(err error) bool {
+	if errors.Is(err, redis.ErrNil) || errors.Is(err, redis.ErrPoolExhausted) || errors.Is(err, io.EOF) {
+		return true
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
@@ -0,0 +1,59 @@
+package provision
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTransient(t *testing.T) {
+	require := require.New(t)
+
+	require.False(IsTransient(fmt.Errorf("invalid flist")))
+	require.True(IsTransient(Transient(fmt.Errorf("hub is down"))))
+	require.True(IsTransient(errors.Wrap(Transient(fmt.Errorf("hub is down")), "failed to mount flist")))
+	require.True(IsTransient(errors.Wrap(&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, "failed to get reservation")))
+	require.Nil(Transient(nil))
+}
+
+func TestSafeCall(t *testing.T) {
+	require := require.New(t)
+
+	// the zbus stubs panic when the broker or the module can't be reached
+	for _, cause := range []error{
+		&net.OpError{Op: "dial", Net: "unix", Err: fmt.Errorf("connection refused")},
+		redis.ErrNil,
+		errors.Wrap(io.EOF, "failed to read response"),
+	} {
+		_, err := safeCall(func() (interface{}, error) {
+			panic(cause)
+		})
+		require.Error(err)
+		require.True(IsTransient(err))
+	}
+
+	// any other panic is a bug that is not retried
+	_, err := safeCall(func() (interface{}, error) {
+		var r *Reservation
+		return r.ID, nil
+	})
+	require.Error(err)
+	require.False(IsTransient(err))
+
+	_, err = safeCall(func() (interface{}, error) {
+		panic("unexpected state")
+	})
+	require.Error(err)
+	require.False(IsTransient(err))
+
+	returned, err := safeCall(func() (interface{}, error) {
+		return "ok", nil
+	})
+	require.NoError(err)
+	require.Equal("ok", returned)
+}
@@ -0,0 +1,257 @@
+package provision
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// jobHandler is called by the scheduler to process a single job. If the
+// job must be processed again, it returns how long to wait before that
+type jobHandler func(ctx context.Context, job *ReservationJob) time.Duration
+
+type task struct {
+	ctx   context.Context
+	job   *ReservationJob
+	keys  map[string]struct{}
+	order int
+	// after is the time before which the task must not be started
+	after time.Time
+}
+
+// conflicts checks if two tasks can not be processed at the same time
+// either because they touch the same resource, or because one of them
+// must be provisioned before the other
+func (t *task) conflicts(other *task) bool {
+	for k := range t.keys {
+		if _, ok := other.keys[k]; ok {
+			return true
+		}
+	}
+
+	return t.job.User == other.job.User && other.order < t.order
+}
+
+// scheduler dispatches reservation jobs to a pool of workers. Jobs are
+// started in the order they are pushed, except that a job never runs
+// concurrently with (or before) an earlier job that shares one of its
+// lock keys, or an earlier job of the same user that comes first
+// in the provision order.
+// A job that must be processed again is queued back in front of the
+// jobs pushed after it, so it keeps blocking the jobs that depend on it
+// while its worker is free to process the other jobs.
+// The scheduler holds at most size jobs that are not done yet, pushing
+// more blocks until a job is done.
+type scheduler struct {
+	sync.Mutex
+
+	workers int
+	slots   chan struct{}
+	order   map[ReservationType]int
+	keys    LockKeysFunc
+	handler jobHandler
+
+	pending []*task
+	running []*task
+	stopped bool
+	wg      sync.WaitGroup
+	// idle are closed the next time no task is running
+	idle []chan struct{}
+}
+
+func newScheduler(workers, size int, order map[ReservationType]int, keys LockKeysFunc, handler jobHandler) *scheduler {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	if size < workers {
+		size = workers
+	}
+
+	return &scheduler{
+		workers: workers,
+		slots:   make(chan struct{}, size),
+		order:   order,
+		keys:    keys,
+		handler: handler,
+	}
+}
+
+func (s *scheduler) task(ctx context.Context, job *ReservationJob) *task {
+	t := &task{
+		ctx:   ctx,
+		job:   job,
+		keys:  map[string]struct{}{job.ID: {}},
+		order: s.order[job.Type],
+	}
+
+	if job.Reference != "" {
+		t.keys[job.Reference] = struct{}{}
+	}
+
+	if s.keys != nil {
+		for _, k := range s.keys(&job.Reservation) {
+			t.keys[k] = struct{}{}
+		}
+	}
+
+	return t
+}
+
+// push queues a job for processing. If the scheduler is full, it blocks
+// until a job is done or the context is canceled, in which case the job is dropped
+func (s *scheduler) push(ctx context.Context, job *ReservationJob) {
+	t := s.task(ctx, job)
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.wg.Add(1)
+	s.pending = append(s.pending, t)
+	s.dispatch()
+}
+
+// dispatch starts all pending tasks that are allowed to run.
+// it must be called with the lock held
+func (s *scheduler) dispatch() {
+	now := time.Now()
+	for i := 0; i < len(s.pending) && len(s.running) < s.workers; {
+		t := s.pending[i]
+		if now.Before(t.after) || s.blocked(t, i) {
+			i++
+			continue
+		}
+
+		s.pending = append(s.pending[:i], s.pending[i+1:]...)
+		s.running = append(s.running, t)
+		go s.run(t)
+	}
+}
+
+// blocked checks if the task at position i in the pending queue
+// conflicts with a running task or with a task queued before it
+func (s *scheduler) blocked(t *task, i int) bool {
+	for _, r := range s.running {
+		if t.conflicts(r) {
+			return true
+		}
+	}
+
+	for _, p := range s.pending[:i] {
+		if t.conflicts(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *scheduler) run(t *task) {
+	delay := s.handler(t.ctx, t.job)
+
+	s.Lock()
+	defer s.Unlock()
+
+	for i, r := range s.running {
+		if r == t {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			break
+		}
+	}
+
+	// the jobs are not processed again once the scheduler is stopped
+	if delay > 0 && !s.stopped && t.ctx.Err() == nil {
+		t.after = time.Now().Add(delay)
+		s.pending = append([]*task{t}, s.pending...)
+		time.AfterFunc(delay, s.wake)
+	} else {
+		s.done()
+	}
+
+	s.dispatch()
+	s.notify()
+}
+
+// notify wakes up the callers of wait if no task is running. Once dispatched,
+// the pending tasks that are not running are waiting to be processed again
+// or conflict with one that is, so they are not due yet.
+// it must be called with the lock held
+func (s *scheduler) notify() {
+	if len(s.running) != 0 {
+		return
+	}
+
+	for _, idle := range s.idle {
+		close(idle)
+	}
+	s.idle = nil
+}
+
+// done releases the slot of a job that is done or dropped
+func (s *scheduler) done() {
+	<-s.slots
+	s.wg.Done()
+}
+
+// wake starts the tasks that were waiting to be processed again
+func (s *scheduler) wake() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.dispatch()
+}
+
+// wait blocks until the jobs that are running or due are processed, or
+// the context is canceled. It doesn't wait for the jobs that are waiting
+// to be processed again after a failure
+func (s *scheduler) wait(ctx context.Context) {
+	s.Lock()
+	if len(s.running) == 0 {
+		s.Unlock()
+		return
+	}
+
+	idle := make(chan struct{})
+	s.idle = append(s.idle, idle)
+	s.Unlock()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+}
+
+// drain blocks until all queued jobs are processed, including the ones
+// waiting to be processed again, or the context is canceled
+func (s *scheduler) drain(ctx context.Context) {
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+}
+
+// stop drops all the jobs that are not started yet and wait
+// for the running ones to finish
+func (s *scheduler) stop() {
+	s.Lock()
+	for range s.pending {
+		s.done()
+	}
+	s.pending = nil
+	s.stopped = true
+	s.Unlock()
+
+	s.wg.Wait()
+}
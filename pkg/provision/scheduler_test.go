@@ -0,0 +1,255 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tracker records the execution of the jobs handled by a scheduler
+type tracker struct {
+	sync.Mutex
+	current int
+	max     int
+	started []string
+	done    []string
+	// events is the timeline of the jobs, "started:<id>" and "done:<id>"
+	events []string
+	delay  time.Duration
+	// release, if set, is waited on instead of delay
+	release chan struct{}
+	// retry is how long to wait before a job is processed again, once
+	retry map[string]time.Duration
+}
+
+func (t *tracker) handle(ctx context.Context, job *ReservationJob) time.Duration {
+	t.Lock()
+	t.current++
+	if t.current > t.max {
+		t.max = t.current
+	}
+	t.started = append(t.started, job.ID)
+	t.events = append(t.events, "started:"+job.ID)
+	t.Unlock()
+
+	if t.release != nil {
+		<-t.release
+	} else {
+		time.Sleep(t.delay)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.current--
+	t.done = append(t.done, job.ID)
+	t.events = append(t.events, "done:"+job.ID)
+
+	retry := t.retry[job.ID]
+	delete(t.retry, job.ID)
+	return retry
+}
+
+// before checks if event a happened before event b
+func (t *tracker) before(a, b string) bool {
+	index := func(event string) int {
+		for i, v := range t.events {
+			if v == event {
+				return i
+			}
+		}
+		return -1
+	}
+
+	return index(a) < index(b)
+}
+
+func job(id, user string, typ ReservationType) *ReservationJob {
+	return &ReservationJob{
+		Reservation: Reservation{
+			ID:   id,
+			User: user,
+			Type: typ,
+		},
+	}
+}
+
+func TestSchedulerConcurrent(t *testing.T) {
+	require := require.New(t)
+	tr := tracker{delay: 100 * time.Millisecond}
+
+	s := newScheduler(4, 10, nil, nil, tr.handle)
+	for i := 0; i < 8; i++ {
+		s.push(context.Background(), job(fmt.Sprintf("%d-1", i), fmt.Sprint(i), "container"))
+	}
+
+	s.drain(context.Background())
+
+	require.Len(tr.done, 8)
+	require.Equal(4, tr.max)
+}
+
+func TestSchedulerSameKey(t *testing.T) {
+	require := require.New(t)
+	tr := tracker{delay: 10 * time.Millisecond}
+
+	keys := func(r *Reservation) []string {
+		return []string{"network:net"}
+	}
+
+	s := newScheduler(4, 10, nil, keys, tr.handle)
+	for i := 0; i < 4; i++ {
+		s.push(context.Background(), job(fmt.Sprintf("%d-1", i), fmt.Sprint(i), "container"))
+	}
+
+	s.drain(context.Background())
+
+	require.Equal(1, tr.max)
+	require.Equal([]string{"0-1", "1-1", "2-1", "3-1"}, tr.done)
+}
+
+func TestSchedulerSameID(t *testing.T) {
+	require := require.New(t)
+	tr := tracker{delay: 10 * time.Millisecond}
+
+	s := newScheduler(4, 10, nil, nil, tr.handle)
+	s.push(context.Background(), job("1-1", "user", "container"))
+	s.push(context.Background(), job("1-1", "user", "container"))
+
+	s.drain(context.Background())
+
+	require.Equal(1, tr.max)
+	require.Len(tr.done, 2)
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	require := require.New(t)
+	tr := tracker{delay: 10 * time.Millisecond}
+
+	order := map[ReservationType]int{
+		"network":   1,
+		"volume":    4,
+		"container": 5,
+	}
+
+	s := newScheduler(4, 10, order, nil, tr.handle)
+	s.push(context.Background(), job("1-1", "user", "network"))
+	s.push(context.Background(), job("1-2", "user", "volume"))
+	s.push(context.Background(), job("1-3", "user", "container"))
+	// a different user is not blocked by the first one
+	s.push(context.Background(), job("2-1", "other", "container"))
+
+	s.drain(context.Background())
+
+	require.Len(tr.done, 4)
+	require.True(tr.before("done:1-1", "started:1-2"))
+	require.True(tr.before("done:1-2", "started:1-3"))
+	require.True(tr.before("started:2-1", "done:1-1"))
+}
+
+func TestSchedulerStop(t *testing.T) {
+	require := require.New(t)
+	tr := tracker{delay: 50 * time.Millisecond}
+
+	keys := func(r *Reservation) []string {
+		return []string{"network:net"}
+	}
+
+	s := newScheduler(1, 10, nil, keys, tr.handle)
+	s.push(context.Background(), job("1-1", "user", "container"))
+	s.push(context.Background(), job("2-1", "user", "container"))
+
+	s.stop()
+
+	require.Equal([]string{"1-1"}, tr.done)
+}
+
+func TestSchedulerRetry(t *testing.T) {
+	require := require.New(t)
+	tr := tracker{
+		delay: 10 * time.Millisecond,
+		retry: map[string]time.Duration{"1-1": 100 * time.Millisecond},
+	}
+
+	keys := func(r *Reservation) []string {
+		return []string{"user:" + r.User}
+	}
+
+	s := newScheduler(1, 10, nil, keys, tr.handle)
+	s.push(context.Background(), job("1-1", "user", "container"))
+	s.push(context.Background(), job("2-1", "other", "container"))
+	s.push(context.Background(), job("3-1", "user", "container"))
+
+	s.drain(context.Background())
+
+	require.Equal([]string{"1-1", "2-1", "1-1", "3-1"}, tr.started)
+	require.Equal(1, tr.max)
+}
+
+func TestSchedulerSize(t *testing.T) {
+	require := require.New(t)
+	tr := tracker{release: make(chan struct{})}
+
+	s := newScheduler(1, 2, nil, nil, tr.handle)
+	for i := 0; i < 2; i++ {
+		s.push(context.Background(), job(fmt.Sprintf("%d-1", i), fmt.Sprint(i), "container"))
+	}
+
+	pushed := make(chan struct{})
+	go func() {
+		s.push(context.Background(), job("2-1", "2", "container"))
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		require.Fail("pushed to a full scheduler")
+	default:
+	}
+
+	// the third job is only queued once the first one is done
+	tr.release <- struct{}{}
+	<-pushed
+	tr.Lock()
+	require.Equal([]string{"0-1"}, tr.done)
+	tr.Unlock()
+
+	// a push is given up when the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.push(ctx, job("3-1", "3", "container"))
+
+	close(tr.release)
+	s.drain(context.Background())
+
+	require.Equal([]string{"0-1", "1-1", "2-1"}, tr.done)
+}
+
+func TestSchedulerWait(t *testing.T) {
+	require := require.New(t)
+	tr := tracker{
+		delay: 10 * time.Millisecond,
+		retry: map[string]time.Duration{"1-1": time.Hour},
+	}
+
+	s := newScheduler(1, 10, nil, nil, tr.handle)
+	s.push(context.Background(), job("1-1", "user", "container"))
+
+	// the job waiting to be processed again is not waited for
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.wait(ctx)
+	require.NoError(ctx.Err())
+	require.Equal([]string{"1-1"}, tr.done)
+
+	// but it is drained, until the context is canceled
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.drain(canceled)
+
+	s.stop()
+	require.Equal([]string{"1-1"}, tr.done)
+}
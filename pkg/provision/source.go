@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
 	"sync"
 	"time"
 
@@ -37,6 +36,8 @@ type ReservationPoller interface {
 type ReservationJob struct {
 	Reservation
 	last bool
+	// retry keeps track of the transient failures of the job
+	retry retryState
 }
 
 // PollSource does a long poll on address to get new and to be deleted
@@ -105,10 +106,7 @@ func (s *pollSource) Reservations(ctx context.Context) <-chan *ReservationJob {
 				return
 			default:
 				for _, r := range res {
-					reservation := ReservationJob{
-						*r,
-						false,
-					}
+					reservation := ReservationJob{Reservation: *r}
 					ch <- &reservation
 				}
 
@@ -186,10 +184,7 @@ func (s *decommissionSource) Reservations(ctx context.Context) <-chan *Reservati
 						Str("duration", fmt.Sprintf("%v", r.Duration)).
 						Msg("reservation expired")
 
-					reservation := ReservationJob{
-						*r,
-						false,
-					}
+					reservation := ReservationJob{Reservation: *r}
 					c <- &reservation
 				}
 			}
@@ -244,10 +239,7 @@ func (s *combinedSource) Reservations(ctx context.Context) <-chan *ReservationJo
 // is an error that should make use retry to get the same reservation or
 // if we should skip it and ask the next one
 func shouldRetry(err error) bool {
-	var perr *net.OpError
-
-	if ok := errors.As(err, &perr); ok {
-		// retry for any network IO error
+	if IsTransient(err) {
 		return true
 	}
 
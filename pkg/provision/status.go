@@ -0,0 +1,198 @@
+package provision
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+// defaultStatusInterval is how often the deployed workloads are inspected
+// if not configured
+const defaultStatusInterval = 5 * time.Minute
+
+// statusStore keeps the last known status of the deployed workloads
+type statusStore struct {
+	sync.RWMutex
+	statuses map[string]pkg.WorkloadStatus
+}
+
+func newStatusStore() *statusStore {
+	return &statusStore{statuses: make(map[string]pkg.WorkloadStatus)}
+}
+
+// set records the new state of a workload. It returns the status and true if
+// the state or the error changed since the last time it was checked
+func (s *statusStore) set(r *Reservation, state pkg.WorkloadState, reason error) (pkg.WorkloadStatus, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	status := pkg.WorkloadStatus{
+		ID:      r.ID,
+		Type:    string(r.Type),
+		State:   state,
+		Checked: now,
+		Since:   now,
+	}
+	if reason != nil {
+		status.LastError = reason.Error()
+	}
+
+	previous, ok := s.statuses[r.ID]
+	if ok && previous.State == status.State {
+		status.Since = previous.Since
+	}
+	s.statuses[r.ID] = status
+
+	changed := !ok || previous.State != status.State || previous.LastError != status.LastError
+	return status, changed
+}
+
+func (s *statusStore) remove(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.statuses, id)
+}
+
+// keep removes the status of all the workloads not in ids
+func (s *statusStore) keep(ids map[string]struct{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	for id := range s.statuses {
+		if _, ok := ids[id]; !ok {
+			delete(s.statuses, id)
+		}
+	}
+}
+
+// list returns the statuses sorted by workload ID
+func (s *statusStore) list() []pkg.WorkloadStatus {
+	s.RLock()
+	defer s.RUnlock()
+
+	statuses := make([]pkg.WorkloadStatus, 0, len(s.statuses))
+	for _, status := range s.statuses {
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+
+	return statuses
+}
+
+// reconcile inspects the deployed workloads every status interval
+// until the context is canceled
+func (e *Engine) reconcile(ctx context.Context) {
+	if len(e.checkers) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := e.checkStatuses(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to check workloads status")
+		}
+	}
+}
+
+// checkStatuses inspects all the cached workloads that have a status checker
+// and informs the feedbacker of the workloads whose state changed
+func (e *Engine) checkStatuses(ctx context.Context) error {
+	reservations, err := e.cache.List()
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[string]struct{})
+	for _, r := range reservations {
+		fn, ok := e.checkers[r.Type]
+		if !ok {
+			continue
+		}
+		ids[r.ID] = struct{}{}
+
+		// the workload is deployed using the reference as ID
+		workload := *r
+		if r.Reference != "" {
+			workload.ID = r.Reference
+		}
+
+		var (
+			state  = pkg.WorkloadSuspended
+			reason error
+		)
+		if !r.Suspended {
+			// the checkers call the modules over zbus, which panics if they
+			// can't be reached. the workload is checked again next time
+			if _, err := safeCall(func() (interface{}, error) {
+				state, reason = fn(ctx, &workload)
+				return nil, nil
+			}); err != nil {
+				log.Error().Err(err).Str("id", r.ID).Msg("failed to check workload state")
+				continue
+			}
+		}
+
+		// the reservation might have been decommissioned while it was checked
+		if exists, err := e.cache.Exists(r.ID); err != nil || !exists {
+			continue
+		}
+
+		status, changed := e.statuses.set(r, state, reason)
+		if !changed {
+			continue
+		}
+
+		log.Info().
+			Str("id", r.ID).
+			Str("state", string(status.State)).
+			Str("error", status.LastError).
+			Msg("workload state changed")
+
+		if err := e.feedback.UpdateStatus(e.nodeID, status); err != nil {
+			log.Error().Err(err).Str("id", r.ID).Msg("failed to send workload status")
+		}
+	}
+
+	e.statuses.keep(ids)
+	return nil
+}
+
+// Statuses is a zbus stream that sends the last known status of the deployed workloads
+func (e *Engine) Statuses(ctx context.Context) <-chan []pkg.WorkloadStatus {
+	ch := make(chan []pkg.WorkloadStatus)
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- e.statuses.list():
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+
+	return ch
+}
@@ -152,6 +152,17 @@ type VolumeAllocater interface {
 	// space which has been reserved for this filesystem will be reclaimed.
 	ReleaseFilesystem(name string) error
 
+	// UpdateFilesystem changes the size limit of the named filesystem.
+	// Growing the filesystem fails with `ErrNotEnoughSpace` if its pool
+	// does not have enough free space left. Shrinking below the current
+	// usage of the filesystem is refused.
+	UpdateFilesystem(name string, size uint64) (Filesystem, error)
+
+	// SnapshotFilesystem creates a read-only snapshot of the named filesystem.
+	// The snapshot is a filesystem of its own named snapshot, living in the
+	// same pool as the source. It is removed with ReleaseFilesystem
+	SnapshotFilesystem(name, snapshot string) (Filesystem, error)
+
 	// ListFilesystems return all the filesystem managed by storeaged present on the nodes
 	// this can be an expensive call on server with a lot of disk, don't use it in a
 	// intensive loop
@@ -192,6 +203,9 @@ type VDiskModule interface {
 	Inspect(id string) (VDisk, error)
 	// List lists all the available vdisks
 	List() ([]VDisk, error)
+	// Snapshot creates a copy of the disk id named snapshot. The copy
+	// shares its data with the source disk until any of them is modified
+	Snapshot(id, snapshot string) (VDisk, error)
 }
 
 // StorageModule defines the api for storage
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 	"github.com/g0rbe/go-chattr"
 	"github.com/pkg/errors"
 	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/storage/image"
 )
 
 const (
@@ -81,30 +83,93 @@ func (d *vdiskModule) Allocate(id string, size int64, sourceDisk string) (string
 		return "", err
 	}
 
-	if sourceDisk != "" {
-		source, err := os.Open(sourceDisk)
-		if err != nil {
-			return "", err
-		}
-		defer source.Close()
-		io.Copy(file, source)
-	}
-
 	defer file.Close()
 	if err = chattr.SetAttr(file, chattr.FS_NOCOW_FL); err != nil {
 		return "", err
 	}
 
-	err = syscall.Fallocate(int(file.Fd()), 0, 0, size*mib)
+	if err = syscall.Fallocate(int(file.Fd()), 0, 0, size*mib); err != nil {
+		return "", err
+	}
+
 	if sourceDisk != "" {
-		err = d.expandfs(path)
+		if err = d.writeImage(file, sourceDisk, size*mib); err != nil {
+			return "", err
+		}
+
+		var btrfs bool
+		btrfs, err = image.IsBtrfs(path)
 		if err != nil {
 			return "", err
 		}
+
+		// other filesystems are left to the VM to grow
+		if btrfs {
+			err = d.expandfs(path)
+		}
 	}
 	return path, err
 }
 
+// writeImage writes the disk image at source into file. qcow2 images are
+// converted to raw
+func (d *vdiskModule) writeImage(file *os.File, source string, size int64) error {
+	info, err := image.Inspect(source)
+	if err != nil {
+		return err
+	}
+
+	if info.Size > uint64(size) {
+		return fmt.Errorf("disk image is larger (%d bytes) than the disk (%d bytes)", info.Size, size)
+	}
+
+	if info.Format == image.FormatQCOW2 {
+		input, err := qcow2Input(source)
+		if err != nil {
+			return err
+		}
+
+		// -n writes into the disk already allocated instead of creating a new file
+		output, err := exec.Command("qemu-img", "convert", "-n", "-O", "raw", input, file.Name()).CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "failed to convert qcow2 image: %s", string(output))
+		}
+
+		return nil
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err := io.Copy(file, src); err != nil {
+		return errors.Wrap(err, "failed to copy disk image")
+	}
+
+	return nil
+}
+
+// qcow2Input returns the qemu-img input of the qcow2 image at path. The
+// backing file is disabled so qemu-img never opens another file than
+// the image even if its header references one
+func qcow2Input(path string) (string, error) {
+	options, err := json.Marshal(map[string]interface{}{
+		"driver":  "qcow2",
+		"backing": nil,
+		"file": map[string]string{
+			"driver":   "file",
+			"filename": path,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "json:" + string(options), nil
+}
+
 func (d *vdiskModule) safePath(base, id string) (string, error) {
 	path := filepath.Join(base, id)
 	// this to avoid passing an `injection` id like '../name'
@@ -181,6 +246,50 @@ func (d *vdiskModule) Inspect(id string) (disk pkg.VDisk, err error) {
 	return
 }
 
+// Snapshot creates a reflink copy of the disk in the same pool, the copy
+// doesn't use any extra space until one of the disks is modified
+func (d *vdiskModule) Snapshot(id, snapshot string) (disk pkg.VDisk, err error) {
+	source, err := d.findDisk(id)
+	if err != nil {
+		return disk, errors.Wrapf(err, "failed to find disk with id '%s'", id)
+	}
+
+	if _, err := d.findDisk(snapshot); err == nil {
+		return disk, errors.Wrapf(os.ErrExist, "disk with id '%s' already exists", snapshot)
+	}
+
+	path, err := d.safePath(filepath.Dir(source), snapshot)
+	if err != nil {
+		return disk, err
+	}
+
+	defer func() {
+		// clean up disk file if error
+		if err != nil {
+			os.RemoveAll(path)
+		}
+	}()
+
+	// a reflink is only possible if both files have the same
+	// copy on write flag, and the vdisks are not copy on write
+	file, err := os.Create(path)
+	if err != nil {
+		return disk, err
+	}
+
+	err = chattr.SetAttr(file, chattr.FS_NOCOW_FL)
+	file.Close()
+	if err != nil {
+		return disk, err
+	}
+
+	if output, err := exec.Command("cp", "--reflink=always", source, path).CombinedOutput(); err != nil {
+		return disk, errors.Wrapf(err, "failed to copy disk '%s': %s", id, string(output))
+	}
+
+	return d.Inspect(snapshot)
+}
+
 func (d *vdiskModule) List() ([]pkg.VDisk, error) {
 	pools, err := d.module.VDiskPools()
 	if err != nil {
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQCOW2Input(t *testing.T) {
+	input, err := qcow2Input(`/var/cache/image,"name".qcow2`)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(input, "json:"))
+
+	var options map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(input, "json:")), &options))
+
+	backing, ok := options["backing"]
+	require.True(t, ok)
+	require.Nil(t, backing)
+	require.Equal(t, "qcow2", options["driver"])
+	require.Equal(t, map[string]interface{}{
+		"driver":   "file",
+		"filename": `/var/cache/image,"name".qcow2`,
+	}, options["file"])
+}
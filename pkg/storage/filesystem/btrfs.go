@@ -375,6 +375,26 @@ func (p *btrfsPool) AddVolume(name string) (Volume, error) {
 	return p.addVolume(root)
 }
 
+func (p *btrfsPool) SnapshotVolume(name, snapshot string) (Volume, error) {
+	mnt, ok := p.Mounted()
+	if !ok {
+		return nil, ErrDeviceNotMounted
+	}
+
+	ctx := context.Background()
+	root := filepath.Join(mnt, snapshot)
+	if err := p.utils.SubvolumeSnapshot(ctx, filepath.Join(mnt, name), root); err != nil {
+		return nil, err
+	}
+
+	volume, err := p.utils.SubvolumeInfo(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBtrfsVolume(volume.ID, root, p.utils), nil
+}
+
 func (p *btrfsPool) removeVolume(root string) error {
 	ctx := context.Background()
 
@@ -133,6 +133,12 @@ func (u *BtrfsUtil) SubvolumeAdd(ctx context.Context, root string) error {
 	return err
 }
 
+// SubvolumeSnapshot creates a read-only snapshot of the subvolume at source
+func (u *BtrfsUtil) SubvolumeSnapshot(ctx context.Context, source, dest string) error {
+	_, err := u.run(ctx, "btrfs", "subvolume", "snapshot", "-r", source, dest)
+	return err
+}
+
 // SubvolumeRemove removes a subvolume
 func (u *BtrfsUtil) SubvolumeRemove(ctx context.Context, root string) error {
 	_, err := u.run(ctx, "btrfs", "subvolume", "delete", root)
@@ -54,6 +54,9 @@ type Pool interface {
 	Volumes() ([]Volume, error)
 	// AddVolume adds a new subvolume with the given name
 	AddVolume(name string) (Volume, error)
+	// SnapshotVolume creates a read-only snapshot of the subvolume name
+	// with the name snapshot
+	SnapshotVolume(name, snapshot string) (Volume, error)
 	// RemoveVolume removes a subvolume with the given name
 	RemoveVolume(name string) error
 	// Devices list attached devices
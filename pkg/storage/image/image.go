@@ -0,0 +1,168 @@
+// Package image inspects the disk images used to create the
+// disks of the virtual machines
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Format of a disk image
+type Format string
+
+const (
+	// FormatRaw is a plain disk image
+	FormatRaw Format = "raw"
+	// FormatQCOW2 is a qemu copy on write image, it needs to be converted
+	// to raw before it can be used as a disk
+	FormatQCOW2 Format = "qcow2"
+)
+
+const (
+	// qcow2 header: magic (4 bytes), version (4 bytes), backing file
+	// offset (8 bytes), backing file size (4 bytes), cluster bits (4 bytes),
+	// the virtual size of the disk (8 bytes) then the encryption method
+	// (4 bytes). Version 3 headers add the feature bits after the 72 bytes
+	// of the version 2 header
+	qcow2VersionOffset      = 4
+	qcow2BackingOffset      = 8
+	qcow2BackingSizeOffset  = 16
+	qcow2SizeOffset         = 24
+	qcow2CryptOffset        = 32
+	qcow2IncompatibleOffset = 72
+	qcow2AutoclearOffset    = 88
+	qcow2V2HeaderSize       = 72
+	qcow2V3HeaderSize       = 104
+	headerSize              = qcow2V3HeaderSize
+
+	// the data of the image is stored in another file
+	qcow2ExternalDataFile = 1 << 2
+	qcow2RawExternalData  = 1 << 1
+
+	btrfsMagicOffset = 0x10040
+)
+
+var (
+	qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+	btrfsMagic = []byte("_BHRfS_M")
+
+	// the formats that are detected only to be refused, otherwise
+	// they would be taken for raw images
+	unsupported = map[string][]byte{
+		"vmdk": []byte("KDMV"),
+		"vhdx": []byte("vhdxfile"),
+		"vhd":  []byte("conectix"),
+	}
+)
+
+// Info about a disk image
+type Info struct {
+	Format Format
+	// Size of the disk the image holds in bytes
+	Size uint64
+}
+
+// Inspect detects the format of the image at path and the size of its disk
+func Inspect(path string) (Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Info{}, errors.Wrap(err, "failed to open disk image")
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return Info{}, errors.Wrap(err, "failed to stat disk image")
+	}
+
+	if !stat.Mode().IsRegular() {
+		return Info{}, fmt.Errorf("disk image '%s' is not a regular file", path)
+	}
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Info{}, errors.Wrap(err, "failed to read disk image header")
+	}
+	header = header[:n]
+
+	if bytes.HasPrefix(header, qcow2Magic) {
+		if err := checkQCOW2(header); err != nil {
+			return Info{}, errors.Wrapf(err, "invalid qcow2 image '%s'", path)
+		}
+
+		return Info{
+			Format: FormatQCOW2,
+			Size:   binary.BigEndian.Uint64(header[qcow2SizeOffset:]),
+		}, nil
+	}
+
+	for name, magic := range unsupported {
+		if bytes.HasPrefix(header, magic) {
+			return Info{}, fmt.Errorf("unsupported disk image format '%s', only raw and qcow2 images are supported", name)
+		}
+	}
+
+	return Info{Format: FormatRaw, Size: uint64(stat.Size())}, nil
+}
+
+// checkQCOW2 refuses the qcow2 images that reference other files, the
+// images come from the users and are converted as root so they must only
+// contain their own data
+func checkQCOW2(header []byte) error {
+	if len(header) < qcow2V2HeaderSize {
+		return fmt.Errorf("truncated header")
+	}
+
+	version := binary.BigEndian.Uint32(header[qcow2VersionOffset:])
+	if version != 2 && version != 3 {
+		return fmt.Errorf("unsupported version %d", version)
+	}
+
+	if binary.BigEndian.Uint64(header[qcow2BackingOffset:]) != 0 ||
+		binary.BigEndian.Uint32(header[qcow2BackingSizeOffset:]) != 0 {
+		return fmt.Errorf("images with a backing file are not supported")
+	}
+
+	if binary.BigEndian.Uint32(header[qcow2CryptOffset:]) != 0 {
+		return fmt.Errorf("encrypted images are not supported")
+	}
+
+	if version == 2 {
+		return nil
+	}
+
+	if len(header) < qcow2V3HeaderSize {
+		return fmt.Errorf("truncated header")
+	}
+
+	if binary.BigEndian.Uint64(header[qcow2IncompatibleOffset:])&qcow2ExternalDataFile != 0 ||
+		binary.BigEndian.Uint64(header[qcow2AutoclearOffset:])&qcow2RawExternalData != 0 {
+		return fmt.Errorf("images with an external data file are not supported")
+	}
+
+	return nil
+}
+
+// IsBtrfs checks if the raw image at path holds a btrfs filesystem
+func IsBtrfs(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open disk image")
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(btrfsMagic))
+	if _, err := file.ReadAt(magic, btrfsMagicOffset); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "failed to read disk image superblock")
+	}
+
+	return bytes.Equal(magic, btrfsMagic), nil
+}
@@ -0,0 +1,111 @@
+package image
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeImage(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+	return path
+}
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	qcow2 := make([]byte, 512)
+	copy(qcow2, qcow2Magic)
+	binary.BigEndian.PutUint32(qcow2[4:], 3)
+	binary.BigEndian.PutUint64(qcow2[qcow2SizeOffset:], 10*1024*1024*1024)
+
+	info, err := Inspect(writeImage(t, dir, "image.qcow2", qcow2))
+	require.NoError(t, err)
+	require.Equal(t, Info{Format: FormatQCOW2, Size: 10 * 1024 * 1024 * 1024}, info)
+
+	info, err = Inspect(writeImage(t, dir, "image.raw", make([]byte, 4096)))
+	require.NoError(t, err)
+	require.Equal(t, Info{Format: FormatRaw, Size: 4096}, info)
+
+	// too small to hold any header
+	info, err = Inspect(writeImage(t, dir, "tiny.raw", []byte{1, 2}))
+	require.NoError(t, err)
+	require.Equal(t, FormatRaw, info.Format)
+
+	_, err = Inspect(writeImage(t, dir, "truncated.qcow2", qcow2Magic))
+	require.Error(t, err)
+
+	// the images referencing host files are refused
+	backing := append([]byte{}, qcow2...)
+	binary.BigEndian.PutUint64(backing[qcow2BackingOffset:], 512)
+	binary.BigEndian.PutUint32(backing[qcow2BackingSizeOffset:], 9)
+	copy(backing[512-9:], "/dev/sda1")
+	_, err = Inspect(writeImage(t, dir, "backing.qcow2", backing))
+	require.Error(t, err)
+
+	backing = append([]byte{}, qcow2...)
+	binary.BigEndian.PutUint32(backing[qcow2BackingSizeOffset:], 9)
+	_, err = Inspect(writeImage(t, dir, "backing-size.qcow2", backing))
+	require.Error(t, err)
+
+	encrypted := append([]byte{}, qcow2...)
+	binary.BigEndian.PutUint32(encrypted[qcow2CryptOffset:], 2)
+	_, err = Inspect(writeImage(t, dir, "encrypted.qcow2", encrypted))
+	require.Error(t, err)
+
+	external := append([]byte{}, qcow2...)
+	binary.BigEndian.PutUint64(external[qcow2IncompatibleOffset:], qcow2ExternalDataFile)
+	_, err = Inspect(writeImage(t, dir, "external.qcow2", external))
+	require.Error(t, err)
+
+	external = append([]byte{}, qcow2...)
+	binary.BigEndian.PutUint64(external[qcow2AutoclearOffset:], qcow2RawExternalData)
+	_, err = Inspect(writeImage(t, dir, "raw-external.qcow2", external))
+	require.Error(t, err)
+
+	// version 2 headers have no feature bits
+	v2 := append([]byte{}, qcow2[:qcow2V2HeaderSize]...)
+	binary.BigEndian.PutUint32(v2[qcow2VersionOffset:], 2)
+	info, err = Inspect(writeImage(t, dir, "v2.qcow2", v2))
+	require.NoError(t, err)
+	require.Equal(t, FormatQCOW2, info.Format)
+
+	_, err = Inspect(writeImage(t, dir, "image.vmdk", append([]byte("KDMV"), make([]byte, 512)...)))
+	require.Error(t, err)
+
+	_, err = Inspect(dir)
+	require.Error(t, err)
+
+	_, err = Inspect(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestIsBtrfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, btrfsMagicOffset+4096)
+	path := writeImage(t, dir, "ext4.raw", data)
+	ok, err := IsBtrfs(path)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	copy(data[btrfsMagicOffset:], btrfsMagic)
+	path = writeImage(t, dir, "btrfs.raw", data)
+	ok, err = IsBtrfs(path)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	path = writeImage(t, dir, "small.raw", make([]byte, 1024))
+	ok, err = IsBtrfs(path)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
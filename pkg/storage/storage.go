@@ -412,6 +412,80 @@ func (s *Module) ReleaseFilesystem(name string) error {
 	return nil
 }
 
+// UpdateFilesystem changes the size limit of the filesystem with the given name
+func (s *Module) UpdateFilesystem(name string, size uint64) (pkg.Filesystem, error) {
+	log.Info().Msgf("Resizing volume %s to %d", name, size)
+
+	pool, fs, err := s.path(name)
+	if err != nil {
+		return pkg.Filesystem{}, err
+	}
+
+	if size < fs.Usage.Used {
+		return pkg.Filesystem{}, fmt.Errorf("cannot shrink volume %s to %d, %d bytes are in use", name, size, fs.Usage.Used)
+	}
+
+	if size > fs.Usage.Size {
+		usage, err := pool.Usage()
+		if err != nil {
+			return pkg.Filesystem{}, err
+		}
+
+		reserved, err := pool.Reserved()
+		if err != nil {
+			return pkg.Filesystem{}, errors.Wrapf(err, "failed to get size of pool %s", pool.Name())
+		}
+
+		if reserved+size-fs.Usage.Size > usage.Size {
+			return pkg.Filesystem{}, pkg.ErrNotEnoughSpace{DeviceType: pool.Type()}
+		}
+	}
+
+	volumes, err := pool.Volumes()
+	if err != nil {
+		return pkg.Filesystem{}, err
+	}
+
+	for _, volume := range volumes {
+		if volume.Name() != name {
+			continue
+		}
+
+		if err := volume.Limit(size); err != nil {
+			return pkg.Filesystem{}, errors.Wrapf(err, "failed to set volume %s size limit", name)
+		}
+
+		break
+	}
+
+	_, fs, err = s.path(name)
+	return fs, err
+}
+
+// SnapshotFilesystem creates a read-only snapshot of the named filesystem
+func (s *Module) SnapshotFilesystem(name, snapshot string) (pkg.Filesystem, error) {
+	log.Info().Msgf("Creating snapshot %s of volume %s", snapshot, name)
+	if strings.HasPrefix(snapshot, "zdb") {
+		return pkg.Filesystem{}, fmt.Errorf("invalid snapshot name. zdb prefix is reserved")
+	}
+
+	if _, _, err := s.path(snapshot); err == nil {
+		return pkg.Filesystem{}, errors.Wrapf(os.ErrExist, "subvolume '%s' already exists", snapshot)
+	}
+
+	pool, _, err := s.path(name)
+	if err != nil {
+		return pkg.Filesystem{}, err
+	}
+
+	if _, err := pool.SnapshotVolume(name, snapshot); err != nil {
+		return pkg.Filesystem{}, errors.Wrapf(err, "failed to snapshot volume %s", name)
+	}
+
+	_, fs, err := s.path(snapshot)
+	return fs, err
+}
+
 // ListFilesystems return all the filesystem managed by storeaged present on the nodes
 func (s *Module) ListFilesystems() ([]pkg.Filesystem, error) {
 	fss := make([]pkg.Filesystem, 0, 10)
@@ -118,6 +118,11 @@ func (p *testPool) AddVolume(name string) (filesystem.Volume, error) {
 	return args.Get(0).(filesystem.Volume), args.Error(1)
 }
 
+func (p *testPool) SnapshotVolume(name, snapshot string) (filesystem.Volume, error) {
+	args := p.Called(name, snapshot)
+	return args.Get(0).(filesystem.Volume), args.Error(1)
+}
+
 func (p *testPool) RemoveVolume(name string) error {
 	args := p.Called(name)
 	return args.Error(1)
@@ -453,3 +458,18 @@ func TestVDiskFindCandidatesNoSpace(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestZDBResizable(t *testing.T) {
+	require := require.New(t)
+
+	// grow with enough space left
+	require.NoError(zdbResizable(1000, 1500, 100, 500))
+	// grow with not enough space left
+	require.Error(zdbResizable(1000, 1600, 100, 500))
+	// shrink above the data held by the namespace
+	require.NoError(zdbResizable(1000, 200, 100, 0))
+	// shrink below the data held by the namespace
+	require.Error(zdbResizable(1000, 50, 100, 0))
+	// same size
+	require.NoError(zdbResizable(1000, 1000, 100, 0))
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"path/filepath"
 	"sort"
 
 	"github.com/rs/zerolog/log"
@@ -159,6 +160,97 @@ func (s *Module) Allocate(nsID string, diskType pkg.DeviceType, size uint64, mod
 
 }
 
+// Resize changes the size reserved for a namespace. The namespace can grow
+// if the pool of its volume has enough free space left, and can shrink as
+// long as the new size is larger than the data the namespace already holds
+func (s *Module) Resize(nsID string, size uint64) (allocation pkg.Allocation, err error) {
+	for _, pool := range s.pools {
+		if _, mounted := pool.Mounted(); !mounted {
+			continue
+		}
+
+		volumes, err := pool.Volumes()
+		if err != nil {
+			return allocation, errors.Wrapf(err, "failed to list volume on pool %s", pool.Name())
+		}
+
+		for _, volume := range volumes {
+			// skip all non-zdb volume
+			if !filesystem.IsZDBVolume(volume) {
+				continue
+			}
+
+			zdb := zdbpool.New(volume.Path())
+
+			if !zdb.Exists(nsID) {
+				continue
+			}
+
+			if err := checkZDBResize(pool, volume, nsID, size); err != nil {
+				return allocation, err
+			}
+
+			if err := zdb.Resize(nsID, size); err != nil {
+				return allocation, errors.Wrapf(err, "failed to resize namespace '%s/%s'", volume.Path(), nsID)
+			}
+
+			return pkg.Allocation{
+				VolumeID:   volume.Name(),
+				VolumePath: volume.Path(),
+			}, nil
+		}
+	}
+
+	return pkg.Allocation{}, fmt.Errorf("not found")
+}
+
+func checkZDBResize(pool filesystem.Pool, volume filesystem.Volume, nsID string, size uint64) error {
+	zdb := zdbpool.New(volume.Path())
+	ns, err := zdb.Namespace(nsID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read namespace %s", nsID)
+	}
+
+	used, err := filesystem.FilesUsage(filepath.Join(volume.Path(), nsID))
+	if err != nil {
+		return errors.Wrapf(err, "failed to get usage of namespace %s", nsID)
+	}
+
+	var free uint64
+	if size > ns.Size {
+		usage, err := pool.Usage()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read usage of pool %s", pool.Name())
+		}
+
+		// the size of a zdb volume is the sum of the sizes of its namespaces
+		volumeUsage, err := volume.Usage()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read usage of volume %s", volume.Path())
+		}
+
+		if usage.Size > volumeUsage.Size {
+			free = usage.Size - volumeUsage.Size
+		}
+	}
+
+	return zdbResizable(ns.Size, size, used, free)
+}
+
+// zdbResizable checks if a namespace of size current, that holds used bytes of data,
+// can be resized to size. free is the space left for the namespace to grow
+func zdbResizable(current, size, used, free uint64) error {
+	if size < used {
+		return fmt.Errorf("namespace holds %d bytes of data, cannot shrink it to %d bytes", used, size)
+	}
+
+	if size > current && size-current > free {
+		return fmt.Errorf("not enough space left to grow namespace from %d to %d bytes", current, size)
+	}
+
+	return nil
+}
+
 type zdbcandidate struct {
 	filesystem.Volume
 	Free uint64
@@ -1,6 +1,7 @@
 package zdbpool
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -66,6 +67,65 @@ func (p *ZDBPool) Create(name, password string, size uint64) error {
 	})
 }
 
+// Resize changes the maximum size of a namespace in its descriptor.
+// like Create, this must be followed by an actual zdb NSSET call
+// for the running 0-db to use the new size
+func (p *ZDBPool) Resize(name string, size uint64) error {
+	path := filepath.Join(p.path, name, "zdb-namespace")
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header, err := ReadHeader(f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read namespace header at %s", path)
+	}
+
+	header.MaxSize = size
+
+	// the new descriptor is written next to the current one and then
+	// replaces it at once, so the namespace never loses its descriptor
+	var buf bytes.Buffer
+	if err := WriteHeader(&buf, header); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := writeSync(tmp, buf.Bytes()); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to write namespace header at %s", tmp)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to replace namespace header at %s", path)
+	}
+
+	return nil
+}
+
+// writeSync writes data to the file at path and flushes it to the disk
+func writeSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
 // Namespace gets a namespace info from pool
 func (p *ZDBPool) Namespace(name string) (info NSInfo, err error) {
 	path := filepath.Join(p.path, name, "zdb-namespace")
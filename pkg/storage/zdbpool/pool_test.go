@@ -1,6 +1,9 @@
 package zdbpool
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -51,3 +54,35 @@ func TestIndexMode(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, IndexModeKeyValue, mode)
 }
+
+func TestResize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pool := New(dir)
+
+	require.NoError(t, pool.Create("test", "password", 1024))
+	require.NoError(t, pool.Resize("test", 4096))
+
+	info, err := pool.Namespace("test")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4096), info.Size)
+
+	require.NoError(t, pool.Resize("test", 2048))
+
+	info, err = pool.Namespace("test")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2048), info.Size)
+
+	require.Error(t, pool.Resize("foo", 2048))
+
+	// a failed resize keeps the descriptor as it was
+	tmp := filepath.Join(dir, "test", "zdb-namespace.tmp")
+	require.NoError(t, os.Mkdir(tmp, 0755))
+	require.Error(t, pool.Resize("test", 1024))
+
+	info, err = pool.Namespace("test")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2048), info.Size)
+}
@@ -260,6 +260,19 @@ func (s *NetworkerStub) Ready() (ret0 error) {
 	return
 }
 
+func (s *NetworkerStub) RemovePubIPv6Tap(arg0 string) (ret0 error) {
+	args := []interface{}{arg0}
+	result, err := s.client.Request(s.module, s.object, "RemovePubIPv6Tap", args...)
+	if err != nil {
+		panic(err)
+	}
+	ret0 = new(zbus.RemoteError)
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	return
+}
+
 func (s *NetworkerStub) RemovePubTap(arg0 string) (ret0 error) {
 	args := []interface{}{arg0}
 	result, err := s.client.Request(s.module, s.object, "RemovePubTap", args...)
@@ -273,8 +286,8 @@ func (s *NetworkerStub) RemovePubTap(arg0 string) (ret0 error) {
 	return
 }
 
-func (s *NetworkerStub) RemoveTap(arg0 pkg.NetID) (ret0 error) {
-	args := []interface{}{arg0}
+func (s *NetworkerStub) RemoveTap(arg0 pkg.NetID, arg1 string) (ret0 error) {
+	args := []interface{}{arg0, arg1}
 	result, err := s.client.Request(s.module, s.object, "RemoveTap", args...)
 	if err != nil {
 		panic(err)
@@ -286,6 +299,35 @@ func (s *NetworkerStub) RemoveTap(arg0 pkg.NetID) (ret0 error) {
 	return
 }
 
+func (s *NetworkerStub) RemoveYggTap(arg0 string) (ret0 error) {
+	args := []interface{}{arg0}
+	result, err := s.client.Request(s.module, s.object, "RemoveYggTap", args...)
+	if err != nil {
+		panic(err)
+	}
+	ret0 = new(zbus.RemoteError)
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (s *NetworkerStub) SetupPubIPv6Tap(arg0 string) (ret0 string, ret1 error) {
+	args := []interface{}{arg0}
+	result, err := s.client.Request(s.module, s.object, "SetupPubIPv6Tap", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
+
 func (s *NetworkerStub) SetupPubTap(arg0 string) (ret0 string, ret1 error) {
 	args := []interface{}{arg0}
 	result, err := s.client.Request(s.module, s.object, "SetupPubTap", args...)
@@ -302,8 +344,8 @@ func (s *NetworkerStub) SetupPubTap(arg0 string) (ret0 string, ret1 error) {
 	return
 }
 
-func (s *NetworkerStub) SetupTap(arg0 pkg.NetID) (ret0 string, ret1 error) {
-	args := []interface{}{arg0}
+func (s *NetworkerStub) SetupTap(arg0 pkg.NetID, arg1 string) (ret0 string, ret1 error) {
+	args := []interface{}{arg0, arg1}
 	result, err := s.client.Request(s.module, s.object, "SetupTap", args...)
 	if err != nil {
 		panic(err)
@@ -318,8 +360,24 @@ func (s *NetworkerStub) SetupTap(arg0 pkg.NetID) (ret0 string, ret1 error) {
 	return
 }
 
-func (s *NetworkerStub) TapExists(arg0 pkg.NetID) (ret0 bool, ret1 error) {
+func (s *NetworkerStub) SetupYggTap(arg0 string) (ret0 pkg.YggTap, ret1 error) {
 	args := []interface{}{arg0}
+	result, err := s.client.Request(s.module, s.object, "SetupYggTap", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (s *NetworkerStub) TapExists(arg0 pkg.NetID, arg1 string) (ret0 bool, ret1 error) {
+	args := []interface{}{arg0, arg1}
 	result, err := s.client.Request(s.module, s.object, "TapExists", args...)
 	if err != nil {
 		panic(err)
@@ -334,6 +392,22 @@ func (s *NetworkerStub) TapExists(arg0 pkg.NetID) (ret0 bool, ret1 error) {
 	return
 }
 
+func (s *NetworkerStub) WireguardPorts() (ret0 []uint, ret1 error) {
+	args := []interface{}{}
+	result, err := s.client.Request(s.module, s.object, "WireguardPorts", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
+
 func (s *NetworkerStub) YggAddresses(ctx context.Context) (<-chan pkg.NetlinkAddresses, error) {
 	ch := make(chan pkg.NetlinkAddresses)
 	recv, err := s.client.Stream(ctx, s.module, s.object, "YggAddresses")
@@ -23,6 +23,19 @@ func NewProvisionStub(client zbus.Client) *ProvisionStub {
 	}
 }
 
+func (s *ProvisionStub) CanProvision(arg0 pkg.ReservationInfo) (ret0 error) {
+	args := []interface{}{arg0}
+	result, err := s.client.Request(s.module, s.object, "CanProvision", args...)
+	if err != nil {
+		panic(err)
+	}
+	ret0 = new(zbus.RemoteError)
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	return
+}
+
 func (s *ProvisionStub) Counters(ctx context.Context) (<-chan pkg.ProvisionCounters, error) {
 	ch := make(chan pkg.ProvisionCounters)
 	recv, err := s.client.Stream(ctx, s.module, s.object, "Counters")
@@ -54,3 +67,105 @@ func (s *ProvisionStub) DecommissionCached(arg0 string, arg1 string) (ret0 error
 	}
 	return
 }
+
+func (s *ProvisionStub) Events(ctx context.Context) (<-chan pkg.ProvisionEvent, error) {
+	ch := make(chan pkg.ProvisionEvent)
+	recv, err := s.client.Stream(ctx, s.module, s.object, "Events")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer close(ch)
+		for event := range recv {
+			var obj pkg.ProvisionEvent
+			if err := event.Unmarshal(&obj); err != nil {
+				panic(err)
+			}
+			ch <- obj
+		}
+	}()
+	return ch, nil
+}
+
+func (s *ProvisionStub) GetReservation(arg0 string) (ret0 pkg.ReservationInfo, ret1 error) {
+	args := []interface{}{arg0}
+	result, err := s.client.Request(s.module, s.object, "GetReservation", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (s *ProvisionStub) GetResult(arg0 string) (ret0 pkg.ResultInfo, ret1 error) {
+	args := []interface{}{arg0}
+	result, err := s.client.Request(s.module, s.object, "GetResult", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (s *ProvisionStub) LastCleanup() (ret0 pkg.CleanupReport, ret1 error) {
+	args := []interface{}{}
+	result, err := s.client.Request(s.module, s.object, "LastCleanup", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (s *ProvisionStub) ListReservations(arg0 pkg.ReservationFilter) (ret0 []pkg.ReservationInfo, ret1 error) {
+	args := []interface{}{arg0}
+	result, err := s.client.Request(s.module, s.object, "ListReservations", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (s *ProvisionStub) Statuses(ctx context.Context) (<-chan []pkg.WorkloadStatus, error) {
+	ch := make(chan []pkg.WorkloadStatus)
+	recv, err := s.client.Stream(ctx, s.module, s.object, "Statuses")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer close(ch)
+		for event := range recv {
+			var obj []pkg.WorkloadStatus
+			if err := event.Unmarshal(&obj); err != nil {
+				panic(err)
+			}
+			ch <- obj
+		}
+	}()
+	return ch, nil
+}
@@ -175,6 +175,22 @@ func (s *StorageModuleStub) ReleaseFilesystem(arg0 string) (ret0 error) {
 	return
 }
 
+func (s *StorageModuleStub) SnapshotFilesystem(arg0 string, arg1 string) (ret0 pkg.Filesystem, ret1 error) {
+	args := []interface{}{arg0, arg1}
+	result, err := s.client.Request(s.module, s.object, "SnapshotFilesystem", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
+
 func (s *StorageModuleStub) Total(arg0 pkg.DeviceType) (ret0 uint64, ret1 error) {
 	args := []interface{}{arg0}
 	result, err := s.client.Request(s.module, s.object, "Total", args...)
@@ -190,3 +206,19 @@ func (s *StorageModuleStub) Total(arg0 pkg.DeviceType) (ret0 uint64, ret1 error)
 	}
 	return
 }
+
+func (s *StorageModuleStub) UpdateFilesystem(arg0 string, arg1 uint64) (ret0 pkg.Filesystem, ret1 error) {
+	args := []interface{}{arg0, arg1}
+	result, err := s.client.Request(s.module, s.object, "UpdateFilesystem", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
@@ -53,3 +53,19 @@ func (s *ZDBAllocaterStub) Find(arg0 string) (ret0 pkg.Allocation, ret1 error) {
 	}
 	return
 }
+
+func (s *ZDBAllocaterStub) Resize(arg0 string, arg1 uint64) (ret0 pkg.Allocation, ret1 error) {
+	args := []interface{}{arg0, arg1}
+	result, err := s.client.Request(s.module, s.object, "Resize", args...)
+	if err != nil {
+		panic(err)
+	}
+	if err := result.Unmarshal(0, &ret0); err != nil {
+		panic(err)
+	}
+	ret1 = new(zbus.RemoteError)
+	if err := result.Unmarshal(1, &ret1); err != nil {
+		panic(err)
+	}
+	return
+}
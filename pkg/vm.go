@@ -1,8 +1,11 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"net"
+
+	"github.com/threefoldtech/zos/pkg/container/stats"
 )
 
 //go:generate zbusc -module vmd -version 0.0.1 -name manager -package stubs github.com/threefoldtech/zos/pkg+VMModule stubs/vmd_stub.go
@@ -27,6 +30,9 @@ type VMIface struct {
 	IP6GatewayIP net.IP
 	// Private or public network
 	Public bool
+	// Yggdrasil network, the gateway is only used to reach
+	// the yggdrasil range (200::/7)
+	Yggdrasil bool
 }
 
 // VMNetworkInfo structure
@@ -50,6 +56,18 @@ type VMDisk struct {
 	Root     bool
 }
 
+// CloudInit is the cloud-init configuration of a VM. It is passed to the
+// VM through a NoCloud seed disk
+type CloudInit struct {
+	// UserData is the content of the user-data file
+	UserData string
+	// MetaData is the content of the meta-data file, a default one
+	// with the VM name as instance id is used if empty
+	MetaData string
+	// NetworkConfig is the content of the network-config file (optional)
+	NetworkConfig string
+}
+
 // VM config structure
 type VM struct {
 	// virtual machine name, or ID
@@ -74,6 +92,19 @@ type VM struct {
 	// it's up to the caller to check for the machine status
 	// and do clean up (module.Delete(vm)) when needed
 	NoKeepAlive bool
+	// CloudInit (optional) configuration. The seed disk is attached
+	// as an extra read-only disk after the Disks
+	CloudInit *CloudInit
+	// MaxCPU (optional) is the number of cores the VM can be resized to
+	// while it is running. (default: CPU)
+	MaxCPU uint8
+	// MaxMemory (optional) is the memory size in Mib the VM can be resized
+	// to while it is running. (default: Memory)
+	MaxMemory int64
+	// Stats backends the metrics of the VM are pushed to
+	Stats []stats.Stats
+	// IO (optional) throttling of the disks of the VM
+	IO VMIO
 }
 
 // Validate vm data
@@ -98,6 +129,14 @@ func (vm *VM) Validate() error {
 		return fmt.Errorf("invalid cpu must be between 1 and 32")
 	}
 
+	if vm.MaxCPU != 0 && (vm.MaxCPU < vm.CPU || vm.MaxCPU > 32) {
+		return fmt.Errorf("invalid max cpu must be between cpu and 32")
+	}
+
+	if vm.MaxMemory != 0 && vm.MaxMemory < vm.Memory {
+		return fmt.Errorf("invalid max memory must not be less than memory")
+	}
+
 	return nil
 }
 
@@ -113,6 +152,66 @@ type VMInfo struct {
 
 	// Number of vCPUs (either 1 or an even number)
 	CPU int64
+
+	// State of the VM as reported by the hypervisor (Running, Paused)
+	State string
+
+	// Limits of the cgroup the VM runs in
+	Limits VMLimits
+}
+
+// VMIO is the io throttling of the disks of a VM, a 0 value is not limited
+type VMIO struct {
+	ReadBps   uint64 `json:"read_bps"`
+	WriteBps  uint64 `json:"write_bps"`
+	ReadIOPS  uint64 `json:"read_iops"`
+	WriteIOPS uint64 `json:"write_iops"`
+}
+
+// VMLimits are the resources limits of the cgroup of a VM
+type VMLimits struct {
+	// Cgroup the VM runs in, relative to the cgroup hierarchy root
+	Cgroup string `json:"cgroup"`
+	// CPUShares is the weight of the VM when the cpu is contended
+	CPUShares uint64 `json:"cpu_shares"`
+	// CPUQuota is the cpu time in microseconds the VM can use each CPUPeriod
+	CPUQuota  int64  `json:"cpu_quota"`
+	CPUPeriod uint64 `json:"cpu_period"`
+	// Memory limit in bytes, the memory of the VM and the hypervisor overhead
+	Memory int64 `json:"memory"`
+	// IO throttling of the Devices (major:minor) the disks of the VM are on
+	IO      VMIO     `json:"io"`
+	Devices []string `json:"devices"`
+}
+
+// VMMetrics is the resource usage of a VM
+type VMMetrics struct {
+	// Name of the VM
+	Name      string `json:"name"`
+	Timestamp int64  `json:"timestamp"`
+	// CPUUsage is the cpu time used by the VM in nanoseconds
+	CPUUsage uint64 `json:"cpu_usage"`
+	// MemoryUsage is the host memory used by the VM in bytes
+	MemoryUsage uint64 `json:"memory_usage"`
+	// MemoryLimit is the memory size of the VM in bytes
+	MemoryLimit uint64 `json:"memory_limit"`
+	// Disk counters of all the disks of the VM
+	DiskReadBytes  uint64 `json:"disk_read_bytes"`
+	DiskWriteBytes uint64 `json:"disk_write_bytes"`
+	DiskReadOps    uint64 `json:"disk_read_ops"`
+	DiskWriteOps   uint64 `json:"disk_write_ops"`
+	// Network counters of all the interfaces of the VM, as seen by the VM
+	NetRxBytes   uint64 `json:"net_rx_bytes"`
+	NetTxBytes   uint64 `json:"net_tx_bytes"`
+	NetRxPackets uint64 `json:"net_rx_packets"`
+	NetTxPackets uint64 `json:"net_tx_packets"`
+}
+
+// ConsoleOutput is a chunk of the serial console output of a VM
+type ConsoleOutput struct {
+	// Name of the VM
+	Name string
+	Data []byte
 }
 
 // VMModule defines the virtual machine module interface
@@ -120,6 +219,44 @@ type VMModule interface {
 	Run(vm VM) error
 	Inspect(name string) (VMInfo, error)
 	Delete(name string) error
+	// Stop shuts a machine down but keeps its configuration so it
+	// can be started again. Stopped machines are not restarted by the monitor
+	Stop(name string) error
+	// Start boots a stopped machine again
+	Start(name string) error
+	// Reboot restarts the machine, the guest is rebooted without
+	// restarting the hypervisor process
+	Reboot(name string) error
+	// Pause freezes the vCPUs of a running machine, the machine keeps
+	// its memory
+	Pause(name string) error
+	// Resume runs a paused machine again
+	Resume(name string) error
+	// Resize changes the number of cores and the memory size in Mib of
+	// a machine. A running machine can only be resized up to the MaxCPU and
+	// MaxMemory it was started with, and its memory can't shrink. The new
+	// size is kept if the machine is restarted
+	Resize(name string, cpu uint8, memory int64) error
+	// ConsoleHistory returns the last output of the serial console of
+	// a running machine
+	ConsoleHistory(name string) ([]byte, error)
+	// ConsoleWrite sends data to the serial console of a running machine
+	ConsoleWrite(name string, data []byte) error
+	// Consoles streams the serial console output of all the machines
+	Consoles(ctx context.Context) <-chan ConsoleOutput
+	// Metrics returns the resource usage of a running machine
+	Metrics(name string) (VMMetrics, error)
+	// AllMetrics streams the resource usage of all the running machines
+	AllMetrics(ctx context.Context) <-chan []VMMetrics
+	// AttachDisk adds a disk to a machine, the disk is hotplugged if the
+	// machine is running. A disk can only be attached to one machine at a time
+	AttachDisk(name string, disk VMDisk) error
+	// DetachDisk removes the disk at path from a machine, the disk is
+	// unplugged if the machine is running
+	DetachDisk(name string, path string) error
+	// DiskUser returns the name of the machine the disk at path is
+	// attached to, if any
+	DiskUser(path string) (string, bool)
 	Exists(name string) bool
 	Logs(name string) (string, error)
 	List() ([]string, error)
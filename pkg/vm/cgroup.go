@@ -0,0 +1,350 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// cgroupParent is the cgroup all the machines cgroups are created in
+	cgroupParent = "vmd"
+
+	// cpuPeriod is the cfs period in microseconds
+	cpuPeriod = 100000
+	// cpuShares are the shares of one vCpu
+	cpuShares = 1024
+	// memoryOverhead is the memory used by the hypervisor on top of
+	// the memory of the machine
+	memoryOverhead = 128 * 1024 * 1024
+)
+
+var (
+	cgroupRoot = "/sys/fs/cgroup"
+	mountInfo  = "/proc/self/mountinfo"
+
+	// cgroupControllers are the v1 hierarchies the machines are limited in
+	cgroupControllers = []string{"cpu", "memory", "blkio"}
+)
+
+// limits computes the resources limits of the machine cgroup
+func (m *Machine) limits() pkg.VMLimits {
+	limits := pkg.VMLimits{
+		Cgroup:    filepath.Join(cgroupParent, m.ID),
+		CPUShares: uint64(m.Config.CPU) * cpuShares,
+		CPUQuota:  int64(m.Config.CPU) * cpuPeriod,
+		CPUPeriod: cpuPeriod,
+		Memory:    int64(m.Config.Mem)*1024*1024 + memoryOverhead,
+		IO:        m.IO,
+	}
+
+	if m.IO == (pkg.VMIO{}) {
+		return limits
+	}
+
+	seen := make(map[string]struct{})
+	for _, disk := range m.Disks {
+		device, err := diskDevice(disk.Path)
+		if err != nil {
+			log.Error().Err(err).Str("disk", disk.Path).Msg("failed to find the device of disk, it's not throttled")
+			continue
+		}
+
+		if _, ok := seen[device]; ok {
+			continue
+		}
+		seen[device] = struct{}{}
+		limits.Devices = append(limits.Devices, device)
+	}
+
+	return limits
+}
+
+// diskDevice returns the major:minor of the block device a disk is on
+func diskDevice(path string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return "", err
+	}
+
+	if stat.Mode&unix.S_IFMT == unix.S_IFBLK {
+		return devNumber(stat.Rdev), nil
+	}
+
+	if unix.Major(stat.Dev) != 0 {
+		return devNumber(stat.Dev), nil
+	}
+
+	// btrfs reports an anonymous device, the device is then
+	// the source of the mount the disk is on
+	source, err := mountSource(path)
+	if err != nil {
+		return "", err
+	}
+
+	if err := unix.Stat(source, &stat); err != nil {
+		return "", err
+	}
+
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("'%s' is not a block device", source)
+	}
+
+	return devNumber(stat.Rdev), nil
+}
+
+func devNumber(dev uint64) string {
+	return fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev))
+}
+
+// mountSource finds the source of the mount path is on
+func mountSource(path string) (string, error) {
+	f, err := os.Open(mountInfo)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read mount info")
+	}
+	defer f.Close()
+
+	var source, target string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root target options [optional...] - type source options
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		mount := fields[4]
+		if !strings.HasPrefix(path, mount) || len(mount) < len(target) {
+			continue
+		}
+		if mount != "/" && len(path) > len(mount) && path[len(mount)] != '/' {
+			continue
+		}
+
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) {
+				source, target = fields[i+2], mount
+				break
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "failed to read mount info")
+	}
+
+	if source == "" {
+		return "", fmt.Errorf("no mount found for '%s'", path)
+	}
+
+	return source, nil
+}
+
+// cgroup of a machine, both the v1 and the unified v2 hierarchies
+// are supported
+type cgroup struct {
+	root string
+	name string
+	v2   bool
+}
+
+// newCgroup returns the cgroup of machine name
+func newCgroup(name string) *cgroup {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return &cgroup{
+		root: cgroupRoot,
+		name: name,
+		v2:   err == nil,
+	}
+}
+
+// paths of the cgroup in all the hierarchies it's part of
+func (c *cgroup) paths() []string {
+	if c.v2 {
+		return []string{filepath.Join(c.root, cgroupParent, c.name)}
+	}
+
+	var paths []string
+	for _, controller := range cgroupControllers {
+		paths = append(paths, filepath.Join(c.root, controller, cgroupParent, c.name))
+	}
+
+	return paths
+}
+
+func (c *cgroup) path(controller string) string {
+	if c.v2 {
+		return filepath.Join(c.root, cgroupParent, c.name)
+	}
+
+	return filepath.Join(c.root, controller, cgroupParent, c.name)
+}
+
+func (c *cgroup) write(controller, file, value string) error {
+	path := filepath.Join(c.path(controller), file)
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write '%s' to %s", value, path)
+	}
+
+	return nil
+}
+
+// create creates the cgroup if it does not exist
+func (c *cgroup) create() error {
+	if c.v2 {
+		// the controllers must be enabled for the children of
+		// each level down to the cgroup
+		parent := filepath.Join(c.root, cgroupParent)
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return errors.Wrap(err, "failed to create cgroup")
+		}
+
+		for _, dir := range []string{c.root, parent} {
+			control := filepath.Join(dir, "cgroup.subtree_control")
+			if err := ioutil.WriteFile(control, []byte("+cpu +memory +io"), 0644); err != nil {
+				return errors.Wrapf(err, "failed to enable controllers in %s", dir)
+			}
+		}
+	}
+
+	for _, path := range c.paths() {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return errors.Wrap(err, "failed to create cgroup")
+		}
+	}
+
+	return nil
+}
+
+// Apply creates the cgroup and sets its limits, it's also used
+// to update the limits of an existing cgroup
+func (c *cgroup) Apply(limits pkg.VMLimits) error {
+	if err := c.create(); err != nil {
+		return err
+	}
+
+	if c.v2 {
+		return c.applyV2(limits)
+	}
+
+	return c.applyV1(limits)
+}
+
+func (c *cgroup) applyV1(limits pkg.VMLimits) error {
+	values := []struct {
+		controller, file string
+		value            interface{}
+	}{
+		{"cpu", "cpu.shares", limits.CPUShares},
+		{"cpu", "cpu.cfs_period_us", limits.CPUPeriod},
+		{"cpu", "cpu.cfs_quota_us", limits.CPUQuota},
+		{"memory", "memory.limit_in_bytes", limits.Memory},
+	}
+
+	for _, v := range values {
+		if err := c.write(v.controller, v.file, fmt.Sprint(v.value)); err != nil {
+			return err
+		}
+	}
+
+	for _, device := range limits.Devices {
+		for file, value := range map[string]uint64{
+			"blkio.throttle.read_bps_device":   limits.IO.ReadBps,
+			"blkio.throttle.write_bps_device":  limits.IO.WriteBps,
+			"blkio.throttle.read_iops_device":  limits.IO.ReadIOPS,
+			"blkio.throttle.write_iops_device": limits.IO.WriteIOPS,
+		} {
+			// 0 removes the limit of the device
+			if err := c.write("blkio", file, fmt.Sprintf("%s %d", device, value)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *cgroup) applyV2(limits pkg.VMLimits) error {
+	// weight is in [1, 10000] where shares are in [2, 262144]
+	weight := 1 + ((limits.CPUShares-2)*9999)/262142
+
+	values := map[string]string{
+		"cpu.weight": fmt.Sprint(weight),
+		"cpu.max":    fmt.Sprintf("%d %d", limits.CPUQuota, limits.CPUPeriod),
+		"memory.max": fmt.Sprint(limits.Memory),
+	}
+
+	for file, value := range values {
+		if err := c.write("", file, value); err != nil {
+			return err
+		}
+	}
+
+	max := func(value uint64) string {
+		if value == 0 {
+			return "max"
+		}
+		return fmt.Sprint(value)
+	}
+
+	for _, device := range limits.Devices {
+		value := fmt.Sprintf("%s rbps=%s wbps=%s riops=%s wiops=%s",
+			device,
+			max(limits.IO.ReadBps),
+			max(limits.IO.WriteBps),
+			max(limits.IO.ReadIOPS),
+			max(limits.IO.WriteIOPS),
+		)
+
+		if err := c.write("", "io.max", value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Join moves the process pid to the cgroup
+func (c *cgroup) Join(pid int) error {
+	for _, path := range c.paths() {
+		procs := filepath.Join(path, "cgroup.procs")
+		if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return errors.Wrapf(err, "failed to move process to cgroup %s", path)
+		}
+	}
+
+	return nil
+}
+
+// Exists checks if the cgroup was created
+func (c *cgroup) Exists() bool {
+	for _, path := range c.paths() {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Remove deletes the cgroup, it must not have any process left
+func (c *cgroup) Remove() error {
+	for _, path := range c.paths() {
+		if err := syscall.Rmdir(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove cgroup %s", path)
+		}
+	}
+
+	return nil
+}
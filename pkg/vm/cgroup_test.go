@@ -0,0 +1,133 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestMachineLimits(t *testing.T) {
+	machine := Machine{
+		ID:     "vm",
+		Config: Config{CPU: 2, Mem: 1024},
+	}
+
+	require.Equal(t, pkg.VMLimits{
+		Cgroup:    "vmd/vm",
+		CPUShares: 2048,
+		CPUQuota:  200000,
+		CPUPeriod: 100000,
+		Memory:    1024*1024*1024 + memoryOverhead,
+	}, machine.limits())
+}
+
+func TestCgroupV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = dir
+
+	cgroup := newCgroup("vm")
+	require.False(t, cgroup.v2)
+	require.False(t, cgroup.Exists())
+
+	err = cgroup.Apply(pkg.VMLimits{
+		CPUShares: 1024,
+		CPUQuota:  100000,
+		CPUPeriod: 100000,
+		Memory:    512,
+		IO:        pkg.VMIO{ReadBps: 10, WriteIOPS: 20},
+		Devices:   []string{"8:0"},
+	})
+	require.NoError(t, err)
+	require.True(t, cgroup.Exists())
+
+	cpu := filepath.Join(dir, "cpu", cgroupParent, "vm")
+	require.Equal(t, "1024", readFile(t, filepath.Join(cpu, "cpu.shares")))
+	require.Equal(t, "100000", readFile(t, filepath.Join(cpu, "cpu.cfs_quota_us")))
+	require.Equal(t, "512", readFile(t, filepath.Join(dir, "memory", cgroupParent, "vm", "memory.limit_in_bytes")))
+
+	blkio := filepath.Join(dir, "blkio", cgroupParent, "vm")
+	require.Equal(t, "8:0 10", readFile(t, filepath.Join(blkio, "blkio.throttle.read_bps_device")))
+	require.Equal(t, "8:0 0", readFile(t, filepath.Join(blkio, "blkio.throttle.write_bps_device")))
+	require.Equal(t, "8:0 20", readFile(t, filepath.Join(blkio, "blkio.throttle.write_iops_device")))
+
+	require.NoError(t, cgroup.Join(10))
+	for _, controller := range cgroupControllers {
+		require.Equal(t, "10", readFile(t, filepath.Join(dir, controller, cgroupParent, "vm", "cgroup.procs")))
+	}
+}
+
+func TestCgroupV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = dir
+
+	err = ioutil.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("cpu io memory"), 0644)
+	require.NoError(t, err)
+
+	cgroup := newCgroup("vm")
+	require.True(t, cgroup.v2)
+
+	err = cgroup.Apply(pkg.VMLimits{
+		CPUShares: 1024,
+		CPUQuota:  100000,
+		CPUPeriod: 100000,
+		Memory:    512,
+		IO:        pkg.VMIO{ReadBps: 10, WriteIOPS: 20},
+		Devices:   []string{"8:0"},
+	})
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, cgroupParent, "vm")
+	require.Equal(t, "39", readFile(t, filepath.Join(path, "cpu.weight")))
+	require.Equal(t, "100000 100000", readFile(t, filepath.Join(path, "cpu.max")))
+	require.Equal(t, "512", readFile(t, filepath.Join(path, "memory.max")))
+	require.Equal(t, "8:0 rbps=10 wbps=max riops=max wiops=20", readFile(t, filepath.Join(path, "io.max")))
+	require.Equal(t, "+cpu +memory +io", readFile(t, filepath.Join(dir, cgroupParent, "cgroup.subtree_control")))
+
+	require.NoError(t, cgroup.Join(10))
+	require.Equal(t, "10", readFile(t, filepath.Join(path, "cgroup.procs")))
+}
+
+func TestMountSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(info string) { mountInfo = info }(mountInfo)
+	mountInfo = filepath.Join(dir, "mountinfo")
+
+	err = ioutil.WriteFile(mountInfo, []byte(`22 1 0:20 / / rw shared:1 - rootfs rootfs rw
+30 22 0:45 / /mnt/pool rw,relatime shared:2 - btrfs /dev/sda rw
+31 30 0:46 /vdisks /mnt/pool/vdisks rw,relatime shared:3 - btrfs /dev/sdb rw
+32 22 0:47 / /mnt/poolx rw,relatime shared:4 - btrfs /dev/sdc rw
+`), 0644)
+	require.NoError(t, err)
+
+	for path, source := range map[string]string{
+		"/mnt/pool/vdisks/disk": "/dev/sdb",
+		"/mnt/pool/other":       "/dev/sda",
+		"/mnt/poolx/disk":       "/dev/sdc",
+		"/var/disk":             "rootfs",
+	} {
+		found, err := mountSource(path)
+		require.NoError(t, err)
+		require.Equal(t, source, found, path)
+	}
+}
@@ -1,7 +1,6 @@
 package vm
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"os"
@@ -9,26 +8,32 @@ import (
 	"path/filepath"
 
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
 )
 
 const (
 	chBin = "cloud-hypervisor"
 )
 
-// Run run the machine with cloud-hypervisor
-func (m *Machine) Run(ctx context.Context, socket, logs string) error {
+// command builds the cloud-hypervisor command that runs the machine. The
+// returned files are passed to the process and must be closed once it
+// is started
+func (m *Machine) command(socket, logs string) (*exec.Cmd, []io.Closer, error) {
 
 	// build command line
 	args := map[string][]string{
 		"--kernel":  {m.Boot.Kernel},
 		"--cmdline": {m.Boot.Args},
 
-		"--cpus":   {m.Config.CPU.String()},
-		"--memory": {m.Config.Mem.String()},
+		"--cpus":   {m.Config.cpus()},
+		"--memory": {m.Config.memory()},
 
 		"--log-file":   {logs},
 		"--api-socket": {socket},
+
+		// the serial console is attached to a pty that vmd reads
+		// to give access to the console of the machine
+		"--serial":  {"pty"},
+		"--console": {"off"},
 	}
 	if m.Boot.Initrd != "" {
 		args["--initramfs"] = []string{m.Boot.Initrd}
@@ -49,7 +54,7 @@ func (m *Machine) Run(ctx context.Context, socket, logs string) error {
 		for _, nic := range m.Interfaces {
 			typ, idx, err := nic.getType()
 			if err != nil {
-				return errors.Wrapf(err, "failed to detect interface type '%s'", nic.Tap)
+				return nil, nil, errors.Wrapf(err, "failed to detect interface type '%s'", nic.Tap)
 			}
 			if typ == InterfaceTAP {
 				interfaces = append(interfaces, nic.asTap())
@@ -60,89 +65,36 @@ func (m *Machine) Run(ctx context.Context, socket, logs string) error {
 				// fds[fd] = idx
 				interfaces = append(interfaces, nic.asMACvTap(fd))
 			} else {
-				return fmt.Errorf("unsupported tap device type '%s'", nic.Tap)
+				return nil, nil, fmt.Errorf("unsupported tap device type '%s'", nic.Tap)
 			}
 		}
 		args["--net"] = interfaces
 	}
 
-	const debug = false
-	if debug {
-		args["--console"] = []string{"off"}
-		args["--serial"] = []string{"tty"}
-	}
-
 	var argsList []string
 	for k, vl := range args {
 		argsList = append(argsList, k)
 		argsList = append(argsList, vl...)
 	}
 
-	var fullArgs []string
-	// setting setsid
-	// without this the CH process will exit if vmd is stopped.
-	// optimally, this should be done by the SysProcAttr
-	// but we always get permission denied error and it's not
-	// clear why. so for now we use busybox setsid command to do
-	// this.
-	fullArgs = append(fullArgs, "setsid", chBin)
-	fullArgs = append(fullArgs, argsList...)
-	cmd := exec.CommandContext(ctx, "busybox", fullArgs...)
-	// TODO: always get permission denied when setting
-	// sid with sys proc attr
-	// cmd.SysProcAttr = &syscall.SysProcAttr{
-	// 	Setsid:     true,
-	// 	Setpgid:    true,
-	// 	Foreground: false,
-	// 	Noctty:     true,
-	// 	Setctty:    true,
-	// }
-
-	var toClose []io.Closer
+	cmd := exec.Command(chBin, argsList...)
 
+	var files []io.Closer
 	for _, tapindex := range fds {
 		tap, err := os.OpenFile(filepath.Join("/dev", fmt.Sprintf("tap%d", tapindex)), os.O_RDWR, 0600)
 		if err != nil {
-			return err
+			closeAll(files)
+			return nil, nil, err
 		}
-		toClose = append(toClose, tap)
+		files = append(files, tap)
 		cmd.ExtraFiles = append(cmd.ExtraFiles, tap)
 	}
 
-	out, err := os.Create(fmt.Sprintf("%s.out", logs))
-	if err != nil {
-		log.Error().Err(err).Msg("failed to create process log file")
-	} else {
-		cmd.Stdout = out
-		cmd.Stderr = out
-		defer out.Close()
-	}
-
-	defer func() {
-		for _, c := range toClose {
-			c.Close()
-		}
-	}()
-
-	if err := cmd.Start(); err != nil {
-		return errors.Wrap(err, "failed to start cloud-hypervisor")
-	}
-
-	pid := cmd.Process.Pid
-
-	go func() {
-		ps, err := os.FindProcess(pid)
-		if err != nil {
-			log.Error().Err(err).Msgf("failed to find process with id: %d", pid)
-			return
-		}
-
-		ps.Wait()
-	}()
+	return cmd, files, nil
+}
 
-	if err := cmd.Process.Release(); err != nil {
-		return errors.Wrap(err, "failed to release cloud-hypervisor process")
+func closeAll(files []io.Closer) {
+	for _, c := range files {
+		c.Close()
 	}
-
-	return nil
 }
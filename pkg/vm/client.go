@@ -1,9 +1,11 @@
 package vm
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 
@@ -30,42 +32,125 @@ func NewClient(unix string) *Client {
 	return &client
 }
 
-// Shutdown shuts the machine down
-func (c *Client) Shutdown(ctx context.Context) error {
-	request, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://unix/api/v1/vm.shutdown", nil)
+// VMData is the information the hypervisor reports about a machine
+type VMData struct {
+	CPU    CPU
+	Memory MemMib
+	// State of the machine (Created, Running, Shutdown, Paused)
+	State string
+	// Serial is the pty of the serial console, if any
+	Serial string
+	// Disks are the ids of the disks of the machine by path
+	Disks map[string]string
+}
+
+// put calls an action on the machine that does not return any content
+func (c *Client) put(ctx context.Context, action string, body interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrapf(err, "failed to serialize machine %s request", action)
+		}
+		reader = bytes.NewBuffer(data)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("http://unix/api/v1/vm.%s", action), reader)
 	if err != nil {
 		return err
 	}
+	if body != nil {
+		request.Header.Add("content-type", "application/json")
+	}
+
 	response, err := c.client.Do(request)
 	if err != nil {
-		return errors.Wrap(err, "error calling machine shutdown")
+		return errors.Wrapf(err, "error calling machine %s", action)
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("got unexpected http code '%s' on machine shutdown", response.Status)
+	// hotplug actions return the info of the added device
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		return fmt.Errorf("got unexpected http code '%s' on machine %s", response.Status, action)
 	}
 
 	return nil
 }
 
+// Shutdown shuts the machine down
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.put(ctx, "shutdown", nil)
+}
+
+// Reboot reboots the machine
+func (c *Client) Reboot(ctx context.Context) error {
+	return c.put(ctx, "reboot", nil)
+}
+
+// Pause pauses the machine
+func (c *Client) Pause(ctx context.Context) error {
+	return c.put(ctx, "pause", nil)
+}
+
+// Resume resumes a paused machine
+func (c *Client) Resume(ctx context.Context) error {
+	return c.put(ctx, "resume", nil)
+}
+
+// Resize hotplugs or removes vCPUs and memory of a running machine
+func (c *Client) Resize(ctx context.Context, cpu CPU, mem MemMib) error {
+	body := struct {
+		CPU    CPU   `json:"desired_vcpus"`
+		Memory int64 `json:"desired_ram"`
+	}{
+		CPU:    cpu,
+		Memory: int64(mem) * 1024 * 1024,
+	}
+
+	return c.put(ctx, "resize", body)
+}
+
+// AddDisk hotplugs a disk to a running machine
+func (c *Client) AddDisk(ctx context.Context, disk Disk) error {
+	body := struct {
+		Path     string `json:"path"`
+		ReadOnly bool   `json:"readonly"`
+	}{
+		Path:     disk.Path,
+		ReadOnly: disk.ReadOnly,
+	}
+
+	return c.put(ctx, "add-disk", body)
+}
+
+// RemoveDevice unplugs the device id from a running machine
+func (c *Client) RemoveDevice(ctx context.Context, id string) error {
+	body := struct {
+		ID string `json:"id"`
+	}{
+		ID: id,
+	}
+
+	return c.put(ctx, "remove-device", body)
+}
+
 // Inspect return information about the vm
-func (c *Client) Inspect(ctx context.Context) (CPU, MemMib, error) {
+func (c *Client) Inspect(ctx context.Context) (VMData, error) {
 	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unix/api/v1/vm.info", nil)
 	if err != nil {
-		return 0, 0, err
+		return VMData{}, err
 	}
 	request.Header.Add("content-type", "application/json")
 
 	response, err := c.client.Do(request)
 	if err != nil {
-		return 0, 0, errors.Wrap(err, "error calling machine info")
+		return VMData{}, errors.Wrap(err, "error calling machine info")
 	}
 
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return 0, 0, fmt.Errorf("got unexpected http code '%s' on machine info", response.Status)
+		return VMData{}, fmt.Errorf("got unexpected http code '%s' on machine info", response.Status)
 	}
 
 	var data struct {
@@ -76,14 +161,63 @@ func (c *Client) Inspect(ctx context.Context) (CPU, MemMib, error) {
 			Memory struct {
 				Size int64 `json:"size"`
 			} `json:"memory"`
+			Serial struct {
+				File string `json:"file"`
+				Mode string `json:"mode"`
+			} `json:"serial"`
+			Disks []struct {
+				ID   string `json:"id"`
+				Path string `json:"path"`
+			} `json:"disks"`
 		} `json:"config"`
+		State string `json:"state"`
 	}
 
 	if err := json.NewDecoder(response.Body).Decode(&data); err != nil {
-		return 0, 0, errors.Wrap(err, "failed to parse machine information")
+		return VMData{}, errors.Wrap(err, "failed to parse machine information")
+	}
+
+	vm := VMData{
+		CPU:    CPU(data.Config.CPUs.Boot),
+		Memory: MemMib(data.Config.Memory.Size / (1024 * 1024)),
+		State:  data.State,
+		Disks:  make(map[string]string),
+	}
+
+	for _, disk := range data.Config.Disks {
+		vm.Disks[disk.Path] = disk.ID
+	}
+
+	if data.Config.Serial.Mode == "Pty" {
+		vm.Serial = data.Config.Serial.File
+	}
+
+	return vm, nil
+}
+
+// Counters returns the counters of the devices of the machine, by
+// device then by counter name
+func (c *Client) Counters(ctx context.Context) (map[string]map[string]uint64, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unix/api/v1/vm.counters", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling machine counters")
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got unexpected http code '%s' on machine counters", response.Status)
+	}
+
+	var counters map[string]map[string]uint64
+	if err := json.NewDecoder(response.Body).Decode(&counters); err != nil {
+		return nil, errors.Wrap(err, "failed to parse machine counters")
 	}
 
-	return CPU(data.Config.CPUs.Boot),
-		MemMib(data.Config.Memory.Size / (1024 * 1024)),
-		nil
+	return counters, nil
 }
@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+const (
+	// cloudInitLabel is the label cloud-init looks for to find the NoCloud seed disk
+	cloudInitLabel = "cidata"
+	// cloudInitSize is the size of the seed disk in MiB
+	cloudInitSize = 2
+)
+
+// cloudInitFiles returns the files of the NoCloud seed disk of machine name
+func cloudInitFiles(name string, cfg pkg.CloudInit) map[string][]byte {
+	metaData := cfg.MetaData
+	if len(metaData) == 0 {
+		metaData = fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", name, name)
+	}
+
+	files := map[string][]byte{
+		"user-data": []byte(cfg.UserData),
+		"meta-data": []byte(metaData),
+	}
+
+	if len(cfg.NetworkConfig) != 0 {
+		files["network-config"] = []byte(cfg.NetworkConfig)
+	}
+
+	return files
+}
+
+// cloudInitSeed creates the NoCloud seed disk of machine name. It is
+// a vfat image labeled cidata holding the cloud-init files
+func (m *Module) cloudInitSeed(name string, cfg pkg.CloudInit) (path string, err error) {
+	files := cloudInitFiles(name, cfg)
+	var size int64
+	for _, data := range files {
+		size += int64(len(data))
+	}
+
+	// leave some room for the filesystem itself
+	if size > (cloudInitSize-1)*1024*1024 {
+		return "", fmt.Errorf("cloud-init configuration is too large (%d bytes)", size)
+	}
+
+	path = m.cloudInitPath(name)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create cloud-init seed disk")
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	err = file.Truncate(cloudInitSize * 1024 * 1024)
+	file.Close()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to set the size of the cloud-init seed disk")
+	}
+
+	if output, err := exec.Command("mkfs.vfat", "-n", cloudInitLabel, path).CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "failed to format cloud-init seed disk: %s", string(output))
+	}
+
+	dir, err := ioutil.TempDir("", "cloud-init")
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't create a temp dir to mount the cloud-init seed disk")
+	}
+	// the dir is only removed if the seed disk is unmounted
+	defer os.Remove(dir)
+
+	if output, err := exec.Command("mount", path, dir).CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "couldn't mount the cloud-init seed disk: %s", string(output))
+	}
+	// the files are only flushed to the seed disk once it's unmounted
+	defer func() {
+		if uerr := syscall.Unmount(dir, 0); uerr != nil && err == nil {
+			path, err = "", errors.Wrap(uerr, "failed to unmount the cloud-init seed disk")
+		}
+	}()
+
+	for file, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			return "", errors.Wrapf(err, "failed to write cloud-init %s", file)
+		}
+	}
+
+	return path, nil
+}
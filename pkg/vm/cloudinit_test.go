@@ -0,0 +1,24 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+func TestCloudInitFiles(t *testing.T) {
+	files := cloudInitFiles("1-1", pkg.CloudInit{UserData: "#cloud-config\n"})
+	require.Equal(t, map[string][]byte{
+		"user-data": []byte("#cloud-config\n"),
+		"meta-data": []byte("instance-id: 1-1\nlocal-hostname: 1-1\n"),
+	}, files)
+
+	files = cloudInitFiles("1-1", pkg.CloudInit{
+		UserData:      "#cloud-config\n",
+		MetaData:      "instance-id: custom\n",
+		NetworkConfig: "version: 2\n",
+	})
+	require.Equal(t, []byte("instance-id: custom\n"), files["meta-data"])
+	require.Equal(t, []byte("version: 2\n"), files["network-config"])
+}
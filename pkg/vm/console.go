@@ -0,0 +1,340 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// consoleHistorySize is how much of the console output is kept
+	// for the clients that attach later
+	consoleHistorySize = 64 * 1024
+	// consoleBacklog is the number of output chunks buffered for a
+	// slow subscriber before output is dropped for it
+	consoleBacklog = 128
+)
+
+// console is the serial console of a running machine. Its output is
+// kept in a history buffer and sent to all the subscribers, a slow
+// subscriber misses output but never blocks the machine
+type console struct {
+	name string
+	pty  io.ReadWriteCloser
+
+	lock    sync.Mutex
+	history []byte
+	subs    map[chan []byte]struct{}
+}
+
+func newConsole(name string, pty io.ReadWriteCloser) *console {
+	return &console{
+		name: name,
+		pty:  pty,
+		subs: make(map[chan []byte]struct{}),
+	}
+}
+
+// run reads the console output until the pty is closed, each chunk
+// is also passed to output
+func (c *console) run(output func(name string, data []byte)) {
+	defer func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for sub := range c.subs {
+			close(sub)
+		}
+		c.subs = nil
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.pty.Read(buf)
+		if n > 0 {
+			data := append([]byte{}, buf[:n]...)
+			c.publish(data)
+			if output != nil {
+				output(c.name, data)
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Debug().Err(err).Str("name", c.name).Msg("console closed")
+			}
+			return
+		}
+	}
+}
+
+func (c *console) publish(data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.history = append(c.history, data...)
+	if over := len(c.history) - consoleHistorySize; over > 0 {
+		c.history = append([]byte{}, c.history[over:]...)
+	}
+
+	for sub := range c.subs {
+		select {
+		case sub <- data:
+		default:
+		}
+	}
+}
+
+// History returns the last output of the console
+func (c *console) History() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]byte{}, c.history...)
+}
+
+// Subscribe returns the history of the console and a channel with
+// the output that follows it. The channel is closed when the console
+// is closed or cancel is called
+func (c *console) Subscribe() (history []byte, output <-chan []byte, cancel func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan []byte, consoleBacklog)
+	history = append([]byte{}, c.history...)
+	if c.subs == nil {
+		// console is already closed
+		close(ch)
+		return history, ch, func() {}
+	}
+
+	c.subs[ch] = struct{}{}
+
+	var once sync.Once
+	return history, ch, func() {
+		once.Do(func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			if _, ok := c.subs[ch]; ok {
+				delete(c.subs, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+// Write sends data to the machine
+func (c *console) Write(data []byte) (int, error) {
+	return c.pty.Write(data)
+}
+
+// Close the console
+func (c *console) Close() error {
+	return c.pty.Close()
+}
+
+// consoles are the serial consoles of the running machines
+type consoles struct {
+	lock sync.Mutex
+	m    map[string]*console
+	subs map[chan pkg.ConsoleOutput]struct{}
+}
+
+func newConsoles() *consoles {
+	return &consoles{
+		m:    make(map[string]*console),
+		subs: make(map[chan pkg.ConsoleOutput]struct{}),
+	}
+}
+
+// Attach starts reading the console of machine name from pty. An
+// already attached console of the machine is closed
+func (c *consoles) Attach(name string, pty io.ReadWriteCloser) {
+	con := newConsole(name, pty)
+
+	c.lock.Lock()
+	if old, ok := c.m[name]; ok && old != nil {
+		old.Close()
+	}
+	c.m[name] = con
+	c.lock.Unlock()
+
+	go func() {
+		con.run(c.publish)
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.m[name] == con {
+			delete(c.m, name)
+		}
+	}()
+}
+
+// Known checks if machine name was already seen by Attach or Mark
+func (c *consoles) Known(name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.m[name]
+	return ok
+}
+
+// Mark records that machine name has no console, so there is no need
+// to look for it again until it is restarted
+func (c *consoles) Mark(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.m[name]; !ok {
+		c.m[name] = nil
+	}
+}
+
+// Get the console of machine name
+func (c *consoles) Get(name string) (*console, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	con := c.m[name]
+	if con == nil {
+		return nil, fmt.Errorf("machine '%s' has no console attached", name)
+	}
+
+	return con, nil
+}
+
+// Detach closes the console of machine name
+func (c *consoles) Detach(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if con := c.m[name]; con != nil {
+		con.Close()
+	}
+	delete(c.m, name)
+}
+
+func (c *consoles) publish(name string, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for sub := range c.subs {
+		select {
+		case sub <- pkg.ConsoleOutput{Name: name, Data: data}:
+		default:
+		}
+	}
+}
+
+// Subscribe to the output of all the consoles until ctx is done
+func (c *consoles) Subscribe(ctx context.Context) <-chan pkg.ConsoleOutput {
+	ch := make(chan pkg.ConsoleOutput, consoleBacklog)
+
+	c.lock.Lock()
+	c.subs[ch] = struct{}{}
+	c.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.subs, ch)
+		close(ch)
+	}()
+
+	return ch
+}
+
+// openPty opens the pty the hypervisor attached the serial console of
+// the machine to, in raw mode so the output of the machine is not echoed
+// back to it
+func openPty(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open console pty")
+	}
+
+	fd := int(file.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "failed to get console pty attributes")
+	}
+
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "failed to set console pty in raw mode")
+	}
+
+	return file, nil
+}
+
+// attachConsole starts reading the serial console of a running machine.
+// Failing to attach the console does not affect the machine, so errors
+// are only logged
+func (m *Module) attachConsole(ctx context.Context, name string) {
+	client := NewClient(m.socketPath(name))
+	data, err := client.Inspect(ctx)
+	if err != nil {
+		log.Error().Err(err).Str("name", name).Msg("failed to get machine console")
+		return
+	}
+
+	if data.Serial == "" {
+		// machines started before the console support
+		m.consoles.Mark(name)
+		return
+	}
+
+	pty, err := openPty(data.Serial)
+	if err != nil {
+		log.Error().Err(err).Str("name", name).Msg("failed to attach machine console")
+		return
+	}
+
+	m.consoles.Attach(name, pty)
+}
+
+// ConsoleHistory returns the last output of the serial console of a machine
+func (m *Module) ConsoleHistory(name string) ([]byte, error) {
+	con, err := m.consoles.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return con.History(), nil
+}
+
+// ConsoleWrite sends data to the serial console of a machine
+func (m *Module) ConsoleWrite(name string, data []byte) error {
+	con, err := m.consoles.Get(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := con.Write(data); err != nil {
+		return errors.Wrapf(err, "failed to write to machine '%s' console", name)
+	}
+
+	return nil
+}
+
+// Consoles streams the serial console output of all the machines
+func (m *Module) Consoles(ctx context.Context) <-chan pkg.ConsoleOutput {
+	return m.consoles.Subscribe(ctx)
+}
@@ -0,0 +1,143 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+// fakePty is the pty of a machine, what the machine prints is written
+// to output, what is sent to the machine is kept in input
+type fakePty struct {
+	reader *io.PipeReader
+	output *io.PipeWriter
+
+	lock  sync.Mutex
+	input bytes.Buffer
+}
+
+func newFakePty() *fakePty {
+	r, w := io.Pipe()
+	return &fakePty{reader: r, output: w}
+}
+
+func (p *fakePty) Read(data []byte) (int, error) {
+	return p.reader.Read(data)
+}
+
+func (p *fakePty) Write(data []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.input.Write(data)
+}
+
+func (p *fakePty) Close() error {
+	return p.reader.Close()
+}
+
+func receive(t *testing.T, ch <-chan []byte) []byte {
+	select {
+	case data := <-ch:
+		return data
+	case <-time.After(time.Second):
+		t.Fatal("no console output")
+	}
+	return nil
+}
+
+func TestConsole(t *testing.T) {
+	pty := newFakePty()
+	con := newConsole("vm", pty)
+
+	done := make(chan struct{})
+	go func() {
+		con.run(nil)
+		close(done)
+	}()
+
+	_, output, cancel := con.Subscribe()
+	defer cancel()
+
+	_, err := pty.output.Write([]byte("booting"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("booting"), receive(t, output))
+
+	// a late subscriber gets the history first
+	history, late, cancelLate := con.Subscribe()
+	require.Equal(t, []byte("booting"), history)
+	cancelLate()
+	_, ok := <-late
+	require.False(t, ok)
+
+	_, err = con.Write([]byte("root\n"))
+	require.NoError(t, err)
+	require.Equal(t, "root\n", pty.input.String())
+
+	pty.output.Close()
+	<-done
+
+	_, ok = <-output
+	require.False(t, ok)
+	require.Equal(t, []byte("booting"), con.History())
+}
+
+func TestConsoleHistory(t *testing.T) {
+	con := newConsole("vm", newFakePty())
+
+	con.publish(bytes.Repeat([]byte{'a'}, consoleHistorySize))
+	con.publish([]byte("end"))
+
+	history := con.History()
+	require.Len(t, history, consoleHistorySize)
+	require.True(t, bytes.HasSuffix(history, []byte("end")))
+}
+
+func TestConsoles(t *testing.T) {
+	consoles := newConsoles()
+
+	_, err := consoles.Get("vm")
+	require.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all := consoles.Subscribe(ctx)
+
+	pty := newFakePty()
+	consoles.Attach("vm", pty)
+	require.True(t, consoles.Known("vm"))
+
+	_, err = pty.output.Write([]byte("login:"))
+	require.NoError(t, err)
+
+	select {
+	case out := <-all:
+		require.Equal(t, pkg.ConsoleOutput{Name: "vm", Data: []byte("login:")}, out)
+	case <-time.After(time.Second):
+		t.Fatal("no console output")
+	}
+
+	con, err := consoles.Get("vm")
+	require.NoError(t, err)
+	require.Equal(t, []byte("login:"), con.History())
+
+	// the console is forgotten once the machine is gone
+	pty.output.Close()
+	require.Eventually(t, func() bool {
+		return !consoles.Known("vm")
+	}, time.Second, 10*time.Millisecond)
+
+	// machines without a console are only known
+	consoles.Mark("legacy")
+	require.True(t, consoles.Known("legacy"))
+	_, err = consoles.Get("legacy")
+	require.Error(t, err)
+
+	consoles.Detach("legacy")
+	require.False(t, consoles.Known("legacy"))
+}
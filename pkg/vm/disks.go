@@ -0,0 +1,145 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+// diskUser returns the machine, other than except, the disk at path
+// is attached to
+func (m *Module) diskUser(path, except string) (string, bool) {
+	configs, err := ioutil.ReadDir(filepath.Join(m.root, configDir))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list machines")
+		return "", false
+	}
+
+	for _, config := range configs {
+		if config.Name() == except {
+			continue
+		}
+
+		machine, err := MachineFromFile(m.configPath(config.Name()))
+		if err != nil {
+			log.Error().Err(err).Str("name", config.Name()).Msg("failed to load machine config")
+			continue
+		}
+
+		for _, disk := range machine.Disks {
+			if disk.Path == path {
+				return machine.ID, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// DiskUser returns the machine the disk at path is attached to
+func (m *Module) DiskUser(path string) (string, bool) {
+	return m.diskUser(path, "")
+}
+
+// AttachDisk adds a disk to a machine. The disk is hotplugged if the
+// machine is running, and it's kept when the machine is restarted
+func (m *Module) AttachDisk(name string, disk pkg.VMDisk) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if disk.Root {
+		return fmt.Errorf("a root disk can't be attached to a machine")
+	}
+
+	machine, err := MachineFromFile(m.configPath(name))
+	if err != nil {
+		return errors.Wrapf(err, "machine '%s' does not exist", name)
+	}
+
+	for _, attached := range machine.Disks {
+		if attached.Path == disk.Path {
+			return nil
+		}
+	}
+
+	if user, ok := m.diskUser(disk.Path, name); ok {
+		return fmt.Errorf("disk '%s' is already attached to machine '%s'", disk.Path, user)
+	}
+
+	device := Disk{
+		ID:       fmt.Sprint(len(machine.Disks) + 2),
+		Path:     disk.Path,
+		ReadOnly: disk.ReadOnly,
+	}
+	machine.Disks = append(machine.Disks, device)
+
+	if !machine.Stopped && m.Exists(name) {
+		// the new disk is throttled like the others
+		if cgroup := newCgroup(name); cgroup.Exists() {
+			if err := cgroup.Apply(machine.limits()); err != nil {
+				log.Error().Err(err).Str("name", name).Msg("failed to update machine limits")
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		log.Debug().Str("name", name).Str("disk", disk.Path).Msg("attaching disk")
+		if err := NewClient(m.socketPath(name)).AddDisk(ctx, device); err != nil {
+			return errors.Wrapf(err, "failed to attach disk to machine '%s'", name)
+		}
+	}
+
+	return machine.Save(m.configPath(name))
+}
+
+// DetachDisk removes the disk at path from a machine. The disk is
+// unplugged if the machine is running, the guest should not use it anymore
+func (m *Module) DetachDisk(name string, path string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	machine, err := MachineFromFile(m.configPath(name))
+	if err != nil {
+		return errors.Wrapf(err, "machine '%s' does not exist", name)
+	}
+
+	index := -1
+	for i, disk := range machine.Disks {
+		if disk.Path == path {
+			index = i
+			break
+		}
+	}
+
+	if index == -1 {
+		return nil
+	}
+
+	if !machine.Stopped && m.Exists(name) {
+		client := NewClient(m.socketPath(name))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		data, err := client.Inspect(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to get machine configuration")
+		}
+
+		if id, ok := data.Disks[path]; ok {
+			log.Debug().Str("name", name).Str("disk", path).Msg("detaching disk")
+			if err := client.RemoveDevice(ctx, id); err != nil {
+				return errors.Wrapf(err, "failed to detach disk from machine '%s'", name)
+			}
+		}
+	}
+
+	machine.Disks = append(machine.Disks[:index], machine.Disks[index+1:]...)
+	return machine.Save(m.configPath(name))
+}
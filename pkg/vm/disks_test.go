@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+func TestAttachDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vmd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, configDir), 0755))
+	m := Module{root: dir}
+
+	// stopped machines are only updated, they get the disk when started
+	for _, name := range []string{"vm1", "vm2"} {
+		machine := Machine{
+			ID:      name,
+			Disks:   Disks{{ID: "2", Path: "/disks/" + name + "-vda", RootDevice: true}},
+			Stopped: true,
+		}
+		require.NoError(t, machine.Save(m.configPath(name)))
+	}
+
+	require.Error(t, m.AttachDisk("vm3", pkg.VMDisk{Path: "/disks/data"}))
+	require.Error(t, m.AttachDisk("vm1", pkg.VMDisk{Path: "/disks/data", Root: true}))
+
+	require.NoError(t, m.AttachDisk("vm1", pkg.VMDisk{Path: "/disks/data"}))
+	// attaching it again does nothing
+	require.NoError(t, m.AttachDisk("vm1", pkg.VMDisk{Path: "/disks/data"}))
+
+	machine, err := MachineFromFile(m.configPath("vm1"))
+	require.NoError(t, err)
+	require.Equal(t, Disks{
+		{ID: "2", Path: "/disks/vm1-vda", RootDevice: true},
+		{ID: "3", Path: "/disks/data"},
+	}, machine.Disks)
+
+	// a disk is only attached to one machine
+	user, ok := m.diskUser("/disks/data", "vm2")
+	require.True(t, ok)
+	require.Equal(t, "vm1", user)
+	require.Error(t, m.AttachDisk("vm2", pkg.VMDisk{Path: "/disks/data"}))
+
+	require.NoError(t, m.DetachDisk("vm1", "/disks/data"))
+	require.NoError(t, m.DetachDisk("vm1", "/disks/data"))
+
+	machine, err = MachineFromFile(m.configPath("vm1"))
+	require.NoError(t, err)
+	require.Len(t, machine.Disks, 1)
+
+	// once detached it can be attached to another machine
+	require.NoError(t, m.AttachDisk("vm2", pkg.VMDisk{Path: "/disks/data", ReadOnly: true}))
+	machine, err = MachineFromFile(m.configPath("vm2"))
+	require.NoError(t, err)
+	require.Equal(t, Disk{ID: "3", Path: "/disks/data", ReadOnly: true}, machine.Disks[1])
+}
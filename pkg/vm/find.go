@@ -10,11 +10,7 @@ import (
 )
 
 func findAll() (map[string]int, error) {
-	const (
-		proc   = "/proc"
-		search = "cloud-hypervisor"
-		idFlag = "--log-file"
-	)
+	const proc = "/proc"
 
 	found := make(map[string]int)
 	err := filepath.Walk(proc, func(path string, info os.FileInfo, _ error) error {
@@ -42,26 +38,8 @@ func findAll() (map[string]int, error) {
 			return err
 		}
 
-		parts := bytes.Split(cmd, []byte{0})
-		if string(parts[0]) != search {
-			return nil
-		}
-
-		// a firecracker instance, now find id
-		for i, part := range parts {
-			if string(part) == idFlag {
-				// a hit
-				if i == len(parts)-1 {
-					// --id some how is last element of the array
-					// so avoid a panic by skipping this
-					return nil
-				}
-				logName := parts[i+1]
-				name := filepath.Base(string(logName))
-				found[name] = pid
-				// this is to stop the scan.
-				return nil
-			}
+		if machine, ok := machineName(cmd); ok {
+			found[machine] = pid
 		}
 
 		return nil
@@ -70,6 +48,47 @@ func findAll() (map[string]int, error) {
 	return found, err
 }
 
+// machineName returns the name of the machine run by a cloud-hypervisor
+// process from its command line
+func machineName(cmdline []byte) (string, bool) {
+	const (
+		search = "cloud-hypervisor"
+		idFlag = "--log-file"
+	)
+
+	parts := bytes.Split(cmdline, []byte{0})
+	if string(parts[0]) != search {
+		return "", false
+	}
+
+	// a firecracker instance, now find id
+	for i, part := range parts {
+		if string(part) == idFlag {
+			// a hit
+			if i == len(parts)-1 {
+				// --id some how is last element of the array
+				// so avoid a panic by skipping this
+				return "", false
+			}
+			logName := parts[i+1]
+			return filepath.Base(string(logName)), true
+		}
+	}
+
+	return "", false
+}
+
+// isHypervisor checks that pid is the cloud-hypervisor process of the machine
+func isHypervisor(pid int, name string) bool {
+	cmd, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+
+	found, ok := machineName(cmd)
+	return ok && found == name
+}
+
 func find(name string) (int, error) {
 	machines, err := findAll()
 	if err != nil {
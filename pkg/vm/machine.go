@@ -8,6 +8,8 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/container/stats"
 	"github.com/vishvananda/netlink"
 )
 
@@ -117,6 +119,63 @@ type Config struct {
 	CPU       CPU    `json:"vcpu_count"`
 	Mem       MemMib `json:"mem_size_mib"`
 	HTEnabled bool   `json:"ht_enabled"`
+	// MaxCPU and MaxMem are the size the machine can be resized to
+	// while it is running, they default to CPU and Mem
+	MaxCPU CPU    `json:"max_vcpu_count,omitempty"`
+	MaxMem MemMib `json:"max_mem_size_mib,omitempty"`
+}
+
+func (c Config) maxCPU() CPU {
+	if c.MaxCPU < c.CPU {
+		return c.CPU
+	}
+	return c.MaxCPU
+}
+
+func (c Config) maxMem() MemMib {
+	if c.MaxMem < c.Mem {
+		return c.Mem
+	}
+	return c.MaxMem
+}
+
+// cpus is the cloud-hypervisor --cpus argument
+func (c Config) cpus() string {
+	if max := c.maxCPU(); max > c.CPU {
+		return fmt.Sprintf("%s,max=%d", c.CPU, max)
+	}
+	return c.CPU.String()
+}
+
+// memory is the cloud-hypervisor --memory argument, the memory above
+// the boot size is reserved for hotplug
+func (c Config) memory() string {
+	if max := c.maxMem(); max > c.Mem {
+		return fmt.Sprintf("%s,hotplug_size=%dM", c.Mem, int64(max-c.Mem))
+	}
+	return c.Mem.String()
+}
+
+// resize changes the size the machine boots with. If running is set
+// the size must be reachable by hotplug
+func (c *Config) resize(cpu CPU, mem MemMib, running bool) error {
+	if cpu == 0 || cpu > c.maxCPU() {
+		return fmt.Errorf("invalid cpu must be between 1 and %d", c.maxCPU())
+	}
+
+	if mem < 512 || mem > c.maxMem() {
+		return fmt.Errorf("invalid memory must be between 512M and %dM", int64(c.maxMem()))
+	}
+
+	if running && mem < c.Mem {
+		return fmt.Errorf("memory of a running machine can't shrink from %dM to %dM", int64(c.Mem), int64(mem))
+	}
+
+	// keep the max size when the boot size changes
+	c.MaxCPU, c.MaxMem = c.maxCPU(), c.maxMem()
+	c.CPU, c.Mem = cpu, mem
+
+	return nil
 }
 
 // Machine struct
@@ -129,6 +188,15 @@ type Machine struct {
 	// NoKeepAlive is not used by firecracker, but instead a marker
 	// for the vm  mananger to not restart the machine when it stops
 	NoKeepAlive bool `json:"no-keep-alive"`
+	// Stopped is a marker for the vm manager to not restart
+	// the machine until it is started again
+	Stopped bool `json:"stopped"`
+	// Restart is the policy the supervisor follows when the machine exits
+	Restart RestartPolicy `json:"restart"`
+	// Stats backends the metrics of the machine are pushed to
+	Stats []stats.Stats `json:"stats,omitempty"`
+	// IO throttling of the disks of the machine
+	IO pkg.VMIO `json:"io"`
 }
 
 // Save saves a machine into a file
@@ -0,0 +1,46 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigArgs(t *testing.T) {
+	cfg := Config{CPU: 2, Mem: 2048}
+	require.Equal(t, "boot=2", cfg.cpus())
+	require.Equal(t, "size=2048M", cfg.memory())
+
+	cfg.MaxCPU = 8
+	cfg.MaxMem = 8192
+	require.Equal(t, "boot=2,max=8", cfg.cpus())
+	require.Equal(t, "size=2048M,hotplug_size=6144M", cfg.memory())
+
+	// a max lower than the boot size is ignored
+	cfg = Config{CPU: 4, Mem: 4096, MaxCPU: 2, MaxMem: 1024}
+	require.Equal(t, "boot=4", cfg.cpus())
+	require.Equal(t, "size=4096M", cfg.memory())
+}
+
+func TestConfigResize(t *testing.T) {
+	cfg := Config{CPU: 2, Mem: 2048, MaxCPU: 4, MaxMem: 4096}
+
+	require.NoError(t, cfg.resize(4, 4096, true))
+	require.Equal(t, Config{CPU: 4, Mem: 4096, MaxCPU: 4, MaxMem: 4096}, cfg)
+
+	require.Error(t, cfg.resize(5, 4096, true))
+	require.Error(t, cfg.resize(0, 4096, true))
+	require.Error(t, cfg.resize(4, 8192, true))
+	require.Error(t, cfg.resize(4, 256, false))
+
+	// a running machine memory can't shrink
+	require.Error(t, cfg.resize(2, 2048, true))
+	require.NoError(t, cfg.resize(1, 2048, false))
+	require.Equal(t, "boot=1,max=4", cfg.cpus())
+	require.Equal(t, "size=2048M,hotplug_size=2048M", cfg.memory())
+
+	// the max size is kept once the machine is resized down
+	cfg = Config{CPU: 2, Mem: 2048}
+	require.NoError(t, cfg.resize(1, 1024, false))
+	require.Equal(t, Config{CPU: 1, Mem: 1024, MaxCPU: 2, MaxMem: 2048}, cfg)
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -23,8 +24,11 @@ import (
 const (
 	// socketDir where vm firecracker sockets are kept
 	socketDir = "/var/run/cloud-hypervisor"
-	configDir = "config"
-	logsDir   = "logs"
+	// stateDir where the supervisors write the state of the machines
+	stateDir     = "/var/run/cloud-hypervisor/state"
+	configDir    = "config"
+	logsDir      = "logs"
+	cloudInitDir = "cloud-init"
 
 	defaultKernelArgs = "ro console=ttyS0 noapic reboot=k panic=1 pci=off nomodules"
 )
@@ -35,6 +39,12 @@ type Module struct {
 	client   zbus.Client
 	lock     sync.Mutex
 	failures *cache.Cache
+	consoles *consoles
+	policy   RestartPolicy
+	io       pkg.VMIO
+
+	statsLock sync.Mutex
+	stats     map[string]context.CancelFunc
 
 	legacyMonitor LegacyMonitor
 }
@@ -43,12 +53,16 @@ var (
 	_ pkg.VMModule = (*Module)(nil)
 )
 
-// NewVMModule creates a new instance of vm manager
-func NewVMModule(cl zbus.Client, root string) (*Module, error) {
+// NewVMModule creates a new instance of vm manager, the machines
+// are restarted following policy when they exit. The disks of the
+// machines without io limits of their own are throttled with io
+func NewVMModule(cl zbus.Client, root string, policy RestartPolicy, io pkg.VMIO) (*Module, error) {
 	for _, dir := range []string{
 		socketDir,
+		stateDir,
 		filepath.Join(root, configDir),
 		filepath.Join(root, logsDir),
+		filepath.Join(root, cloudInitDir),
 	} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return nil, err
@@ -60,6 +74,10 @@ func NewVMModule(cl zbus.Client, root string) (*Module, error) {
 		client: cl,
 		// values are cached only for 1 minute. purge cache every 20 second
 		failures: cache.New(2*time.Minute, 20*time.Second),
+		consoles: newConsoles(),
+		policy:   policy,
+		io:       io,
+		stats:    make(map[string]context.CancelFunc),
 
 		legacyMonitor: LegacyMonitor{root},
 	}
@@ -98,12 +116,73 @@ func (m *Module) logsPath(name string) string {
 	return filepath.Join(m.root, logsDir, name)
 }
 
-// Exists checks if firecracker process running for this machine
+func (m *Module) cloudInitPath(name string) string {
+	return filepath.Join(m.root, cloudInitDir, name)
+}
+
+func (m *Module) statePath(name string) string {
+	return filepath.Join(stateDir, name)
+}
+
+// Exists checks if the machine is running
 func (m *Module) Exists(id string) bool {
+	if state, err := LoadState(m.statePath(id)); err == nil {
+		return state.Alive()
+	}
+
+	// machines started before they were supervised
 	_, err := find(id)
 	return err == nil
 }
 
+// alive returns the names of all the running machines
+func (m *Module) alive() (map[string]struct{}, error) {
+	names := make(map[string]struct{})
+	items, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if item.IsDir() || filepath.Ext(item.Name()) == ".tmp" {
+			continue
+		}
+
+		state, err := LoadState(filepath.Join(stateDir, item.Name()))
+		if err != nil {
+			log.Error().Err(err).Str("name", item.Name()).Msg("failed to load machine state")
+			continue
+		}
+
+		if state.Alive() {
+			names[item.Name()] = struct{}{}
+		}
+	}
+
+	// machines started before they were supervised have no state,
+	// they are only found by scanning the processes
+	configs, err := ioutil.ReadDir(filepath.Join(m.root, configDir))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, config := range configs {
+		if _, err := os.Stat(m.statePath(config.Name())); os.IsNotExist(err) {
+			legacy, err := findAll()
+			if err != nil {
+				return nil, err
+			}
+
+			for name := range legacy {
+				names[name] = struct{}{}
+			}
+			break
+		}
+	}
+
+	return names, nil
+}
+
 func (m *Module) makeNetwork(vm *pkg.VM) ([]Interface, string, error) {
 	// assume there is always at least 1 iface present
 
@@ -167,12 +246,17 @@ func (m *Module) makeNetwork(vm *pkg.VM) ([]Interface, string, error) {
 }
 
 func (m *Module) makeNetCmdLine(idx int, ifcfg pkg.VMIface) string {
-	// net_%ifacename=%ip4_cidr,$ip4_gw[,$ip4_route],$ipv6_cidr,$ipv6_gw,public|priv
+	// net_%ifacename=%ip4_cidr,$ip4_gw[,$ip4_route],$ipv6_cidr,$ipv6_gw,public|priv|ygg
+	// the ipv4 section is `none` if the iface has no ipv4
 	ip4Elems := make([]string, 0, 3)
-	ip4Elems = append(ip4Elems, ifcfg.IP4AddressCIDR.String())
-	ip4Elems = append(ip4Elems, ifcfg.IP4GatewayIP.String())
-	if len(ifcfg.IP4Net.IP) > 0 {
-		ip4Elems = append(ip4Elems, ifcfg.IP4Net.String())
+	if ifcfg.IP4AddressCIDR.IP.To4() != nil {
+		ip4Elems = append(ip4Elems, ifcfg.IP4AddressCIDR.String())
+		ip4Elems = append(ip4Elems, ifcfg.IP4GatewayIP.String())
+		if len(ifcfg.IP4Net.IP) > 0 {
+			ip4Elems = append(ip4Elems, ifcfg.IP4Net.String())
+		}
+	} else {
+		ip4Elems = append(ip4Elems, "none")
 	}
 
 	ip6Elems := make([]string, 0, 3)
@@ -186,6 +270,8 @@ func (m *Module) makeNetCmdLine(idx int, ifcfg pkg.VMIface) string {
 	privPub := "priv"
 	if ifcfg.Public {
 		privPub = "public"
+	} else if ifcfg.Yggdrasil {
+		privPub = "ygg"
 	}
 
 	return fmt.Sprintf("net_eth%d=%s,%s,%s", idx, strings.Join(ip4Elems, ","), strings.Join(ip6Elems, ","), privPub)
@@ -244,7 +330,7 @@ func (m *Module) withLogs(path string, err error) error {
 
 // List all running vms names
 func (m *Module) List() ([]string, error) {
-	machines, err := findAll()
+	machines, err := m.alive()
 	if err != nil {
 		return nil, err
 	}
@@ -282,6 +368,20 @@ func (m *Module) Run(vm pkg.VM) error {
 		return fmt.Errorf("a vm with same name already exists")
 	}
 
+	for _, disk := range vm.Disks {
+		if user, ok := m.diskUser(disk.Path, vm.Name); ok {
+			return fmt.Errorf("disk '%s' is already attached to machine '%s'", disk.Path, user)
+		}
+	}
+
+	if vm.CloudInit != nil {
+		seed, err := m.cloudInitSeed(vm.Name, *vm.CloudInit)
+		if err != nil {
+			return err
+		}
+		vm.Disks = append(vm.Disks, pkg.VMDisk{Path: seed, ReadOnly: true})
+	}
+
 	devices, err := m.makeDevices(&vm)
 	if err != nil {
 		return err
@@ -315,10 +415,18 @@ func (m *Module) Run(vm pkg.VM) error {
 			CPU:       CPU(vm.CPU),
 			Mem:       MemMib(vm.Memory),
 			HTEnabled: false,
+			MaxCPU:    CPU(vm.MaxCPU),
+			MaxMem:    MemMib(vm.MaxMemory),
 		},
 		Interfaces:  nics,
 		Disks:       devices,
 		NoKeepAlive: vm.NoKeepAlive,
+		Stats:       vm.Stats,
+		IO:          vm.IO,
+	}
+	machine.Restart = m.restartPolicy(&machine)
+	if machine.IO == (pkg.VMIO{}) {
+		machine.IO = m.io
 	}
 
 	log.Debug().Str("name", vm.Name).Msg("saving machine")
@@ -336,23 +444,106 @@ func (m *Module) Run(vm pkg.VM) error {
 		m.failures.Set(vm.Name, permanent, cache.NoExpiration)
 	}
 
-	if err = machine.Run(ctx, m.socketPath(vm.Name), m.logsPath(vm.Name)); err != nil {
+	if err = m.spawn(vm.Name); err != nil {
 		return m.withLogs(m.logsPath(vm.Name), err)
 	}
 
-	if err := m.waitAndAdjOom(ctx, vm.Name); err != nil {
+	if err := m.wait(ctx, vm.Name); err != nil {
 		return m.withLogs(m.logsPath(vm.Name), err)
 	}
 
+	m.attachConsole(ctx, vm.Name)
+	m.startStats(vm.Name, vm.Stats)
+
+	return nil
+}
+
+// supervisorCmd runs the supervisor of a machine, it's the vmd supervise
+// command of the running binary
+var supervisorCmd = []string{"/proc/self/exe", "vmd", "supervise"}
+
+// spawn starts the supervisor of the machine, which runs the machine
+// and restarts it following its restart policy
+func (m *Module) spawn(name string) error {
+	if state, err := LoadState(m.statePath(name)); err == nil {
+		m.killOrphan(name, state)
+	}
+
+	// the state of the previous run must not be taken for the new one
+	if err := os.Remove(m.statePath(name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove machine state")
+	}
+
+	args := append([]string{}, supervisorCmd[1:]...)
+	args = append(args,
+		"--socket", m.socketPath(name),
+		"--logs", m.logsPath(name),
+		"--state", m.statePath(name),
+		m.configPath(name),
+	)
+
+	out, err := os.Create(fmt.Sprintf("%s.out", m.logsPath(name)))
+	if err != nil {
+		return errors.Wrap(err, "failed to create process log file")
+	}
+	defer out.Close()
+
+	cmd := exec.Command(supervisorCmd[0], args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// the supervisor must not be killed with vmd
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed to start machine supervisor")
+	}
+
+	// the supervisor must not be killed before its machine, or the
+	// machine would be left running without a supervisor
+	if err := protectOOM(cmd.Process.Pid); err != nil {
+		log.Error().Err(err).Str("name", name).Msg("failed to update oom priority of machine supervisor")
+	}
+
+	// the supervisor is reaped by vmd if it's still running
+	// when it exits, otherwise it's reaped by init
+	go cmd.Wait()
+
 	return nil
 }
 
-func (m *Module) waitAndAdjOom(ctx context.Context, name string) error {
+// killOrphan kills the hypervisor of a machine whose supervisor died
+// while it was running, so a second hypervisor is never started on
+// the same disks and taps
+func (m *Module) killOrphan(name string, state ProcessState) {
+	if state.Alive() || state.Pid == 0 || !isHypervisor(state.Pid, name) {
+		return
+	}
+
+	log.Warn().Str("name", name).Int("pid", state.Pid).Msg("killing machine left running without supervisor")
+	syscall.Kill(state.Pid, syscall.SIGKILL)
+
+	now := time.Now()
+	for isHypervisor(state.Pid, name) && time.Since(now) < stopTimeout {
+		<-time.After(100 * time.Millisecond)
+	}
+}
+
+// wait waits for the machine to be ready to accept api calls
+func (m *Module) wait(ctx context.Context, name string) error {
 	check := func() error {
-		if !m.Exists(name) {
-			return fmt.Errorf("failed to spawn vm machine process '%s'", name)
+		state, err := LoadState(m.statePath(name))
+		if err != nil {
+			return err
+		}
+
+		if state.Done {
+			return backoff.Permanent(fmt.Errorf("failed to spawn vm machine process '%s': %s", name, state.Reason))
 		}
-		//TODO: check unix connection
+
+		if state.Pid == 0 {
+			return fmt.Errorf("vm machine process '%s' is not running", name)
+		}
+
 		socket := m.socketPath(name)
 		con, err := net.Dial("unix", socket)
 		if err != nil {
@@ -366,20 +557,7 @@ func (m *Module) waitAndAdjOom(ctx context.Context, name string) error {
 	ctx, cancel := context.WithTimeout(ctx, 6*time.Second)
 	defer cancel()
 
-	if err := backoff.Retry(check, backoff.WithContext(backoff.NewConstantBackOff(2*time.Second), ctx)); err != nil {
-		return err
-	}
-
-	pid, err := find(name)
-	if err != nil {
-		return errors.Wrapf(err, "failed to find vm with id '%s'", name)
-	}
-
-	if err := ioutil.WriteFile(filepath.Join("/proc/", fmt.Sprint(pid), "oom_adj"), []byte("-17"), 0644); err != nil {
-		return errors.Wrapf(err, "failed to update oom priority for machine '%s' (PID: %d)", name, pid)
-	}
-
-	return nil
+	return backoff.Retry(check, backoff.WithContext(backoff.NewConstantBackOff(500*time.Millisecond), ctx))
 }
 
 // Logs returns machine logs for give machine name
@@ -393,16 +571,30 @@ func (m *Module) Inspect(name string) (pkg.VMInfo, error) {
 	if !m.Exists(name) {
 		return pkg.VMInfo{}, fmt.Errorf("machine '%s' does not exist", name)
 	}
+
+	machine, err := MachineFromFile(m.configPath(name))
+	if err != nil {
+		return pkg.VMInfo{}, errors.Wrapf(err, "machine '%s' does not exist", name)
+	}
+
+	limits := machine.limits()
+	if !newCgroup(name).Exists() {
+		// machines started before they had their own cgroup
+		limits = pkg.VMLimits{}
+	}
+
 	client := NewClient(m.socketPath(name))
-	cpu, mem, err := client.Inspect(context.Background())
+	data, err := client.Inspect(context.Background())
 	if err != nil {
 		return pkg.VMInfo{}, errors.Wrap(err, "failed to get machine configuration")
 	}
 
 	return pkg.VMInfo{
-		CPU:       int64(cpu),
-		Memory:    int64(mem),
+		CPU:       int64(data.CPU),
+		Memory:    int64(data.Memory),
 		HtEnabled: false,
+		State:     data.State,
+		Limits:    limits,
 	}, nil
 }
 
@@ -414,6 +606,15 @@ func (m *Module) Delete(name string) error {
 	// to revive this machine
 	m.failures.Set(name, permanent, cache.NoExpiration)
 	defer os.RemoveAll(m.configPath(name))
+	defer os.RemoveAll(m.cloudInitPath(name))
+	defer os.RemoveAll(m.statePath(name))
+	defer m.consoles.Detach(name)
+	defer m.stopStats(name)
+	defer func() {
+		if err := newCgroup(name).Remove(); err != nil {
+			log.Error().Err(err).Str("name", name).Msg("failed to remove machine cgroup")
+		}
+	}()
 
 	//is this the real life? is this just legacy?
 	if pid, err := findFC(name); err == nil {
@@ -422,6 +623,49 @@ func (m *Module) Delete(name string) error {
 	}
 
 	// normal operation
+	return m.shutdown(name)
+}
+
+// shutdown stops the machine process, first gracefully then by force
+func (m *Module) shutdown(name string) error {
+	state, err := LoadState(m.statePath(name))
+	if os.IsNotExist(err) {
+		return m.shutdownLegacy(name)
+	} else if err != nil {
+		return err
+	}
+
+	if !state.Alive() {
+		m.killOrphan(name, state)
+		return nil
+	}
+
+	// the supervisor shuts the machine down gracefully
+	// then by force when it's asked to stop
+	log.Debug().Str("name", name).Msg("shutting vm down [supervisor]")
+	syscall.Kill(state.Supervisor, syscall.SIGTERM)
+
+	const killAfter = 3*stopTimeout + 5*time.Second
+	now := time.Now()
+	for m.Exists(name) {
+		if time.Since(now) > killAfter {
+			log.Debug().Str("name", name).Msg("shutting vm down [sigkill]")
+			syscall.Kill(state.Supervisor, syscall.SIGKILL)
+			if state, err := LoadState(m.statePath(name)); err == nil && state.Pid != 0 {
+				syscall.Kill(state.Pid, syscall.SIGKILL)
+			}
+			break
+		}
+
+		<-time.After(500 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// shutdownLegacy stops a machine that was started before the
+// machines were supervised
+func (m *Module) shutdownLegacy(name string) error {
 	pid, err := find(name)
 	if err != nil {
 		// machine already gone
@@ -468,3 +712,172 @@ func (m *Module) Delete(name string) error {
 
 	return nil
 }
+
+// Stop shuts a machine down and marks it as stopped so the
+// monitor does not try to restart it
+func (m *Module) Stop(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	machine, err := MachineFromFile(m.configPath(name))
+	if err != nil {
+		return errors.Wrapf(err, "machine '%s' does not exist", name)
+	}
+
+	if !machine.Stopped {
+		machine.Stopped = true
+		if err := machine.Save(m.configPath(name)); err != nil {
+			return err
+		}
+	}
+
+	log.Debug().Str("name", name).Msg("stopping vm")
+	defer m.consoles.Detach(name)
+	defer m.stopStats(name)
+	return m.shutdown(name)
+}
+
+// Start boots a stopped machine with the configuration it had
+// when it was stopped
+func (m *Module) Start(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	machine, err := MachineFromFile(m.configPath(name))
+	if err != nil {
+		return errors.Wrapf(err, "machine '%s' does not exist", name)
+	}
+
+	if machine.Stopped || machine.Restart.Mode == "" {
+		machine.Stopped = false
+		if machine.Restart.Mode == "" {
+			// machines created before they were supervised
+			machine.Restart = m.restartPolicy(machine)
+		}
+		if err := machine.Save(m.configPath(name)); err != nil {
+			return err
+		}
+	}
+
+	if m.Exists(name) {
+		return nil
+	}
+
+	// the machine is started fresh, forget about its previous failures
+	m.failures.Delete(name)
+
+	ctx := context.Background()
+	if err := m.spawn(name); err != nil {
+		return m.withLogs(m.logsPath(name), err)
+	}
+
+	if err := m.wait(ctx, name); err != nil {
+		return m.withLogs(m.logsPath(name), err)
+	}
+
+	m.attachConsole(ctx, name)
+	m.startStats(name, machine.Stats)
+
+	return nil
+}
+
+// running returns a client to the hypervisor of a running machine
+func (m *Module) running(name string) (*Client, error) {
+	if !m.Exists(name) {
+		return nil, fmt.Errorf("machine '%s' is not running", name)
+	}
+
+	return NewClient(m.socketPath(name)), nil
+}
+
+// Reboot reboots a running machine
+func (m *Module) Reboot(name string) error {
+	client, err := m.running(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	log.Debug().Str("name", name).Msg("rebooting vm")
+	return client.Reboot(ctx)
+}
+
+// Pause pauses a running machine. A paused machine process is still
+// running so the monitor leaves it alone
+func (m *Module) Pause(name string) error {
+	client, err := m.running(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	log.Debug().Str("name", name).Msg("pausing vm")
+	return client.Pause(ctx)
+}
+
+// Resume resumes a paused machine
+func (m *Module) Resume(name string) error {
+	client, err := m.running(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	log.Debug().Str("name", name).Msg("resuming vm")
+	return client.Resume(ctx)
+}
+
+// Resize changes the cpu and memory of a machine. A running machine
+// is resized live, a stopped one boots with the new size when it is
+// started again
+func (m *Module) Resize(name string, cpu uint8, memory int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	machine, err := MachineFromFile(m.configPath(name))
+	if err != nil {
+		return errors.Wrapf(err, "machine '%s' does not exist", name)
+	}
+
+	running := !machine.Stopped && m.Exists(name)
+	if err := machine.Config.resize(CPU(cpu), MemMib(memory), running); err != nil {
+		return err
+	}
+
+	if running {
+		client := NewClient(m.socketPath(name))
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		// the limits are raised before the machine grows
+		if cgroup := newCgroup(name); cgroup.Exists() {
+			if err := cgroup.Apply(machine.limits()); err != nil {
+				return errors.Wrapf(err, "failed to update limits of machine '%s'", name)
+			}
+		}
+
+		log.Debug().Str("name", name).Uint8("cpu", cpu).Int64("memory", memory).Msg("resizing vm")
+		if err := client.Resize(ctx, CPU(cpu), MemMib(memory)); err != nil {
+			return errors.Wrapf(err, "failed to resize machine '%s'", name)
+		}
+	}
+
+	// the machine is restarted with its new size
+	return machine.Save(m.configPath(name))
+}
+
+// restartPolicy returns the restart policy of a machine, machines that
+// are not kept alive are never restarted
+func (m *Module) restartPolicy(machine *Machine) RestartPolicy {
+	if machine.NoKeepAlive {
+		return RestartPolicy{Mode: RestartNever}
+	}
+
+	return m.policy
+}
@@ -0,0 +1,301 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg"
+	"github.com/threefoldtech/zos/pkg/container/stats"
+)
+
+const (
+	// metricsInterval is how often the metrics of all the machines are streamed
+	metricsInterval = 30 * time.Second
+
+	// clockTicks is the USER_HZ the cpu times in /proc are expressed in
+	clockTicks = 100
+)
+
+var (
+	procRoot = "/proc"
+	netRoot  = "/sys/class/net"
+)
+
+// pid returns the pid of the hypervisor of a running machine
+func (m *Module) pid(name string) (int, error) {
+	state, err := LoadState(m.statePath(name))
+	if os.IsNotExist(err) {
+		// machines started before they were supervised
+		return find(name)
+	} else if err != nil {
+		return 0, err
+	}
+
+	if !state.Alive() || state.Pid == 0 {
+		return 0, fmt.Errorf("machine '%s' is not running", name)
+	}
+
+	return state.Pid, nil
+}
+
+// Metrics returns the resource usage of a running machine
+func (m *Module) Metrics(name string) (pkg.VMMetrics, error) {
+	machine, err := MachineFromFile(m.configPath(name))
+	if err != nil {
+		return pkg.VMMetrics{}, errors.Wrapf(err, "machine '%s' does not exist", name)
+	}
+
+	pid, err := m.pid(name)
+	if err != nil {
+		return pkg.VMMetrics{}, err
+	}
+
+	metrics := pkg.VMMetrics{
+		Name:        name,
+		Timestamp:   time.Now().Unix(),
+		MemoryLimit: uint64(machine.Config.Mem) * 1024 * 1024,
+	}
+
+	if err := processUsage(pid, &metrics); err != nil {
+		return metrics, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	counters, err := NewClient(m.socketPath(name)).Counters(ctx)
+	if err != nil {
+		return metrics, errors.Wrap(err, "failed to get machine disks counters")
+	}
+	diskUsage(counters, &metrics)
+
+	for _, nic := range machine.Interfaces {
+		if err := tapUsage(nic.Tap, &metrics); err != nil {
+			log.Error().Err(err).Str("name", name).Str("tap", nic.Tap).Msg("failed to get tap counters")
+		}
+	}
+
+	return metrics, nil
+}
+
+// AllMetrics streams the resource usage of all the running machines
+func (m *Module) AllMetrics(ctx context.Context) <-chan []pkg.VMMetrics {
+	ch := make(chan []pkg.VMMetrics)
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(metricsInterval):
+			}
+
+			names, err := m.alive()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to list machines")
+				continue
+			}
+
+			all := make([]pkg.VMMetrics, 0, len(names))
+			for name := range names {
+				metrics, err := m.Metrics(name)
+				if err != nil {
+					log.Debug().Err(err).Str("name", name).Msg("failed to get machine metrics")
+					continue
+				}
+				all = append(all, metrics)
+			}
+
+			select {
+			case ch <- all:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// processUsage sets the cpu and memory used by the hypervisor process
+func processUsage(pid int, metrics *pkg.VMMetrics) error {
+	stat, err := ioutil.ReadFile(filepath.Join(procRoot, fmt.Sprint(pid), "stat"))
+	if err != nil {
+		return errors.Wrap(err, "failed to read hypervisor process stat")
+	}
+
+	// the command name can have spaces, the fields start after it
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	// utime and stime are the 14th and 15th fields of the stat file
+	if len(fields) < 13 {
+		return fmt.Errorf("invalid hypervisor process stat")
+	}
+
+	var ticks uint64
+	for _, field := range fields[11:13] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "invalid hypervisor process cpu time")
+		}
+		ticks += value
+	}
+	metrics.CPUUsage = ticks * uint64(time.Second/clockTicks)
+
+	statm, err := ioutil.ReadFile(filepath.Join(procRoot, fmt.Sprint(pid), "statm"))
+	if err != nil {
+		return errors.Wrap(err, "failed to read hypervisor process memory")
+	}
+
+	fields = strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid hypervisor process memory")
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid hypervisor process resident memory")
+	}
+	metrics.MemoryUsage = pages * uint64(os.Getpagesize())
+
+	return nil
+}
+
+// diskUsage adds the counters of all the disks of the machine
+func diskUsage(counters map[string]map[string]uint64, metrics *pkg.VMMetrics) {
+	for _, device := range counters {
+		if _, ok := device["read_bytes"]; !ok {
+			// not a disk
+			continue
+		}
+
+		metrics.DiskReadBytes += device["read_bytes"]
+		metrics.DiskWriteBytes += device["write_bytes"]
+		metrics.DiskReadOps += device["read_ops"]
+		metrics.DiskWriteOps += device["write_ops"]
+	}
+}
+
+// tapUsage adds the counters of a tap device of the machine. What
+// the tap device receives is what the machine sends
+func tapUsage(tap string, metrics *pkg.VMMetrics) error {
+	counter := func(name string) (uint64, error) {
+		data, err := ioutil.ReadFile(filepath.Join(netRoot, tap, "statistics", name))
+		if err != nil {
+			return 0, err
+		}
+
+		return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+
+	for name, value := range map[string]*uint64{
+		"rx_bytes":   &metrics.NetTxBytes,
+		"tx_bytes":   &metrics.NetRxBytes,
+		"rx_packets": &metrics.NetTxPackets,
+		"tx_packets": &metrics.NetRxPackets,
+	} {
+		count, err := counter(name)
+		if err != nil {
+			return err
+		}
+		*value += count
+	}
+
+	return nil
+}
+
+// startStats pushes the metrics of a machine to its stats backends
+// until it is stopped. Pushing is only started once per machine
+func (m *Module) startStats(name string, backends []stats.Stats) {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+
+	if _, ok := m.stats[name]; ok {
+		return
+	}
+
+	var writers []io.WriteCloser
+	for _, backend := range backends {
+		switch backend.Type {
+		case stats.RedisType:
+			writer, err := stats.NewRedis(backend.Data.Endpoint)
+			if err != nil {
+				log.Error().Err(err).Str("name", name).Msg("redis stats")
+				continue
+			}
+			writers = append(writers, writer)
+		default:
+			log.Error().Str("type", backend.Type).Msg("invalid stats type requested")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// machines without backends are marked so they are not looked at again
+	m.stats[name] = cancel
+	if len(writers) == 0 {
+		return
+	}
+
+	go func() {
+		defer func() {
+			for _, writer := range writers {
+				writer.Close()
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(stats.StatsPushInterval):
+			}
+
+			metrics, err := m.Metrics(name)
+			if err != nil {
+				// the machine could be restarting
+				continue
+			}
+
+			data, err := json.Marshal(metrics)
+			if err != nil {
+				continue
+			}
+
+			for _, writer := range writers {
+				if _, err := writer.Write(data); err != nil {
+					log.Error().Err(err).Str("name", name).Msg("failed to push machine metrics")
+				}
+			}
+		}
+	}()
+}
+
+// stopStats stops pushing the metrics of a machine
+func (m *Module) stopStats(name string) {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+
+	if cancel, ok := m.stats[name]; ok {
+		cancel()
+		delete(m.stats, name)
+	}
+}
+
+// hasStats checks if the stats of machine name were already started
+func (m *Module) hasStats(name string) bool {
+	m.statsLock.Lock()
+	defer m.statsLock.Unlock()
+
+	_, ok := m.stats[name]
+	return ok
+}
@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/zos/pkg"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestProcessUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(root string) { procRoot = root }(procRoot)
+	procRoot = dir
+
+	writeFiles(t, dir, map[string]string{
+		"10/stat":  "10 (cloud hypervisor) S 1 10 10 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 4 0 100 0 0",
+		"10/statm": "1000 200 50 10 0 300 0",
+	})
+
+	var metrics pkg.VMMetrics
+	require.NoError(t, processUsage(10, &metrics))
+	require.Equal(t, uint64(3*1000*1000*1000), metrics.CPUUsage)
+	require.Equal(t, uint64(200*os.Getpagesize()), metrics.MemoryUsage)
+
+	require.Error(t, processUsage(11, &metrics))
+}
+
+func TestDiskUsage(t *testing.T) {
+	var metrics pkg.VMMetrics
+	diskUsage(map[string]map[string]uint64{
+		"_disk0": {"read_bytes": 100, "write_bytes": 200, "read_ops": 1, "write_ops": 2},
+		"_disk1": {"read_bytes": 10, "write_bytes": 20, "read_ops": 3, "write_ops": 4},
+		"_net2":  {"rx_bytes": 1000, "tx_bytes": 2000},
+	}, &metrics)
+
+	require.Equal(t, pkg.VMMetrics{
+		DiskReadBytes:  110,
+		DiskWriteBytes: 220,
+		DiskReadOps:    4,
+		DiskWriteOps:   6,
+	}, metrics)
+}
+
+func TestTapUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(root string) { netRoot = root }(netRoot)
+	netRoot = dir
+
+	for _, tap := range []string{"t-1", "t-2"} {
+		writeFiles(t, filepath.Join(dir, tap, "statistics"), map[string]string{
+			"rx_bytes":   "100\n",
+			"tx_bytes":   "2000\n",
+			"rx_packets": "1\n",
+			"tx_packets": "20\n",
+		})
+	}
+
+	var metrics pkg.VMMetrics
+	require.NoError(t, tapUsage("t-1", &metrics))
+	require.NoError(t, tapUsage("t-2", &metrics))
+
+	// the counters are the ones of the vm, what the tap receives
+	// is sent by the vm
+	require.Equal(t, pkg.VMMetrics{
+		NetRxBytes:   4000,
+		NetTxBytes:   200,
+		NetRxPackets: 40,
+		NetTxPackets: 2,
+	}, metrics)
+
+	require.Error(t, tapUsage("t-3", &metrics))
+}
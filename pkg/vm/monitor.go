@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
@@ -28,6 +29,10 @@ var (
 
 // Monitor start vms  monitoring
 func (m *Module) Monitor(ctx context.Context) {
+	if err := m.watch(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to watch machines state, exits are only detected by the monitoring")
+	}
+
 	go func() {
 		for {
 			select {
@@ -57,7 +62,7 @@ func (m *Module) monitor(ctx context.Context) error {
 		return err
 	}
 
-	running, err := findAll()
+	running, err := m.alive()
 	if err != nil {
 		return err
 	}
@@ -77,15 +82,33 @@ func (m *Module) monitor(ctx context.Context) error {
 	return nil
 }
 
-func (m *Module) monitorID(ctx context.Context, running map[string]int, id string) error {
+func (m *Module) monitorID(ctx context.Context, running map[string]struct{}, id string) error {
 	log := log.With().Str("id", id).Logger()
 
 	if _, ok := running[id]; ok {
+		// vmd was restarted while the machine was running
+		if !m.consoles.Known(id) {
+			m.attachConsole(ctx, id)
+		}
+		if !m.hasStats(id) {
+			if vm, err := MachineFromFile(m.configPath(id)); err == nil {
+				m.startStats(id, vm.Stats)
+			}
+		}
 		return nil
 	}
 
 	// otherwise machine is not running. we need to check if we need to restart
 	// it
+	vm, err := MachineFromFile(m.configPath(id))
+	if err != nil {
+		return err
+	}
+
+	if vm.Stopped {
+		// the machine was stopped on purpose
+		return nil
+	}
 
 	marker, ok := m.failures.Get(id)
 	if !ok {
@@ -101,36 +124,49 @@ func (m *Module) monitorID(ctx context.Context, running map[string]int, id strin
 		return nil
 	}
 
-	count, err := m.failures.IncrementInt(id, 1)
-	if err != nil {
-		// this should never happen because we make sure value
-		// is set
-		return errors.Wrap(err, "failed to check number of failure for the vm")
+	if vm.NoKeepAlive {
+		// if the permanent marker was not set, and we reach here it's possible that
+		// the vmd was restarted, hence the in-memory copy of this flag was gone. Hence
+		// we need to set it correctly, and just return
+		m.failures.Set(id, permanent, cache.NoExpiration)
+		return nil
 	}
 
 	var reason error
-	if count < failuresBeforeDestroy {
-		vm, err := MachineFromFile(m.configPath(id))
-
+	if state, err := LoadState(m.statePath(id)); err == nil && state.Done && !state.Stopped() {
+		// the supervisor already restarted the machine as much as
+		// its policy allows
+		reason = fmt.Errorf("deleting vm: %s", state.Reason)
+	} else {
+		// the supervisor is gone, or the machine was started
+		// before it was supervised
+		count, err := m.failures.IncrementInt(id, 1)
 		if err != nil {
-			return err
+			// this should never happen because we make sure value
+			// is set
+			return errors.Wrap(err, "failed to check number of failure for the vm")
 		}
 
-		if vm.NoKeepAlive {
-			// if the permanent marker was not set, and we reach here it's possible that
-			// the vmd was restarted, hence the in-memory copy of this flag was gone. Hence
-			// we need to set it correctly, and just return
-			m.failures.Set(id, permanent, cache.NoExpiration)
-			return nil
-		}
+		if count < failuresBeforeDestroy {
+			if vm.Restart.Mode == "" {
+				vm.Restart = m.restartPolicy(vm)
+				if err := vm.Save(m.configPath(id)); err != nil {
+					return err
+				}
+			}
 
-		log.Debug().Str("name", id).Msg("trying to restart the vm")
-		reason = vm.Run(ctx, m.socketPath(id), m.logsPath(id))
-		if reason == nil {
-			reason = m.waitAndAdjOom(ctx, id)
+			log.Debug().Str("name", id).Msg("trying to restart the vm")
+			reason = m.spawn(id)
+			if reason == nil {
+				reason = m.wait(ctx, id)
+			}
+			if reason == nil {
+				m.attachConsole(ctx, id)
+				m.startStats(id, vm.Stats)
+			}
+		} else {
+			reason = fmt.Errorf("deleting vm due to so many crashes")
 		}
-	} else {
-		reason = fmt.Errorf("deleting vm due to so many crashes")
 	}
 
 	if reason != nil {
@@ -145,3 +181,68 @@ func (m *Module) monitorID(ctx context.Context, running map[string]int, id strin
 
 	return nil
 }
+
+// watch reports the exits of the machines as soon as their supervisor
+// writes them, instead of waiting for the next monitoring
+func (m *Module) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(stateDir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-watcher.Events:
+				if event.Op&(fsnotify.Create|fsnotify.Write) == 0 || filepath.Ext(event.Name) == ".tmp" {
+					continue
+				}
+				m.stateChanged(ctx, filepath.Base(event.Name))
+			case err := <-watcher.Errors:
+				log.Error().Err(err).Msg("failed to watch machines state")
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (m *Module) stateChanged(ctx context.Context, id string) {
+	state, err := LoadState(m.statePath(id))
+	if err != nil || state.Pid != 0 {
+		return
+	}
+
+	log.Info().
+		Str("id", id).
+		Int("exit-code", state.ExitCode).
+		Str("signal", state.Signal).
+		Int("restarts", state.Restarts).
+		Str("reason", state.Reason).
+		Msg("machine exited")
+
+	if !state.Done || state.Stopped() {
+		// the supervisor restarts the machine, or it was stopped on purpose
+		return
+	}
+
+	if _, err := os.Stat(m.configPath(id)); err != nil {
+		// machine is deleted
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.monitorID(ctx, map[string]struct{}{}, id); err != nil {
+		log.Err(err).Str("id", id).Msg("failed to handle machine exit")
+	}
+}
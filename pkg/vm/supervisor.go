@@ -0,0 +1,323 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// RestartMode defines when the supervisor restarts a machine
+type RestartMode string
+
+const (
+	// RestartAlways restarts the machine whenever it exits
+	RestartAlways RestartMode = "always"
+	// RestartOnFailure restarts the machine only if it exits with an error
+	RestartOnFailure RestartMode = "on-failure"
+	// RestartNever never restarts the machine
+	RestartNever RestartMode = "never"
+)
+
+const (
+	// reasonStopped is the reason of a supervisor that was asked to stop
+	reasonStopped = "stopped"
+
+	stopTimeout = 5 * time.Second
+)
+
+// RestartPolicy of a machine
+type RestartPolicy struct {
+	Mode RestartMode `json:"mode"`
+	// MaxRestarts is the number of restarts allowed within Window (or
+	// ever if Window is 0), the supervisor gives up once it's reached.
+	// 0 means no limit
+	MaxRestarts int           `json:"max_restarts"`
+	Window      time.Duration `json:"window"`
+	// Delay between an exit and the restart
+	Delay time.Duration `json:"delay"`
+}
+
+// ProcessState is the state of a supervised machine, the supervisor
+// writes it each time the hypervisor starts or exits
+type ProcessState struct {
+	// Supervisor is the pid of the supervisor process
+	Supervisor int `json:"supervisor"`
+	// Pid of the hypervisor, 0 if it is not running
+	Pid int `json:"pid"`
+	// Restarts is the number of times the hypervisor was restarted
+	Restarts int `json:"restarts"`
+	// ExitCode and Signal of the last exit of the hypervisor
+	ExitCode int    `json:"exit_code"`
+	Signal   string `json:"signal,omitempty"`
+	// Done is set when the supervisor exits, Reason says why
+	Done    bool      `json:"done"`
+	Reason  string    `json:"reason,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Alive checks if the supervisor of the machine is still running
+func (s *ProcessState) Alive() bool {
+	if s.Done || s.Supervisor == 0 {
+		return false
+	}
+
+	return syscall.Kill(s.Supervisor, 0) == nil
+}
+
+// Stopped checks if the supervisor exited because it was asked to
+func (s *ProcessState) Stopped() bool {
+	return s.Done && s.Reason == reasonStopped
+}
+
+func (s *ProcessState) exit() string {
+	if s.Signal != "" {
+		return fmt.Sprintf("killed by signal %s", s.Signal)
+	}
+
+	return fmt.Sprintf("exited with code %d", s.ExitCode)
+}
+
+// Save writes the state to path, the file is replaced at once so
+// it's never read half written
+func (s *ProcessState) Save(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize process state")
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write process state")
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// LoadState loads the process state of a machine
+func LoadState(path string) (ProcessState, error) {
+	var state ProcessState
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, errors.Wrap(err, "failed to decode process state")
+	}
+
+	return state, nil
+}
+
+// supervisor runs the hypervisor of a machine and restarts it
+// following the restart policy
+type supervisor struct {
+	policy RestartPolicy
+	// start starts a new hypervisor process
+	start func() (*exec.Cmd, error)
+	// shutdown asks the machine to shutdown gracefully (optional)
+	shutdown func(ctx context.Context) error
+	// report is called each time the state changes
+	report func(ProcessState)
+}
+
+// run supervises the machine until the policy does not allow more
+// restarts or ctx is canceled, in which case the machine is stopped
+func (s *supervisor) run(ctx context.Context) ProcessState {
+	state := ProcessState{Supervisor: os.Getpid()}
+	var restarts []time.Time
+
+	for {
+		cmd, err := s.start()
+		if err != nil {
+			state.Pid = 0
+			return s.done(state, fmt.Sprintf("failed to start hypervisor: %s", err))
+		}
+
+		state.Pid = cmd.Process.Pid
+		s.update(state)
+
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			s.stop(cmd, exited)
+			state.Pid = 0
+			setExit(&state, cmd.ProcessState)
+			return s.done(state, reasonStopped)
+		}
+
+		state.Pid = 0
+		failed := setExit(&state, cmd.ProcessState)
+		log.Info().Int("restarts", state.Restarts).Msgf("hypervisor %s", state.exit())
+
+		if s.policy.Mode == RestartNever || (s.policy.Mode == RestartOnFailure && !failed) {
+			return s.done(state, state.exit())
+		}
+
+		now := time.Now()
+		restarts = append(restarts, now)
+		for s.policy.Window > 0 && now.Sub(restarts[0]) > s.policy.Window {
+			restarts = restarts[1:]
+		}
+
+		if s.policy.MaxRestarts > 0 && len(restarts) > s.policy.MaxRestarts {
+			return s.done(state, fmt.Sprintf("too many restarts, hypervisor %s", state.exit()))
+		}
+
+		s.update(state)
+
+		select {
+		case <-time.After(s.policy.Delay):
+		case <-ctx.Done():
+			return s.done(state, reasonStopped)
+		}
+
+		state.Restarts++
+	}
+}
+
+// stop shuts the machine down, first gracefully then by force
+func (s *supervisor) stop(cmd *exec.Cmd, exited <-chan error) {
+	signals := []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL}
+	if s.shutdown != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		if err := s.shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to shutdown machine")
+		}
+		cancel()
+	} else {
+		cmd.Process.Signal(signals[0])
+		signals = signals[1:]
+	}
+
+	for _, sig := range signals {
+		select {
+		case <-exited:
+			return
+		case <-time.After(stopTimeout):
+		}
+
+		cmd.Process.Signal(sig)
+	}
+
+	<-exited
+}
+
+func (s *supervisor) update(state ProcessState) {
+	state.Updated = time.Now()
+	if s.report != nil {
+		s.report(state)
+	}
+}
+
+func (s *supervisor) done(state ProcessState, reason string) ProcessState {
+	state.Done = true
+	state.Reason = reason
+	s.update(state)
+	return state
+}
+
+// protectOOM makes sure the process is the last thing the kernel kills
+// when the node is out of memory
+func protectOOM(pid int) error {
+	oom := filepath.Join("/proc", fmt.Sprint(pid), "oom_adj")
+	return ioutil.WriteFile(oom, []byte("-17"), 0644)
+}
+
+// setExit records how the process exited in the state, it returns true
+// if the process failed
+func setExit(state *ProcessState, ps *os.ProcessState) bool {
+	state.ExitCode, state.Signal = 0, ""
+	if ps == nil {
+		return true
+	}
+
+	if status, ok := ps.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		state.ExitCode = -1
+		state.Signal = status.Signal().String()
+		return true
+	}
+
+	state.ExitCode = ps.ExitCode()
+	return state.ExitCode != 0
+}
+
+// Supervise runs the machine with config at path and supervises it
+// until the restart policy gives up or ctx is canceled. It is the
+// entry point of the supervisor process vmd starts for each machine,
+// the state of the machine is written to state. The supervisor runs
+// in its own session so the machine survives restarts of vmd
+func Supervise(ctx context.Context, path, socket, logs, state string) error {
+	machine, err := MachineFromFile(path)
+	if err != nil {
+		return err
+	}
+
+	s := supervisor{
+		policy: machine.Restart,
+		start: func() (*exec.Cmd, error) {
+			// the config is loaded again since the machine could have
+			// been resized since the last start
+			machine, err := MachineFromFile(path)
+			if err != nil {
+				return nil, err
+			}
+
+			// a restarted machine must not find the socket of the previous run
+			os.Remove(socket)
+
+			cmd, files, err := machine.command(socket, logs)
+			if err != nil {
+				return nil, err
+			}
+			defer closeAll(files)
+
+			// the output of the supervisor is already redirected by vmd
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Start(); err != nil {
+				return nil, errors.Wrap(err, "failed to start cloud-hypervisor")
+			}
+
+			// the machine must be the last thing the kernel kills
+			if err := protectOOM(cmd.Process.Pid); err != nil {
+				log.Error().Err(err).Msg("failed to update oom priority of machine")
+			}
+
+			// the limits are applied on each start so the cgroup is
+			// created again if the node rebooted
+			cgroup := newCgroup(machine.ID)
+			if err := cgroup.Apply(machine.limits()); err != nil {
+				log.Error().Err(err).Msg("failed to set machine limits")
+			} else if err := cgroup.Join(cmd.Process.Pid); err != nil {
+				log.Error().Err(err).Msg("failed to move machine to its cgroup")
+			}
+
+			return cmd, nil
+		},
+		shutdown: NewClient(socket).Shutdown,
+		report: func(s ProcessState) {
+			if err := s.Save(state); err != nil {
+				log.Error().Err(err).Msg("failed to save process state")
+			}
+		},
+	}
+
+	final := s.run(ctx)
+	log.Info().Str("reason", final.Reason).Msg("supervisor exited")
+
+	return nil
+}
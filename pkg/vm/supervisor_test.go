@@ -0,0 +1,211 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHypervisor writes a script that takes the place of cloud-hypervisor
+func fakeHypervisor(t *testing.T, dir, script string) string {
+	path := filepath.Join(dir, chBin)
+	err := ioutil.WriteFile(path, []byte(fmt.Sprintf("#!/bin/sh\n%s\n", script)), 0755)
+	require.NoError(t, err)
+	return path
+}
+
+func testSupervisor(bin string, policy RestartPolicy) (*supervisor, *[]ProcessState) {
+	var states []ProcessState
+	return &supervisor{
+		policy: policy,
+		start: func() (*exec.Cmd, error) {
+			cmd := exec.Command(bin)
+			return cmd, cmd.Start()
+		},
+		report: func(s ProcessState) {
+			states = append(states, s)
+		},
+	}, &states
+}
+
+func TestSupervisorRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bin := fakeHypervisor(t, dir, "exit 3")
+	s, states := testSupervisor(bin, RestartPolicy{Mode: RestartAlways, MaxRestarts: 2, Window: time.Minute})
+
+	final := s.run(context.Background())
+	require.True(t, final.Done)
+	require.Equal(t, 2, final.Restarts)
+	require.Equal(t, 3, final.ExitCode)
+	require.Equal(t, 0, final.Pid)
+	require.Equal(t, "too many restarts, hypervisor exited with code 3", final.Reason)
+	require.Equal(t, os.Getpid(), final.Supervisor)
+
+	// each start and exit is reported
+	require.Len(t, *states, 6)
+	require.NotZero(t, (*states)[0].Pid)
+	require.Zero(t, (*states)[1].Pid)
+	require.False(t, (*states)[1].Done)
+}
+
+func TestSupervisorOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bin := fakeHypervisor(t, dir, "exit 0")
+	s, _ := testSupervisor(bin, RestartPolicy{Mode: RestartOnFailure})
+
+	final := s.run(context.Background())
+	require.True(t, final.Done)
+	require.Equal(t, 0, final.Restarts)
+	require.Equal(t, "exited with code 0", final.Reason)
+
+	bin = fakeHypervisor(t, dir, "kill -9 $$")
+	s, _ = testSupervisor(bin, RestartPolicy{Mode: RestartNever})
+
+	final = s.run(context.Background())
+	require.Equal(t, "killed", final.Signal)
+	require.Equal(t, -1, final.ExitCode)
+	require.Equal(t, "killed by signal killed", final.Reason)
+}
+
+func TestSupervisorStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bin := fakeHypervisor(t, dir, "exec sleep 30")
+	s, _ := testSupervisor(bin, RestartPolicy{Mode: RestartAlways})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	report := s.report
+	s.report = func(state ProcessState) {
+		report(state)
+		if state.Pid != 0 {
+			close(started)
+		}
+	}
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	final := s.run(ctx)
+	require.True(t, final.Stopped())
+	require.Equal(t, "terminated", final.Signal)
+	require.Equal(t, 0, final.Restarts)
+}
+
+func TestSupervise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = filepath.Join(dir, "cgroup")
+
+	args := filepath.Join(dir, "args")
+	fakeHypervisor(t, dir, fmt.Sprintf(`echo "$@" > %s; exit 1`, args))
+	os.Setenv("PATH", fmt.Sprintf("%s:%s", dir, os.Getenv("PATH")))
+
+	machine := Machine{
+		ID:      "vm",
+		Boot:    Boot{Kernel: "/kernel"},
+		Config:  Config{CPU: 1, Mem: 512},
+		Restart: RestartPolicy{Mode: RestartOnFailure, MaxRestarts: 1},
+	}
+	config := filepath.Join(dir, "config")
+	require.NoError(t, machine.Save(config))
+
+	state := filepath.Join(dir, "state")
+	err = Supervise(context.Background(), config, filepath.Join(dir, "socket"), filepath.Join(dir, "logs"), state)
+	require.NoError(t, err)
+
+	final, err := LoadState(state)
+	require.NoError(t, err)
+	require.True(t, final.Done)
+	require.False(t, final.Alive())
+	require.Equal(t, 1, final.Restarts)
+	require.Equal(t, 1, final.ExitCode)
+
+	data, err := ioutil.ReadFile(args)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "--kernel /kernel")
+	require.Contains(t, string(data), "--serial pty")
+
+	// the hypervisor is moved to the cgroup of the machine
+	procs, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu", cgroupParent, "vm", "cgroup.procs"))
+	require.NoError(t, err)
+	require.NotEmpty(t, procs)
+}
+
+func TestProcessState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vm")
+	_, err = LoadState(path)
+	require.True(t, os.IsNotExist(err))
+
+	state := ProcessState{Supervisor: os.Getpid(), Pid: 1}
+	require.NoError(t, state.Save(path))
+
+	loaded, err := LoadState(path)
+	require.NoError(t, err)
+	require.True(t, loaded.Alive())
+
+	loaded.Done = true
+	loaded.Reason = reasonStopped
+	require.False(t, loaded.Alive())
+	require.True(t, loaded.Stopped())
+}
+
+func TestKillOrphan(t *testing.T) {
+	// a process that looks like the hypervisor of the machine vm
+	orphan := &exec.Cmd{
+		Path: "/bin/sh",
+		Args: []string{chBin, "-c", "sleep 30; true", "--log-file", "/var/log/vm"},
+	}
+	require.NoError(t, orphan.Start())
+	exited := make(chan error, 1)
+	go func() {
+		exited <- orphan.Wait()
+	}()
+
+	require.Eventually(t, func() bool {
+		return isHypervisor(orphan.Process.Pid, "vm")
+	}, time.Second, 10*time.Millisecond)
+	require.False(t, isHypervisor(orphan.Process.Pid, "other"))
+
+	var m Module
+	// the hypervisor of another machine is left alone
+	m.killOrphan("other", ProcessState{Pid: orphan.Process.Pid})
+	// and so is the one of a machine that is still supervised
+	m.killOrphan("vm", ProcessState{Supervisor: os.Getpid(), Pid: orphan.Process.Pid})
+	select {
+	case <-exited:
+		t.Fatal("hypervisor must not be killed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	m.killOrphan("vm", ProcessState{Pid: orphan.Process.Pid})
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("orphan hypervisor was not killed")
+	}
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+// ConsoleHandler serves the serial consoles of the machines over
+// websocket at /console/<name>. The client first receives the history
+// of the console then its live output, what the client sends is written
+// to the console
+func (m *Module) ConsoleHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/console/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/console/")
+		con, err := m.consoles.Get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		// the endpoint is only reachable locally so the origin is not checked
+		server := websocket.Server{
+			Handler: func(ws *websocket.Conn) {
+				serveConsole(ws, con)
+			},
+		}
+		server.ServeHTTP(w, r)
+	})
+
+	return mux
+}
+
+func serveConsole(ws *websocket.Conn, con *console) {
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+
+	history, output, cancel := con.Subscribe()
+	defer cancel()
+
+	// input from the client
+	go func() {
+		defer cancel()
+		buf := make([]byte, 1024)
+		for {
+			n, err := ws.Read(buf)
+			if n > 0 {
+				if _, err := con.Write(buf[:n]); err != nil {
+					log.Error().Err(err).Str("name", con.name).Msg("failed to write to console")
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	if len(history) > 0 {
+		if _, err := ws.Write(history); err != nil {
+			return
+		}
+	}
+
+	for data := range output {
+		if _, err := ws.Write(data); err != nil {
+			return
+		}
+	}
+}
@@ -42,4 +42,9 @@ type ZDBAllocater interface {
 	// Find searches the system for the current allocation for the namespace
 	// Return error = "not found" if no allocation exists.
 	Find(namespace string) (allocation Allocation, err error)
+
+	// Resize changes the size reserved for an allocated namespace
+	// it returns an error if the namespace can't grow to size because
+	// there is not enough space left, or if it already holds more data than size
+	Resize(namespace string, size uint64) (allocation Allocation, err error)
 }
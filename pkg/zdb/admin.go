@@ -108,6 +108,26 @@ func (c *clientImpl) NamespaceSetPublic(name string, public bool) error {
 	return nil
 }
 
+// NamespaceSetLock changes the lock flag, a locked namespace is read-only
+func (c *clientImpl) NamespaceSetLock(name string, lock bool) error {
+	con := c.pool.Get()
+	defer con.Close()
+
+	flag := 0
+	if lock {
+		flag = 1
+	}
+
+	ok, err := redis.String(con.Do("NSSET", name, "lock", flag))
+	if err != nil {
+		return err
+	}
+	if ok != "OK" {
+		return fmt.Errorf(ok)
+	}
+	return nil
+}
+
 // DBSize returns the size of the database in bytes
 func (c *clientImpl) DBSize() (uint64, error) {
 	con := c.pool.Get()
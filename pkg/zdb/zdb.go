@@ -22,6 +22,7 @@ type Client interface {
 	NamespaceSetSize(name string, size uint64) error
 	NamespaceSetPassword(name, password string) error
 	NamespaceSetPublic(name string, public bool) error
+	NamespaceSetLock(name string, lock bool) error
 	DBSize() (uint64, error)
 }
 